@@ -0,0 +1,480 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	stdtls "crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/peterbourgon/ff/v4"
+	"github.com/peterbourgon/ff/v4/ffhelp"
+	"github.com/rodaine/table"
+)
+
+const (
+	agentPath = "/run"
+	// agentMaxSkew is how far the clocks of the coordinator and agents may
+	// drift apart before requests are rejected as stale.
+	agentMaxSkew = 5 * time.Minute
+	// agentMaxRepeat bounds the work one request can make an agent do.
+	agentMaxRepeat = 10
+	// agentRunTimeout bounds a whole run of the suite on an agent.
+	agentRunTimeout = 30 * time.Minute
+
+	agentTimeHeader      = "X-Heybabe-Time"
+	agentSignatureHeader = "X-Heybabe-Signature"
+)
+
+// agentJob is the test run a coordinator asks an agent for.
+type agentJob struct {
+	SNI    string `json:"sni"`
+	Port   uint16 `json:"port"`
+	IP     string `json:"ip,omitempty"`
+	IPv4   bool   `json:"ipv4,omitempty"`
+	IPv6   bool   `json:"ipv6,omitempty"`
+	Repeat uint   `json:"repeat"`
+}
+
+// agentResult is the result of one test against one target on an agent.
+type agentResult struct {
+	Label     string `json:"label"`
+	AddrPort  string `json:"addr_port"`
+	Status    string `json:"status"`
+	Successes int    `json:"successes"`
+}
+
+type agentResponse struct {
+	Results []agentResult `json:"results,omitempty"`
+	Error   string        `json:"error,omitempty"`
+}
+
+// testOptions turns the job into options for runSuite, the same way the
+// command line flags are.
+func (j agentJob) testOptions() (TestOptions, error) {
+	to := TestOptions{
+		ResolveIPv4: j.IPv4,
+		ResolveIPv6: j.IPv6,
+		Port:        j.Port,
+		SNI:         j.SNI,
+		Repeat:      j.Repeat,
+		DSCP:        -1,
+	}
+	if j.SNI == "" {
+		return to, errors.New("must specify SNI")
+	}
+	if j.Repeat == 0 || j.Repeat > agentMaxRepeat {
+		return to, fmt.Errorf("repeat must be between 1 and %d", agentMaxRepeat)
+	}
+	if j.IP != "" {
+		addr, err := netip.ParseAddr(j.IP)
+		if err != nil {
+			return to, err
+		}
+		to.ManualIPs = []netip.Addr{addr.Unmap()}
+	} else if to.ResolveIPv4 == to.ResolveIPv6 {
+		to.ResolveIPv4, to.ResolveIPv6 = true, true
+	}
+	return to, nil
+}
+
+// sign authenticates a message with the shared token.
+func sign(token string, parts ...[]byte) string {
+	mac := hmac.New(sha256.New, []byte(token))
+	for _, p := range parts {
+		mac.Write(p)
+		mac.Write([]byte{'\n'})
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// runAgentCommand runs "heybabe agent [addr]", a long running server that
+// runs the test suite on behalf of a coordinator, so the same tests can be
+// compared from several networks.
+//
+// Requests and responses are authenticated with an HMAC keyed by the shared
+// token, which never goes on the wire. They travel over TLS with a
+// self-signed certificate, which only hides them from passive observers.
+func runAgentCommand(l *slog.Logger, args []string) {
+	fs := ff.NewFlagSet(appName + " agent")
+	var (
+		token    = fs.StringLong("token", "", "shared secret coordinators authenticate with (or HEYBABE_TOKEN)")
+		logLevel = fs.StringEnumLong("loglevel", fmt.Sprintf("specify a log level (valid values: %s)", logLevels), logLevels...)
+		logJson  = fs.Bool('j', "json", "log in json format")
+	)
+
+	err := ff.Parse(fs, args, ff.WithEnvVarPrefix("HEYBABE"))
+	switch {
+	case errors.Is(err, ff.ErrHelp):
+		fmt.Fprintf(os.Stderr, "usage: %s agent [flags] [addr]\n\n%s\n", appName, ffhelp.Flags(fs))
+		os.Exit(0)
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	l = newLogger(os.Stdout, *logLevel, *logJson)
+
+	if *token == "" {
+		fatal(l, errors.New("must specify a token"))
+	}
+	addr := ":8444"
+	switch rest := fs.GetArgs(); len(rest) {
+	case 0:
+	case 1:
+		addr = rest[0]
+	default:
+		fatal(l, fmt.Errorf("agent takes a single address, got %q", rest))
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	if err := agent(ctx, l, addr, *token); err != nil {
+		fatal(l, err)
+	}
+}
+
+func agent(ctx context.Context, l *slog.Logger, addr, token string) error {
+	cert, err := selfSignedCert()
+	if err != nil {
+		l.Error("failed to generate certificate", "error", err)
+		return err
+	}
+
+	// The suite is run one job at a time, as concurrent runs would
+	// disturb each other's timings and traffic.
+	var mu sync.Mutex
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST "+agentPath, func(w http.ResponseWriter, r *http.Request) {
+		l := l.With("remote", r.RemoteAddr)
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 64*1024))
+		if err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		ts := r.Header.Get(agentTimeHeader)
+		reqSig := r.Header.Get(agentSignatureHeader)
+		if !hmac.Equal([]byte(reqSig), []byte(sign(token, []byte(ts), body))) {
+			l.Warn("rejected request with a bad signature")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		sec, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil || time.Since(time.Unix(sec, 0)).Abs() > agentMaxSkew {
+			l.Warn("rejected stale request", "time", ts)
+			http.Error(w, "stale request", http.StatusUnauthorized)
+			return
+		}
+
+		var (
+			job  agentJob
+			resp agentResponse
+		)
+		if err := json.Unmarshal(body, &job); err != nil {
+			resp.Error = err.Error()
+		} else if to, err := job.testOptions(); err != nil {
+			resp.Error = err.Error()
+		} else {
+			mu.Lock()
+			l.Info("running job", "job", job)
+			runCtx, cancel := context.WithTimeout(r.Context(), agentRunTimeout)
+			results, order, _, err := runSuite(runCtx, l, to)
+			cancel()
+			mu.Unlock()
+			if err != nil {
+				resp.Error = err.Error()
+			}
+			for _, label := range order {
+				for _, tr := range results[label] {
+					status, successes := tr.status()
+					resp.Results = append(resp.Results, agentResult{
+						Label:     label,
+						AddrPort:  tr.AddrPort.String(),
+						Status:    status,
+						Successes: successes,
+					})
+				}
+			}
+			l.Info("job completed", "results", len(resp.Results), "error", resp.Error)
+		}
+
+		out, err := json.Marshal(resp)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// Bind the response to the request, so it can't be replayed
+		// as the answer to another one.
+		w.Header().Set(agentSignatureHeader, sign(token, []byte(reqSig), out))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(out)
+	})
+
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		TLSConfig:         &stdtls.Config{Certificates: []stdtls.Certificate{cert}},
+		BaseContext:       func(net.Listener) context.Context { return ctx },
+	}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	l.Info("agent listening", "addr", addr)
+	if err := srv.ListenAndServeTLS("", ""); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		l.Error("agent failed", "error", err)
+		return err
+	}
+	return nil
+}
+
+// agentSpec is an agent given to the coordinator, as name=host:port or
+// just host:port.
+type agentSpec struct {
+	name, addr string
+}
+
+func parseAgentSpecs(s string) ([]agentSpec, error) {
+	var specs []agentSpec
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		name, addr, ok := strings.Cut(f, "=")
+		if !ok {
+			name, addr = f, f
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("invalid agent %q: %w", f, err)
+		}
+		if slices.ContainsFunc(specs, func(a agentSpec) bool { return a.name == name }) {
+			return nil, fmt.Errorf("duplicate agent name %q", name)
+		}
+		specs = append(specs, agentSpec{name: name, addr: addr})
+	}
+	if len(specs) == 0 {
+		return nil, errors.New("no agents given")
+	}
+	return specs, nil
+}
+
+// runCoordinatorCommand runs "heybabe coordinator", which runs the same
+// tests on several agents and prints their results side by side.
+func runCoordinatorCommand(l *slog.Logger, args []string) {
+	fs := ff.NewFlagSet(appName + " coordinator")
+	var (
+		agents   = fs.StringLong("agents", "", "comma separated agents, as name=host:port or host:port")
+		token    = fs.StringLong("token", "", "shared secret the agents were started with (or HEYBABE_TOKEN)")
+		v4       = fs.BoolShort('4', "only resolve IPv4 (only works when IP is not set)")
+		v6       = fs.BoolShort('6', "only resolve IPv6 (only works when IP is not set)")
+		sniName  = fs.StringLong("sni", "", "tls sni (resolved by each agent, unless IP is set)")
+		port     = fs.UintLong("port", 443, "tls port")
+		ip       = fs.StringLong("ip", "", "manually provide IP (no DNS lookup)")
+		repeat   = fs.UintLong("repeat", 1, "number of times to repeat each test")
+		logLevel = fs.StringEnumLong("loglevel", fmt.Sprintf("specify a log level (valid values: %s)", logLevels), logLevels...)
+		logJson  = fs.Bool('j', "json", "log in json format")
+	)
+
+	err := ff.Parse(fs, args, ff.WithEnvVarPrefix("HEYBABE"))
+	switch {
+	case errors.Is(err, ff.ErrHelp):
+		fmt.Fprintf(os.Stderr, "usage: %s coordinator [flags]\n\n%s\n", appName, ffhelp.Flags(fs))
+		os.Exit(0)
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	l = newLogger(os.Stdout, *logLevel, *logJson)
+
+	specs, err := parseAgentSpecs(*agents)
+	if err != nil {
+		fatal(l, err)
+	}
+	if *token == "" {
+		fatal(l, errors.New("must specify a token"))
+	}
+	if *port > uint(^uint16(0)) {
+		fatal(l, fmt.Errorf("invalid port %v", *port))
+	}
+	if *ip != "" && (*v4 || *v6) {
+		fatal(l, errors.New("cannot set ip and -4 or -6"))
+	}
+	job := agentJob{SNI: *sniName, Port: uint16(*port), IP: *ip, IPv4: *v4, IPv6: *v6, Repeat: *repeat}
+	if _, err := job.testOptions(); err != nil {
+		fatal(l, err)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	coordinate(ctx, l, specs, *token, job)
+}
+
+func coordinate(ctx context.Context, l *slog.Logger, specs []agentSpec, token string, job agentJob) {
+	responses := make([]agentResponse, len(specs))
+	var wg sync.WaitGroup
+	for i, spec := range specs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l := l.With("agent", spec.name)
+			l.Info("dispatching job", "addr", spec.addr)
+			resp, err := callAgent(ctx, spec.addr, token, job)
+			if err != nil {
+				l.Error("agent failed", "error", err)
+				resp.Error = err.Error()
+			}
+			responses[i] = resp
+			l.Info("agent finished", "results", len(resp.Results))
+		}()
+	}
+	wg.Wait()
+	printAgentComparison(specs, responses)
+}
+
+func callAgent(ctx context.Context, addr, token string, job agentJob) (agentResponse, error) {
+	var resp agentResponse
+	body, err := json.Marshal(job)
+	if err != nil {
+		return resp, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://"+addr+agentPath, bytes.NewReader(body))
+	if err != nil {
+		return resp, err
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	reqSig := sign(token, []byte(ts), body)
+	req.Header.Set(agentTimeHeader, ts)
+	req.Header.Set(agentSignatureHeader, reqSig)
+
+	// The agents' certificates are self-signed, the HMAC is what
+	// authenticates them.
+	client := &http.Client{
+		Timeout:   agentRunTimeout + time.Minute,
+		Transport: &http.Transport{TLSClientConfig: &stdtls.Config{InsecureSkipVerify: true}},
+	}
+	r, err := client.Do(req)
+	if err != nil {
+		return resp, err
+	}
+	defer r.Body.Close()
+	out, err := io.ReadAll(io.LimitReader(r.Body, 16<<20))
+	if err != nil {
+		return resp, err
+	}
+	if r.StatusCode != http.StatusOK {
+		return resp, fmt.Errorf("agent returned %s: %s", r.Status, strings.TrimSpace(string(out)))
+	}
+	if !hmac.Equal([]byte(r.Header.Get(agentSignatureHeader)), []byte(sign(token, []byte(reqSig), out))) {
+		return resp, errors.New("agent response has a bad signature")
+	}
+	if err := json.Unmarshal(out, &resp); err != nil {
+		return resp, err
+	}
+	if resp.Error != "" {
+		return resp, errors.New(resp.Error)
+	}
+	return resp, nil
+}
+
+// printAgentComparison prints the status of every test on every agent, and
+// which agents each test works from.
+func printAgentComparison(specs []agentSpec, responses []agentResponse) {
+	headerFmt := color.New(color.FgHiMagenta, color.Bold, color.Underline).SprintfFunc()
+	columnFmt := color.New(color.FgHiCyan, color.Bold).SprintfFunc()
+
+	header := []any{"Test Method"}
+	for _, spec := range specs {
+		header = append(header, spec.name)
+	}
+	tbl := table.New(header...)
+	tbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt)
+
+	// Tests show up in the order the first agent to report them ran them.
+	var order []string
+	for _, resp := range responses {
+		for _, r := range resp.Results {
+			if !slices.Contains(order, r.Label) {
+				order = append(order, r.Label)
+			}
+		}
+	}
+
+	// Agents that failed have no say in whether a test is blocked.
+	reporting := 0
+	for _, resp := range responses {
+		if len(resp.Results) > 0 {
+			reporting++
+		}
+	}
+
+	okCount := make([]int, len(specs))
+	var lines []string
+	for _, label := range order {
+		row := []any{label}
+		var ok []string
+		for i, resp := range responses {
+			var statuses []string
+			successes := 0
+			for _, r := range resp.Results {
+				if r.Label == label {
+					statuses = append(statuses, r.Status)
+					successes += r.Successes
+				}
+			}
+			if len(statuses) == 0 {
+				statuses = []string{"-"}
+			}
+			row = append(row, strings.Join(statuses, " / "))
+			if successes > 0 {
+				ok = append(ok, specs[i].name)
+				okCount[i]++
+			}
+		}
+		tbl.AddRow(row...)
+
+		switch len(ok) {
+		case reporting:
+		case 0:
+			lines = append(lines, fmt.Sprintf("%s: blocked from all agents", label))
+		default:
+			lines = append(lines, fmt.Sprintf("%s: only works from %s", label, strings.Join(ok, ", ")))
+		}
+	}
+
+	fmt.Println("")
+	tbl.Print()
+	fmt.Println("")
+	for i, spec := range specs {
+		if responses[i].Error != "" {
+			fmt.Printf("%s: error: %s\n", spec.name, responses[i].Error)
+			continue
+		}
+		fmt.Printf("%s: %d/%d tests work\n", spec.name, okCount[i], len(order))
+	}
+	if len(lines) > 0 {
+		fmt.Println("")
+		fmt.Println(strings.Join(lines, "\n"))
+	}
+	fmt.Println("")
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// batchTarget is a target from a --targets file, with the options it
+// overrides for its run.
+type batchTarget struct {
+	SNI    string
+	Host   string       // name to connect to, if not the SNI
+	Port   uint16       // 0 to keep the run's port
+	IPs    []netip.Addr // addresses to test instead of resolving
+	Repeat uint         // 0 to keep the run's repeat count
+	Tests  []string     // IDs of the tests to run, all if empty
+}
+
+// batchRow is a row of a --targets file, in CSV or YAML. In CSV, the
+// addresses and tests are separated by spaces.
+type batchRow struct {
+	SNI    string   `yaml:"sni"`
+	Host   string   `yaml:"host"`
+	Port   uint16   `yaml:"port"`
+	IP     []string `yaml:"ip"`
+	Repeat uint     `yaml:"repeat"`
+	Tests  []string `yaml:"tests"`
+}
+
+// readBatchTargets reads a --targets file, YAML if it's named so and CSV
+// with a header row otherwise.
+func readBatchTargets(path string) ([]batchTarget, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rows []batchRow
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		err = yaml.NewDecoder(f).Decode(&rows)
+	default:
+		rows, err = readBatchCSV(f)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, errors.New("no targets")
+	}
+
+	targets := make([]batchTarget, len(rows))
+	for i, row := range rows {
+		if targets[i], err = row.target(); err != nil {
+			return nil, fmt.Errorf("target %d: %w", i+1, err)
+		}
+	}
+	return targets, nil
+}
+
+// readBatchCSV reads CSV rows under a header naming the batchRow columns,
+// in any order.
+func readBatchCSV(r io.Reader) ([]batchRow, error) {
+	cr := csv.NewReader(r)
+	cr.Comment = '#'
+	cr.TrimLeadingSpace = true
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("header: %w", err)
+	}
+	for _, col := range header {
+		if !slices.Contains([]string{"sni", "host", "port", "ip", "repeat", "tests"}, col) {
+			return nil, fmt.Errorf("unknown column %q", col)
+		}
+	}
+
+	var rows []batchRow
+	for {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var row batchRow
+		for i, v := range record {
+			switch header[i] {
+			case "sni":
+				row.SNI = v
+			case "host":
+				row.Host = v
+			case "port":
+				if v == "" {
+					continue
+				}
+				port, err := strconv.ParseUint(v, 10, 16)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: invalid port %q", len(rows)+2, v)
+				}
+				row.Port = uint16(port)
+			case "ip":
+				row.IP = strings.Fields(v)
+			case "repeat":
+				if v == "" {
+					continue
+				}
+				repeat, err := strconv.ParseUint(v, 10, 0)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: invalid repeat %q", len(rows)+2, v)
+				}
+				row.Repeat = uint(repeat)
+			case "tests":
+				row.Tests = strings.Fields(v)
+			}
+		}
+		rows = append(rows, row)
+	}
+}
+
+func (row batchRow) target() (batchTarget, error) {
+	t := batchTarget{SNI: row.SNI, Host: row.Host, Port: row.Port, Repeat: row.Repeat, Tests: row.Tests}
+	if t.SNI == "" {
+		return t, errors.New("no SNI")
+	}
+	if t.Host != "" && len(row.IP) > 0 {
+		return t, errors.New("both host and ip set")
+	}
+	for _, s := range row.IP {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return t, err
+		}
+		t.IPs = append(t.IPs, addr.Unmap())
+	}
+	return t, nil
+}
+
+// options returns the run's options with the target's overrides.
+func (t batchTarget) options(to TestOptions) TestOptions {
+	to.Targets = nil
+	to.SNI, to.Host, to.ManualIPs = t.SNI, t.Host, t.IPs
+	if t.Port != 0 {
+		to.Port = t.Port
+	}
+	if len(t.IPs) > 0 {
+		to.ResolveEveryAttempt = false
+	}
+	if t.Repeat != 0 {
+		to.Repeat = t.Repeat
+	}
+	if len(t.Tests) > 0 {
+		to.Tests = t.Tests
+	}
+	return to
+}
+
+// runBatch runs the suite against each of the targets in turn, and returns
+// the results of all of them together, like runSuite does for one. A target
+// that can't be resolved is skipped.
+func runBatch(ctx context.Context, l *slog.Logger, to TestOptions) (map[string][]TestResult, []string, []testCase, error) {
+	results := make(map[string][]TestResult)
+	var (
+		order []string
+		suite []testCase
+	)
+	for i, t := range to.Targets {
+		l.Info("testing target", "target", i+1, "targets", len(to.Targets), "sni", t.SNI)
+		res, labels, cases, err := runSuite(ctx, l, t.options(to))
+		for _, id := range t.Tests {
+			if !slices.ContainsFunc(cases, func(c testCase) bool { return testID(c.label) == id }) {
+				l.Warn("no such test", "sni", t.SNI, "test", id)
+			}
+		}
+		for _, label := range labels {
+			if _, ok := results[label]; !ok {
+				order = append(order, label)
+			}
+			results[label] = append(results[label], res[label]...)
+		}
+		for _, tc := range cases {
+			if !slices.ContainsFunc(suite, func(c testCase) bool { return c.label == tc.label }) {
+				suite = append(suite, tc)
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return results, order, suite, err
+		}
+		if err != nil {
+			l.Warn("target failed", "sni", t.SNI, "error", err)
+		}
+	}
+	return results, order, suite, nil
+}
@@ -0,0 +1,181 @@
+package sni
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Fingerprint holds the fingerprints identifying the client that sent a
+// ClientHello.
+type Fingerprint struct {
+	// JA3 is the JA3 string: version, cipher suites, extensions, curves and
+	// point formats, with GREASE values left out.
+	JA3 string
+	// JA3Hash is the MD5 hash of JA3, which is what JA3 databases list.
+	JA3Hash string
+	// JA4 is the JA4 fingerprint. Unlike JA3 it sorts the cipher suites and
+	// extensions, so it survives the extension shuffling modern browsers do.
+	JA4 string
+	// JA4Raw is JA4 with the sorted lists in full instead of hashed, which
+	// is what to compare when two JA4s differ.
+	JA4Raw string
+}
+
+// isGREASE reports whether v is one of the GREASE values of RFC 8701,
+// which clients sprinkle around at random and fingerprints ignore.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// Fingerprint computes the fingerprints of the ClientHello.
+func (m *ClientHelloMsg) Fingerprint() Fingerprint {
+	extensions := make([]uint16, len(m.Extensions))
+	for i, e := range m.Extensions {
+		extensions[i] = e.Type
+	}
+	ja3 := strings.Join([]string{
+		strconv.Itoa(int(m.Versions)),
+		joinUint16s(m.CipherSuites, "-"),
+		joinUint16s(extensions, "-"),
+		joinUint16s(m.SupportedCurves, "-"),
+		joinUint8s(m.SupportedPoints, "-"),
+	}, ",")
+	sum := md5.Sum([]byte(ja3))
+
+	ja4, ja4Raw := m.ja4()
+	return Fingerprint{
+		JA3:     ja3,
+		JA3Hash: hex.EncodeToString(sum[:]),
+		JA4:     ja4,
+		JA4Raw:  ja4Raw,
+	}
+}
+
+// ja4 computes the JA4 fingerprint and its raw form, see
+// https://github.com/FoxIO-LLC/ja4/blob/main/technical_details/JA4.md.
+func (m *ClientHelloMsg) ja4() (string, string) {
+	var ciphers, extensions []string
+	for _, c := range m.CipherSuites {
+		if !isGREASE(c) {
+			ciphers = append(ciphers, fmt.Sprintf("%04x", c))
+		}
+	}
+	extCount := 0
+	for _, e := range m.Extensions {
+		if isGREASE(e.Type) {
+			continue
+		}
+		extCount++
+		// SNI and ALPN are already covered by the first part.
+		if e.Type != extensionServerName && e.Type != extensionALPN {
+			extensions = append(extensions, fmt.Sprintf("%04x", e.Type))
+		}
+	}
+	slices.Sort(ciphers)
+	slices.Sort(extensions)
+
+	var sigAlgs []string
+	for _, s := range m.SignatureAlgorithms {
+		if !isGREASE(s) {
+			sigAlgs = append(sigAlgs, fmt.Sprintf("%04x", s))
+		}
+	}
+
+	sni := "i"
+	if m.ServerName != "" {
+		sni = "d"
+	}
+	// ReadClientHello only reads TLS records, so this is always TLS over TCP.
+	a := fmt.Sprintf("t%s%s%02d%02d%s",
+		m.ja4Version(), sni, min(len(ciphers), 99), min(extCount, 99), m.ja4ALPN())
+
+	b := strings.Join(ciphers, ",")
+	c := strings.Join(extensions, ",")
+	// The signature algorithms are kept in the order they were sent.
+	if len(sigAlgs) > 0 {
+		c += "_" + strings.Join(sigAlgs, ",")
+	}
+
+	return a + "_" + ja4Hash(b, len(ciphers) == 0) + "_" + ja4Hash(c, len(extensions) == 0),
+		a + "_" + b + "_" + c
+}
+
+// ja4Version is the highest version offered, in supported_versions if the
+// client sent it.
+func (m *ClientHelloMsg) ja4Version() string {
+	v := m.Versions
+	for _, sv := range m.SupportedVersions {
+		if !isGREASE(sv) && sv > v {
+			v = sv
+		}
+	}
+	switch v {
+	case 0x0304:
+		return "13"
+	case 0x0303:
+		return "12"
+	case 0x0302:
+		return "11"
+	case 0x0301:
+		return "10"
+	case 0x0300:
+		return "s3"
+	case 0x0002:
+		return "s2"
+	}
+	return "00"
+}
+
+// ja4ALPN is the first and last character of the first ALPN protocol, or
+// the first and last hex digit of it if either isn't alphanumeric.
+func (m *ClientHelloMsg) ja4ALPN() string {
+	if len(m.ALPNProtocols) == 0 || m.ALPNProtocols[0] == "" {
+		return "00"
+	}
+	p := m.ALPNProtocols[0]
+	first, last := p[0], p[len(p)-1]
+	if !isAlnum(first) || !isAlnum(last) {
+		h := hex.EncodeToString([]byte(p))
+		return h[:1] + h[len(h)-1:]
+	}
+	return string([]byte{first, last})
+}
+
+func isAlnum(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// ja4Hash is the truncated SHA-256 JA4 uses, or zeros if the list hashed
+// is empty.
+func ja4Hash(s string, empty bool) string {
+	if empty {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// joinUint16s formats the non-GREASE values of list in decimal, separated
+// by sep.
+func joinUint16s(list []uint16, sep string) string {
+	parts := make([]string, 0, len(list))
+	for _, v := range list {
+		if !isGREASE(v) {
+			parts = append(parts, strconv.Itoa(int(v)))
+		}
+	}
+	return strings.Join(parts, sep)
+}
+
+func joinUint8s(list []uint8, sep string) string {
+	parts := make([]string, len(list))
+	for i, v := range list {
+		parts[i] = strconv.Itoa(int(v))
+	}
+	return strings.Join(parts, sep)
+}
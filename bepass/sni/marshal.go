@@ -0,0 +1,133 @@
+package sni
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+)
+
+// Marshal serializes the ClientHello back into a handshake message, in the
+// same form as Raw, with all the lengths recomputed. An unmodified parsed
+// hello marshals back to Raw.
+//
+// The header is built from Versions, Random, SessionID, CipherSuites and
+// CompressionMethods, and the extensions from Extensions, in order. The
+// server_name extension is the exception: when ServerName was changed it is
+// rebuilt from it, or left out if ServerName is empty, and it is added first
+// if ServerName is set and there is none. The other parsed fields, such as
+// ALPNProtocols, are only a view of Extensions and are ignored.
+func (m *ClientHelloMsg) Marshal() ([]byte, error) {
+	if len(m.Random) != 32 {
+		return nil, fmt.Errorf("sni: random is %d bytes, not 32", len(m.Random))
+	}
+	if len(m.SessionID) > 32 {
+		return nil, fmt.Errorf("sni: session ID is %d bytes, more than 32", len(m.SessionID))
+	}
+	if len(m.ServerName) > 0xffff-5 {
+		return nil, errors.New("sni: server name is too long")
+	}
+
+	extensions := m.Extensions
+	if m.ServerName != "" && !m.hasExtension(extensionServerName) {
+		extensions = append([]Extension{{Type: extensionServerName}}, extensions...)
+	}
+
+	var exts []byte
+	for _, e := range extensions {
+		data := e.Data
+		if e.Type == extensionServerName && serverName(data) != m.ServerName {
+			if m.ServerName == "" {
+				continue
+			}
+			data = marshalServerName(m.ServerName)
+		}
+		if len(data) > 0xffff {
+			return nil, fmt.Errorf("sni: extension %d is too long", e.Type)
+		}
+		exts = appendUint16(exts, e.Type)
+		exts = appendUint16(exts, uint16(len(data)))
+		exts = append(exts, data...)
+	}
+	if len(exts) > 0xffff {
+		return nil, errors.New("sni: extensions are too long")
+	}
+	if len(m.CipherSuites) > 0x7fff {
+		return nil, errors.New("sni: too many cipher suites")
+	}
+	if len(m.CompressionMethods) > 0xff {
+		return nil, errors.New("sni: too many compression methods")
+	}
+
+	b := []byte{typeClientHello, 0, 0, 0}
+	b = appendUint16(b, m.Versions)
+	b = append(b, m.Random...)
+	b = append(b, byte(len(m.SessionID)))
+	b = append(b, m.SessionID...)
+	b = appendUint16(b, uint16(2*len(m.CipherSuites)))
+	for _, c := range m.CipherSuites {
+		b = appendUint16(b, c)
+	}
+	b = append(b, byte(len(m.CompressionMethods)))
+	b = append(b, m.CompressionMethods...)
+	// A hello parsed without any extension is kept that way.
+	if len(extensions) > 0 {
+		b = appendUint16(b, uint16(len(exts)))
+		b = append(b, exts...)
+	}
+
+	n := len(b) - 4
+	if n > 0xffffff {
+		return nil, errors.New("sni: ClientHello is too long")
+	}
+	b[1], b[2], b[3] = byte(n>>16), byte(n>>8), byte(n)
+	return b, nil
+}
+
+// MarshalRecord is Marshal wrapped in TLS handshake records, ready to be
+// written to a connection. A ClientHello longer than a record can carry is
+// split over as many as it needs.
+func (m *ClientHelloMsg) MarshalRecord() ([]byte, error) {
+	msg, err := m.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 0, len(msg)+(len(msg)/maxPlaintext+1)*recordHeaderLen)
+	for len(msg) > 0 {
+		n := min(len(msg), maxPlaintext)
+		// Like most clients, use TLS 1.0 as the record version of the hello.
+		b = append(b, byte(recordTypeHandshake), 0x03, 0x01)
+		b = appendUint16(b, uint16(n))
+		b = append(b, msg[:n]...)
+		msg = msg[n:]
+	}
+	return b, nil
+}
+
+func (m *ClientHelloMsg) hasExtension(typ uint16) bool {
+	for _, e := range m.Extensions {
+		if e.Type == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// serverName is the host name in the body of a server_name extension.
+func serverName(data []byte) string {
+	var m ClientHelloMsg
+	m.unmarshalExtension(extensionServerName, data, slog.New(slog.DiscardHandler))
+	return m.ServerName
+}
+
+// marshalServerName builds the body of a server_name extension holding a
+// single host_name.
+func marshalServerName(name string) []byte {
+	b := appendUint16(nil, uint16(3+len(name)))
+	b = append(b, 0) // host_name
+	b = appendUint16(b, uint16(len(name)))
+	return append(b, name...)
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
@@ -0,0 +1,54 @@
+package sni
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMarshalRecord(t *testing.T) {
+	hello := chromeHello(t)
+	msg, err := ReadClientHello(bytes.NewReader(hello), discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := msg.MarshalRecord()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, hello) {
+		t.Fatalf("MarshalRecord of a parsed ClientHello differs from the one read:\n got %x\nwant %x", b, hello)
+	}
+
+	// Padding past a record has the hello split over several.
+	msg.Extensions = append(msg.Extensions[:len(msg.Extensions):len(msg.Extensions)], Extension{Type: 21, Data: make([]byte, 2*maxPlaintext)})
+	b, err = msg.MarshalRecord()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records int
+	for rest := b; len(rest) > 0; records++ {
+		if len(rest) < recordHeaderLen {
+			t.Fatalf("truncated record header %x", rest)
+		}
+		n := int(rest[3])<<8 | int(rest[4])
+		if n > maxPlaintext || n > len(rest)-recordHeaderLen {
+			t.Fatalf("record %d has a payload of %d bytes", records, n)
+		}
+		rest = rest[recordHeaderLen+n:]
+	}
+	if records != 3 {
+		t.Errorf("got %d records, want 3", records)
+	}
+
+	padded, err := ReadClientHello(bytes.NewReader(b), discard)
+	if err != nil {
+		t.Fatalf("failed to read back a ClientHello split over records: %v", err)
+	}
+	want, err := msg.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(padded.Raw, want) {
+		t.Error("ClientHello read back differs from the one marshaled")
+	}
+}
@@ -6,6 +6,10 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
+	"net"
+	"slices"
+
+	"golang.org/x/crypto/cryptobyte"
 )
 
 const (
@@ -30,8 +34,13 @@ var (
 	extensionStatusRequest   uint16 = 5
 	extensionSupportedCurves uint16 = 10
 	extensionSupportedPoints uint16 = 11
+	extensionSignatureAlgs   uint16 = 13
+	extensionALPN            uint16 = 16
 	extensionSessionTicket   uint16 = 35
+	extensionSupportedVers   uint16 = 43
+	extensionKeyShare        uint16 = 51
 	extensionNextProtoNeg    uint16 = 13172 // not IANA assigned
+	extensionECH             uint16 = 0xfe0d
 )
 
 // TLS CertificateStatusType (RFC 3546)
@@ -39,196 +48,185 @@ const (
 	statusTypeOCSP uint8 = 1
 )
 
-// A block is a simple data buffer.
-type block struct {
-	data []byte
-	off  int // index for Read
+const (
+	// maxPlaintext is the largest record payload allowed, RFC 8446 section
+	// 5.1.
+	maxPlaintext = 16384
+	// maxClientHelloLen caps the handshake message ReadClientHello
+	// reassembles, as its length comes from untrusted bytes. Real hellos,
+	// even padded or with post-quantum key shares, are a few KB.
+	maxClientHelloLen = 1 << 16
+)
+
+var errNotTLS = errors.New("not a tls packet")
+
+// ReadClientHello reads the handshake records from rd until they make up a
+// whole ClientHello message, and parses it.
+func ReadClientHello(rd io.Reader, l *slog.Logger) (*ClientHelloMsg, error) {
+	msg, _, err := readClientHello(rd, l)
+	return msg, err
 }
 
-// resize resizes block to be n bytes, growing if necessary.
-func (b *block) resize(n int) {
-	if n > cap(b.data) {
-		b.reserve(n)
-	}
-	b.data = b.data[0:n]
+// PeekClientHello reads and parses the ClientHello the client sent on conn,
+// and returns a reader that yields everything read from conn again followed
+// by the rest of the connection, for proxies that forward the hello as is.
+// The reader is returned even if the ClientHello can't be parsed.
+func PeekClientHello(conn net.Conn, l *slog.Logger) (*ClientHelloMsg, io.Reader, error) {
+	msg, raw, err := readClientHello(conn, l)
+	return msg, io.MultiReader(bytes.NewReader(raw), conn), err
 }
 
-// reserve makes sure that block contains a capacity of at least n bytes.
-func (b *block) reserve(n int) {
-	if cap(b.data) >= n {
-		return
-	}
-	m := cap(b.data)
-	if m == 0 {
-		m = 1024
-	}
-	for m < n {
-		m *= 2
-	}
-	data := make([]byte, len(b.data), m)
-	copy(data, b.data)
-	b.data = data
+// recordReader reads TLS records, keeping every byte read in a single
+// buffer the records are parsed in place from.
+type recordReader struct {
+	rd  io.Reader
+	raw []byte // everything read so far
+	l   *slog.Logger
 }
 
-// readFromUntil reads from r into b until b contains at least n bytes
-// or else returns an error.
-func (b *block) readFromUntil(r io.Reader, n int) error {
-	// quick case
-	if len(b.data) >= n {
-		return nil
+// read reads exactly n more bytes and returns them.
+func (r *recordReader) read(n int) ([]byte, error) {
+	start := len(r.raw)
+	r.raw = slices.Grow(r.raw, n)
+	got, err := io.ReadFull(r.rd, r.raw[start:start+n])
+	r.raw = r.raw[:start+got]
+	if err != nil {
+		return nil, err
 	}
+	return r.raw[start:], nil
+}
 
-	// read until have enough.
-	b.reserve(n)
-	for {
-		m, err := r.Read(b.data[len(b.data):cap(b.data)])
-		b.data = b.data[0 : len(b.data)+m]
-		if len(b.data) >= n {
-			break
-		}
-		if err != nil {
-			return err
-		}
+// readRecord reads the next TLS record and returns its payload.
+func (r *recordReader) readRecord() ([]byte, error) {
+	r.l.Debug("readRecord: reading record header", "header_length", recordHeaderLen)
+	header, err := r.read(recordHeaderLen)
+	if err != nil {
+		r.l.Error("readRecord: failed to read record header", "error", err)
+		return nil, err
 	}
-	return nil
-}
 
-func (b *block) Read(p []byte) (n int, err error) {
-	n = copy(p, b.data[b.off:])
-	b.off += n
-	return
-}
+	// No valid TLS record has a type of 0x80, however SSLv2 handshakes
+	// start with uint16 length where the MSB is set and the first record
+	// is always < 256 bytes long. Therefore, typ == 0x80 strongly suggests
+	// an SSLv2 client.
+	if header[0] == 0x80 {
+		r.l.Error("readRecord: unsupported SSLv2 handshake detected")
+		return nil, errors.New("tls: unsupported SSLv2 handshake received")
+	}
 
-// newBlock allocates a new block
-func newBlock() *block {
-	return new(block)
-}
+	var (
+		s       = cryptobyte.String(header)
+		typ     uint8
+		version uint16
+		n       uint16
+	)
+	s.ReadUint8(&typ)
+	s.ReadUint16(&version)
+	s.ReadUint16(&n)
+	r.l.Debug("readRecord: parsed record header",
+		"type", typ,
+		"version_hex", fmt.Sprintf("0x%04x", version),
+		"payload_length", n)
+
+	// First message, be extra suspicious:
+	// this might not be a TLS client.
+	// Bail out before reading a full 'body', if possible.
+	// The current max version is 3.1.
+	// If the version is >= 16.0, it's probably not real.
+	if recordType(typ) != recordTypeHandshake || version >= 0x1000 {
+		r.l.Error("readRecord: not a valid TLS packet", "type", typ, "version", version)
+		return nil, errNotTLS
+	}
+	if n > maxPlaintext {
+		r.l.Error("readRecord: record too long", "payload_length", n, "max_length", maxPlaintext)
+		return nil, errNotTLS
+	}
+	// Zero length handshake records are forbidden by RFC 8446 section 5.1,
+	// and would let a peer keep the reader going without ever progressing.
+	if n == 0 {
+		r.l.Error("readRecord: empty handshake record")
+		return nil, errNotTLS
+	}
 
-// splitBlock splits a block after the first n bytes,
-// returning a block with those n bytes and a
-// block with the remainder.  the latter may be nil.
-func splitBlock(b *block, n int) (*block, *block) {
-	if len(b.data) <= n {
-		return b, nil
+	payload, err := r.read(int(n))
+	if err != nil {
+		r.l.Error("readRecord: failed to read record payload", "error", err)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
 	}
-	bb := newBlock()
-	bb.resize(len(b.data) - n)
-	copy(bb.data, b.data[n:])
-	b.data = b.data[0:n]
-	return b, bb
+	return payload, nil
 }
 
-// ReadClientHello readHandshake reads the next handshake message from
-// the record layer.
-func ReadClientHello(rd io.Reader, l *slog.Logger) (*ClientHelloMsg, error) {
+// readClientHello reads and parses a ClientHello, returning the bytes read
+// from rd along with it. The ClientHello only gets copied out of them if it
+// spans several records.
+func readClientHello(rd io.Reader, l *slog.Logger) (*ClientHelloMsg, []byte, error) {
 	l.Debug("starting ReadClientHello", "reader_type", fmt.Sprintf("%T", rd))
-	
-	var nextBlock *block  // raw input, right off the wire
-	var hand bytes.Buffer // handshake data waiting to be read
 
-	// readRecord reads the next TLS record from the connection
-	// and updates the record layer state.
-	readRecord := func() error {
-		l.Debug("readRecord: starting to read TLS record")
-		
-		// Caller must be in sync with connection:
-		// handshake data if handshake not yet completed,
-		// else application data.  (We don't support renegotiation.)
-		if nextBlock == nil {
-			nextBlock = newBlock()
-			l.Debug("readRecord: created new block")
-		}
-		b := nextBlock
+	r := &recordReader{rd: rd, l: l}
+	var hand []byte // handshake data waiting to be read
 
-		// Read header, payload.
-		l.Debug("readRecord: reading record header", "header_length", recordHeaderLen)
-		if err := b.readFromUntil(rd, recordHeaderLen); err != nil {
-			l.Error("readRecord: failed to read record header", "error", err)
+	// readRecord appends the next record to hand. The first one is used in
+	// place, appending the next ones makes a copy as hand has no spare
+	// capacity.
+	readRecord := func() error {
+		payload, err := r.readRecord()
+		if err != nil {
 			return err
 		}
-		typ := recordType(b.data[0])
-		l.Debug("readRecord: read record type", "type", typ, "type_hex", fmt.Sprintf("0x%02x", typ))
-
-		// No valid TLS record has a type of 0x80, however SSLv2 handshakes
-		// start with uint16 length where the MSB is set and the first record
-		// is always < 256 bytes long. Therefore, typ == 0x80 strongly suggests
-		// an SSLv2 client.
-		if typ == 0x80 {
-			l.Error("readRecord: unsupported SSLv2 handshake detected")
-			return errors.New("tls: unsupported SSLv2 handshake received")
-		}
-
-		versions := uint16(b.data[1])<<8 | uint16(b.data[2])
-		n := int(b.data[3])<<8 | int(b.data[4])
-		l.Debug("readRecord: parsed record header", "version", versions, "version_hex", fmt.Sprintf("0x%04x", versions), "payload_length", n)
-
-		// First message, be extra suspicious:
-		// this might not be a TLS client.
-		// Bail out before reading a full 'body', if possible.
-		// The current max version is 3.1.
-		// If the version is >= 16.0, it's probably not real.
-		if (typ != recordTypeHandshake) || versions >= 0x1000 {
-			l.Error("readRecord: not a valid TLS packet", "type", typ, "version", versions)
-			return errors.New("not a tls packet")
-		}
-
-		l.Debug("readRecord: reading full record payload", "total_length", recordHeaderLen+n)
-		if err := b.readFromUntil(rd, recordHeaderLen+n); err != nil {
-			l.Error("readRecord: failed to read record payload", "error", err)
-			return err
+		if hand == nil {
+			hand = payload[:len(payload):len(payload)]
+		} else {
+			hand = append(hand, payload...)
 		}
-
-		// Process message.
-		b, nextBlock = splitBlock(b, recordHeaderLen+n)
-		b.off = recordHeaderLen
-		data := b.data[b.off : recordHeaderLen+n]
-		l.Debug("readRecord: extracted handshake data", "data_length", len(data))
-
-		hand.Write(data)
-		l.Debug("readRecord: wrote data to handshake buffer", "buffer_length", hand.Len())
-
+		l.Debug("readRecord: wrote data to handshake buffer", "buffer_length", len(hand))
 		return nil
 	}
 
 	l.Debug("ReadClientHello: reading first record")
-	if err := readRecord(); err != nil {
-		l.Error("ReadClientHello: failed to read first record", "error", err)
-		return nil, err
+	for len(hand) < 4 {
+		if err := readRecord(); err != nil {
+			l.Error("ReadClientHello: failed to read record", "error", err)
+			return nil, r.raw, err
+		}
 	}
 
-	data := hand.Bytes()
-	l.Debug("ReadClientHello: got initial handshake data", "data_length", len(data))
-	if len(data) < 4 {
-		l.Error("ReadClientHello: handshake data too short", "length", len(data))
-		return nil, errors.New("not a tls packet")
+	var (
+		s       = cryptobyte.String(hand)
+		msgType uint8
+		n       uint32
+	)
+	s.ReadUint8(&msgType)
+	s.ReadUint24(&n)
+	l.Debug("ReadClientHello: parsed handshake message header", "message_type", msgType, "message_length", n)
+	if msgType != typeClientHello {
+		l.Error("ReadClientHello: not a ClientHello message", "message_type", msgType, "expected_type", typeClientHello)
+		return nil, r.raw, errNotTLS
+	}
+	if n > maxClientHelloLen {
+		l.Error("ReadClientHello: ClientHello too long", "message_length", n, "max_length", maxClientHelloLen)
+		return nil, r.raw, errNotTLS
 	}
-	n := int(data[1])<<16 | int(data[2])<<8 | int(data[3])
-	l.Debug("ReadClientHello: parsed handshake message length", "message_length", n, "current_buffer_length", hand.Len())
 
-	for hand.Len() < 4+n {
-		l.Debug("ReadClientHello: reading additional records to complete handshake", "needed", 4+n-hand.Len())
+	for len(hand) < 4+int(n) {
+		l.Debug("ReadClientHello: reading additional records to complete handshake", "needed", 4+int(n)-len(hand))
 		if err := readRecord(); err != nil {
 			l.Error("ReadClientHello: failed to read additional record", "error", err)
-			return nil, err
+			return nil, r.raw, err
 		}
 	}
 
-	data = hand.Next(4 + n)
-	l.Debug("ReadClientHello: extracted complete handshake message", "message_length", len(data))
-	if data[0] != typeClientHello {
-		l.Error("ReadClientHello: not a ClientHello message", "message_type", data[0], "expected_type", typeClientHello)
-		return nil, errors.New("not a tls packet")
-	}
-
 	l.Debug("ReadClientHello: parsing ClientHello message")
 	msg := new(ClientHelloMsg)
-	if !msg.unmarshal(data, l) {
+	if !msg.unmarshal(hand[:4+int(n)], l) {
 		l.Error("ReadClientHello: failed to unmarshal ClientHello message")
-		return nil, errors.New("not a tls packet")
+		return nil, r.raw, errNotTLS
 	}
 
 	l.Debug("ReadClientHello: successfully parsed ClientHello", "server_name", msg.ServerName, "version", msg.Versions)
-	return msg, nil
+	return msg, r.raw, nil
 }
 
 // ClientHelloMsg represents a TLS ClientHello message. It contains various fields
@@ -248,211 +246,255 @@ type ClientHelloMsg struct {
 	SupportedPoints    []uint8
 	TicketSupported    bool
 	SessionTicket      []uint8
+	// ALPNProtocols are the protocols offered in the ALPN extension, in
+	// order of preference.
+	ALPNProtocols       []string
+	SupportedVersions   []uint16
+	SignatureAlgorithms []uint16
+	// KeyShareGroups are the groups the client sent a key share for. The
+	// key exchange data itself is not kept.
+	KeyShareGroups []uint16
+	// Extensions are all the extensions sent, in the order they were sent.
+	// Marshal serializes them as they are, so reordering, adding or
+	// removing them changes the hello it produces.
+	Extensions []Extension
+	// ECH is the raw body of the encrypted_client_hello extension, nil if
+	// the client didn't send one. Clients that don't use ECH often send a
+	// GREASE one, which can't be told apart from a real one from outside.
+	ECH []byte
+}
+
+// Extension is a raw ClientHello extension.
+type Extension struct {
+	Type uint16
+	Data []byte
+}
+
+// readUint16List reads a list of uint16s prefixed with its length in bytes,
+// as read by readLen, which must make up the rest of s. The list must not
+// be empty.
+func readUint16List(s cryptobyte.String, readLen func(*cryptobyte.String, *cryptobyte.String) bool) ([]uint16, bool) {
+	var list cryptobyte.String
+	if !readLen(&s, &list) || !s.Empty() || list.Empty() || len(list)%2 != 0 {
+		return nil, false
+	}
+	values := make([]uint16, 0, len(list)/2)
+	for !list.Empty() {
+		var v uint16
+		list.ReadUint16(&v)
+		values = append(values, v)
+	}
+	return values, true
 }
 
 func (m *ClientHelloMsg) unmarshal(data []byte, l *slog.Logger) bool {
 	l.Debug("unmarshal: starting to parse ClientHello data", "data_length", len(data))
-	
-	if len(data) < 42 {
-		l.Error("unmarshal: data too short for ClientHello", "length", len(data), "minimum_required", 42)
+
+	*m = ClientHelloMsg{Raw: data}
+	s := cryptobyte.String(data)
+
+	var random []byte
+	if !s.Skip(4) || // message type and uint24 length
+		!s.ReadUint16(&m.Versions) ||
+		!s.ReadBytes(&random, 32) ||
+		!s.ReadUint8LengthPrefixed((*cryptobyte.String)(&m.SessionID)) {
+		l.Error("unmarshal: ClientHello header truncated", "length", len(data))
 		return false
 	}
-	m.Raw = data
-	m.Versions = uint16(data[4])<<8 | uint16(data[5])
+	m.Random = random
 	l.Debug("unmarshal: parsed TLS version", "version", m.Versions, "version_hex", fmt.Sprintf("0x%04x", m.Versions))
-	
-	m.Random = data[6:38]
-	l.Debug("unmarshal: extracted random data", "random_length", len(m.Random))
-	
-	sessionIDLen := int(data[38])
-	l.Debug("unmarshal: parsed session ID length", "session_id_length", sessionIDLen)
-	
-	if sessionIDLen > 32 || len(data) < 39+sessionIDLen {
-		l.Error("unmarshal: invalid session ID length", "session_id_length", sessionIDLen, "data_length", len(data))
+	if len(m.SessionID) > 32 {
+		l.Error("unmarshal: invalid session ID length", "session_id_length", len(m.SessionID))
 		return false
 	}
-	m.SessionID = data[39 : 39+sessionIDLen]
 	l.Debug("unmarshal: extracted session ID", "session_id_length", len(m.SessionID))
-	
-	data = data[39+sessionIDLen:]
-	l.Debug("unmarshal: remaining data after session ID", "remaining_length", len(data))
-	
-	if len(data) < 2 {
-		l.Error("unmarshal: insufficient data for cipher suites", "remaining_length", len(data))
-		return false
-	}
-	// cipherSuiteLen is the number of bytes of cipher suite numbers. Since
-	// they are uint16s, the number must be even.
-	cipherSuiteLen := int(data[0])<<8 | int(data[1])
-	l.Debug("unmarshal: parsed cipher suite length", "cipher_suite_length", cipherSuiteLen)
-	
-	if cipherSuiteLen%2 == 1 || len(data) < 2+cipherSuiteLen {
-		l.Error("unmarshal: invalid cipher suite length", "cipher_suite_length", cipherSuiteLen, "remaining_length", len(data))
+
+	var cipherSuites cryptobyte.String
+	if !s.ReadUint16LengthPrefixed(&cipherSuites) || len(cipherSuites)%2 != 0 {
+		l.Error("unmarshal: invalid cipher suites", "remaining_length", len(s))
 		return false
 	}
-	numCipherSuites := cipherSuiteLen / 2
-	m.CipherSuites = make([]uint16, numCipherSuites)
-	for i := 0; i < numCipherSuites; i++ {
-		m.CipherSuites[i] = uint16(data[2+2*i])<<8 | uint16(data[3+2*i])
+	m.CipherSuites = make([]uint16, 0, len(cipherSuites)/2)
+	for !cipherSuites.Empty() {
+		var suite uint16
+		cipherSuites.ReadUint16(&suite)
+		m.CipherSuites = append(m.CipherSuites, suite)
 	}
-	l.Debug("unmarshal: parsed cipher suites", "num_cipher_suites", numCipherSuites)
-	
-	data = data[2+cipherSuiteLen:]
-	l.Debug("unmarshal: remaining data after cipher suites", "remaining_length", len(data))
-	
-	if len(data) < 1 {
-		l.Error("unmarshal: insufficient data for compression methods", "remaining_length", len(data))
-		return false
-	}
-	compressionMethodsLen := int(data[0])
-	l.Debug("unmarshal: parsed compression methods length", "compression_methods_length", compressionMethodsLen)
-	
-	if len(data) < 1+compressionMethodsLen {
-		l.Error("unmarshal: invalid compression methods length", "compression_methods_length", compressionMethodsLen, "remaining_length", len(data))
+	l.Debug("unmarshal: parsed cipher suites", "num_cipher_suites", len(m.CipherSuites))
+
+	if !s.ReadUint8LengthPrefixed((*cryptobyte.String)(&m.CompressionMethods)) {
+		l.Error("unmarshal: invalid compression methods", "remaining_length", len(s))
 		return false
 	}
-	m.CompressionMethods = data[1 : 1+compressionMethodsLen]
 	l.Debug("unmarshal: extracted compression methods", "compression_methods_length", len(m.CompressionMethods))
 
-	data = data[1+compressionMethodsLen:]
-	l.Debug("unmarshal: remaining data after compression methods", "remaining_length", len(data))
-
-	m.NextProtoNeg = false
-	m.ServerName = ""
-	m.OcspStapling = false
-	m.TicketSupported = false
-	m.SessionTicket = nil
-
-	if len(data) == 0 {
+	if s.Empty() {
 		// ClientHello is optionally followed by extension data
 		l.Debug("unmarshal: no extensions found, ClientHello parsing complete")
 		return true
 	}
-	if len(data) < 2 {
-		l.Error("unmarshal: insufficient data for extensions", "remaining_length", len(data))
-		return false
-	}
 
-	extensionsLength := int(data[0])<<8 | int(data[1])
-	l.Debug("unmarshal: parsed extensions length", "extensions_length", extensionsLength)
-	
-	data = data[2:]
-	if extensionsLength != len(data) {
-		l.Error("unmarshal: extensions length mismatch", "expected_length", extensionsLength, "actual_length", len(data))
+	var extensions cryptobyte.String
+	if !s.ReadUint16LengthPrefixed(&extensions) || !s.Empty() {
+		l.Error("unmarshal: extensions length mismatch", "remaining_length", len(s))
 		return false
 	}
 
-	l.Debug("unmarshal: starting to parse extensions", "extensions_data_length", len(data))
-	for len(data) != 0 {
-		if len(data) < 4 {
-			l.Error("unmarshal: insufficient data for extension header", "remaining_length", len(data))
+	l.Debug("unmarshal: starting to parse extensions", "extensions_data_length", len(extensions))
+	for !extensions.Empty() {
+		var (
+			extension uint16
+			body      cryptobyte.String
+		)
+		if !extensions.ReadUint16(&extension) || !extensions.ReadUint16LengthPrefixed(&body) {
+			l.Error("unmarshal: extension truncated", "remaining_length", len(extensions))
 			return false
 		}
-		extension := uint16(data[0])<<8 | uint16(data[1])
-		length := int(data[2])<<8 | int(data[3])
-		l.Debug("unmarshal: parsing extension", "extension_type", extension, "extension_type_hex", fmt.Sprintf("0x%04x", extension), "extension_length", length)
-		
-		data = data[4:]
-		if len(data) < length {
-			l.Error("unmarshal: extension data too short", "expected_length", length, "remaining_length", len(data))
+		l.Debug("unmarshal: parsing extension", "extension_type", extension, "extension_type_hex", fmt.Sprintf("0x%04x", extension), "extension_length", len(body))
+		m.Extensions = append(m.Extensions, Extension{Type: extension, Data: body})
+
+		if !m.unmarshalExtension(extension, body, l) {
 			return false
 		}
+	}
 
-		switch extension {
-		case extensionServerName:
-			l.Debug("unmarshal: processing ServerName extension")
-			if length < 2 {
-				l.Error("unmarshal: ServerName extension too short", "length", length)
-				return false
-			}
-			numNames := int(data[0])<<8 | int(data[1])
-			l.Debug("unmarshal: ServerName extension has names", "num_names", numNames)
-			
-			d := data[2:]
-			for i := 0; i < numNames; i++ {
-				if len(d) < 3 {
-					l.Error("unmarshal: insufficient data for ServerName entry", "remaining_length", len(d))
-					return false
-				}
-				nameType := d[0]
-				nameLen := int(d[1])<<8 | int(d[2])
-				l.Debug("unmarshal: ServerName entry", "name_type", nameType, "name_length", nameLen)
-				
-				d = d[3:]
-				if len(d) < nameLen {
-					l.Error("unmarshal: ServerName data too short", "expected_length", nameLen, "remaining_length", len(d))
-					return false
-				}
-				if nameType == 0 {
-					m.ServerName = string(d[0:nameLen])
-					l.Debug("unmarshal: extracted ServerName", "server_name", m.ServerName)
-					break
-				}
-				d = d[nameLen:]
-			}
-		case extensionNextProtoNeg:
-			l.Debug("unmarshal: processing NextProtoNeg extension")
-			if length > 0 {
-				l.Error("unmarshal: NextProtoNeg extension should be empty", "length", length)
-				return false
-			}
-			m.NextProtoNeg = true
-		case extensionStatusRequest:
-			l.Debug("unmarshal: processing StatusRequest extension")
-			if length < 1 {
-				l.Error("unmarshal: StatusRequest extension too short", "length", length)
-				return false
-			}
-			if data[0] == statusTypeOCSP {
-				m.OcspStapling = true
-				l.Debug("unmarshal: OCSP stapling enabled")
-			}
-		case extensionSupportedCurves:
-			l.Debug("unmarshal: processing SupportedCurves extension")
-			if length < 2 {
-				l.Error("unmarshal: SupportedCurves extension too short", "length", length)
-				return false
-			}
-			lVal := int(data[0])<<8 | int(data[1])
-			if lVal%2 != 0 || length != lVal+2 {
-				l.Error("unmarshal: SupportedCurves length mismatch or odd length", "lVal", lVal, "length", length)
+	l.Debug("unmarshal: ClientHello parsing completed successfully",
+		"server_name", m.ServerName,
+		"version", m.Versions,
+		"cipher_suites_count", len(m.CipherSuites),
+		"has_session_ticket", m.TicketSupported,
+		"alpn", m.ALPNProtocols,
+		"has_ech", m.ECH != nil)
+	return true
+}
+
+// unmarshalExtension fills the fields of m the extension maps to. Unknown
+// extensions are only kept in Extensions.
+func (m *ClientHelloMsg) unmarshalExtension(extension uint16, body cryptobyte.String, l *slog.Logger) bool {
+	switch extension {
+	case extensionServerName:
+		l.Debug("unmarshal: processing ServerName extension")
+		var names cryptobyte.String
+		if !body.ReadUint16LengthPrefixed(&names) || !body.Empty() {
+			l.Error("unmarshal: invalid ServerName extension")
+			return false
+		}
+		for !names.Empty() {
+			var (
+				nameType uint8
+				name     cryptobyte.String
+			)
+			if !names.ReadUint8(&nameType) || !names.ReadUint16LengthPrefixed(&name) {
+				l.Error("unmarshal: ServerName entry truncated", "remaining_length", len(names))
 				return false
 			}
-			numCurves := lVal / 2
-			m.SupportedCurves = make([]uint16, numCurves)
-			d := data[2:]
-			for i := 0; i < numCurves; i++ {
-				m.SupportedCurves[i] = uint16(d[0])<<8 | uint16(d[1])
-				d = d[2:]
+			l.Debug("unmarshal: ServerName entry", "name_type", nameType, "name_length", len(name))
+			if nameType == 0 {
+				m.ServerName = string(name)
+				l.Debug("unmarshal: extracted ServerName", "server_name", m.ServerName)
+				break
 			}
-			l.Debug("unmarshal: parsed supported curves", "num_curves", numCurves)
-		case extensionSupportedPoints:
-			l.Debug("unmarshal: processing SupportedPoints extension")
-			if length < 1 {
-				l.Error("unmarshal: SupportedPoints extension too short", "length", length)
+		}
+	case extensionNextProtoNeg:
+		l.Debug("unmarshal: processing NextProtoNeg extension")
+		if !body.Empty() {
+			l.Error("unmarshal: NextProtoNeg extension should be empty", "length", len(body))
+			return false
+		}
+		m.NextProtoNeg = true
+	case extensionStatusRequest:
+		l.Debug("unmarshal: processing StatusRequest extension")
+		var statusType uint8
+		if !body.ReadUint8(&statusType) {
+			l.Error("unmarshal: StatusRequest extension too short")
+			return false
+		}
+		if statusType == statusTypeOCSP {
+			m.OcspStapling = true
+			l.Debug("unmarshal: OCSP stapling enabled")
+		}
+	case extensionSupportedCurves:
+		l.Debug("unmarshal: processing SupportedCurves extension")
+		curves, ok := readUint16List(body, (*cryptobyte.String).ReadUint16LengthPrefixed)
+		if !ok {
+			l.Error("unmarshal: invalid SupportedCurves extension", "length", len(body))
+			return false
+		}
+		m.SupportedCurves = curves
+		l.Debug("unmarshal: parsed supported curves", "num_curves", len(curves))
+	case extensionSupportedPoints:
+		l.Debug("unmarshal: processing SupportedPoints extension")
+		if !body.ReadUint8LengthPrefixed((*cryptobyte.String)(&m.SupportedPoints)) || !body.Empty() || len(m.SupportedPoints) == 0 {
+			l.Error("unmarshal: invalid SupportedPoints extension")
+			return false
+		}
+		l.Debug("unmarshal: parsed supported points", "num_points", len(m.SupportedPoints))
+	case extensionSessionTicket:
+		l.Debug("unmarshal: processing SessionTicket extension")
+		m.TicketSupported = true
+		m.SessionTicket = body
+		l.Debug("unmarshal: extracted session ticket", "ticket_length", len(body))
+	case extensionSignatureAlgs:
+		l.Debug("unmarshal: processing SignatureAlgorithms extension")
+		algs, ok := readUint16List(body, (*cryptobyte.String).ReadUint16LengthPrefixed)
+		if !ok {
+			l.Error("unmarshal: invalid SignatureAlgorithms extension", "length", len(body))
+			return false
+		}
+		m.SignatureAlgorithms = algs
+		l.Debug("unmarshal: parsed signature algorithms", "num_algorithms", len(algs))
+	case extensionALPN:
+		l.Debug("unmarshal: processing ALPN extension")
+		var protocols cryptobyte.String
+		if !body.ReadUint16LengthPrefixed(&protocols) || !body.Empty() || protocols.Empty() {
+			l.Error("unmarshal: invalid ALPN extension")
+			return false
+		}
+		for !protocols.Empty() {
+			var proto cryptobyte.String
+			if !protocols.ReadUint8LengthPrefixed(&proto) || proto.Empty() {
+				l.Error("unmarshal: invalid ALPN protocol", "remaining_length", len(protocols))
 				return false
 			}
-			lVal := int(data[0])
-			if length != lVal+1 {
-				l.Error("unmarshal: SupportedPoints length mismatch", "expected_length", lVal+1, "actual_length", length)
+			m.ALPNProtocols = append(m.ALPNProtocols, string(proto))
+		}
+		l.Debug("unmarshal: parsed ALPN protocols", "protocols", m.ALPNProtocols)
+	case extensionSupportedVers:
+		l.Debug("unmarshal: processing SupportedVersions extension")
+		versions, ok := readUint16List(body, (*cryptobyte.String).ReadUint8LengthPrefixed)
+		if !ok {
+			l.Error("unmarshal: invalid SupportedVersions extension", "length", len(body))
+			return false
+		}
+		m.SupportedVersions = versions
+		l.Debug("unmarshal: parsed supported versions", "num_versions", len(versions))
+	case extensionKeyShare:
+		l.Debug("unmarshal: processing KeyShare extension")
+		var shares cryptobyte.String
+		if !body.ReadUint16LengthPrefixed(&shares) || !body.Empty() {
+			l.Error("unmarshal: invalid KeyShare extension")
+			return false
+		}
+		for !shares.Empty() {
+			var (
+				group uint16
+				key   cryptobyte.String
+			)
+			if !shares.ReadUint16(&group) || !shares.ReadUint16LengthPrefixed(&key) {
+				l.Error("unmarshal: KeyShare entry truncated", "remaining_length", len(shares))
 				return false
 			}
-			m.SupportedPoints = make([]uint8, lVal)
-			copy(m.SupportedPoints, data[1:])
-			l.Debug("unmarshal: parsed supported points", "num_points", lVal)
-		case extensionSessionTicket:
-			l.Debug("unmarshal: processing SessionTicket extension")
-			m.TicketSupported = true
-			m.SessionTicket = data[:length]
-			l.Debug("unmarshal: extracted session ticket", "ticket_length", length)
+			m.KeyShareGroups = append(m.KeyShareGroups, group)
+		}
+		l.Debug("unmarshal: parsed key shares", "num_key_shares", len(m.KeyShareGroups))
+	case extensionECH:
+		l.Debug("unmarshal: processing EncryptedClientHello extension")
+		if body.Empty() {
+			l.Error("unmarshal: EncryptedClientHello extension is empty")
+			return false
 		}
-		data = data[length:]
+		m.ECH = body
+		l.Debug("unmarshal: extracted encrypted client hello", "ech_length", len(body))
 	}
-
-	l.Debug("unmarshal: ClientHello parsing completed successfully", 
-		"server_name", m.ServerName, 
-		"version", m.Versions,
-		"cipher_suites_count", len(m.CipherSuites),
-		"has_session_ticket", m.TicketSupported)
 	return true
 }
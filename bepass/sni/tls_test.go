@@ -0,0 +1,145 @@
+package sni
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"testing"
+)
+
+var discard = slog.New(slog.DiscardHandler)
+
+// chromeHello returns the record of a ClientHello for www.example.com made
+// by uTLS' HelloChrome_120.
+func chromeHello(tb testing.TB) []byte {
+	tb.Helper()
+	b, err := os.ReadFile("testdata/chrome_client_hello.bin")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return b
+}
+
+// fragment splits the handshake message in record into records of at most
+// size bytes.
+func fragment(record []byte, size int) []byte {
+	var out []byte
+	msg := record[recordHeaderLen:]
+	for len(msg) > 0 {
+		n := min(size, len(msg))
+		out = append(out, record[0], record[1], record[2], byte(n>>8), byte(n))
+		out = append(out, msg[:n]...)
+		msg = msg[n:]
+	}
+	return out
+}
+
+// handshakeRecord wraps a ClientHello body in a handshake message header
+// and a record.
+func handshakeRecord(body []byte) []byte {
+	n := len(body) + 4
+	b := []byte{22, 3, 1, byte(n >> 8), byte(n), typeClientHello, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}
+	return append(b, body...)
+}
+
+// helloBody returns a ClientHello body with the given session ID, cipher
+// suites and trailing bytes where the extensions go.
+func helloBody(sessionID, cipherSuites, rest []byte) []byte {
+	b := []byte{3, 3}
+	b = append(b, make([]byte, 32)...)
+	b = append(b, byte(len(sessionID)))
+	b = append(b, sessionID...)
+	b = append(b, byte(len(cipherSuites)>>8), byte(len(cipherSuites)))
+	b = append(b, cipherSuites...)
+	b = append(b, 1, 0) // null compression
+	return append(b, rest...)
+}
+
+func TestReadClientHello(t *testing.T) {
+	hello := chromeHello(t)
+	for _, size := range []int{1, 4, 100, maxPlaintext} {
+		msg, err := ReadClientHello(bytes.NewReader(fragment(hello, size)), discard)
+		if err != nil {
+			t.Fatalf("records of %d bytes: %v", size, err)
+		}
+		if msg.ServerName != "www.example.com" {
+			t.Errorf("records of %d bytes: ServerName = %q", size, msg.ServerName)
+		}
+		if !bytes.Equal(msg.Raw, hello[recordHeaderLen:]) {
+			t.Errorf("records of %d bytes: Raw isn't the handshake message", size)
+		}
+	}
+}
+
+func TestReadClientHelloBounds(t *testing.T) {
+	hello := chromeHello(t)
+	suites := []byte{0x13, 0x01}
+	tests := []struct {
+		name    string
+		in      []byte
+		wantErr error // nil for any error
+	}{
+		{"empty", nil, io.EOF},
+		{"truncated record header", hello[:3], io.ErrUnexpectedEOF},
+		{"truncated record", hello[:len(hello)-1], io.ErrUnexpectedEOF},
+		{"truncated across records", fragment(hello, 64)[:300], nil},
+		{"SSLv2", []byte{0x80, 0x2e, 0x01, 0x03, 0x01}, nil},
+		{"not a handshake", append([]byte{23}, hello[1:]...), errNotTLS},
+		{"future version", append([]byte{22, 0x10, 0x00}, hello[3:]...), errNotTLS},
+		{"record too long", []byte{22, 3, 1, 0x40, 0x01}, errNotTLS},
+		{"empty first record", append([]byte{22, 3, 1, 0, 0}, hello...), errNotTLS},
+		{"empty record mid message", append(fragment(hello, 64)[:69], append([]byte{22, 3, 1, 0, 0}, fragment(hello, 64)[69:]...)...), errNotTLS},
+		{"empty records only", bytes.Repeat([]byte{22, 3, 1, 0, 0}, 1000), errNotTLS},
+		{"not a ClientHello", append(hello[:recordHeaderLen:recordHeaderLen], append([]byte{2}, hello[recordHeaderLen+1:]...)...), errNotTLS},
+		{"message too long", []byte{22, 3, 1, 0, 4, typeClientHello, 0x01, 0x00, 0x01}, errNotTLS},
+		{"header truncated", handshakeRecord([]byte{3, 3, 0}), errNotTLS},
+		{"session ID too long", handshakeRecord(helloBody(make([]byte, 33), suites, nil)), errNotTLS},
+		{"odd cipher suites", handshakeRecord(helloBody(nil, []byte{0x13, 0x01, 0x13}, nil)), errNotTLS},
+		{"extensions length mismatch", handshakeRecord(helloBody(nil, suites, []byte{0, 8, 0, 0, 0, 0})), errNotTLS},
+		{"trailing bytes after extensions", handshakeRecord(helloBody(nil, suites, []byte{0, 0, 0})), errNotTLS},
+		{"extension truncated", handshakeRecord(helloBody(nil, suites, []byte{0, 4, 0, 0, 0, 9})), errNotTLS},
+		{"server name list truncated", handshakeRecord(helloBody(nil, suites, []byte{0, 6, 0, 0, 0, 2, 0, 4})), errNotTLS},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ReadClientHello(bytes.NewReader(tt.in), discard)
+			switch {
+			case err == nil:
+				t.Fatal("got no error")
+			case tt.wantErr != nil && !errors.Is(err, tt.wantErr):
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	if _, err := ReadClientHello(bytes.NewReader(handshakeRecord(helloBody(nil, suites, nil))), discard); err != nil {
+		t.Errorf("ClientHello without extensions: %v", err)
+	}
+}
+
+func FuzzReadClientHello(f *testing.F) {
+	hello := chromeHello(f)
+	f.Add(hello)
+	f.Add(fragment(hello, 1))
+	f.Add(fragment(hello, 64))
+	for _, n := range []int{1, recordHeaderLen, recordHeaderLen + 4, 43, len(hello) / 2, len(hello) - 1} {
+		f.Add(hello[:n])
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := ReadClientHello(bytes.NewReader(data), discard)
+		if err != nil {
+			return
+		}
+		// Whatever parses must marshal back to the message as read.
+		b, err := msg.Marshal()
+		if err != nil {
+			t.Fatalf("failed to marshal a parsed ClientHello: %v", err)
+		}
+		if !bytes.Equal(b, msg.Raw) {
+			t.Fatalf("marshaled ClientHello differs from the one read:\n got %x\nwant %x", b, msg.Raw)
+		}
+	})
+}
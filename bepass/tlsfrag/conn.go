@@ -1,15 +1,15 @@
 package tlsfrag
 
 import (
-	"bytes"
+	"context"
 	"fmt"
 	"log/slog"
-	"math/rand"
 	"net"
+	"slices"
 	"sync"
 	"time"
 
-	"github.com/markpash/heybabe/bepass/sni"
+	"github.com/markpash/heybabe/sockopt"
 )
 
 // Adapter represents an adapter for implementing fragmentation as net.Conn interface
@@ -19,215 +19,184 @@ type Adapter struct {
 	writeMutex   sync.Mutex
 	isFirstWrite bool
 	logger       *slog.Logger
-	// search for sni and if sni was found, initially split client hello packet to 3 packets
-	// first chunk is contents of original tls hello packet before reaching sni
-	// second packet is sni itself
-	// and third package is contents of original tls hello packet after sni
-	// we fragment each part separately BSL indicates each fragment's size(a range) for
-	// original packet contents before reaching the sni
-	// SL indicates each fragment's size(a range) for the sni itself
-	// ASL indicates each fragment's size(a range) for remaining contents of original packet that comes after sni
-	// and delay indicates how much delay system should take before sending next fragment as a separate packet
-	BSL   [2]int
-	SL    [2]int
-	ASL   [2]int
-	Delay [2]int
+	// Fragmenter decides how the first packet is cut up.
+	Fragmenter Fragmenter
+	// OnFirstWrite, if set, is called with what was put on the wire once the
+	// first packet has been written, even if writing it failed midway.
+	OnFirstWrite func(Stats)
+	// Context, if set, cuts the delays between fragments short and stops
+	// the remaining fragments from being written once it's done.
+	Context context.Context
+
+	// offsets of the first packet where it was cut, see SplitPositions
+	splits []int
 }
 
-// New creates a new Adapter from a net.Conn connection.
+// Stats describes how the first packet was actually sent.
+type Stats struct {
+	Fragments int             `json:"fragments"`
+	Sizes     []int           `json:"sizes"`
+	Delays    []time.Duration `json:"delays"` // slept after each fragment
+	TTLs      []int           `json:"ttls"`   // 0 for the default TTL
+}
+
+// New creates a new Adapter from a net.Conn connection, using the bepass
+// SNIFragmenter.
 func New(conn net.Conn, bsl, sl, asl, delay [2]int, logger *slog.Logger) *Adapter {
-	logger.Debug("creating new TLS fragmentation adapter", 
+	logger.Debug("creating new TLS fragmentation adapter",
 		"local_addr", conn.LocalAddr(),
 		"remote_addr", conn.RemoteAddr(),
 		"bsl", bsl,
 		"sl", sl,
 		"asl", asl,
 		"delay", delay)
-	
+
+	return NewWithFragmenter(conn, &SNIFragmenter{BSL: bsl, SL: sl, ASL: asl, Delay: delay}, logger)
+}
+
+// NewWithFragmenter creates a new Adapter from a net.Conn connection that
+// sends the first packet as planned by f.
+func NewWithFragmenter(conn net.Conn, f Fragmenter, logger *slog.Logger) *Adapter {
+	logger.Debug("creating new TLS fragmentation adapter with fragmenter",
+		"local_addr", conn.LocalAddr(),
+		"remote_addr", conn.RemoteAddr(),
+		"fragmenter", fmt.Sprintf("%T", f))
+
 	return &Adapter{
 		conn:         conn,
 		isFirstWrite: true,
 		logger:       logger,
-		BSL:          bsl,
-		SL:           sl,
-		ASL:          asl,
-		Delay:        delay,
+		Fragmenter:   f,
 	}
 }
 
-// it will search for sni or host in package and if found then chunks Write writes data to the net.Conn connection.
-func (a *Adapter) writeFragments(b []byte, index int) (int, error) {
-	a.logger.Debug("writeFragments: starting fragmentation", 
-		"data_length", len(b), 
-		"fragment_index", index,
-		"is_sni_fragment", index == 1)
-	
-	nw := 0
-	position := 0
-	lengthMin, lengthMax := 0, 0
-	if index == 0 {
-		lengthMin, lengthMax = a.BSL[0], a.BSL[1]
-		a.logger.Debug("writeFragments: using BSL (before SNI) fragment sizes", "min", lengthMin, "max", lengthMax)
-	} else if index == 1 { // if its sni
-		lengthMin, lengthMax = a.SL[0], a.SL[1]
-		a.logger.Debug("writeFragments: using SL (SNI) fragment sizes", "min", lengthMin, "max", lengthMax)
-	} else { // if its after sni
-		lengthMin, lengthMax = a.ASL[0], a.ASL[1]
-		a.logger.Debug("writeFragments: using ASL (after SNI) fragment sizes", "min", lengthMin, "max", lengthMax)
-	}
-	
-	fragmentCount := 0
-	for position < len(b) {
-		fragmentCount++
-		a.logger.Debug("writeFragments: creating fragment", 
-			"fragment_number", fragmentCount,
-			"position", position,
-			"remaining_bytes", len(b)-position)
-		
-		var fragmentLength int
-		if lengthMax-lengthMin > 0 {
-			fragmentLength = rand.Intn(lengthMax-lengthMin) + lengthMin
-			a.logger.Debug("writeFragments: random fragment length", "length", fragmentLength, "range", fmt.Sprintf("%d-%d", lengthMin, lengthMax))
-		} else {
-			fragmentLength = lengthMin
-			a.logger.Debug("writeFragments: fixed fragment length", "length", fragmentLength)
-		}
+// SplitPositions returns the offsets within the first packet at which it
+// was cut into separate writes, so that a run can be reproduced.
+func (a *Adapter) SplitPositions() []int {
+	a.writeMutex.Lock()
+	defer a.writeMutex.Unlock()
+	return slices.Clone(a.splits)
+}
 
-		if fragmentLength > len(b)-position {
-			fragmentLength = len(b) - position
-			a.logger.Debug("writeFragments: adjusted fragment length to remaining data", "new_length", fragmentLength)
-		}
+func (a *Adapter) ctx() context.Context {
+	if a.Context == nil {
+		return context.Background()
+	}
+	return a.Context
+}
 
-		var delay int
-		if a.Delay[1]-a.Delay[0] > 0 {
-			delay = rand.Intn(a.Delay[1]-a.Delay[0]) + a.Delay[0]
-			a.logger.Debug("writeFragments: random delay", "delay_ms", delay, "range", fmt.Sprintf("%d-%d", a.Delay[0], a.Delay[1]))
-		} else {
-			delay = a.Delay[0]
-			a.logger.Debug("writeFragments: fixed delay", "delay_ms", delay)
-		}
+// sleep waits for d, or until the Adapter's Context is done.
+func (a *Adapter) sleep(d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-a.ctx().Done():
+		return a.ctx().Err()
+	}
+}
 
-		a.logger.Debug("writeFragments: writing fragment", 
-			"fragment_number", fragmentCount,
-			"fragment_length", fragmentLength,
-			"delay_ms", delay,
-			"data_range", fmt.Sprintf("%d:%d", position, position+fragmentLength))
-
-		tnw, ew := a.conn.Write(b[position : position+fragmentLength])
-		if ew != nil {
-			a.logger.Error("writeFragments: failed to write fragment", 
-				"fragment_number", fragmentCount,
-				"error", ew)
-			return 0, ew
-		}
+// writeFragment writes a single fragment, with the TTL it asks for.
+func (a *Adapter) writeFragment(f Fragment) (int, error) {
+	if f.TTL == 0 {
+		nw, err := a.conn.Write(f.Data)
+		a.trace("writeFragment: wrote fragment", f.Data[:nw])
+		return nw, err
+	}
 
-		a.logger.Debug("writeFragments: fragment written successfully", 
-			"fragment_number", fragmentCount,
-			"bytes_written", tnw)
+	ttl, err := sockopt.TTL(a.conn)
+	if err != nil {
+		return 0, err
+	}
+	if err := sockopt.SetTTL(a.conn, f.TTL); err != nil {
+		return 0, err
+	}
+	a.logger.Debug("writeFragment: lowered TTL", "ttl", f.TTL, "previous_ttl", ttl)
 
-		nw += tnw
-		position += fragmentLength
-		
-		if delay > 0 {
-			a.logger.Debug("writeFragments: sleeping before next fragment", "delay_ms", delay)
-			time.Sleep(time.Duration(delay) * time.Millisecond)
-		}
+	nw, err := a.conn.Write(f.Data)
+	a.trace("writeFragment: wrote fragment", f.Data[:nw], "ttl", f.TTL)
+	if err != nil {
+		return nw, err
 	}
 
-	a.logger.Debug("writeFragments: fragmentation completed", 
-		"total_fragments", fragmentCount,
-		"total_bytes_written", nw,
-		"original_data_length", len(b))
+	// let the kernel push the fragment out before restoring the TTL
+	if err := a.sleep(time.Millisecond); err != nil {
+		return nw, err
+	}
+	if err := sockopt.SetTTL(a.conn, ttl); err != nil {
+		return nw, err
+	}
+	a.logger.Debug("writeFragment: restored TTL", "ttl", ttl)
 	return nw, nil
 }
 
-// it will search for sni or host in package and if found then chunks Write writes data to the net.Conn connection.
+// fragmentAndWriteFirstPacket asks the Fragmenter how to cut up the first
+// packet and writes the fragments.
 func (a *Adapter) fragmentAndWriteFirstPacket(b []byte) (int, error) {
 	a.logger.Debug("fragmentAndWriteFirstPacket: starting to process first packet", "packet_length", len(b))
-	
-	hello, err := sni.ReadClientHello(bytes.NewReader(b), a.logger)
-	if err != nil {
-		a.logger.Warn("fragmentAndWriteFirstPacket: failed to parse ClientHello, writing packet as-is", "error", err)
-		return a.conn.Write(b)
-	}
-	
-	a.logger.Debug("fragmentAndWriteFirstPacket: successfully parsed ClientHello", 
-		"server_name", hello.ServerName,
-		"tls_version", hello.Versions)
-	
-	helloPacketSni := []byte(hello.ServerName)
-	chunks := make(map[int][]byte)
-
-	/*
-		splitting original hello packet to BeforeSNI, SNI, AfterSNI chunks
-	*/
-	// search for sni through original tls client hello
-	a.logger.Debug("fragmentAndWriteFirstPacket: searching for SNI in packet", "sni", hello.ServerName)
-	index := bytes.Index(b, helloPacketSni)
-	if index == -1 {
-		a.logger.Warn("fragmentAndWriteFirstPacket: SNI not found in packet, writing packet as-is")
-		return a.conn.Write(b)
+
+	plan := a.Fragmenter.SplitPlan(b)
+	a.logger.Debug("fragmentAndWriteFirstPacket: got split plan", "fragment_count", len(plan))
+
+	var stats Stats
+	if a.OnFirstWrite != nil {
+		defer func() { a.OnFirstWrite(stats) }()
 	}
-	
-	a.logger.Debug("fragmentAndWriteFirstPacket: found SNI at position", "sni_position", index, "sni_length", len(helloPacketSni))
-	
-	// before helloPacketSni
-	chunks[0] = make([]byte, index)
-	copy(chunks[0], b[:index])
-	a.logger.Debug("fragmentAndWriteFirstPacket: created before-SNI chunk", "chunk_length", len(chunks[0]))
-	
-	// helloPacketSni
-	chunks[1] = make([]byte, len(helloPacketSni))
-	copy(chunks[1], b[index:index+len(helloPacketSni)])
-	a.logger.Debug("fragmentAndWriteFirstPacket: created SNI chunk", "chunk_length", len(chunks[1]), "sni_content", string(chunks[1]))
-	
-	// after helloPacketSni
-	chunks[2] = make([]byte, len(b)-index-len(helloPacketSni))
-	copy(chunks[2], b[index+len(helloPacketSni):])
-	a.logger.Debug("fragmentAndWriteFirstPacket: created after-SNI chunk", "chunk_length", len(chunks[2]))
-
-	/*
-		sending fragments
-	*/
-	// number of written packets
+
 	nw := 0
-	var ew error = nil
-
-	a.logger.Debug("fragmentAndWriteFirstPacket: starting to send fragmented chunks")
-	for i := 0; i < 3; i++ {
-		chunkName := "before-SNI"
-		if i == 1 {
-			chunkName = "SNI"
-		} else if i == 2 {
-			chunkName = "after-SNI"
+	for i, f := range plan {
+		if nw > 0 {
+			a.splits = append(a.splits, nw)
+		}
+
+		a.logger.Debug("fragmentAndWriteFirstPacket: writing fragment",
+			"fragment_number", i+1,
+			"fragment_length", len(f.Data),
+			"ttl", f.TTL,
+			"delay", f.Delay,
+			"data_range", fmt.Sprintf("%d:%d", nw, nw+len(f.Data)))
+
+		if err := a.ctx().Err(); err != nil {
+			a.logger.Debug("fragmentAndWriteFirstPacket: context done, not writing fragment",
+				"fragment_number", i+1,
+				"error", err)
+			return 0, err
 		}
-		
-		a.logger.Debug("fragmentAndWriteFirstPacket: sending chunk", 
-			"chunk_index", i,
-			"chunk_name", chunkName,
-			"chunk_length", len(chunks[i]))
-		
-		tnw, ew := a.writeFragments(chunks[i], i)
-		if ew != nil {
-			a.logger.Error("fragmentAndWriteFirstPacket: failed to write chunk", 
-				"chunk_index", i,
-				"chunk_name", chunkName,
-				"error", ew)
-			return 0, ew
+
+		tnw, err := a.writeFragment(f)
+		if err != nil {
+			a.logger.Error("fragmentAndWriteFirstPacket: failed to write fragment",
+				"fragment_number", i+1,
+				"error", err)
+			return 0, err
 		}
-		
-		a.logger.Debug("fragmentAndWriteFirstPacket: chunk sent successfully", 
-			"chunk_index", i,
-			"chunk_name", chunkName,
-			"bytes_written", tnw)
-		
 		nw += tnw
+
+		var delay time.Duration
+		if f.Delay > 0 && i < len(plan)-1 {
+			delay = f.Delay
+		}
+		stats.Fragments++
+		stats.Sizes = append(stats.Sizes, tnw)
+		stats.Delays = append(stats.Delays, delay)
+		stats.TTLs = append(stats.TTLs, f.TTL)
+
+		if delay > 0 {
+			a.logger.Debug("fragmentAndWriteFirstPacket: sleeping before next fragment", "delay", delay)
+			if err := a.sleep(delay); err != nil {
+				return 0, err
+			}
+		}
 	}
 
-	a.logger.Debug("fragmentAndWriteFirstPacket: all chunks sent successfully", 
+	a.logger.Debug("fragmentAndWriteFirstPacket: all fragments sent successfully",
 		"total_bytes_written", nw,
 		"original_packet_length", len(b))
-	return nw, ew
+
+	// The plan may add bytes (e.g. record headers), but the caller only
+	// cares about its own.
+	return len(b), nil
 }
 
 // Write writes data to the net.Conn connection.
@@ -235,7 +204,7 @@ func (a *Adapter) Write(b []byte) (int, error) {
 	a.writeMutex.Lock()
 	defer a.writeMutex.Unlock()
 
-	a.logger.Debug("Write: starting write operation", 
+	a.logger.Debug("Write: starting write operation",
 		"data_length", len(b),
 		"is_first_write", a.isFirstWrite)
 
@@ -271,11 +240,12 @@ func (a *Adapter) Read(b []byte) (int, error) {
 	a.logger.Debug("Read: starting read operation", "buffer_size", len(b))
 
 	bytesRead, err := a.conn.Read(b)
+	a.trace("Read: read data", b[:bytesRead])
 	if err != nil {
 		a.logger.Error("Read: read operation failed", "error", err, "bytes_read", bytesRead)
 		return 0, err
 	}
-	
+
 	a.logger.Debug("Read: read operation completed successfully", "bytes_read", bytesRead)
 	return bytesRead, err
 }
@@ -0,0 +1,193 @@
+package tlsfrag
+
+import (
+	"bytes"
+	"log/slog"
+	"math/rand"
+	"time"
+
+	"github.com/markpash/heybabe/bepass/sni"
+)
+
+// Fragment is a piece of the first packet, written to the connection with a
+// single Write.
+type Fragment struct {
+	Data []byte
+	// Delay is how long to wait after writing this fragment.
+	Delay time.Duration
+	// TTL, when non-zero, is the IP TTL this fragment is sent with. The
+	// previous TTL is restored right after.
+	TTL int
+}
+
+// Fragmenter decides how the first packet of a connection (the TLS
+// ClientHello) is cut up and sent.
+type Fragmenter interface {
+	// SplitPlan returns the fragments to write in order. The fragments don't
+	// have to add up to clientHello, e.g. they may carry extra records.
+	SplitPlan(clientHello []byte) []Fragment
+}
+
+// randRange returns a random number in [r[0], r[1]), or r[0] if the range
+// is empty.
+func randRange(r [2]int) int {
+	if r[1]-r[0] > 0 {
+		return rand.Intn(r[1]-r[0]) + r[0]
+	}
+	return r[0]
+}
+
+func randDelay(r [2]int) time.Duration {
+	return time.Duration(randRange(r)) * time.Millisecond
+}
+
+// SNIFragmenter is the bepass strategy: search for the SNI and, if found,
+// initially split the client hello packet into 3 chunks.
+// The first chunk is the contents of the original tls hello packet before
+// reaching the SNI, the second is the SNI itself and the third is the
+// contents of the original tls hello packet after the SNI.
+// Each chunk is then fragmented separately, BSL, SL and ASL give the range of
+// fragment sizes for each of them, and Delay how long to wait before sending
+// the next fragment.
+type SNIFragmenter struct {
+	BSL   [2]int
+	SL    [2]int
+	ASL   [2]int
+	Delay [2]int
+	// SNISplitAt, when set, splits the SNI chunk at these exact offsets
+	// within the hostname instead of using SL.
+	SNISplitAt []int
+}
+
+// SplitPlan implements Fragmenter. The packet is sent as a single fragment
+// if it does not carry an SNI.
+func (f *SNIFragmenter) SplitPlan(b []byte) []Fragment {
+	hello, err := sni.ReadClientHello(bytes.NewReader(b), slog.New(slog.DiscardHandler))
+	if err != nil || hello.ServerName == "" {
+		return []Fragment{{Data: b}}
+	}
+	index := bytes.Index(b, []byte(hello.ServerName))
+	if index == -1 {
+		return []Fragment{{Data: b}}
+	}
+	end := index + len(hello.ServerName)
+
+	var plan []Fragment
+	plan = append(plan, f.fragment(b[:index], f.BSL)...)
+	if len(f.SNISplitAt) > 0 {
+		prev := index
+		for _, at := range f.SNISplitAt {
+			if index+at <= prev || index+at >= end {
+				continue
+			}
+			plan = append(plan, Fragment{Data: b[prev : index+at], Delay: randDelay(f.Delay)})
+			prev = index + at
+		}
+		plan = append(plan, Fragment{Data: b[prev:end], Delay: randDelay(f.Delay)})
+	} else {
+		plan = append(plan, f.fragment(b[index:end], f.SL)...)
+	}
+	plan = append(plan, f.fragment(b[end:], f.ASL)...)
+
+	return plan
+}
+
+// fragment cuts b into pieces with random lengths within size.
+func (f *SNIFragmenter) fragment(b []byte, size [2]int) []Fragment {
+	var plan []Fragment
+	for len(b) > 0 {
+		n := min(max(randRange(size), 1), len(b))
+		plan = append(plan, Fragment{Data: b[:n], Delay: randDelay(f.Delay)})
+		b = b[n:]
+	}
+	return plan
+}
+
+// FixedSize cuts the packet into fragments of Size bytes.
+type FixedSize struct {
+	Size  int
+	Delay [2]int
+}
+
+// SplitPlan implements Fragmenter.
+func (f *FixedSize) SplitPlan(b []byte) []Fragment {
+	size := max(f.Size, 1)
+	var plan []Fragment
+	for len(b) > 0 {
+		n := min(size, len(b))
+		plan = append(plan, Fragment{Data: b[:n], Delay: randDelay(f.Delay)})
+		b = b[n:]
+	}
+	return plan
+}
+
+// RecordSplit splits the handshake record into several TLS records, each
+// carrying at most Size bytes of the handshake message. Unlike TCP
+// fragmentation this is visible to the server, which has to reassemble the
+// message from the records, as allowed by the TLS spec.
+type RecordSplit struct {
+	Size  int
+	Delay [2]int
+}
+
+// SplitPlan implements Fragmenter. Each record is its own fragment.
+func (f *RecordSplit) SplitPlan(b []byte) []Fragment {
+	const headerLen = 5
+	if len(b) < headerLen || b[0] != 0x16 {
+		return []Fragment{{Data: b}}
+	}
+	recordLen := int(b[3])<<8 | int(b[4])
+	if len(b) < headerLen+recordLen {
+		return []Fragment{{Data: b}}
+	}
+
+	size := max(f.Size, 1)
+	payload, rest := b[headerLen:headerLen+recordLen], b[headerLen+recordLen:]
+	var plan []Fragment
+	for len(payload) > 0 {
+		n := min(size, len(payload))
+		record := make([]byte, 0, headerLen+n)
+		record = append(record, b[0], b[1], b[2], byte(n>>8), byte(n))
+		record = append(record, payload[:n]...)
+		plan = append(plan, Fragment{Data: record, Delay: randDelay(f.Delay)})
+		payload = payload[n:]
+	}
+	if len(rest) > 0 {
+		plan = append(plan, Fragment{Data: rest})
+	}
+	return plan
+}
+
+// Disorder makes the first fragment of the wrapped Fragmenter arrive after
+// the rest. It is sent with a TTL of 1 so it gets dropped on the first hop,
+// and the kernel retransmits it once the other fragments are already out.
+type Disorder struct {
+	Fragmenter
+}
+
+// SplitPlan implements Fragmenter.
+func (f *Disorder) SplitPlan(b []byte) []Fragment {
+	plan := f.Fragmenter.SplitPlan(b)
+	if len(plan) > 1 {
+		plan[0].TTL = 1
+	}
+	return plan
+}
+
+// RecordVersion sends the handshake record unsplit, but with its
+// legacy_record_version set to Version, to find parsers that reject or
+// ignore nonstandard outer versions. Servers don't check it before the
+// version is negotiated.
+type RecordVersion struct {
+	Version uint16
+}
+
+// SplitPlan implements Fragmenter.
+func (f *RecordVersion) SplitPlan(b []byte) []Fragment {
+	if len(b) < 5 || b[0] != 0x16 {
+		return []Fragment{{Data: b}}
+	}
+	record := bytes.Clone(b)
+	record[1], record[2] = byte(f.Version>>8), byte(f.Version)
+	return []Fragment{{Data: record}}
+}
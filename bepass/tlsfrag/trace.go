@@ -0,0 +1,51 @@
+package tlsfrag
+
+import (
+	"bytes"
+	"encoding/hex"
+	"log/slog"
+)
+
+// LevelTrace is the log level below slog.LevelDebug at which the Adapter
+// hexdumps the bytes it writes and reads.
+const LevelTrace = slog.LevelDebug - 4
+
+// TraceOptions bound and redact the hexdumps logged at LevelTrace.
+type TraceOptions struct {
+	// MaxBytes is how many bytes of each write or read are dumped, 0 for
+	// all of them.
+	MaxBytes int
+	// Redact lists byte strings, e.g. the SNI, replaced with 'x's in the
+	// dumps.
+	Redact [][]byte
+}
+
+// Trace applies to the hexdumps of all Adapters. Set it before they're
+// used.
+var Trace = TraceOptions{MaxBytes: 512}
+
+// trace hexdumps b at LevelTrace, within the bounds of Trace.
+func (a *Adapter) trace(msg string, b []byte, args ...any) {
+	if !a.logger.Enabled(a.ctx(), LevelTrace) {
+		return
+	}
+
+	length := len(b)
+	b = redact(b, Trace.Redact)
+	if Trace.MaxBytes > 0 && len(b) > Trace.MaxBytes {
+		b = b[:Trace.MaxBytes]
+	}
+	args = append(args, "length", length, "dumped", len(b), "hexdump", hex.Dump(b))
+	a.logger.Log(a.ctx(), LevelTrace, msg, args...)
+}
+
+// redact returns b with every occurrence of secrets replaced with 'x's,
+// leaving b itself alone.
+func redact(b []byte, secrets [][]byte) []byte {
+	for _, s := range secrets {
+		if len(s) > 0 {
+			b = bytes.ReplaceAll(b, s, bytes.Repeat([]byte{'x'}, len(s)))
+		}
+	}
+	return b
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"strings"
+
+	"github.com/fatih/color"
+	"github.com/rodaine/table"
+)
+
+// sniProbe is a hostname handshaked with in place of the SNI, and whether
+// that was blocked.
+type sniProbe struct {
+	variant string
+	host    string
+	blocked bool
+}
+
+// maskSNI returns sni with every character outside [start, end) replaced by
+// a letter it doesn't have there, keeping the dots so the labels and their
+// lengths stay the same.
+func maskSNI(sni string, start, end int) string {
+	b := []byte(sni)
+	for i, c := range b {
+		if (i >= start && i < end) || c == '.' {
+			continue
+		}
+		if c == 'x' {
+			b[i] = 'z'
+		} else {
+			b[i] = 'x'
+		}
+	}
+	return string(b)
+}
+
+// runBisect finds which part of the SNI triggers the blocking, by
+// handshaking with variants of it: with a subdomain in front, in upper
+// case, with a label masked at a time, and then with all but a shrinking
+// window of it masked, bisecting to the smallest window still blocked. It
+// prints what it tried and the part it found.
+func runBisect(ctx context.Context, l *slog.Logger, to TestOptions) error {
+	suite := []testCase{cooldownTest}
+	sni := strings.ToLower(to.SNI)
+
+	// The SNI itself is resolved, and the variants sent to the same
+	// addresses. A variant counts as blocked when no address was reached.
+	l.Info("checking the SNI is blocked", "sni", sni)
+	reached, err := reachTargets(ctx, l, to, suite)
+	if err != nil {
+		return err
+	}
+	var addrs []netip.Addr
+	blocked := true
+	for addrPort, ok := range reached {
+		if addrPort.IsValid() {
+			addrs = append(addrs, addrPort.Addr())
+			blocked = blocked && !ok
+		}
+	}
+	if len(addrs) == 0 {
+		return errors.New("the SNI couldn't be resolved, set --ip to bisect it")
+	}
+	probes := []sniProbe{{variant: "SNI", host: sni, blocked: blocked}}
+	if !blocked {
+		printBisect(probes, "The SNI isn't blocked, there is nothing to bisect.")
+		return nil
+	}
+
+	try := func(variant, host string) (bool, error) {
+		vto := to
+		vto.SNI = host
+		vto.Host = ""
+		vto.ManualIPs = addrs
+		l.Info("trying SNI variant", "variant", variant, "sni", host)
+		reached, err := reachTargets(ctx, l, vto, suite)
+		if err != nil {
+			return false, err
+		}
+		blocked := true
+		for _, ok := range reached {
+			blocked = blocked && !ok
+		}
+		probes = append(probes, sniProbe{variant: variant, host: host, blocked: blocked})
+		return blocked, nil
+	}
+
+	masked := maskSNI(sni, 0, 0)
+	if blocked, err := try("Masked", masked); err != nil {
+		return err
+	} else if blocked {
+		printBisect(probes, "The fully masked SNI is blocked too, so the blocking isn't by SNI; see the IP blocking checks of the tests.")
+		return nil
+	}
+
+	variants := []struct{ name, host string }{
+		{"Subdomain", "heybabe." + sni},
+		{"Upper Case", strings.ToUpper(sni)},
+	}
+	labels := strings.Split(sni, ".")
+	for i, off := 0, 0; i < len(labels); i++ {
+		// Masking a label leaves the rest as is.
+		host := sni[:off] + maskSNI(labels[i], 0, 0) + sni[off+len(labels[i]):]
+		variants = append(variants, struct{ name, host string }{fmt.Sprintf("Label %d Masked", i+1), host})
+		off += len(labels[i]) + 1
+	}
+	for _, v := range variants {
+		if _, err := try(v.name, v.host); err != nil {
+			return err
+		}
+	}
+
+	// Blocking is assumed to be monotone: a window of the SNI containing
+	// the trigger stays blocked. The start is moved right as far as the
+	// rest stays blocked, then the end left.
+	lo, hi := 0, len(sni)
+	for hi-lo > 1 {
+		mid := (lo + hi) / 2
+		blocked, err := try(fmt.Sprintf("Keep %d-%d", mid, len(sni)-1), maskSNI(sni, mid, len(sni)))
+		if err != nil {
+			return err
+		}
+		if blocked {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	start := lo
+	lo, hi = start, len(sni)
+	for hi-lo > 1 {
+		mid := (lo + hi) / 2
+		blocked, err := try(fmt.Sprintf("Keep %d-%d", start, mid-1), maskSNI(sni, start, mid))
+		if err != nil {
+			return err
+		}
+		if blocked {
+			hi = mid
+		} else {
+			lo = mid
+		}
+	}
+	end := hi
+
+	summary := fmt.Sprintf("Blocking is triggered by %q at offset %d of the SNI, as in %s.", sni[start:end], start, maskSNI(sni, start, end))
+	// Blocks lasting beyond the connection would fail every variant
+	// after the first blocked one.
+	if blocked, err := try("Masked Again", masked); err != nil {
+		return err
+	} else if blocked {
+		summary = "The fully masked SNI got blocked after the variants, so blocking outlasts connections and skewed the results; see --cooldown and --max-connections-per-minute."
+	}
+	printBisect(probes, summary)
+	return nil
+}
+
+// printBisect shows the SNI variants tried, and what they found.
+func printBisect(probes []sniProbe, summary string) {
+	headerFmt := color.New(color.FgHiMagenta, color.Bold, color.Underline).SprintfFunc()
+	columnFmt := color.New(color.FgHiCyan, color.Bold).SprintfFunc()
+
+	tbl := table.New("Variant", "SNI", "Result")
+	tbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt)
+	for _, p := range probes {
+		result := "Reached"
+		if p.blocked {
+			result = "Blocked"
+		}
+		tbl.AddRow(p.variant, p.host, result)
+	}
+
+	fmt.Println("")
+	tbl.Print()
+	fmt.Printf("\n%s\n\n", summary)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"log/slog"
+)
+
+// insecure reports whether the tests should complete handshakes whatever
+// the server's certificate, to time and analyze decoy or self-signed
+// endpoints.
+func insecure(ctx context.Context) bool {
+	return tlsSettingsFrom(ctx).insecure
+}
+
+// verifyPeer does the verification an insecure handshake skipped, against
+// the system roots, and returns why certs aren't a valid chain for sni. It
+// returns nil when not in insecure mode, where the handshake verified them.
+func verifyPeer(ctx context.Context, l *slog.Logger, sni string, certs []*x509.Certificate) error {
+	if !insecure(ctx) {
+		return nil
+	}
+	if len(certs) == 0 {
+		err := errors.New("server sent no certificate")
+		l.Warn("certificate verification failed", "error", err)
+		return err
+	}
+
+	leaf := certs[0]
+	opts := x509.VerifyOptions{
+		DNSName:       sni,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	if _, err := leaf.Verify(opts); err != nil {
+		l.Warn("certificate verification failed",
+			"error", err,
+			"subject", leaf.Subject.String(),
+			"issuer", leaf.Issuer.String(),
+			"dns_names", leaf.DNSNames,
+			"ip_addresses", leaf.IPAddresses,
+			"not_before", leaf.NotBefore,
+			"not_after", leaf.NotAfter,
+			"chain_length", len(certs))
+		return err
+	}
+	l.Debug("certificate verified", "subject", leaf.Subject.String(), "issuer", leaf.Issuer.String())
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+)
+
+// Default value of the --control-host flag, a host that is reachable from
+// anywhere unless the local network itself is broken.
+const defaultControlHost = "cp.cloudflare.com"
+
+// controlResult is how the control host fared with the Default tests.
+type controlResult struct {
+	host    string
+	results map[string][]TestResult
+	order   []string
+	err     error // why the control host couldn't be tested at all
+}
+
+// ok reports whether any test reached the control host.
+func (cr controlResult) ok() bool {
+	for _, label := range cr.order {
+		for _, tr := range cr.results[label] {
+			if _, success := tr.status(); success > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// controlSuite returns the Default tests, which the control host is
+// measured with.
+func controlSuite() []testCase {
+	var suite []testCase
+	for _, tc := range testSuite {
+		if strings.HasPrefix(tc.label, "Default - ") {
+			suite = append(suite, tc)
+		}
+	}
+	return suite
+}
+
+// runControl measures the control host with the Default tests, once each,
+// on the address families the run tests.
+func runControl(ctx context.Context, l *slog.Logger, to TestOptions) controlResult {
+	cto := to
+	cto.SNI = to.ControlHost
+	cto.Host = ""
+	cto.Port = 443
+	cto.Repeat = 1
+	cto.OnTestDone = nil
+	cto.FailureControls = false
+	cto.ManualIPs = nil
+	if len(to.ManualIPs) > 0 {
+		cto.ResolveIPv4, cto.ResolveIPv6 = false, false
+		for _, addr := range to.ManualIPs {
+			cto.ResolveIPv4 = cto.ResolveIPv4 || addr.Is4()
+			cto.ResolveIPv6 = cto.ResolveIPv6 || addr.Is6()
+		}
+	}
+
+	suite := controlSuite()
+	if to.Quick {
+		suite = slices.DeleteFunc(suite, func(tc testCase) bool { return !slices.Contains(quickTests, testID(tc.label)) })
+	}
+
+	l.Debug("measuring control host", "control_host", cto.SNI)
+	results, order, err := runCases(ctx, l, cto, suite)
+	return controlResult{host: cto.SNI, results: results, order: order, err: err}
+}
+
+// printControl shows the control host's results, and whether the run's
+// failures are down to the local network rather than censorship.
+func printControl(cr controlResult) {
+	if cr.err != nil {
+		fmt.Printf("Control host %s could not be tested: %v\n", cr.host, cr.err)
+	} else {
+		fmt.Printf("Control host %s:\n", cr.host)
+		printTable(cr.results, cr.order, nil)
+	}
+
+	if cr.ok() {
+		fmt.Printf("Control host reachable, failures above are not down to local connectivity\n\n")
+	} else {
+		fmt.Printf("Local connectivity problem: the control host failed too, so failures above are likely not censorship\n\n")
+	}
+}
+
+// withControl returns results and order with the control host's results
+// added first, under labels starting with "Control - ".
+func withControl(cr controlResult, results map[string][]TestResult, order []string) (map[string][]TestResult, []string) {
+	merged := make(map[string][]TestResult, len(results)+len(cr.order))
+	var mergedOrder []string
+	for _, label := range cr.order {
+		merged["Control - "+label] = cr.results[label]
+		mergedOrder = append(mergedOrder, "Control - "+label)
+	}
+	for _, label := range order {
+		merged[label] = results[label]
+	}
+	return merged, append(mergedOrder, order...)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"slices"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/rodaine/table"
+)
+
+// Default value of the --cooldown-sni flag, a name no censor blocks.
+const defaultCooldownSNI = "example.com"
+
+// cooldownSchedule is when the target is probed after triggering the block,
+// counting from the trigger. After the last, the wait keeps doubling.
+var cooldownSchedule = []time.Duration{0, 10 * time.Second, 30 * time.Second, time.Minute, 2 * time.Minute, 5 * time.Minute, 10 * time.Minute, 20 * time.Minute, 30 * time.Minute, time.Hour}
+
+// cooldownTest is the test that triggers the block and probes the target.
+var cooldownTest = testCase{fn: test_TCP_TLS13_Default, label: "Default - TCP - TLS 1.3"}
+
+// cooldownResult is how long the block triggered on one target lasted.
+type cooldownResult struct {
+	addrPort netip.AddrPort
+	// unreachable is set when the probe SNI failed before anything was
+	// triggered, so there is nothing to measure.
+	unreachable bool
+	// triggered is set when the SNI failed, which the rest is about.
+	triggered bool
+	// lifted is set when a probe got through, liftedAt after the trigger,
+	// and blocked is when the last probe before it failed.
+	lifted            bool
+	blocked, liftedAt time.Duration
+	probes            int
+}
+
+func (cr cooldownResult) String() string {
+	switch {
+	case cr.unreachable:
+		return "unreachable with the probe SNI, can't measure"
+	case !cr.triggered:
+		return "SNI not blocked, nothing triggered"
+	case !cr.lifted:
+		return fmt.Sprintf("still blocked after %v (permanent)", cr.blocked)
+	case cr.probes == 1:
+		return "none, only the connection is blocked"
+	default:
+		return fmt.Sprintf("lifted between %v and %v", cr.blocked, cr.liftedAt)
+	}
+}
+
+// reachedServer reports whether an attempt got through to the server. An
+// alert or a certificate the client rejects is an answer too, from a server
+// that doesn't serve the SNI.
+func reachedServer(attempt TestAttemptResult) bool {
+	return attempt.Err == nil || attempt.Err.Class == ErrorClassTLSAlert || attempt.Err.Class == ErrorClassCertificate
+}
+
+// runCooldown triggers the block on each of the targets with a handshake
+// for the SNI, then probes them with handshakes for to.CooldownSNI at
+// increasing intervals, until the probes get through or to.Cooldown has
+// passed, and prints how long the block lasted. Probes may extend blocks
+// that are renewed by every connection, which is what clients retrying
+// would run into too.
+func runCooldown(ctx context.Context, l *slog.Logger, to TestOptions) error {
+	suite := []testCase{cooldownTest}
+
+	probe := func(addrs []netip.Addr) (map[netip.AddrPort]bool, error) {
+		pto := to
+		pto.SNI = to.CooldownSNI
+		pto.Host = ""
+		pto.ManualIPs = addrs
+		return reachTargets(ctx, l, pto, suite)
+	}
+
+	// The probe goes first, to the addresses of the SNI, so a failure later
+	// isn't down to the probe SNI being blocked as well.
+	bto := to
+	bto.SNI = to.CooldownSNI
+	bto.Host = to.resolveHost()
+	l.Info("checking the probe SNI reaches the target", "probe_sni", to.CooldownSNI)
+	baseline, err := reachTargets(ctx, l, bto, suite)
+	if err != nil {
+		return err
+	}
+
+	var (
+		results []cooldownResult
+		reached []netip.Addr
+		runErr  error
+	)
+	for addrPort, ok := range baseline {
+		results = append(results, cooldownResult{addrPort: addrPort, unreachable: !ok})
+		if ok {
+			reached = append(reached, addrPort.Addr())
+		}
+	}
+	slices.SortFunc(results, func(a, b cooldownResult) int { return a.addrPort.Compare(b.addrPort) })
+	if len(reached) > 0 {
+		tto := to
+		tto.ManualIPs = reached
+		l.Info("triggering the block", "sni", to.SNI)
+		triggered, err := reachTargets(ctx, l, tto, suite)
+		if err != nil {
+			return err
+		}
+		t0 := time.Now()
+
+		var blocked []netip.Addr
+		for i, cr := range results {
+			if ok, ran := triggered[cr.addrPort]; ran && !ok {
+				results[i].triggered = true
+				blocked = append(blocked, cr.addrPort.Addr())
+			}
+		}
+
+		// An interrupted measurement still shows how long the blocks
+		// lasted so far.
+		for i, next := 0, time.Duration(0); len(blocked) > 0 && next <= to.Cooldown; i++ {
+			if runErr = sleep(ctx, time.Until(t0.Add(next))); runErr != nil {
+				break
+			}
+			l.Info("probing", "since_trigger", next, "targets", len(blocked))
+			var reached map[netip.AddrPort]bool
+			if reached, runErr = probe(blocked); runErr != nil {
+				break
+			}
+			blocked = blocked[:0]
+			for j, cr := range results {
+				if !cr.triggered || cr.lifted {
+					continue
+				}
+				results[j].probes++
+				if reached[cr.addrPort] {
+					results[j].lifted, results[j].liftedAt = true, next
+					l.Info("block lifted", "target", cr.addrPort, "since_trigger", next)
+					continue
+				}
+				results[j].blocked = next
+				blocked = append(blocked, cr.addrPort.Addr())
+			}
+
+			if i+1 < len(cooldownSchedule) {
+				next = cooldownSchedule[i+1]
+			} else {
+				next *= 2
+			}
+		}
+	}
+
+	printCooldown(to.SNI, to.CooldownSNI, results)
+	return runErr
+}
+
+// reachTargets runs suite once for to, and returns whether each target was
+// reached.
+func reachTargets(ctx context.Context, l *slog.Logger, to TestOptions, suite []testCase) (map[netip.AddrPort]bool, error) {
+	to.Repeat = 1
+	to.WarmUp = false
+	to.Shuffle = false
+	to.OnTestDone = nil
+	to.FailureControls = false
+	results, order, err := runCases(ctx, l, to, suite)
+	if err != nil {
+		return nil, err
+	}
+
+	reached := make(map[netip.AddrPort]bool)
+	for _, label := range order {
+		for _, tr := range results[label] {
+			for _, attempt := range tr.Attempts {
+				reached[tr.AddrPort] = reached[tr.AddrPort] || reachedServer(attempt)
+			}
+		}
+	}
+	return reached, nil
+}
+
+// printCooldown shows how long the block lasted on each target.
+func printCooldown(sni, probeSNI string, results []cooldownResult) {
+	headerFmt := color.New(color.FgHiMagenta, color.Bold, color.Underline).SprintfFunc()
+	columnFmt := color.New(color.FgHiCyan, color.Bold).SprintfFunc()
+
+	fmt.Printf("\nBlock persistence after triggering %s, probed with %s:\n", sni, probeSNI)
+	tbl := table.New("IP:Port", "Block Persistence", "Probes")
+	tbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt)
+	for _, cr := range results {
+		tbl.AddRow(cr.addrPort, cr, cr.probes)
+	}
+	tbl.Print()
+	fmt.Println("")
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func TestCronNextDST(t *testing.T) {
+	tests := []struct {
+		zone, expr string
+		from, want string // in zone, without the offset
+	}{
+		// Spring forward skips 02:00-03:00.
+		{"America/New_York", "0 0 * * 7", "2026-03-08 00:00", "2026-03-15 00:00"},
+		{"America/New_York", "30 2 * * *", "2026-03-08 00:00", "2026-03-09 02:30"},
+		{"America/New_York", "0 * 8 3 *", "2026-03-08 01:00", "2026-03-08 03:00"},
+		{"Europe/Berlin", "30 2 * * *", "2026-03-29 00:00", "2026-03-30 02:30"},
+		{"Europe/Berlin", "*/20 * * * *", "2026-03-29 01:50", "2026-03-29 03:00"},
+		// Fall back repeats 02:00-03:00.
+		{"Europe/Berlin", "0 3 * * *", "2026-10-25 00:00", "2026-10-25 03:00"},
+		{"America/New_York", "0 3 * * *", "2026-11-01 00:00", "2026-11-01 03:00"},
+		// Midnight is skipped.
+		{"America/Sao_Paulo", "0 * 4 11 *", "2018-11-03 12:00", "2018-11-04 01:00"},
+		{"America/Sao_Paulo", "0 0 * * *", "2018-11-03 12:00", "2018-11-05 00:00"},
+	}
+	for _, tt := range tests {
+		loc, err := time.LoadLocation(tt.zone)
+		if err != nil {
+			t.Fatal(err)
+		}
+		from, err := time.ParseInLocation(time.DateTime[:16], tt.from, loc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := parseCron(tt.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := c.next(from).Format(time.DateTime[:16]); got != tt.want {
+			t.Errorf("%s: %q.next(%s) = %s, want %s", tt.zone, tt.expr, tt.from, got, tt.want)
+		}
+	}
+}
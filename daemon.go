@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/peterbourgon/ff/v4"
+	"github.com/peterbourgon/ff/v4/ffhelp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// daemonRunTimeout bounds a whole run of the suite against one target.
+const daemonRunTimeout = 30 * time.Minute
+
+// daemonSchedule is a set of targets tested on a cron schedule, given as
+// "CRON=sni1,sni2".
+type daemonSchedule struct {
+	cron *cronSchedule
+	snis []string
+	next time.Time
+}
+
+func parseDaemonSchedule(s string) (*daemonSchedule, error) {
+	expr, targets, ok := strings.Cut(s, "=")
+	if !ok {
+		return nil, fmt.Errorf("schedule %q must be CRON=sni1,sni2", s)
+	}
+	c, err := parseCron(expr)
+	if err != nil {
+		return nil, fmt.Errorf("schedule %q: %w", s, err)
+	}
+	ds := &daemonSchedule{cron: c}
+	for _, sni := range strings.Split(targets, ",") {
+		if sni = strings.TrimSpace(sni); sni != "" {
+			ds.snis = append(ds.snis, sni)
+		}
+	}
+	if len(ds.snis) == 0 {
+		return nil, fmt.Errorf("schedule %q has no targets", s)
+	}
+	return ds, nil
+}
+
+// runDaemonCommand runs "heybabe daemon", which keeps running and tests
+// sets of targets on cron schedules, so one process can monitor several
+// domains on different cadences.
+func runDaemonCommand(l *slog.Logger, args []string) {
+	fs := ff.NewFlagSet(appName + " daemon")
+	var (
+		schedules  = fs.StringListLong("schedule", "cron schedule and the SNIs to test on it, as \"*/15 * * * *=sni1,sni2\" (repeatable)")
+		v4         = fs.BoolShort('4', "only resolve IPv4")
+		v6         = fs.BoolShort('6', "only resolve IPv6")
+		port       = fs.UintLong("port", 443, "tls port")
+		repeat     = fs.UintLong("repeat", 1, "number of times to repeat each test")
+		outputFile = fs.StringLong("output-file", "", "append every attempt to this file as JSON lines")
+		labels     = fs.StringListLong("label", "label to describe the runs with in the output, e.g. office-wifi (repeatable)")
+		otlp       = fs.StringLong("otlp-endpoint", "", "export OpenTelemetry traces of the runs over OTLP/HTTP to this endpoint, e.g. http://localhost:4318")
+		logLevel   = fs.StringEnumLong("loglevel", fmt.Sprintf("specify a log level (valid values: %s)", logLevels), logLevels...)
+		logJson    = fs.Bool('j', "json", "log in json format")
+	)
+
+	err := ff.Parse(fs, args, ff.WithEnvVarPrefix("HEYBABE"))
+	switch {
+	case errors.Is(err, ff.ErrHelp):
+		fmt.Fprintf(os.Stderr, "usage: %s daemon [flags]\n\n%s\n", appName, ffhelp.Flags(fs))
+		os.Exit(0)
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	l = newLogger(os.Stdout, *logLevel, *logJson)
+
+	if len(*schedules) == 0 {
+		fatal(l, errors.New("must specify at least one schedule"))
+	}
+	var dss []*daemonSchedule
+	for _, s := range *schedules {
+		ds, err := parseDaemonSchedule(s)
+		if err != nil {
+			fatal(l, err)
+		}
+		dss = append(dss, ds)
+	}
+	if *port > 65535 {
+		fatal(l, errors.New("invalid port"))
+	}
+
+	to := TestOptions{
+		ResolveIPv4: *v4 || !*v6,
+		ResolveIPv6: *v6 || !*v4,
+		Port:        uint16(*port),
+		Repeat:      *repeat,
+		DSCP:        -1,
+		Labels:      *labels,
+	}
+
+	var out *attemptWriter
+	if *outputFile != "" {
+		f, err := os.OpenFile(*outputFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			fatal(l, err)
+		}
+		defer f.Close()
+		if out, err = newAttemptWriter(f, "json"); err != nil {
+			fatal(l, err)
+		}
+	}
+
+	if *otlp != "" {
+		shutdown, err := setupTracing(context.Background(), *otlp)
+		if err != nil {
+			fatal(l, fmt.Errorf("invalid OTLP endpoint %q: %w", *otlp, err))
+		}
+		defer flushTracing(l, shutdown)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	daemon(ctx, l, to, dss, out)
+}
+
+// daemon tests each schedule's targets whenever it fires, until ctx is
+// done. Runs happen one at a time, as concurrent runs would disturb each
+// other's timings and traffic; a schedule that fires while another run is
+// going waits for it, and firings missed meanwhile are skipped.
+func daemon(ctx context.Context, l *slog.Logger, to TestOptions, dss []*daemonSchedule, out *attemptWriter) {
+	for _, ds := range dss {
+		ds.next = ds.cron.next(time.Now())
+		if ds.next.IsZero() {
+			l.Warn("schedule never fires", "schedule", ds.cron)
+			continue
+		}
+		l.Info("scheduled", "schedule", ds.cron, "targets", ds.snis, "next", ds.next)
+	}
+
+	for {
+		var due *daemonSchedule
+		for _, ds := range dss {
+			if !ds.next.IsZero() && (due == nil || ds.next.Before(due.next)) {
+				due = ds
+			}
+		}
+		if due == nil {
+			l.Error("no schedule will ever fire")
+			return
+		}
+		if err := sleep(ctx, time.Until(due.next)); err != nil {
+			l.Info("daemon stopped")
+			return
+		}
+
+		for _, sni := range due.snis {
+			runScheduled(ctx, l.With("schedule", due.cron.String(), "sni", sni), to, sni, out)
+			if ctx.Err() != nil {
+				l.Info("daemon stopped")
+				return
+			}
+		}
+		now := time.Now()
+		for _, ds := range dss {
+			if !ds.next.IsZero() && !ds.next.After(now) {
+				ds.next = ds.cron.next(now)
+			}
+		}
+	}
+}
+
+// runScheduled runs the suite against sni, logging how each test fared and
+// appending the attempts to out, if any.
+func runScheduled(ctx context.Context, l *slog.Logger, to TestOptions, sni string, out *attemptWriter) {
+	to.SNI = sni
+	run := newRunInfo(to.Labels)
+	l.Info("running scheduled tests", "run_id", run.ID)
+	runCtx, cancel := context.WithTimeout(ctx, daemonRunTimeout)
+	runCtx, span := tracer.Start(runCtx, "run", trace.WithAttributes(attribute.String("heybabe.sni", sni)))
+	results, order, _, err := runSuite(runCtx, l, to)
+	endSpan(span, err)
+	cancel()
+	run.End = time.Now()
+	if err != nil {
+		l.Warn("scheduled run failed", "error", err)
+	}
+
+	for _, label := range order {
+		for _, tr := range results[label] {
+			status, successes := tr.status()
+			l.Info("test completed", "test", label, "addr_port", tr.AddrPort, "status", status, "successes", successes)
+		}
+	}
+	if out != nil {
+		if err := out.write(attemptRecords(results, order, nil, run)); err != nil {
+			l.Warn("failed to write output", "error", err)
+		}
+	}
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	stdtls "crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"os/signal"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/markpash/heybabe/bepass/sni"
+	"github.com/markpash/heybabe/recipe"
+	"github.com/peterbourgon/ff/v4"
+	"github.com/peterbourgon/ff/v4/ffhelp"
+	tls "github.com/refraction-networking/utls"
+	"github.com/rodaine/table"
+)
+
+const (
+	// echoPayloadSize is the size of the payload the echo client sends
+	// through the tunnel and expects back.
+	echoPayloadSize = 16 * 1024
+	// echoMaxPayload bounds the payload the echo server accepts.
+	echoMaxPayload = 1 << 20
+	echoTimeout    = 10 * time.Second
+)
+
+// echoReport is what the echo server sends back over the established TLS
+// connection: first what it saw of the ClientHello, then the hash of the
+// payload it received.
+type echoReport struct {
+	SNI           string `json:"sni,omitempty"`
+	JA4           string `json:"ja4,omitempty"`
+	HelloSHA256   string `json:"hello_sha256,omitempty"`
+	HelloSize     int    `json:"hello_size,omitempty"`
+	Reads         []int  `json:"reads,omitempty"`
+	PayloadSHA256 string `json:"payload_sha256,omitempty"`
+}
+
+// runEchoCommand runs "heybabe echo", which is either a TLS echo server, or
+// with --connect the matching client. Between the two, they tell whether
+// the ClientHello and the data after the handshake got through unmodified,
+// and in which direction things break.
+func runEchoCommand(l *slog.Logger, args []string) {
+	fs := ff.NewFlagSet(appName + " echo")
+	var (
+		connect  = fs.StringLong("connect", "", "run as a client of the echo server at this address, e.g. 203.0.113.7:8443")
+		sniName  = fs.StringLong("sni", "", "tls sni the client sends")
+		rcp      = fs.StringLong("recipe", "", "reshape the client's ClientHello with a strategy recipe, e.g. \"split(sni+1) delay(20)\"")
+		logLevel = fs.StringEnumLong("loglevel", fmt.Sprintf("specify a log level (valid values: %s)", logLevels), logLevels...)
+		logJson  = fs.Bool('j', "json", "log in json format")
+	)
+
+	err := ff.Parse(fs, args)
+	switch {
+	case errors.Is(err, ff.ErrHelp):
+		fmt.Fprintf(os.Stderr, "usage: %s echo [flags] [addr]\n\n%s\n", appName, ffhelp.Flags(fs))
+		os.Exit(0)
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	l = newLogger(os.Stdout, *logLevel, *logJson)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	if *connect == "" {
+		addr := ":8443"
+		switch rest := fs.GetArgs(); len(rest) {
+		case 0:
+		case 1:
+			addr = rest[0]
+		default:
+			fatal(l, fmt.Errorf("echo takes a single address, got %q", rest))
+		}
+		if err := echoServer(ctx, l, addr); err != nil {
+			fatal(l, err)
+		}
+		return
+	}
+
+	if *sniName == "" {
+		fatal(l, errors.New("must specify SNI"))
+	}
+	var rec *recipe.Recipe
+	if *rcp != "" {
+		if rec, err = recipe.Parse(*rcp); err != nil {
+			l.Error("failed to parse recipe", "error", err)
+			fatal(l, err)
+		}
+	}
+	if err := echoClient(ctx, l, *connect, *sniName, rec); err != nil {
+		fatal(l, err)
+	}
+}
+
+// selfSignedCert makes a throwaway certificate for the echo server. The
+// client doesn't verify it, the point is only to get a TLS connection up.
+func selfSignedCert() (stdtls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return stdtls.Certificate{}, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: appName + " echo"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return stdtls.Certificate{}, err
+	}
+	return stdtls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// echoServer accepts connections on addr until ctx is done.
+func echoServer(ctx context.Context, l *slog.Logger, addr string) error {
+	cert, err := selfSignedCert()
+	if err != nil {
+		l.Error("failed to generate certificate", "error", err)
+		return err
+	}
+	cfg := &stdtls.Config{Certificates: []stdtls.Certificate{cert}}
+
+	var lc net.ListenConfig
+	ln, err := lc.Listen(ctx, "tcp", addr)
+	if err != nil {
+		l.Error("failed to listen", "addr", addr, "error", err)
+		return err
+	}
+	l.Info("echo server listening", "addr", ln.Addr().String())
+
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				l.Debug("listener closed")
+				return nil
+			}
+			l.Error("failed to accept connection", "error", err)
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			serveEcho(ctx, l.With("remote", conn.RemoteAddr().String()), conn, cfg)
+		}()
+	}
+}
+
+// replayConn is a net.Conn that reads from r instead.
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *replayConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func serveEcho(ctx context.Context, l *slog.Logger, conn net.Conn, cfg *stdtls.Config) {
+	l.Debug("accepted connection")
+	conn.SetDeadline(time.Now().Add(echoTimeout))
+
+	rr := &readRecorder{Conn: conn}
+	hello, rd, err := sni.PeekClientHello(rr, l)
+	if err != nil {
+		l.Warn("failed to read ClientHello", "error", err, "reads", len(rr.sizes), "read_sizes", rr.sizes)
+		return
+	}
+	sum := sha256.Sum256(hello.Raw)
+	report := echoReport{
+		SNI:         hello.ServerName,
+		JA4:         hello.Fingerprint().JA4,
+		HelloSHA256: hex.EncodeToString(sum[:]),
+		HelloSize:   len(hello.Raw),
+		Reads:       slices.Clone(rr.sizes),
+	}
+	l = l.With("sni", report.SNI)
+	l.Debug("received ClientHello", "ja4", report.JA4, "hello_sha256", report.HelloSHA256, "reads", report.Reads)
+
+	tlsConn := stdtls.Server(&replayConn{Conn: rr, r: rd}, cfg)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		// The ClientHello made it here, so it's the way back that broke.
+		l.Warn("TLS handshake failed after the ClientHello arrived", "error", err)
+		return
+	}
+
+	if err := json.NewEncoder(tlsConn).Encode(report); err != nil {
+		l.Warn("failed to send ClientHello report", "error", err)
+		return
+	}
+
+	var n uint32
+	if err := binary.Read(tlsConn, binary.BigEndian, &n); err != nil {
+		l.Warn("failed to read payload length", "error", err)
+		return
+	}
+	if n > echoMaxPayload {
+		l.Warn("payload too large", "size", n, "max_size", echoMaxPayload)
+		return
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(tlsConn, payload); err != nil {
+		l.Warn("failed to read payload", "error", err)
+		return
+	}
+	sum = sha256.Sum256(payload)
+	if err := json.NewEncoder(tlsConn).Encode(echoReport{PayloadSHA256: hex.EncodeToString(sum[:])}); err != nil {
+		l.Warn("failed to send payload report", "error", err)
+		return
+	}
+	if _, err := tlsConn.Write(payload); err != nil {
+		l.Warn("failed to echo payload", "error", err)
+		return
+	}
+	l.Info("echo completed", "ja4", report.JA4, "hello_size", report.HelloSize, "reads", report.Reads, "payload_size", n)
+}
+
+// echoCheck is one line of the echo client's report.
+type echoCheck struct {
+	name, result string
+	ok           bool
+}
+
+// echoClient connects to the echo server at addr and checks that what it
+// sends and receives arrives unmodified.
+func echoClient(ctx context.Context, l *slog.Logger, addr, sniName string, rec *recipe.Recipe) error {
+	l = l.With("server", addr, "sni", sniName)
+	var checks []echoCheck
+	defer func() { printEchoChecks(checks) }()
+
+	dialer := net.Dialer{Timeout: 5 * time.Second}
+	tcpConn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		l.Error("failed to establish TCP connection", "error", err)
+		checks = append(checks, echoCheck{"TCP connection", err.Error(), false})
+		return nil
+	}
+	defer tcpConn.Close()
+	tcpConn.SetDeadline(time.Now().Add(echoTimeout))
+	checks = append(checks, echoCheck{"TCP connection", "established", true})
+
+	conn := tcpConn
+	if rec != nil {
+		recipeConn, err := rec.Wrap(tcpConn, l)
+		if err != nil {
+			l.Error("failed to apply recipe", "error", err)
+			return err
+		}
+		recipeConn.Context = ctx
+		conn = recipeConn
+	}
+
+	// The echo server's certificate is self-signed, and this is about
+	// whether the bytes get through, not who is at the other end.
+	tlsConn := tls.UClient(conn, &tls.Config{ServerName: sniName, InsecureSkipVerify: true}, tls.HelloChrome_Auto)
+	defer tlsConn.Close()
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		l.Error("TLS handshake failed", "error", err)
+		checks = append(checks, echoCheck{"TLS handshake", err.Error() + " (if the server logged the ClientHello, server → client is blocked)", false})
+		return nil
+	}
+	checks = append(checks, echoCheck{"TLS handshake", "completed", true})
+
+	br := bufio.NewReader(tlsConn)
+	report, err := readEchoReport(br)
+	if err != nil {
+		l.Error("failed to read ClientHello report", "error", err)
+		checks = append(checks, echoCheck{"ClientHello report", err.Error(), false})
+		return nil
+	}
+	sum := sha256.Sum256(tlsConn.HandshakeState.Hello.Raw)
+	l.Debug("received ClientHello report", "report", report, "sent_sha256", hex.EncodeToString(sum[:]))
+	if report.HelloSHA256 == hex.EncodeToString(sum[:]) {
+		checks = append(checks, echoCheck{"ClientHello client → server", fmt.Sprintf("intact, %d bytes read as %v", report.HelloSize, report.Reads), true})
+	} else {
+		checks = append(checks, echoCheck{"ClientHello client → server", fmt.Sprintf("modified, server saw %d bytes for SNI %q", report.HelloSize, report.SNI), false})
+	}
+
+	payload := make([]byte, echoPayloadSize)
+	rand.Read(payload)
+	sum = sha256.Sum256(payload)
+	if err := binary.Write(tlsConn, binary.BigEndian, uint32(len(payload))); err == nil {
+		_, err = tlsConn.Write(payload)
+	}
+	if err != nil {
+		l.Error("failed to send payload", "error", err)
+		checks = append(checks, echoCheck{"Payload client → server", err.Error(), false})
+		return nil
+	}
+
+	// The report is read through br, which may buffer the start of the
+	// echo too.
+	if report, err = readEchoReport(br); err != nil {
+		l.Error("failed to read payload report", "error", err)
+		checks = append(checks, echoCheck{"Payload client → server", err.Error(), false})
+		return nil
+	}
+	if report.PayloadSHA256 == hex.EncodeToString(sum[:]) {
+		checks = append(checks, echoCheck{"Payload client → server", "intact", true})
+	} else {
+		checks = append(checks, echoCheck{"Payload client → server", "modified", false})
+	}
+
+	echoed := make([]byte, len(payload))
+	if _, err := io.ReadFull(br, echoed); err != nil {
+		l.Error("failed to read echoed payload", "error", err)
+		checks = append(checks, echoCheck{"Payload server → client", err.Error(), false})
+		return nil
+	}
+	// Compare with what the server says it received, so a change on the
+	// way there isn't blamed on the way back.
+	echoedSum := sha256.Sum256(echoed)
+	if hex.EncodeToString(echoedSum[:]) == report.PayloadSHA256 {
+		checks = append(checks, echoCheck{"Payload server → client", "intact", true})
+	} else {
+		checks = append(checks, echoCheck{"Payload server → client", "modified", false})
+	}
+	l.Debug("echo completed")
+	return nil
+}
+
+// readEchoReport reads a line holding an echoReport.
+func readEchoReport(br *bufio.Reader) (echoReport, error) {
+	var report echoReport
+	line, err := br.ReadBytes('\n')
+	if err != nil {
+		return report, err
+	}
+	return report, json.Unmarshal(line, &report)
+}
+
+func printEchoChecks(checks []echoCheck) {
+	headerFmt := color.New(color.FgHiMagenta, color.Bold, color.Underline).SprintfFunc()
+	columnFmt := color.New(color.FgHiCyan, color.Bold).SprintfFunc()
+
+	tbl := table.New("Check", "Result")
+	tbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt)
+	for _, c := range checks {
+		result := color.GreenString(c.result)
+		if !c.ok {
+			result = color.RedString(c.result)
+		}
+		tbl.AddRow(c.name, result)
+	}
+	fmt.Println("")
+	tbl.Print()
+	fmt.Println("")
+}
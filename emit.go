@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Valid values for the --emit-config flag.
+var emitFormats = []string{"sing-box", "xray", "bepass", "zapret", "goodbyedpi"}
+
+// fragmentSettings holds the tlsfrag.Adapter settings used by a test.
+type fragmentSettings struct {
+	BSL        [2]int
+	SL         [2]int
+	ASL        [2]int
+	Delay      [2]int
+	Disorder   bool  // the before-SNI chunk is sent after the others
+	SNISplitAt []int // exact split offsets within the hostname, replaces SL
+}
+
+// strategy describes what a test puts on the wire, so that a working test
+// can be turned into settings for other tools.
+type strategy struct {
+	Transport       string            // "tcp" or "quic"
+	Fingerprint     string            // uTLS fingerprint name, empty for crypto/tls or custom specs
+	Fragment        *fragmentSettings // nil when the ClientHello is written in one go
+	Fake            string            // SNI of a decoy ClientHello sent first, if any
+	FakeTTL         int               // TTL the decoy is injected with, 0 when it is sent in-stream
+	FakeBadChecksum bool              // the decoy is injected with an invalid TCP checksum
+	MaxSeg          int               // TCP_MAXSEG set on the socket, 0 for the default
+	PadSize         int               // size the ClientHello is padded to, 0 for no padding
+	MPTCP           bool              // the connection is dialed with MPTCP
+}
+
+// isDesync reports whether the strategy works below the TLS library, by
+// reshaping or adding packets.
+func (s strategy) isDesync() bool {
+	return s.Fragment != nil || s.Fake != ""
+}
+
+// bestTest picks the test with the highest success rate across all targets,
+// considering only tests accepted by keep (or all of them if keep is nil).
+// Ties go to the test that comes first in the suite, since the simpler
+// strategies are listed first.
+func bestTest(results map[string][]TestResult, suite []testCase, keep func(testCase) bool) (testCase, bool) {
+	var (
+		best     testCase
+		bestRate float64
+		found    bool
+	)
+
+	for _, tc := range suite {
+		if keep != nil && !keep(tc) {
+			continue
+		}
+
+		var success, total int
+		for _, tr := range results[tc.label] {
+			for _, attempt := range tr.Attempts {
+				total++
+				if attempt.Err == nil {
+					success++
+				}
+			}
+		}
+		if total == 0 || success == 0 {
+			continue
+		}
+
+		rate := float64(success) / float64(total)
+		if rate > bestRate {
+			best, bestRate, found = tc, rate, true
+		}
+	}
+
+	return best, found
+}
+
+// emitConfig writes a ready-to-paste config snippet for the given tool,
+// based on the best performing test.
+func emitConfig(w io.Writer, format, sni string, results map[string][]TestResult, suite []testCase) error {
+	// Proxy tools only know how to shape TCP connections.
+	tc, ok := bestTest(results, suite, func(tc testCase) bool { return tc.strategy.Transport == "tcp" })
+	if !ok {
+		fmt.Fprintf(w, "No TCP test succeeded, nothing to emit for %s.\n\n", format)
+		return nil
+	}
+
+	// zapret and GoodbyeDPI work below the TLS library, so only desync
+	// strategies translate to them, and bepass only knows fragmentation.
+	if (format == "zapret" || format == "goodbyedpi") && !tc.strategy.isDesync() {
+		fmt.Fprintf(w, "Best test %q does not use a desync strategy, %s is not needed.\n\n", tc.label, format)
+		return nil
+	}
+	if format == "bepass" && tc.strategy.Fragment == nil {
+		fmt.Fprintf(w, "Best test %q does not fragment, bepass is not needed.\n\n", tc.label)
+		return nil
+	}
+	if format == "bepass" && tc.strategy.Fragment.Disorder {
+		fmt.Fprintf(w, "Best test %q sends fragments out of order, which bepass can't do.\n\n", tc.label)
+		return nil
+	}
+
+	var snippet any
+	switch format {
+	case "sing-box":
+		snippet = singBoxSnippet(tc.strategy, sni)
+	case "xray":
+		snippet = xraySnippet(tc.strategy, sni)
+	case "bepass":
+		snippet = bepassSnippet(*tc.strategy.Fragment)
+	case "zapret":
+		fmt.Fprintf(w, "zapret (nfqws) parameters based on %q:\n%s\n\n", tc.label, zapretArgs(tc.strategy, sni))
+		return nil
+	case "goodbyedpi":
+		fmt.Fprintf(w, "GoodbyeDPI parameters based on %q:\n%s\n\n", tc.label, goodbyeDPIArgs(tc.strategy))
+		return nil
+	default:
+		return fmt.Errorf("unknown config format %q (valid values: %s)", format, strings.Join(emitFormats, ", "))
+	}
+
+	b, err := json.MarshalIndent(snippet, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "%s config based on %q:\n%s\n\n", format, tc.label, b)
+	return nil
+}
+
+func singBoxSnippet(s strategy, sni string) any {
+	type utls struct {
+		Enabled     bool   `json:"enabled"`
+		Fingerprint string `json:"fingerprint"`
+	}
+	type outboundTLS struct {
+		Enabled    bool   `json:"enabled"`
+		ServerName string `json:"server_name"`
+		UTLS       *utls  `json:"utls,omitempty"`
+	}
+	type rule struct {
+		Domain      []string `json:"domain"`
+		Action      string   `json:"action"`
+		TLSFragment bool     `json:"tls_fragment,omitempty"`
+	}
+	type route struct {
+		Rules []rule `json:"rules"`
+	}
+
+	type outbound struct {
+		Tag          string      `json:"tag"`
+		TCPMultiPath bool        `json:"tcp_multi_path,omitempty"`
+		TLS          outboundTLS `json:"tls"`
+	}
+
+	out := struct {
+		Outbounds []outbound `json:"outbounds"`
+		Route     *route     `json:"route,omitempty"`
+	}{
+		Outbounds: []outbound{{
+			Tag:          "proxy",
+			TCPMultiPath: s.MPTCP,
+			TLS:          outboundTLS{Enabled: true, ServerName: sni},
+		}},
+	}
+	if s.Fingerprint != "" {
+		out.Outbounds[0].TLS.UTLS = &utls{Enabled: true, Fingerprint: s.Fingerprint}
+	}
+	if s.Fragment != nil {
+		out.Route = &route{Rules: []rule{{Domain: []string{sni}, Action: "route-options", TLSFragment: true}}}
+	}
+
+	return out
+}
+
+func xraySnippet(s strategy, sni string) any {
+	type fragment struct {
+		Packets  string `json:"packets"`
+		Length   string `json:"length"`
+		Interval string `json:"interval"`
+	}
+	type freedomSettings struct {
+		Fragment *fragment `json:"fragment,omitempty"`
+	}
+	type tlsSettings struct {
+		ServerName  string `json:"serverName"`
+		Fingerprint string `json:"fingerprint,omitempty"`
+	}
+	type sockopt struct {
+		DialerProxy string `json:"dialerProxy,omitempty"`
+		TCPMaxSeg   int    `json:"tcpMaxSeg,omitempty"`
+		TCPMptcp    bool   `json:"tcpMptcp,omitempty"`
+	}
+	type streamSettings struct {
+		Security    string       `json:"security,omitempty"`
+		TLSSettings *tlsSettings `json:"tlsSettings,omitempty"`
+		Sockopt     *sockopt     `json:"sockopt,omitempty"`
+	}
+	type outbound struct {
+		Tag            string           `json:"tag"`
+		Protocol       string           `json:"protocol,omitempty"`
+		Settings       *freedomSettings `json:"settings,omitempty"`
+		StreamSettings *streamSettings  `json:"streamSettings,omitempty"`
+	}
+
+	// The proxy outbound is to be merged into the user's own one. With
+	// fragmentation it dials through a freedom outbound, which then owns the
+	// TCP socket and so its socket options.
+	proxy := outbound{
+		Tag: "proxy",
+		StreamSettings: &streamSettings{
+			Security:    "tls",
+			TLSSettings: &tlsSettings{ServerName: sni, Fingerprint: s.Fingerprint},
+		},
+	}
+	dialer := &proxy
+	var fragmentOut *outbound
+	if f := s.Fragment; f != nil {
+		proxy.StreamSettings.Sockopt = &sockopt{DialerProxy: "fragment"}
+		fragmentOut = &outbound{
+			Tag:      "fragment",
+			Protocol: "freedom",
+			Settings: &freedomSettings{Fragment: &fragment{
+				Packets:  "tlshello",
+				Length:   fmt.Sprintf("%d-%d", f.SL[0], f.SL[1]),
+				Interval: fmt.Sprintf("%d-%d", f.Delay[0], f.Delay[1]),
+			}},
+		}
+		dialer = fragmentOut
+	}
+	if s.MaxSeg > 0 || s.MPTCP {
+		if dialer.StreamSettings == nil {
+			dialer.StreamSettings = &streamSettings{}
+		}
+		if dialer.StreamSettings.Sockopt == nil {
+			dialer.StreamSettings.Sockopt = &sockopt{}
+		}
+		dialer.StreamSettings.Sockopt.TCPMaxSeg = s.MaxSeg
+		dialer.StreamSettings.Sockopt.TCPMptcp = s.MPTCP
+	}
+
+	out := struct {
+		Outbounds []outbound `json:"outbounds"`
+	}{
+		Outbounds: []outbound{proxy},
+	}
+	if fragmentOut != nil {
+		out.Outbounds = append(out.Outbounds, *fragmentOut)
+	}
+
+	return out
+}
+
+func bepassSnippet(f fragmentSettings) any {
+	return struct {
+		TLSHeaderLength       int    `json:"TLSHeaderLength"`
+		ChunksLengthBeforeSni [2]int `json:"ChunksLengthBeforeSni"`
+		SniChunksLength       [2]int `json:"SniChunksLength"`
+		ChunksLengthAfterSni  [2]int `json:"ChunksLengthAfterSni"`
+		DelayBetweenChunks    [2]int `json:"DelayBetweenChunks"`
+	}{
+		TLSHeaderLength:       5,
+		ChunksLengthBeforeSni: f.BSL,
+		SniChunksLength:       f.SL,
+		ChunksLengthAfterSni:  f.ASL,
+		DelayBetweenChunks:    f.Delay,
+	}
+}
+
+// zapretArgs translates a strategy into nfqws arguments. The bepass style
+// fragmentation splits the ClientHello around the SNI, which nfqws expresses
+// as a multisplit on the host markers.
+func zapretArgs(s strategy, sni string) string {
+	args := []string{
+		"nfqws",
+		"--filter-tcp=443",
+		"--hostlist-domains=" + sni,
+	}
+	var modes []string
+	if s.Fake != "" {
+		modes = append(modes, "fake")
+		args = append(args, "--dpi-desync-fake-tls-mod=sni="+s.Fake)
+		if s.FakeTTL > 0 {
+			args = append(args, "--dpi-desync-ttl="+strconv.Itoa(s.FakeTTL))
+		}
+		if s.FakeBadChecksum {
+			args = append(args, "--dpi-desync-fooling=badsum")
+		}
+	}
+	if s.Fragment != nil {
+		mode := "multisplit"
+		if s.Fragment.Disorder {
+			mode = "multidisorder"
+		}
+		modes = append(modes, mode)
+		pos := []string{"host", "midsld", "endhost"}
+		if len(s.Fragment.SNISplitAt) > 0 {
+			pos = pos[:0]
+			for _, at := range s.Fragment.SNISplitAt {
+				pos = append(pos, fmt.Sprintf("host+%d", at))
+			}
+		}
+		args = append(args, "--dpi-desync-split-pos="+strings.Join(pos, ","))
+	}
+	if len(modes) > 0 {
+		args = append(args, "--dpi-desync="+strings.Join(modes, ","))
+	}
+	return strings.Join(args, " ")
+}
+
+// goodbyeDPIArgs translates a strategy into GoodbyeDPI arguments.
+// --frag-by-sni makes GoodbyeDPI split right before the SNI, and -e sets the
+// size of the following fragment.
+func goodbyeDPIArgs(s strategy) string {
+	args := []string{"goodbyedpi.exe"}
+	if s.Fake != "" {
+		args = append(args, "--fake-with-sni", s.Fake)
+		if s.FakeTTL > 0 {
+			args = append(args, "--set-ttl", strconv.Itoa(s.FakeTTL))
+		}
+		if s.FakeBadChecksum {
+			args = append(args, "--wrong-chksum")
+		}
+	}
+	if f := s.Fragment; f != nil {
+		size := f.SL[0]
+		if len(f.SNISplitAt) > 0 {
+			size = f.SNISplitAt[0]
+		}
+		args = append(args,
+			"-e", strconv.Itoa(size),
+			"--native-frag",
+			"--frag-by-sni",
+		)
+		if f.Disorder {
+			args = append(args, "--reverse-frag")
+		}
+	}
+	return strings.Join(args, " ")
+}
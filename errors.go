@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"syscall"
+
+	quic "github.com/refraction-networking/uquic"
+)
+
+// ErrorClass is a coarse class of test failure, to tell apart the ways
+// middleboxes interfere (resets, timeouts, forged alerts) without parsing
+// error messages.
+type ErrorClass string
+
+const (
+	ErrorClassReset       ErrorClass = "reset"
+	ErrorClassTimeout     ErrorClass = "timeout"
+	ErrorClassEOF         ErrorClass = "eof"
+	ErrorClassTLSAlert    ErrorClass = "tls_alert"
+	ErrorClassCertificate ErrorClass = "certificate"
+	ErrorClassRefused     ErrorClass = "refused"
+	ErrorClassUnreachable ErrorClass = "unreachable"
+	ErrorClassDNS         ErrorClass = "dns"
+	ErrorClassSkipped     ErrorClass = "skipped"
+	ErrorClassOther       ErrorClass = "other"
+)
+
+// TestError is why a test attempt failed.
+type TestError struct {
+	Class ErrorClass
+	// Alert is the TLS alert code the server sent (or the QUIC crypto
+	// error carried), for ErrorClassTLSAlert.
+	Alert uint8
+	// Errno is the system error under Err, 0 if there is none.
+	Errno syscall.Errno
+	Err   error
+}
+
+// newTestError classifies err, and returns nil if err is nil.
+func newTestError(err error) *TestError {
+	if err == nil {
+		return nil
+	}
+	var te *TestError
+	if errors.As(err, &te) {
+		return te
+	}
+
+	te = &TestError{Class: errorClass(err), Err: err}
+	if te.Class == ErrorClassTLSAlert {
+		te.Alert, _ = alertCode(err)
+	}
+	errors.As(err, &te.Errno)
+	return te
+}
+
+func (e *TestError) Error() string { return e.Err.Error() }
+func (e *TestError) Unwrap() error { return e.Err }
+
+// Transient reports whether the attempt is worth retrying: it timed out or
+// hit a temporary DNS failure, as opposed to the connection being refused,
+// reset or answered.
+func (e *TestError) Transient() bool { return transient(e.Err) }
+
+// errorClass sorts a test error into a coarse class.
+func errorClass(err error) ErrorClass {
+	var (
+		skipErr    *skipError
+		dnsErr     *net.DNSError
+		hostErr    x509.HostnameError
+		authErr    x509.UnknownAuthorityError
+		invalidErr x509.CertificateInvalidError
+		netErr     net.Error
+	)
+	switch {
+	case err == nil:
+		return ""
+	case errors.As(err, &skipErr):
+		return ErrorClassSkipped
+	case errors.As(err, &hostErr), errors.As(err, &authErr), errors.As(err, &invalidErr):
+		return ErrorClassCertificate
+	case errors.As(err, &dnsErr):
+		return ErrorClassDNS
+	}
+	if _, ok := alertCode(err); ok {
+		return ErrorClassTLSAlert
+	}
+	switch {
+	case errors.Is(err, syscall.ECONNRESET):
+		return ErrorClassReset
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ErrorClassRefused
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return ErrorClassUnreachable
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return ErrorClassEOF
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return ErrorClassTimeout
+	default:
+		return ErrorClassOther
+	}
+}
+
+// Error codes are stable names of why an attempt failed, for tools reading
+// --output to branch on. Unlike the classes and messages, they are kept
+// across releases: codes may be added, but never renamed or reused.
+const (
+	ErrorCodeDNSNXDomain   = "E_DNS_NXDOMAIN"
+	ErrorCodeDNSTimeout    = "E_DNS_TIMEOUT"
+	ErrorCodeDNSFailure    = "E_DNS_FAILURE"
+	ErrorCodeTCPTimeout    = "E_TCP_TIMEOUT" // before the connection was established
+	ErrorCodeTCPRefused    = "E_TCP_REFUSED"
+	ErrorCodeTCPReset      = "E_TCP_RST"
+	ErrorCodeUDPRefused    = "E_UDP_REFUSED" // ICMP port unreachable
+	ErrorCodeUnreachable   = "E_NET_UNREACHABLE"
+	ErrorCodeTLSTimeout    = "E_TLS_TIMEOUT" // after the connection was established
+	ErrorCodeTLSEOF        = "E_TLS_EOF"
+	ErrorCodeTLSAlert      = "E_TLS_ALERT_" // followed by the alert number, e.g. E_TLS_ALERT_40
+	ErrorCodeQUICTimeout   = "E_QUIC_TIMEOUT"
+	ErrorCodeQUICReset     = "E_QUIC_STATELESS_RESET"
+	ErrorCodeQUICVersion   = "E_QUIC_VERSION"
+	ErrorCodeQUICTransport = "E_QUIC_TRANSPORT"
+	ErrorCodeCertMismatch  = "E_CERT_MISMATCH"
+	ErrorCodeCertUnknownCA = "E_CERT_UNKNOWN_CA"
+	ErrorCodeCertExpired   = "E_CERT_EXPIRED"
+	ErrorCodeCertInvalid   = "E_CERT_INVALID"
+	ErrorCodeSkipped       = "E_SKIPPED"
+	ErrorCodeOther         = "E_OTHER"
+)
+
+// Code returns the error code of e, for an attempt that had established
+// its connection if connected.
+func (e *TestError) Code(connected bool) string {
+	var (
+		dnsErr     *net.DNSError
+		opErr      *net.OpError
+		invalidErr x509.CertificateInvalidError
+		idleErr    *quic.IdleTimeoutError
+		hsErr      *quic.HandshakeTimeoutError
+		resetErr   *quic.StatelessResetError
+		versionErr *quic.VersionNegotiationError
+		quicErr    *quic.TransportError
+	)
+	udp := errors.As(e.Err, &opErr) && strings.HasPrefix(opErr.Net, "udp")
+
+	switch e.Class {
+	case ErrorClassDNS:
+		errors.As(e.Err, &dnsErr)
+		switch {
+		case dnsErr != nil && dnsErr.IsNotFound:
+			return ErrorCodeDNSNXDomain
+		case dnsErr != nil && dnsErr.IsTimeout:
+			return ErrorCodeDNSTimeout
+		}
+		return ErrorCodeDNSFailure
+	case ErrorClassTLSAlert:
+		return fmt.Sprintf("%s%d", ErrorCodeTLSAlert, e.Alert)
+	case ErrorClassCertificate:
+		switch {
+		case errors.As(e.Err, new(x509.HostnameError)):
+			return ErrorCodeCertMismatch
+		case errors.As(e.Err, new(x509.UnknownAuthorityError)):
+			return ErrorCodeCertUnknownCA
+		case errors.As(e.Err, &invalidErr) && invalidErr.Reason == x509.Expired:
+			return ErrorCodeCertExpired
+		}
+		return ErrorCodeCertInvalid
+	case ErrorClassSkipped:
+		return ErrorCodeSkipped
+	case ErrorClassReset:
+		return ErrorCodeTCPReset
+	case ErrorClassRefused:
+		if udp {
+			return ErrorCodeUDPRefused
+		}
+		return ErrorCodeTCPRefused
+	case ErrorClassUnreachable:
+		return ErrorCodeUnreachable
+	case ErrorClassEOF:
+		return ErrorCodeTLSEOF
+	}
+
+	switch {
+	case errors.As(e.Err, &idleErr), errors.As(e.Err, &hsErr):
+		return ErrorCodeQUICTimeout
+	case errors.As(e.Err, &resetErr):
+		return ErrorCodeQUICReset
+	case errors.As(e.Err, &versionErr):
+		return ErrorCodeQUICVersion
+	case errors.As(e.Err, &quicErr):
+		return ErrorCodeQUICTransport
+	case e.Class == ErrorClassTimeout && udp:
+		return ErrorCodeQUICTimeout
+	case e.Class == ErrorClassTimeout && connected:
+		return ErrorCodeTLSTimeout
+	case e.Class == ErrorClassTimeout:
+		return ErrorCodeTCPTimeout
+	}
+	return ErrorCodeOther
+}
+
+// alertCode returns the TLS alert the peer sent, if err is one. crypto/tls
+// and uTLS both report remote alerts as a "remote error" wrapping their
+// unexported uint8 alert type, and QUIC carries them as crypto errors.
+func alertCode(err error) (uint8, bool) {
+	var (
+		opErr   *net.OpError
+		quicErr *quic.TransportError
+	)
+	switch {
+	case errors.As(err, &opErr) && opErr.Op == "remote error":
+		if v := reflect.ValueOf(opErr.Err); v.Kind() == reflect.Uint8 {
+			return uint8(v.Uint()), true
+		}
+	case errors.As(err, &quicErr) && quicErr.Remote && quicErr.ErrorCode.IsCryptoError():
+		return uint8(quicErr.ErrorCode - 0x100), true
+	}
+	return 0, false
+}
+
+// transient reports whether err is worth retrying: a timeout or a
+// temporary DNS failure, as opposed to the connection being refused, reset
+// or answered.
+func transient(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTimeout || dnsErr.IsTemporary
+	}
+	return errorClass(err) == ErrorClassTimeout
+}
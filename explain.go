@@ -0,0 +1,295 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/rodaine/table"
+)
+
+// testExplanations say what each test changes from a plain connection, by
+// the start of its label. The longest matching prefix wins.
+var testExplanations = []struct{ prefix, what string }{
+	{"Default - TCP - TLS 1.2", "plain TLS 1.2 handshake, the baseline for TLS 1.2"},
+	{"Renegotiation", "renegotiates after a TLS 1.2 handshake, which some middleboxes break"},
+	{"Default - TCP - TLS 1.3", "plain TLS 1.3 handshake with Go's ClientHello, the baseline"},
+	{"Default - TCP - TLS 1.3 - uTLS ChromeAuto", "TLS 1.3 looking like Chrome; failing where Go's works means fingerprint filtering"},
+	{"SNI Last", "moves the SNI to the end of the ClientHello, for DPI reading it at a fixed place"},
+	{"No Compat Mode", "leaves out the TLS 1.3 middlebox compatibility mode"},
+	{"ESNI", "sends an encrypted_server_name extension, which some censors block outright"},
+	{"ECH Outer SNI", "sends ECH with this public name as the SNI and the real one encrypted; failing means the outer name or ECH is blocked"},
+	{"Cert Compression", "offers certificate compression, which changes the size of the server's reply"},
+	{"No Cert Compression", "doesn't offer certificate compression, for DPI keyed on it"},
+	{"ALPS Old Codepoint", "sends ALPS with the codepoint of older Chrome versions"},
+	{"No ALPS", "leaves ALPS out, for DPI keyed on it"},
+	{"Record Version", "sends the ClientHello record with an unusual record version"},
+	{"Record Size", "splits the ClientHello into TLS records of this size"},
+	{"Tiny MSS", "makes the kernel send the ClientHello in tiny TCP segments"},
+	{"Default - QUIC", "plain QUIC handshake looking like Chrome, the baseline for HTTP/3"},
+	{"Version Negotiation - QUIC", "QUIC packet of an unknown version; works when UDP reaches the server at all"},
+	{"Padded Initial", "pads the QUIC Initial datagram; failing only when large means MTU trouble"},
+	{"Padded Initial + Chaff", "sends junk datagrams before the QUIC Initial, for DPI only reading the first"},
+	{"Split Initial", "splits the QUIC ClientHello over several Initial packets"},
+	{"Coalesced Split Initial", "splits the QUIC ClientHello over packets sharing a datagram"},
+	{"Bepass Fragment", "splits the ClientHello over TCP segments, for DPI that doesn't reassemble them"},
+	{"Bepass Disorder", "sends the ClientHello segments out of order"},
+	{"Bepass SNI Split", "splits the ClientHello inside the SNI"},
+	{"MPTCP", "uses Multipath TCP, which some DPI can't follow"},
+	{"MPTCP Bepass Fragment", "combines Multipath TCP with a fragmented ClientHello"},
+	{"WarpPlus", "the ClientHello of the warp-plus client"},
+	{"Decoy", "sends a fake ClientHello first, for DPI that only inspects one"},
+	{"Fake TTL", "sends a fake ClientHello that expires before the server, to desync the DPI"},
+	{"Fake Bad Checksum", "sends a fake ClientHello with a bad checksum, which the server drops"},
+	{"Padded", "pads the ClientHello to this size, which moves or splits the SNI"},
+	{"Recipe", "your custom strategy recipe"},
+	{"Keepalive", "holds the connection idle with keepalives this often, then checks it still works"},
+	{"NFQUEUE", "the same fragments, cut from the kernel's packet through a netfilter queue"},
+	{"Custom", "your custom test settings"},
+	{"Matrix", "one combination of fingerprint, TLS version and fragmentation from --full"},
+	{"Captured Fingerprint", "the fingerprint of the captured ClientHello, rebuilt by uTLS"},
+	{"Replay", "replays the captured ClientHello as is"},
+	{"Replay Bepass Fragment", "replays the captured ClientHello, fragmented"},
+	{"Replay Recipe", "replays the captured ClientHello with your recipe"},
+	{"obfs4", "an obfs4 handshake with your Tor bridge; failing while the bridge is up means obfs4 is blocked"},
+	{"REALITY", "a REALITY handshake and VLESS request with your server; failing while it's up means REALITY is blocked or misconfigured"},
+	{"Control", "a host that should always work, to rule out local problems"},
+}
+
+// explainTest returns what the test labelled label does, or "" if it's
+// unknown.
+func explainTest(label string) string {
+	var best, what string
+	for _, e := range testExplanations {
+		if strings.HasPrefix(label, e.prefix) && len(e.prefix) > len(best) {
+			best, what = e.prefix, e.what
+		}
+	}
+	return what
+}
+
+// printExplanation prints what each test that ran does, then what the
+// results suggest, for --explain.
+func printExplanation(results map[string][]TestResult, order []string) {
+	headerFmt := color.New(color.FgHiMagenta, color.Bold, color.Underline).SprintfFunc()
+	columnFmt := color.New(color.FgHiCyan, color.Bold).SprintfFunc()
+
+	tbl := table.New("Test Method", "What It Tests")
+	tbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt)
+	for _, testName := range order {
+		if what := explainTest(testName); what != "" {
+			tbl.AddRow(testName, what)
+		}
+	}
+	tbl.Print()
+	fmt.Println("")
+
+	fmt.Println("What this suggests:")
+	for _, finding := range explainFindings(results, order) {
+		fmt.Printf("- %s\n", finding)
+	}
+	fmt.Println("")
+}
+
+// explainFindings draws conclusions from how the tests fared against any
+// target, by comparing the ones that changed one thing from the baselines.
+func explainFindings(results map[string][]TestResult, order []string) []string {
+	// outcome tells whether any test with a label matching match ran, and
+	// whether any of them worked.
+	outcome := func(match func(label string) bool) (ran, ok bool) {
+		for _, testName := range order {
+			if !match(testName) {
+				continue
+			}
+			for _, tr := range results[testName] {
+				ran = true
+				if _, success := tr.status(); success > 0 {
+					ok = true
+				}
+			}
+		}
+		return ran, ok
+	}
+	is := func(label string) func(string) bool {
+		return func(testName string) bool { return testName == label }
+	}
+	prefixed := func(prefixes ...string) func(string) bool {
+		return func(testName string) bool {
+			return slices.ContainsFunc(prefixes, func(p string) bool { return strings.HasPrefix(testName, p) })
+		}
+	}
+	// failures counts the failed attempts of the test labelled testName
+	// by class.
+	failures := func(testName string) map[ErrorClass]int {
+		classes := make(map[ErrorClass]int)
+		for _, tr := range results[testName] {
+			for _, attempt := range tr.Attempts {
+				if attempt.Err != nil {
+					classes[attempt.Err.Class]++
+				}
+			}
+		}
+		return classes
+	}
+
+	var findings []string
+	add := func(finding string) { findings = append(findings, finding) }
+
+	const (
+		tls12  = "Default - TCP - TLS 1.2"
+		tls13  = "Default - TCP - TLS 1.3"
+		chrome = "Default - TCP - TLS 1.3 - uTLS ChromeAuto"
+		quic   = "Default - QUIC - TLS 1.3 - uQUIC Chrome"
+	)
+	ran12, ok12 := outcome(is(tls12))
+	ran13, ok13 := outcome(is(tls13))
+	ranChrome, okChrome := outcome(is(chrome))
+	ranQUIC, okQUIC := outcome(is(quic))
+	ranFrag, okFrag := outcome(prefixed("Bepass Fragment", "Bepass Disorder", "Bepass SNI Split", "MPTCP Bepass Fragment", "Record Size", "Tiny MSS", "WarpPlus Record Split", "NFQUEUE"))
+	ranDesync, okDesync := outcome(prefixed("Decoy", "Fake TTL", "Fake Bad Checksum"))
+	ranVN, okVN := outcome(is("Version Negotiation - QUIC"))
+
+	baselineFailed := (ran13 && !ok13) || (ranChrome && !okChrome)
+	var ipBlocked bool
+	switch {
+	case ran13 && ok13 && (!ranChrome || okChrome) && (!ran12 || ok12):
+		add("The plain TLS handshakes work, so the SNI doesn't look blocked on this path.")
+	case baselineFailed:
+		transport := 0
+		for _, testName := range []string{tls13, chrome} {
+			for _, tr := range results[testName] {
+				for _, attempt := range tr.Attempts {
+					if attempt.TransportEstablishDuration > 0 {
+						transport++
+					}
+				}
+			}
+		}
+		if transport == 0 {
+			ipBlocked = true
+			add("The plain handshakes fail before TCP even connects, which points at IP or port blocking rather than SNI inspection.")
+			break
+		}
+		classes := failures(tls13)
+		for class, n := range failures(chrome) {
+			classes[class] += n
+		}
+		switch {
+		case classes[ErrorClassReset] > 0:
+			add("The plain handshakes are reset after TCP connects, typical of DPI injecting RSTs when it sees the SNI.")
+			// A round trip is about what TCP took to connect, and the
+			// server can't answer the ClientHello sooner than that.
+			var rst, rtt time.Duration
+			for _, testName := range []string{tls13, chrome} {
+				for _, tr := range results[testName] {
+					for _, attempt := range tr.Attempts {
+						if attempt.TimeToRST > 0 && (rst == 0 || attempt.TimeToRST < rst) {
+							rst, rtt = attempt.TimeToRST, attempt.TransportEstablishDuration
+						}
+					}
+				}
+			}
+			if rst > 0 && rst < rtt {
+				add(fmt.Sprintf("The RST came %.1f ms after the ClientHello, sooner than the %.1f ms round trip to the server, so it was sent from on the way.", float64(rst)/float64(time.Millisecond), float64(rtt)/float64(time.Millisecond)))
+			}
+		case classes[ErrorClassTimeout] > 0:
+			add("The plain handshakes time out after TCP connects, typical of DPI silently dropping packets once it sees the SNI.")
+			retransmits := 0
+			for _, testName := range []string{tls13, chrome} {
+				for _, tr := range results[testName] {
+					for _, attempt := range tr.Attempts {
+						if attempt.Err != nil && attempt.TCPInfo != nil {
+							retransmits += attempt.TCPInfo.Retransmits
+						}
+					}
+				}
+			}
+			if retransmits > 0 {
+				add(fmt.Sprintf("The kernel retransmitted %d segments in those handshakes, so packets were lost on the way rather than the server being slow.", retransmits))
+			}
+		case classes[ErrorClassTLSAlert] > 0 || classes[ErrorClassEOF] > 0:
+			add("The plain handshakes are cut off with an alert or a closed connection, which may be forged by a middlebox.")
+		}
+		// Whether anything came back tells a ClientHello that never got an
+		// answer from one whose answer was cut off.
+		var silent, answered int
+		for _, testName := range []string{tls13, chrome} {
+			for _, tr := range results[testName] {
+				for _, attempt := range tr.Attempts {
+					switch {
+					case attempt.Err == nil || attempt.Wire == nil:
+					case attempt.Wire.BytesReceived == 0:
+						silent++
+					default:
+						answered++
+					}
+				}
+			}
+		}
+		if silent > 0 && answered == 0 {
+			add("Not a byte came back in those handshakes once the ClientHello was sent, so the server's answer never got through, if it was sent at all.")
+		}
+	}
+
+	if ran13 && ranChrome && ok13 != okChrome {
+		if ok13 {
+			add("Go's handshake works but Chrome's doesn't, so the filtering is by ClientHello fingerprint (JA3/JA4).")
+		} else {
+			add("Chrome's handshake works but Go's doesn't, so the filtering is by ClientHello fingerprint (JA3/JA4).")
+		}
+	}
+	if ran12 && ran13 && ok12 && !ok13 {
+		add("TLS 1.2 works where TLS 1.3 fails, so TLS 1.3 itself is being targeted.")
+	}
+	if ipBlocked {
+		// Nothing done to the ClientHello matters without a connection.
+		ranFrag, ranDesync = false, false
+	}
+	if baselineFailed && ranFrag && okFrag {
+		add("A plain handshake fails but a fragmented one works, so the DPI inspects the SNI without reassembling the ClientHello.")
+	}
+	if baselineFailed && ranFrag && !okFrag {
+		add("Fragmenting the ClientHello doesn't help, so the DPI reassembles it or blocks by something other than the SNI.")
+	}
+	if baselineFailed && ranDesync && okDesync {
+		add("A decoy or fake ClientHello gets the real one through, so the DPI is stateful and can be desynchronized.")
+	}
+	if ranQUIC && !okQUIC {
+		switch {
+		case okVN:
+			add("QUIC fails while UDP reaches the server, so the QUIC handshake itself is filtered, likely by the SNI in its Initial.")
+		case ranVN && !okVN:
+			add("QUIC fails and the server doesn't answer any UDP, so UDP to it is likely blocked altogether.")
+		case ok13 || okChrome:
+			add("QUIC fails while TCP works, so HTTP/3 is blocked or throttled on this path.")
+		}
+	}
+	// The controls run after the failures weigh in on each of them.
+	causes := make(map[string]int)
+	var causeOrder []string
+	for _, testName := range order {
+		for _, tr := range results[testName] {
+			for _, attempt := range tr.Attempts {
+				if fc := attempt.FailureControl; fc != nil {
+					if causes[fc.Cause()] == 0 {
+						causeOrder = append(causeOrder, fc.Cause())
+					}
+					causes[fc.Cause()]++
+				}
+			}
+		}
+	}
+	if len(causeOrder) > 0 {
+		tally := make([]string, len(causeOrder))
+		for i, cause := range causeOrder {
+			tally[i] = fmt.Sprintf("%s (%d)", cause, causes[cause])
+		}
+		add("The controls run right after the failures point at: " + strings.Join(tally, ", ") + ".")
+	}
+	if len(findings) == 0 {
+		add("Nothing conclusive, compare the rows above.")
+	}
+	return findings
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"strconv"
+
+	"github.com/fatih/color"
+	"github.com/rodaine/table"
+)
+
+// FailureControl is how a failed attempt's test fared when run again right
+// after it with one thing changed: with a benign SNI to the same address,
+// and with the same SNI to the control host's address.
+type FailureControl struct {
+	BenignSNI     string
+	SameIPReached bool
+	// ControlAddr is where the SNI was sent instead, invalid if there's no
+	// control host or it couldn't be resolved.
+	ControlAddr    netip.AddrPort
+	SameSNIReached bool
+}
+
+// Cause is what the controls point at as the cause of the failure.
+func (fc *FailureControl) Cause() string {
+	sameSNI := fc.ControlAddr.IsValid()
+	switch {
+	case fc.SameIPReached && (!sameSNI || !fc.SameSNIReached):
+		return "SNI"
+	case fc.SameIPReached:
+		// Blocking scoped to the server's addresses, or a flaky failure.
+		return "SNI at this IP"
+	case sameSNI && fc.SameSNIReached:
+		return "IP"
+	case sameSNI:
+		return "both failed"
+	default:
+		// A block triggered by the SNI may still be on for the address.
+		return "IP or lasting block"
+	}
+}
+
+// runFailureControl runs test again against addrPort with to.CooldownSNI,
+// and against the control host's address with the SNI, once each, to tell
+// whether the failure it just had was down to the SNI or the IP.
+func runFailureControl(ctx context.Context, l *slog.Logger, to TestOptions, test testFunc, addrPort netip.AddrPort) *FailureControl {
+	fc := &FailureControl{BenignSNI: to.CooldownSNI}
+	try := func(addrPort netip.AddrPort, sni string) (bool, error) {
+		if err := to.Pacer.wait(ctx); err != nil {
+			return false, err
+		}
+		testCtx, cancel := context.WithTimeout(ctx, to.attemptTimeout())
+		defer cancel()
+		res := test(testCtx, l, addrPort, sni)
+		l.Debug("failure control attempt done", "target", addrPort.String(), "sni", sni, "error", res.Err)
+		return reachedServer(res), nil
+	}
+
+	var err error
+	if fc.SameIPReached, err = try(addrPort, to.CooldownSNI); err != nil {
+		return nil
+	}
+
+	if to.ControlHost == "" {
+		return fc
+	}
+	resolveCtx, cancel := context.WithTimeout(ctx, to.attemptTimeout())
+	v4, v6, err := resolve(resolveCtx, to.ControlHost, addrPort.Addr().Is4(), addrPort.Addr().Is6())
+	cancel()
+	control := v4
+	if addrPort.Addr().Is6() {
+		control = v6
+	}
+	if err != nil || control.IsUnspecified() {
+		l.Debug("failed to resolve control host for failure control", "control_host", to.ControlHost, "error", err)
+		return fc
+	}
+	fc.ControlAddr = netip.AddrPortFrom(control, 443)
+	if fc.SameSNIReached, err = try(fc.ControlAddr, to.SNI); err != nil {
+		return nil
+	}
+	return fc
+}
+
+// printFailureControls lists the failed attempts that were followed by
+// controls, with what the controls point at.
+func printFailureControls(results map[string][]TestResult, order []string) {
+	headerFmt := color.New(color.FgHiMagenta, color.Bold, color.Underline).SprintfFunc()
+	columnFmt := color.New(color.FgHiCyan, color.Bold).SprintfFunc()
+
+	tbl := table.New("Test Method", "IP:Port", "Attempt", "Benign SNI, Same IP", "Same SNI, Control IP", "Points At")
+	tbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt)
+
+	reached := func(ok bool) string {
+		if ok {
+			return "Reached"
+		}
+		return "Failed"
+	}
+	var found bool
+	for _, testName := range order {
+		for _, tr := range results[testName] {
+			for i, attempt := range tr.Attempts {
+				fc := attempt.FailureControl
+				if fc == nil {
+					continue
+				}
+				sameSNI := "-"
+				if fc.ControlAddr.IsValid() {
+					sameSNI = fmt.Sprintf("%s (%s)", reached(fc.SameSNIReached), fc.ControlAddr.Addr())
+				}
+				tbl.AddRow(testName, tr.AddrPort, strconv.Itoa(i+1), fmt.Sprintf("%s (%s)", reached(fc.SameIPReached), fc.BenignSNI), sameSNI, fc.Cause())
+				found = true
+			}
+		}
+	}
+	if !found {
+		return
+	}
+
+	tbl.Print()
+	fmt.Println("")
+}
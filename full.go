@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/fatih/color"
+	tls "github.com/refraction-networking/utls"
+	"github.com/rodaine/table"
+)
+
+// fullFragments are the fragmentation variants of --full, nil for none.
+var fullFragments = []*fragmentSettings{nil, &bepassFragment, &bepassDisorder}
+
+// fullVersions are the TLS versions of --full, each offered on its own.
+var fullVersions = []uint16{tls.VersionTLS12, tls.VersionTLS13}
+
+// fullPace is the default --max-connections-per-minute of --full, as its
+// hundreds of attempts in a row would otherwise look like a scan.
+const fullPace = 20
+
+// fullMatrix returns the tests of --full: every TCP fingerprint with every
+// TLS version and fragmentation variant, then every QUIC fingerprint, which
+// only does TLS 1.3 and can't be fragmented.
+func fullMatrix() []customSettings {
+	var matrix []customSettings
+	for _, fp := range append([]string{"go"}, mapKeys(customFingerprints)...) {
+		for _, v := range fullVersions {
+			for _, frag := range fullFragments {
+				matrix = append(matrix, customSettings{
+					Transport:   "tcp",
+					MinVersion:  v,
+					MaxVersion:  v,
+					Fingerprint: fp,
+					Fragment:    frag,
+					OCSP:        ocspOff,
+				})
+			}
+		}
+	}
+	for _, fp := range mapKeys(customQUICFingerprints) {
+		matrix = append(matrix, customSettings{
+			Transport:   "quic",
+			MinVersion:  tls.VersionTLS13,
+			MaxVersion:  tls.VersionTLS13,
+			Fingerprint: fp,
+			OCSP:        ocspOff,
+		})
+	}
+	return matrix
+}
+
+// fullLabel is the label of a test of --full.
+func fullLabel(cs customSettings) string {
+	return "Matrix - " + cs.String()
+}
+
+// printFullMatrix pivots the results of --full: one row per fingerprint,
+// transport and TLS version, and one column per fragmentation variant, with
+// the cells of printMatrix over all the SNIs.
+func printFullMatrix(results map[string][]TestResult) {
+	headerFmt := color.New(color.FgHiMagenta, color.Bold, color.Underline).SprintfFunc()
+	columnFmt := color.New(color.FgHiCyan, color.Bold).SprintfFunc()
+
+	tbl := table.New("Fingerprint", "Transport", "TLS", "Plain", "Bepass Fragment", "Bepass Disorder")
+	tbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt)
+
+	matrix := fullMatrix()
+	for i := 0; i < len(matrix); {
+		cs := matrix[i]
+		row := []any{cs.Fingerprint, cs.Transport, tls.VersionName(cs.MinVersion)}
+		for _, frag := range fullFragments {
+			if i < len(matrix) && matrix[i].Fragment == frag && matrix[i].Fingerprint == cs.Fingerprint &&
+				matrix[i].Transport == cs.Transport && matrix[i].MinVersion == cs.MinVersion {
+				row = append(row, matrixCell(results[fullLabel(matrix[i])], ""))
+				i++
+				continue
+			}
+			row = append(row, "-")
+		}
+		tbl.AddRow(row...)
+	}
+
+	tbl.Print()
+	fmt.Println("")
+}
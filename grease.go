@@ -0,0 +1,90 @@
+package main
+
+import (
+	"slices"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// greaseMode controls the GREASE values (RFC 8701) in the ClientHellos of
+// the uTLS tests, to find out whether they are what trips a middlebox.
+type greaseMode int
+
+const (
+	greaseDefault greaseMode = iota // as the fingerprint has it
+	greaseOff                       // all GREASE values removed
+	greaseOn                        // GREASE values added where missing
+)
+
+func (m greaseMode) String() string {
+	switch m {
+	case greaseOff:
+		return "off"
+	case greaseOn:
+		return "on"
+	}
+	return "default"
+}
+
+// isGREASE reports whether v is one of the reserved GREASE values, of the
+// form 0x?a?a with both bytes equal.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// removeGREASE removes the GREASE cipher suites, extensions, groups, key
+// shares and versions from spec, as well as the GREASE ECH extension.
+func removeGREASE(spec *tls.ClientHelloSpec) {
+	spec.CipherSuites = slices.DeleteFunc(slices.Clone(spec.CipherSuites), isGREASE)
+	spec.Extensions = slices.DeleteFunc(slices.Clone(spec.Extensions), func(e tls.TLSExtension) bool {
+		switch e := e.(type) {
+		case *tls.UtlsGREASEExtension, *tls.GREASEEncryptedClientHelloExtension:
+			return true
+		case *tls.SupportedCurvesExtension:
+			e.Curves = slices.DeleteFunc(slices.Clone(e.Curves), func(c tls.CurveID) bool { return isGREASE(uint16(c)) })
+		case *tls.KeyShareExtension:
+			e.KeyShares = slices.DeleteFunc(slices.Clone(e.KeyShares), func(ks tls.KeyShare) bool { return isGREASE(uint16(ks.Group)) })
+		case *tls.SupportedVersionsExtension:
+			e.Versions = slices.DeleteFunc(slices.Clone(e.Versions), isGREASE)
+		}
+		return false
+	})
+}
+
+// addGREASE adds GREASE values where Chrome puts them to the parts of spec
+// that have none: first in the cipher suites, groups, key shares and
+// versions, and an empty GREASE extension first and a one byte one last
+// among the extensions (before padding and pre_shared_key, which must stay
+// at the end).
+func addGREASE(spec *tls.ClientHelloSpec) {
+	if !slices.ContainsFunc(spec.CipherSuites, isGREASE) {
+		spec.CipherSuites = slices.Insert(slices.Clone(spec.CipherSuites), 0, tls.GREASE_PLACEHOLDER)
+	}
+
+	exts := slices.Clone(spec.Extensions)
+	for _, e := range exts {
+		switch e := e.(type) {
+		case *tls.SupportedCurvesExtension:
+			if !slices.ContainsFunc(e.Curves, func(c tls.CurveID) bool { return isGREASE(uint16(c)) }) {
+				e.Curves = slices.Insert(slices.Clone(e.Curves), 0, tls.CurveID(tls.GREASE_PLACEHOLDER))
+			}
+		case *tls.KeyShareExtension:
+			if !slices.ContainsFunc(e.KeyShares, func(ks tls.KeyShare) bool { return isGREASE(uint16(ks.Group)) }) {
+				e.KeyShares = slices.Insert(slices.Clone(e.KeyShares), 0, tls.KeyShare{Group: tls.CurveID(tls.GREASE_PLACEHOLDER), Data: []byte{0}})
+			}
+		case *tls.SupportedVersionsExtension:
+			if !slices.ContainsFunc(e.Versions, isGREASE) {
+				e.Versions = slices.Insert(slices.Clone(e.Versions), 0, tls.GREASE_PLACEHOLDER)
+			}
+		}
+	}
+
+	if !slices.ContainsFunc(exts, func(e tls.TLSExtension) bool {
+		_, ok := e.(*tls.UtlsGREASEExtension)
+		return ok
+	}) {
+		exts = appendExtension(exts, &tls.UtlsGREASEExtension{Body: []byte{0}})
+		exts = slices.Insert(exts, 0, tls.TLSExtension(&tls.UtlsGREASEExtension{}))
+	}
+	spec.Extensions = exts
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"math"
+	"os"
+	"time"
+)
+
+// historyRuns is how many past runs the trends show, before the current.
+const historyRuns = 10
+
+// sparkBlocks are the sparkline levels, from no success to all.
+var sparkBlocks = []rune("▁▂▃▄▅▆▇█")
+
+// historyRecord is how one test fared against one SNI in one run, as kept
+// in the --history file, one JSON object per line.
+type historyRecord struct {
+	Time      time.Time `json:"time"`
+	Test      string    `json:"test"`
+	SNI       string    `json:"sni"`
+	Successes int       `json:"successes"`
+	Attempts  int       `json:"attempts"`
+}
+
+// historyKey identifies a test against an SNI across runs.
+type historyKey struct{ test, sni string }
+
+// history is the success rates of past runs, oldest first.
+type history map[historyKey][]float64
+
+// loadHistory reads the --history file, which may not exist yet.
+func loadHistory(path string) (history, error) {
+	h := make(history)
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return h, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var r historyRecord
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil || r.Attempts == 0 {
+			// A line cut short by an interrupted write is left out.
+			continue
+		}
+		k := historyKey{r.Test, r.SNI}
+		h[k] = append(h[k], float64(r.Successes)/float64(r.Attempts))
+	}
+	return h, sc.Err()
+}
+
+// historyRecords returns the records of a run's results, one per test and
+// SNI, leaving out the tests that were skipped.
+func historyRecords(results map[string][]TestResult, order []string, now time.Time) []historyRecord {
+	var records []historyRecord
+	for _, testName := range order {
+		var snis []string
+		bySNI := make(map[string]*historyRecord)
+		for _, tr := range results[testName] {
+			r := bySNI[tr.SNI]
+			if r == nil {
+				r = &historyRecord{Time: now, Test: testName, SNI: tr.SNI}
+				bySNI[tr.SNI] = r
+				snis = append(snis, tr.SNI)
+			}
+			successes, ran := attemptCounts(tr)
+			r.Successes += successes
+			r.Attempts += ran
+		}
+		for _, sni := range snis {
+			if r := bySNI[sni]; r.Attempts > 0 {
+				records = append(records, *r)
+			}
+		}
+	}
+	return records
+}
+
+// attemptCounts returns how many of tr's attempts succeeded and how many
+// ran rather than being skipped.
+func attemptCounts(tr TestResult) (successes, ran int) {
+	for _, attempt := range tr.Attempts {
+		var skipErr *skipError
+		switch {
+		case attempt.Err == nil:
+			successes++
+			ran++
+		case !errors.As(attempt.Err, &skipErr):
+			ran++
+		}
+	}
+	return successes, ran
+}
+
+// appendHistory appends records to the --history file.
+func appendHistory(path string, records []historyRecord) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// trends returns the sparkline of the last historyRuns runs of each test
+// against each SNI, followed by the current run's.
+func (h history) trends(records []historyRecord) map[historyKey]string {
+	trends := make(map[historyKey]string)
+	for _, r := range records {
+		k := historyKey{r.Test, r.SNI}
+		past := h[k]
+		past = past[max(0, len(past)-historyRuns):]
+		trends[k] = sparkline(append(past[:len(past):len(past)], float64(r.Successes)/float64(r.Attempts)))
+	}
+	return trends
+}
+
+// sparkline renders success rates between 0 and 1 as a line of blocks.
+func sparkline(rates []float64) string {
+	line := make([]rune, len(rates))
+	for i, rate := range rates {
+		level := int(math.Round(rate * float64(len(sparkBlocks)-1)))
+		line[i] = sparkBlocks[max(0, min(level, len(sparkBlocks)-1))]
+	}
+	return string(line)
+}
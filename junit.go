@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// JUnit XML, as understood by CI systems, with a test case per test and
+// target.
+type (
+	junitTestSuites struct {
+		XMLName  xml.Name         `xml:"testsuites"`
+		Name     string           `xml:"name,attr"`
+		Tests    int              `xml:"tests,attr"`
+		Failures int              `xml:"failures,attr"`
+		Skipped  int              `xml:"skipped,attr"`
+		Time     string           `xml:"time,attr"`
+		Suites   []junitTestSuite `xml:"testsuite"`
+	}
+	junitTestSuite struct {
+		Name       string           `xml:"name,attr"`
+		Tests      int              `xml:"tests,attr"`
+		Failures   int              `xml:"failures,attr"`
+		Skipped    int              `xml:"skipped,attr"`
+		Time       string           `xml:"time,attr"`
+		Timestamp  string           `xml:"timestamp,attr,omitempty"`
+		Properties *junitProperties `xml:"properties,omitempty"`
+		Cases      []junitTestCase  `xml:"testcase"`
+	}
+	junitProperties struct {
+		Property []junitProperty `xml:"property"`
+	}
+	junitProperty struct {
+		Name  string `xml:"name,attr"`
+		Value string `xml:"value,attr"`
+	}
+	junitTestCase struct {
+		Name      string        `xml:"name,attr"`
+		ClassName string        `xml:"classname,attr"`
+		Time      string        `xml:"time,attr"`
+		Failure   *junitMessage `xml:"failure,omitempty"`
+		Skipped   *junitMessage `xml:"skipped,omitempty"`
+		SystemOut string        `xml:"system-out,omitempty"`
+	}
+	junitMessage struct {
+		Message string `xml:"message,attr"`
+		Type    string `xml:"type,attr,omitempty"`
+		Text    string `xml:",chardata"`
+	}
+)
+
+// writeJUnit writes the results to w as JUnit XML, with a test suite per
+// SNI. A test against a target fails when none of its attempts succeeded,
+// so that heybabe can gate CI pipelines on reachability.
+func writeJUnit(w io.Writer, results map[string][]TestResult, order []string, ni *networkInfo, run *runInfo) error {
+	seconds := func(d time.Duration) string { return strconv.FormatFloat(d.Seconds(), 'f', 3, 64) }
+
+	doc := junitTestSuites{Name: "heybabe"}
+	var (
+		suites    []*junitTestSuite
+		bySNI     = make(map[string]*junitTestSuite)
+		durations = make(map[*junitTestSuite]time.Duration)
+	)
+	for _, testName := range order {
+		for _, tr := range results[testName] {
+			suite := bySNI[tr.SNI]
+			if suite == nil {
+				suite = &junitTestSuite{Name: tr.SNI}
+				var props []junitProperty
+				if ni != nil {
+					props = append(props,
+						junitProperty{"public_ip", ni.PublicIP.String()},
+						junitProperty{"asn", strconv.Itoa(ni.ASN)},
+						junitProperty{"country", ni.Country})
+				}
+				if run != nil {
+					props = append(props,
+						junitProperty{"run_id", run.ID},
+						junitProperty{"run_start", run.Start.Format(time.RFC3339Nano)},
+						junitProperty{"version", run.Version},
+						junitProperty{"os", run.OS})
+					if !run.End.IsZero() {
+						props = append(props, junitProperty{"run_end", run.End.Format(time.RFC3339Nano)})
+					}
+					for _, label := range run.Labels {
+						props = append(props, junitProperty{"label", label})
+					}
+				}
+				if props != nil {
+					suite.Properties = &junitProperties{props}
+				}
+				bySNI[tr.SNI] = suite
+				suites = append(suites, suite)
+			}
+
+			var (
+				d       time.Duration
+				details []string
+			)
+			for i, attempt := range tr.Attempts {
+				d += attempt.TransportEstablishDuration + attempt.TLSHandshakeDuration + attempt.TTFBDuration
+				if suite.Timestamp == "" && !attempt.Start.IsZero() {
+					suite.Timestamp = attempt.Start.UTC().Format("2006-01-02T15:04:05")
+				}
+				result := "ok"
+				if attempt.Err != nil {
+					result = fmt.Sprintf("%s: %v", attempt.Err.Class, attempt.Err)
+				}
+				details = append(details, fmt.Sprintf("attempt %d: %s", i+1, result))
+			}
+			durations[suite] += d
+
+			tc := junitTestCase{
+				Name:      fmt.Sprintf("%s (%s)", testName, tr.AddrPort),
+				ClassName: "heybabe." + testID(testName),
+				Time:      seconds(d),
+			}
+			status, successCount := tr.status()
+			e := firstErr(tr)
+			var skipErr *skipError
+			switch {
+			case successCount > 0:
+				tc.SystemOut = status + "\n" + strings.Join(details, "\n")
+			case e != nil && errors.As(e, &skipErr):
+				tc.Skipped = &junitMessage{Message: skipErr.reason}
+				suite.Skipped++
+			default:
+				tc.Failure = &junitMessage{Message: status, Text: strings.Join(details, "\n")}
+				if e != nil {
+					tc.Failure.Type = string(e.Class)
+				}
+				suite.Failures++
+			}
+			suite.Cases = append(suite.Cases, tc)
+			suite.Tests++
+		}
+	}
+
+	var total time.Duration
+	for _, suite := range suites {
+		suite.Time = seconds(durations[suite])
+		total += durations[suite]
+		doc.Tests += suite.Tests
+		doc.Failures += suite.Failures
+		doc.Skipped += suite.Skipped
+		doc.Suites = append(doc.Suites, *suite)
+	}
+	doc.Time = seconds(total)
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// firstErr returns the error of tr's first attempt that failed, if any.
+func firstErr(tr TestResult) *TestError {
+	for _, attempt := range tr.Attempts {
+		if attempt.Err != nil {
+			return attempt.Err
+		}
+	}
+	return nil
+}
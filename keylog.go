@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/hex"
+	"net"
+	"strings"
+)
+
+// handshakeRecorder keeps what's read from a connection until it's stopped,
+// for tests looking into the server's side of the handshake.
+type handshakeRecorder struct {
+	net.Conn
+	read    []byte
+	stopped bool
+}
+
+func (c *handshakeRecorder) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if !c.stopped {
+		c.read = append(c.read, b[:n]...)
+	}
+	return n, err
+}
+
+// stop stops recording and returns what was read.
+func (c *handshakeRecorder) stop() []byte {
+	c.stopped = true
+	return c.read
+}
+
+// keyLogSecret returns the client random and secret of the label line in
+// keyLog, written by a tls.Config.KeyLogWriter, or nils if there's none.
+func keyLogSecret(keyLog, label string) (clientRandom, secret []byte) {
+	for _, line := range strings.Split(keyLog, "\n") {
+		f := strings.Fields(line)
+		if len(f) == 3 && f[0] == label {
+			clientRandom, _ = hex.DecodeString(f[1])
+			secret, _ = hex.DecodeString(f[2])
+		}
+	}
+	return clientRandom, secret
+}
+
+// tlsRecords splits b into TLS records, dropping any incomplete one at the
+// end.
+func tlsRecords(b []byte) [][]byte {
+	var records [][]byte
+	for len(b) >= 5 {
+		n := 5 + (int(b[3])<<8 | int(b[4]))
+		if len(b) < n {
+			break
+		}
+		records = append(records, b[:n])
+		b = b[n:]
+	}
+	return records
+}
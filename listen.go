@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/markpash/heybabe/bepass/sni"
+	"github.com/peterbourgon/ff/v4"
+	"github.com/peterbourgon/ff/v4/ffhelp"
+)
+
+// listenTimeout bounds how long a client has to send its ClientHello.
+const listenTimeout = 10 * time.Second
+
+// runListenCommand runs "heybabe listen [addr]", which accepts TCP
+// connections and logs the ClientHello each client sends, to see what
+// heybabe, or any other client, puts on the wire once it has gone through
+// the network.
+func runListenCommand(l *slog.Logger, args []string) {
+	fs := ff.NewFlagSet(appName + " listen")
+	var (
+		logLevel = fs.StringEnumLong("loglevel", fmt.Sprintf("specify a log level (valid values: %s)", logLevels), logLevels...)
+		logJson  = fs.Bool('j', "json", "log in json format")
+	)
+
+	err := ff.Parse(fs, args)
+	switch {
+	case errors.Is(err, ff.ErrHelp):
+		fmt.Fprintf(os.Stderr, "usage: %s listen [flags] [addr]\n\n%s\n", appName, ffhelp.Flags(fs))
+		os.Exit(0)
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	l = newLogger(os.Stdout, *logLevel, *logJson)
+
+	addr := ":8443"
+	switch rest := fs.GetArgs(); len(rest) {
+	case 0:
+	case 1:
+		addr = rest[0]
+	default:
+		fatal(l, fmt.Errorf("listen takes a single address, got %q", rest))
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	if err := listen(ctx, l, addr); err != nil {
+		fatal(l, err)
+	}
+}
+
+// listen accepts connections on addr until ctx is done.
+func listen(ctx context.Context, l *slog.Logger, addr string) error {
+	var lc net.ListenConfig
+	ln, err := lc.Listen(ctx, "tcp", addr)
+	if err != nil {
+		l.Error("failed to listen", "addr", addr, "error", err)
+		return err
+	}
+	l.Info("listening for ClientHellos", "addr", ln.Addr().String())
+
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				l.Debug("listener closed")
+				return nil
+			}
+			l.Error("failed to accept connection", "error", err)
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			inspectClientHello(l.With("remote", conn.RemoteAddr().String()), conn)
+		}()
+	}
+}
+
+// readRecorder records the size and time of every read from a connection.
+// It reads as much as the socket has each time, whatever the parser asks
+// for, so how the ClientHello comes out hints at how it was fragmented,
+// though the kernel merges segments that arrive before they are read.
+type readRecorder struct {
+	net.Conn
+	buf     []byte
+	pending []byte // read from r but not consumed yet
+	start   time.Time
+	sizes   []int
+	times   []time.Duration
+}
+
+func (rr *readRecorder) Read(p []byte) (int, error) {
+	if len(rr.pending) == 0 {
+		if rr.buf == nil {
+			rr.buf = make([]byte, 64*1024)
+		}
+		n, err := rr.Conn.Read(rr.buf)
+		if n == 0 {
+			return 0, err
+		}
+		if rr.sizes == nil {
+			rr.start = time.Now()
+		}
+		rr.sizes = append(rr.sizes, n)
+		rr.times = append(rr.times, time.Since(rr.start))
+		rr.pending = rr.buf[:n]
+	}
+	n := copy(p, rr.pending)
+	rr.pending = rr.pending[n:]
+	return n, nil
+}
+
+// inspectClientHello reads the ClientHello from conn and logs what was
+// found. The connection is not answered, so the client's handshake fails.
+func inspectClientHello(l *slog.Logger, conn net.Conn) {
+	l.Debug("accepted connection")
+	conn.SetReadDeadline(time.Now().Add(listenTimeout))
+
+	rr := &readRecorder{Conn: conn}
+	hello, err := sni.ReadClientHello(rr, l)
+	if err != nil {
+		l.Warn("failed to read ClientHello",
+			"error", err,
+			"reads", len(rr.sizes),
+			"read_sizes", rr.sizes)
+		return
+	}
+
+	fp := hello.Fingerprint()
+	l.Info("received ClientHello",
+		"sni", hello.ServerName,
+		"alpn", hello.ALPNProtocols,
+		"ja3", fp.JA3Hash,
+		"ja4", fp.JA4,
+		"hello_size", len(hello.Raw),
+		"ech", hello.ECH != nil,
+		"reads", len(rr.sizes),
+		"read_sizes", rr.sizes,
+		"read_times", rr.times)
+	l.Debug("ClientHello fingerprint details", "ja3_full", fp.JA3, "ja4_raw", fp.JA4Raw)
+}
@@ -4,13 +4,21 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"net"
 	"net/netip"
+	"net/url"
 	"os"
 	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
-	"github.com/carlmjohnson/versioninfo"
+	"github.com/markpash/heybabe/bepass/tlsfrag"
+	"github.com/markpash/heybabe/recipe"
 	"github.com/peterbourgon/ff/v4"
 	"github.com/peterbourgon/ff/v4/ffhelp"
 )
@@ -24,23 +32,109 @@ var (
 		slog.LevelDebug.String(),
 		slog.LevelWarn.String(),
 		slog.LevelError.String(),
+		levelTraceName,
 	}
 )
 
+// levelTraceName is the name of tlsfrag.LevelTrace, which slog would call
+// DEBUG-4.
+const levelTraceName = "TRACE"
+
 func main() {
 	l := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelInfo}))
 	l.Debug("starting heybabe application")
-	
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "listen":
+			runListenCommand(l, os.Args[2:])
+			return
+		case "echo":
+			runEchoCommand(l, os.Args[2:])
+			return
+		case "agent":
+			runAgentCommand(l, os.Args[2:])
+			return
+		case "coordinator":
+			runCoordinatorCommand(l, os.Args[2:])
+			return
+		case "daemon":
+			runDaemonCommand(l, os.Args[2:])
+			return
+		}
+	}
+
 	fs := ff.NewFlagSet(appName)
 	var (
 		v4       = fs.BoolShort('4', "only resolve IPv4 (only works when IP is not set)")
 		v6       = fs.BoolShort('6', "only resolve IPv6 (only works when IP is not set)")
 		sni      = fs.StringLong("sni", "", "tls sni (if IP flag not provided, this SNI will be resolved by system DNS)")
 		port     = fs.UintLong("port", 443, "tls port")
-		ip       = fs.StringLong("ip", "", "manually provide IP (no DNS lookup)")
+		tgtFile  = fs.StringLong("targets", "", "CSV or YAML file of targets to test in one run, each with an sni and optionally a host, port, ip, repeat and tests to run")
+		testList = fs.StringLong("test-list", "", "test the hostnames of a Citizen Lab test list, global or a country code like ir, with a few tests each, for a censorship snapshot by category")
+		obfs4    = fs.StringListLong("obfs4", "obfs4 bridge line to test the obfs4 handshake with, e.g. \"obfs4 192.0.2.1:443 cert=... iat-mode=0\", repeatable (tests only the bridges without an SNI)")
+		reality  = fs.StringListLong("reality", "vless:// share link of a REALITY server to check it authenticates and proxies, repeatable (tests only the servers without an SNI)")
+		host     = fs.StringLong("host", "", "name or IP to resolve and connect to instead of the SNI, which is still sent in the handshake")
+		ip       = fs.StringListLong("ip", "manually provide IP (no DNS lookup), repeatable or comma separated to test several")
+		quick    = fs.BoolLong("quick", "run a single attempt of only the Default TLS 1.3, fragment and QUIC tests, with short timeouts, and print a verdict in seconds")
+		full     = fs.BoolLong("full", "also run every fingerprint with every TLS version and fragmentation variant, paced to --max-connections-per-minute 20 unless set, and print them as a matrix")
 		repeat   = fs.UintLong("repeat", 1, "number of times to repeat each test")
+		retries  = fs.UintLong("retries", 0, "number of times to retry an attempt after a timeout or temporary DNS failure, with exponential backoff")
+		resolveE = fs.BoolLong("resolve-every-attempt", "resolve the SNI again before every attempt instead of once per run, to measure DNS flakiness and rotation")
+		warmUp   = fs.BoolLong("warm-up", "run an extra attempt of each test against each target first, left out of the results, so cold caches don't skew the first attempt's timings")
+		tcpTO    = fs.DurationLong("tcp-timeout", 5*time.Second, "how long the TCP connect of each attempt may take")
+		kaPeriod = fs.DurationLong("keepalive", 15*time.Second, "TCP keepalive period of the test connections (negative to disable keepalives)")
+		kaSweep  = fs.StringLong("keepalive-sweep", "", "comma separated keepalive periods to hold an idle connection open with, one test each, e.g. 10s,30s,60s")
+		kaHold   = fs.DurationLong("keepalive-hold", 2*time.Minute, "how long the keepalive sweep tests keep their connection idle")
+		tlsTO    = fs.DurationLong("tls-timeout", 0, "how long the TLS handshake of each TCP attempt may take on its own, to fail stalled handshakes quickly (0 for no limit of its own)")
+		cooldown = fs.DurationLong("cooldown", 0, "instead of the tests, trigger the block with the SNI and probe the target with --cooldown-sni at increasing intervals for up to this long, to measure how long the block persists (0 to run the tests)")
+		cdSNI    = fs.StringLong("cooldown-sni", defaultCooldownSNI, "unblocked SNI to probe the target with after triggering the block, and to run the failure controls with")
+		failCtl  = fs.BoolLong("failure-controls", "after each failed attempt, run its test again with --cooldown-sni to the same IP and with the SNI to the control host's IP, to tell SNI from IP blocking")
+		bisect   = fs.BoolLong("bisect-sni", "instead of the tests, handshake with variants of the SNI to find which part of it triggers the blocking")
+		shuffle  = fs.BoolLong("shuffle", "run the tests and targets in random order, so that blocking triggered by earlier tests doesn't always skew the same later ones")
+		maxConns = fs.UintLong("max-connections-per-minute", 0, "space out attempts so that at most this many start a minute, to not trigger rate based blocking (0 for no limit)")
+		rcp      = fs.StringLong("recipe", "", "run an extra test with a custom strategy recipe, e.g. \"split(sni+1) delay(20)\"")
+		rcpFile  = fs.StringLong("recipe-file", "", "read the custom strategy recipe from a file")
+		padSizes = fs.StringLong("pad-sizes", "", "comma separated ClientHello sizes to test with padding, e.g. 512,1500,4000")
+		recSizes = fs.StringLong("record-sizes", "", "comma separated TLS record sizes to split the ClientHello into, one test each, e.g. 64,256,1024,4096")
+		qSizes   = fs.StringLong("quic-sizes", "", "comma separated datagram sizes (1200-1452) to pad the QUIC Initial to, one test each, e.g. 1200,1350,1452")
+		nfq      = fs.UintLong("nfqueue", 0, "netfilter queue number to run the fragment tests through at the packet level, on Linux as root with iptables (0 to skip them)")
+		sniSplit = fs.StringLong("sni-split-at", "", "comma separated offsets within the hostname to split the SNI at, e.g. 1 (adds a bepass fragment test)")
+		echOuter = fs.StringListLong("ech-outer-sni", "public name to send as the outer SNI of an ECH ClientHello with the SNI encrypted inside, one test each, to check whether the outer name itself is blocked, e.g. cloudflare-ech.com, repeatable")
+		srcIP    = fs.StringLong("source-ip", "", "local address to send test traffic from, on hosts with several public IPs")
+		iface    = fs.StringLong("interface", "", "network interface to send test traffic through, e.g. eth1 (to compare uplinks)")
+		dscp     = fs.StringLong("dscp", "", "DSCP value (0-63) to mark test traffic with, e.g. 46 for EF")
+		ttl      = fs.UintLong("ttl", 0, "IP TTL (IPv6 hop limit) of test traffic, to bound how far it travels (0 for the system default)")
+		helloArg = fs.StringLong("clienthello", "", "file with a captured ClientHello (raw or hex) to replay as is and through fragmentation, for clients you can't modify")
+		custom   = fs.StringLong("custom", "", "run an extra test assembled from settings, e.g. \"transport=tcp tls=1.3 fingerprint=firefox alpn=h2 fragment=on proxy=socks5://127.0.0.1:1080\"")
+		pcapFile = fs.StringLong("from-pcap", "", "take the ClientHello to replay from the first one in a pcap or pcapng capture")
+		wCiphers = fs.StringLong("warp-ciphers", "", "comma separated cipher suites for a tuned warp-plus test, by name or hex ID, e.g. GREASE,TLS_AES_128_GCM_SHA256,0x0039")
+		wPadding = fs.StringLong("warp-padding", "", "padding extension length for a tuned warp-plus test (0 to leave it out)")
+		wRecSize = fs.StringLong("warp-record-size", "", "TLS record size to split the ClientHello into for a tuned warp-plus test (0 for one record)")
+		ciphers  = fs.StringLong("ciphers", "", "comma separated cipher suites for the uTLS tests' ClientHellos in order, by name or hex ID, e.g. GREASE,TLS_AES_128_GCM_SHA256,0xc02b")
+		curves   = fs.StringLong("curves", "", "comma separated groups to offer in order, by name or hex ID, e.g. X25519,P-256 (not for the QUIC tests)")
+		alpn     = fs.StringLong("alpn", "", "comma separated ALPN protocols to offer in order instead of each test's own, e.g. h2,http/1.1 (h3 ones go to the QUIC tests, the others to the TCP tests)")
+		grease   = fs.BoolLong("grease", "add GREASE values to the uTLS tests' ClientHellos where the fingerprint has none")
+		noGrease = fs.BoolLong("no-grease", "remove all GREASE values from the uTLS tests' ClientHellos")
+		insecure = fs.BoolLong("insecure", "complete handshakes whatever the certificate, then verify it and report the errors (for decoy or self-signed endpoints)")
+		emitCfg  = fs.StringLong("emit-config", "", fmt.Sprintf("print a config snippet for the best working test (valid values: %s)", emitFormats))
+		output   = fs.StringLong("output", "", fmt.Sprintf("print every attempt's timings and errors, JUnit XML, or InfluxDB or statsd metrics instead of the tables (valid values: %s)", outputFormats))
+		outFile  = fs.StringLong("output-file", "", "write the --output attempts to a file, and print the tables too")
+		labels   = fs.StringListLong("label", "label to describe the run with in the --output reports, e.g. office-wifi, so archived results stay interpretable (repeatable)")
+		submitTo = fs.StringLong("submit", "", "opt in to uploading an anonymized summary of the results, with the ASN and country but not your IP, to this collector endpoint (implies --network-info)")
+		submitIP = fs.BoolLong("submit-ip", "also include your public IP in the --submit summary")
+		histFile = fs.StringLong("history", "", "file to keep each run's success rates in, shown as a sparkline trend of the last runs next to the current results")
+		control  = fs.StringLong("control-host", defaultControlHost, "host measured with the Default tests first, to tell a local connectivity problem from censorship (empty to skip)")
+		netInfo  = fs.BoolLong("network-info", "discover the public IP, ASN and country the tests leave from, to tell apart results from different networks")
+		stream   = fs.BoolLong("stream", "print each test's results (table rows or --output attempts) as soon as it finishes")
+		explain  = fs.BoolLong("explain", "after the results, print what each test does and what its outcome suggests, e.g. SNI inspection or IP blocking")
+		best     = fs.BoolLong("print-best", "print only the best test's ID, IP:port and latency in ms on one line, for scripts")
 		logLevel = fs.StringEnumLong("loglevel", fmt.Sprintf("specify a log level (valid values: %s)", logLevels), logLevels...)
 		logJson  = fs.Bool('j', "json", "log in json format")
+		trBytes  = fs.UintLong("trace-bytes", uint(tlsfrag.Trace.MaxBytes), "bytes of each write or read to hexdump at the TRACE log level (0 for all)")
+		trRedact = fs.BoolLong("trace-redact", "replace the SNI with x's in the TRACE hexdumps")
+		logFile  = fs.StringLong("log-file", "", "write logs to this file, or to stderr if \"stderr\", to keep stdout for the results")
+		otlp     = fs.StringLong("otlp-endpoint", "", "export OpenTelemetry traces of the run over OTLP/HTTP to this endpoint, e.g. http://localhost:4318")
 		verFlag  = fs.BoolLong("version", "displays version number")
 	)
 
@@ -48,7 +142,7 @@ func main() {
 	err := ff.Parse(fs, os.Args[1:])
 	switch {
 	case errors.Is(err, ff.ErrHelp):
-		fmt.Fprintf(os.Stderr, "%s\n", ffhelp.Flags(fs))
+		fmt.Fprintf(os.Stderr, "%s\n", ffhelp.Flags(fs, appName+" [flags] [url]"))
 		os.Exit(0)
 	case err != nil:
 		l.Error("failed to parse command line arguments", "error", err)
@@ -57,38 +151,129 @@ func main() {
 	}
 
 	if *verFlag {
-		if version == "" {
-			version = versioninfo.Short()
-		}
-		fmt.Fprintf(os.Stderr, "%s\n", version)
+		fmt.Fprintf(os.Stderr, "%s\n", heybabeVersion())
 		os.Exit(0)
 	}
 
 	l.Debug("configuring logger", "log_level", *logLevel, "log_json", *logJson)
-	var lOpts *slog.HandlerOptions
-	switch *logLevel {
-	case slog.LevelDebug.String():
-		lOpts = &slog.HandlerOptions{Level: slog.LevelDebug}
-	case slog.LevelInfo.String():
-		lOpts = &slog.HandlerOptions{Level: slog.LevelInfo}
-	case slog.LevelWarn.String():
-		lOpts = &slog.HandlerOptions{Level: slog.LevelWarn}
-	case slog.LevelError.String():
-		lOpts = &slog.HandlerOptions{Level: slog.LevelError}
+	// Keep stdout for the attempts or the best test when they are written
+	// there.
+	logOut := io.Writer(os.Stdout)
+	if (*output != "" && *outFile == "") || *best {
+		logOut = os.Stderr
+	}
+	switch *logFile {
+	case "":
+	case "stderr":
+		logOut = os.Stderr
 	default:
-		// Default to INFO level if no log level specified
-		lOpts = &slog.HandlerOptions{Level: slog.LevelInfo}
+		f, err := os.OpenFile(*logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			l.Error("failed to open log file", "path", *logFile, "error", err)
+			fatal(l, err)
+		}
+		defer f.Close()
+		logOut = f
 	}
+	l = newLogger(logOut, *logLevel, *logJson)
+	l.Debug("logger configured successfully")
 
-	var lHandler slog.Handler
-	if *logJson {
-		lHandler = slog.NewJSONHandler(os.Stdout, lOpts)
-	} else {
-		lHandler = slog.NewTextHandler(os.Stdout, lOpts)
+	tlsfrag.Trace.MaxBytes = int(*trBytes)
+
+	// A target URL stands in for --sni and --port, or for --host if the
+	// SNI is set apart from it.
+	switch rest := fs.GetArgs(); len(rest) {
+	case 0:
+	case 1:
+		t, err := parseTargetURL(rest[0])
+		if err != nil {
+			l.Error("invalid target URL", "url", rest[0], "error", err)
+			fatal(l, fmt.Errorf("invalid target URL: %w", err))
+		}
+		if f, _ := fs.GetFlag("port"); f.IsSet() && *port != uint(t.port) {
+			l.Error("port conflicts with the target URL", "port", *port, "url", rest[0])
+			fatal(l, errors.New("--port conflicts with the target URL's port"))
+		}
+		*port = uint(t.port)
+		switch {
+		case t.addr.IsValid() && len(*ip) > 0:
+			l.Error("cannot specify both a target URL with an IP and IP", "url", rest[0], "ip", *ip)
+			fatal(l, errors.New("--ip can't be set with a target URL with an IP"))
+		case t.addr.IsValid():
+			*ip = []string{t.addr.String()}
+		case *sni == "":
+			*sni = t.host
+		case *sni != t.host && *host != "":
+			l.Error("cannot specify both a target URL and host", "url", rest[0], "host", *host)
+			fatal(l, errors.New("--host can't be set with a target URL and a different --sni"))
+		case *sni != t.host:
+			*host = t.host
+		}
+		if t.path != "" && t.path != "/" {
+			l.Warn("no test makes HTTP requests, so the target URL's path is ignored", "path", t.path)
+		}
+	default:
+		l.Error("too many arguments", "args", rest)
+		fatal(l, fmt.Errorf("takes a single target URL, got %q", rest))
 	}
 
-	l = slog.New(lHandler)
-	l.Debug("logger configured successfully")
+	var targets []batchTarget
+	if *tgtFile != "" {
+		if *sni != "" || *host != "" || len(*ip) > 0 || len(fs.GetArgs()) > 0 {
+			l.Error("cannot specify both targets file and a target")
+			fatal(l, errors.New("--targets can't be set with --sni, --host, --ip or a target URL"))
+		}
+		if *emitCfg != "" {
+			l.Error("cannot emit a config for several targets")
+			fatal(l, errors.New("--targets can't be set with --emit-config"))
+		}
+		targets, err = readBatchTargets(*tgtFile)
+		if err != nil {
+			l.Error("failed to read targets", "path", *tgtFile, "error", err)
+			fatal(l, fmt.Errorf("invalid targets file %s: %w", *tgtFile, err))
+		}
+		l.Debug("loaded targets", "path", *tgtFile, "count", len(targets))
+	}
+
+	var categories map[string]string
+	if *testList != "" {
+		if *tgtFile != "" || *sni != "" || *host != "" || len(*ip) > 0 || len(fs.GetArgs()) > 0 {
+			l.Error("cannot specify both test list and a target")
+			fatal(l, errors.New("--test-list can't be set with --targets, --sni, --host, --ip or a target URL"))
+		}
+		if *emitCfg != "" {
+			l.Error("cannot emit a config for several targets")
+			fatal(l, errors.New("--test-list can't be set with --emit-config"))
+		}
+		l.Info("downloading test list", "test_list", *testList)
+		targets, categories, err = fetchTestList(context.Background(), *testList)
+		if err != nil {
+			l.Error("failed to get test list", "test_list", *testList, "error", err)
+			fatal(l, fmt.Errorf("failed to get test list %s: %w", *testList, err))
+		}
+		l.Info("loaded test list", "test_list", *testList, "hostnames", len(targets))
+	}
+
+	// Quick runs trade the repeats and long timeouts for a fast verdict.
+	if *quick && *full {
+		l.Error("cannot specify both quick and full")
+		fatal(l, errors.New("--quick and --full are mutually exclusive"))
+	}
+	var tests []string
+	if *quick {
+		tests = quickTests
+		*repeat, *retries, *warmUp = 1, 0, false
+		if f, _ := fs.GetFlag("tcp-timeout"); !f.IsSet() {
+			*tcpTO = quickTimeout
+		}
+		if f, _ := fs.GetFlag("tls-timeout"); !f.IsSet() {
+			*tlsTO = quickTimeout
+		}
+	}
+	// Full runs make many more connections, so they're paced by default.
+	if f, _ := fs.GetFlag("max-connections-per-minute"); *full && !f.IsSet() {
+		*maxConns = fullPace
+	}
 
 	// Make sure that port does not exceed 65535
 	if *port > uint(^uint16(0)) {
@@ -96,31 +281,365 @@ func main() {
 		fatal(l, fmt.Errorf("invalid port %v", *port))
 	}
 
-	if *sni == "" {
+	var hello []byte
+	if *helloArg != "" || *pcapFile != "" {
+		if *helloArg != "" && *pcapFile != "" {
+			l.Error("cannot specify both ClientHello file and pcap")
+			fatal(l, errors.New("cannot set --clienthello and --from-pcap"))
+		}
+		path := *helloArg
+		var b []byte
+		if *pcapFile != "" {
+			path = *pcapFile
+			b, err = readPcapClientHello(path, l)
+		} else {
+			b, err = os.ReadFile(path)
+		}
+		if err != nil {
+			l.Error("failed to read ClientHello", "path", path, "error", err)
+			fatal(l, err)
+		}
+		record, msg, err := parseClientHello(b)
+		if err != nil {
+			l.Error("failed to parse ClientHello", "path", path, "error", err)
+			fatal(l, fmt.Errorf("invalid ClientHello in %s: %w", path, err))
+		}
+		hello = record
+		fp := msg.Fingerprint()
+		l.Info("loaded captured ClientHello",
+			"sni", msg.ServerName,
+			"alpn", msg.ALPNProtocols,
+			"ja3", fp.JA3Hash,
+			"ja4", fp.JA4,
+			"size", len(hello))
+		switch {
+		case *sni == "":
+			// Test the server the ClientHello was meant for.
+			*sni = msg.ServerName
+		case msg.ServerName != *sni:
+			l.Warn("captured ClientHello is for a different SNI, the other tests will use --sni", "sni", *sni, "clienthello_sni", msg.ServerName)
+		}
+	}
+
+	var bridges []obfs4Bridge
+	for _, line := range *obfs4 {
+		b, err := parseObfs4Bridge(line)
+		if err != nil {
+			l.Error("invalid obfs4 bridge line", "obfs4", line, "error", err)
+			fatal(l, fmt.Errorf("invalid obfs4 bridge line %q: %w", line, err))
+		}
+		bridges = append(bridges, b)
+	}
+
+	var realityServers []realityServer
+	for _, link := range *reality {
+		s, err := parseRealityLink(link)
+		if err != nil {
+			l.Error("invalid REALITY share link", "error", err)
+			fatal(l, fmt.Errorf("invalid REALITY share link: %w", err))
+		}
+		realityServers = append(realityServers, s)
+	}
+
+	if *sni == "" && targets == nil && bridges == nil && realityServers == nil {
 		l.Error("SNI not specified")
 		fatal(l, errors.New("must specify SNI"))
 	}
 
-	l.Debug("validating configuration", 
+	if *trRedact {
+		tlsfrag.Trace.Redact = [][]byte{[]byte(*sni)}
+	}
+
+	if *emitCfg != "" && !slices.Contains(emitFormats, *emitCfg) {
+		l.Error("invalid config format", "emit_config", *emitCfg)
+		fatal(l, fmt.Errorf("invalid config format %q (valid values: %s)", *emitCfg, emitFormats))
+	}
+
+	if *output != "" && !slices.Contains(outputFormats, *output) {
+		l.Error("invalid output format", "output", *output)
+		fatal(l, fmt.Errorf("invalid output format %q (valid values: %s)", *output, outputFormats))
+	}
+	if *outFile != "" && *output == "" {
+		l.Error("output file given without output format", "output_file", *outFile)
+		fatal(l, errors.New("--output-file requires --output"))
+	}
+	if *output != "" && *outFile == "" && *emitCfg != "" {
+		l.Error("config snippet and attempts both on stdout", "output", *output, "emit_config", *emitCfg)
+		fatal(l, errors.New("--emit-config requires --output-file with --output"))
+	}
+	if *output == "junit" && *stream {
+		l.Error("cannot stream JUnit XML")
+		fatal(l, errors.New("cannot set --stream with --output junit"))
+	}
+	if *best && *stream {
+		l.Error("cannot specify both print-best and stream")
+		fatal(l, errors.New("cannot set --print-best and --stream"))
+	}
+	if *best && ((*output != "" && *outFile == "") || *emitCfg != "") {
+		l.Error("best test and other output both on stdout", "output", *output, "emit_config", *emitCfg)
+		fatal(l, errors.New("--print-best can't be set with --emit-config, or --output without --output-file"))
+	}
+
+	if *iface != "" {
+		if _, err := net.InterfaceByName(*iface); err != nil {
+			l.Error("invalid network interface", "interface", *iface, "error", err)
+			fatal(l, fmt.Errorf("invalid interface %q: %w", *iface, err))
+		}
+	}
+
+	if *host != "" {
+		if len(*ip) > 0 {
+			l.Error("cannot specify both host and IP", "host", *host, "ip", *ip)
+			fatal(l, errors.New("--host can't be set with --ip"))
+		}
+		// An IP as the host is just a manual IP.
+		if _, err := netip.ParseAddr(*host); err == nil {
+			*ip, *host = []string{*host}, ""
+		}
+	}
+
+	if *resolveE && len(*ip) > 0 {
+		l.Error("nothing to resolve with a manual IP", "ip", *ip)
+		fatal(l, errors.New("--resolve-every-attempt can't be set with --ip"))
+	}
+
+	if *tcpTO <= 0 || *tlsTO < 0 {
+		l.Error("invalid timeout", "tcp_timeout", *tcpTO, "tls_timeout", *tlsTO)
+		fatal(l, errors.New("--tcp-timeout must be positive and --tls-timeout not negative"))
+	}
+
+	if *kaPeriod == 0 || *kaHold <= 0 {
+		l.Error("invalid keepalive", "keepalive", *kaPeriod, "keepalive_hold", *kaHold)
+		fatal(l, errors.New("--keepalive can't be 0 and --keepalive-hold must be positive"))
+	}
+	keepAliveSweep, err := parseDurationList(*kaSweep)
+	if err != nil {
+		l.Error("invalid keepalive sweep", "keepalive_sweep", *kaSweep, "error", err)
+		fatal(l, fmt.Errorf("invalid keepalive sweep: %w", err))
+	}
+	slices.Sort(keepAliveSweep)
+	keepAliveSweep = slices.Compact(keepAliveSweep)
+
+	if *cooldown < 0 || *cdSNI == "" {
+		l.Error("invalid cooldown", "cooldown", *cooldown, "cooldown_sni", *cdSNI)
+		fatal(l, errors.New("--cooldown can't be negative and --cooldown-sni can't be empty"))
+	}
+	if *cooldown > 0 && (targets != nil || *output != "" || *best || *emitCfg != "" || *stream) {
+		l.Error("cannot measure the cooldown with other modes")
+		fatal(l, errors.New("--cooldown can't be set with --targets, --output, --print-best, --emit-config or --stream"))
+	}
+	if *bisect && (*cooldown > 0 || targets != nil || *output != "" || *best || *emitCfg != "" || *stream) {
+		l.Error("cannot bisect the SNI with other modes")
+		fatal(l, errors.New("--bisect-sni can't be set with --cooldown, --targets, --output, --print-best, --emit-config or --stream"))
+	}
+
+	if *ttl > 255 {
+		l.Error("invalid TTL", "ttl", *ttl, "max_ttl", 255)
+		fatal(l, fmt.Errorf("invalid TTL %v", *ttl))
+	}
+
+	dscpValue := -1
+	if *dscp != "" {
+		dscpValue, err = strconv.Atoi(*dscp)
+		if err != nil || dscpValue < 0 || dscpValue > 63 {
+			l.Error("invalid DSCP value", "dscp", *dscp)
+			fatal(l, fmt.Errorf("invalid DSCP value %q (must be 0-63)", *dscp))
+		}
+	}
+
+	var rec *recipe.Recipe
+	if *rcp != "" || *rcpFile != "" {
+		if *rcp != "" && *rcpFile != "" {
+			l.Error("cannot specify both recipe and recipe file")
+			fatal(l, errors.New("cannot set --recipe and --recipe-file"))
+		}
+		src := *rcp
+		if *rcpFile != "" {
+			b, err := os.ReadFile(*rcpFile)
+			if err != nil {
+				l.Error("failed to read recipe file", "path", *rcpFile, "error", err)
+				fatal(l, err)
+			}
+			src = string(b)
+		}
+		rec, err = recipe.Parse(src)
+		if err != nil {
+			l.Error("failed to parse recipe", "error", err)
+			fatal(l, err)
+		}
+		l.Debug("parsed recipe", "recipe", rec.String())
+	}
+
+	// A TLS record carries at most 16384 bytes.
+	recordSizes, err := parseIntList(*recSizes, 1, 16384)
+	if err != nil {
+		l.Error("invalid record sizes", "record_sizes", *recSizes, "error", err)
+		fatal(l, fmt.Errorf("invalid record sizes: %w", err))
+	}
+	slices.Sort(recordSizes)
+	recordSizes = slices.Compact(recordSizes)
+
+	// QUIC Initials must be at least 1200 bytes, and uQUIC sends at most 1452.
+	quicSizes, err := parseIntList(*qSizes, quicMinDatagram, quicMaxDatagram)
+	if err != nil {
+		l.Error("invalid QUIC sizes", "quic_sizes", *qSizes, "error", err)
+		fatal(l, fmt.Errorf("invalid QUIC sizes: %w", err))
+	}
+	slices.Sort(quicSizes)
+	quicSizes = slices.Compact(quicSizes)
+
+	// The padding has to fit in the 16 bit extensions length.
+	pads, err := parseIntList(*padSizes, 1, 0xffff)
+	if err != nil {
+		l.Error("invalid pad sizes", "pad_sizes", *padSizes, "error", err)
+		fatal(l, fmt.Errorf("invalid pad sizes: %w", err))
+	}
+
+	// A hostname is at most 253 bytes long.
+	splitAt, err := parseIntList(*sniSplit, 1, 252)
+	if err != nil {
+		l.Error("invalid SNI split offsets", "sni_split_at", *sniSplit, "error", err)
+		fatal(l, fmt.Errorf("invalid SNI split offsets: %w", err))
+	}
+	slices.Sort(splitAt)
+	splitAt = slices.Compact(splitAt)
+
+	for _, name := range *echOuter {
+		if !validOuterSNI(name) {
+			l.Error("invalid ECH outer SNI", "ech_outer_sni", name)
+			fatal(l, fmt.Errorf("invalid ECH outer SNI %q: not a hostname", name))
+		}
+	}
+
+	greaseMode := greaseDefault
+	switch {
+	case *grease && *noGrease:
+		l.Error("cannot specify both grease and no-grease")
+		fatal(l, errors.New("cannot set --grease and --no-grease"))
+	case *grease:
+		greaseMode = greaseOn
+	case *noGrease:
+		greaseMode = greaseOff
+	}
+
+	var cipherSuites []uint16
+	if *ciphers != "" {
+		cipherSuites, err = parseCipherSuites(*ciphers)
+		if err != nil {
+			l.Error("invalid cipher suites", "ciphers", *ciphers, "error", err)
+			fatal(l, fmt.Errorf("invalid cipher suites: %w", err))
+		}
+	}
+
+	var curveIDs []uint16
+	if *curves != "" {
+		curveIDs, err = parseCurves(*curves)
+		if err != nil {
+			l.Error("invalid curves", "curves", *curves, "error", err)
+			fatal(l, fmt.Errorf("invalid curves: %w", err))
+		}
+	}
+
+	var tcpALPN, quicALPN []string
+	if *alpn != "" {
+		tcpALPN, quicALPN, err = parseALPN(*alpn)
+		if err != nil {
+			l.Error("invalid ALPN protocols", "alpn", *alpn, "error", err)
+			fatal(l, fmt.Errorf("invalid ALPN protocols: %w", err))
+		}
+	}
+
+	var cs *customSettings
+	if *custom != "" {
+		settings, err := parseCustom(*custom)
+		if err != nil {
+			l.Error("invalid custom test settings", "custom", *custom, "error", err)
+			fatal(l, fmt.Errorf("invalid custom test: %w", err))
+		}
+		cs = &settings
+		l.Debug("custom test", "settings", cs.String())
+	}
+
+	var warp *warpPlusSettings
+	if *wCiphers != "" || *wPadding != "" || *wRecSize != "" {
+		// Unset knobs keep the warp-plus defaults.
+		ws := warpPlusCustom
+		if *wCiphers != "" {
+			ws.CipherSuites, err = parseCipherSuites(*wCiphers)
+			if err != nil {
+				l.Error("invalid warp-plus cipher suites", "warp_ciphers", *wCiphers, "error", err)
+				fatal(l, fmt.Errorf("invalid warp-plus cipher suites: %w", err))
+			}
+		}
+		if *wPadding != "" {
+			ws.PaddingLen, err = strconv.Atoi(*wPadding)
+			if err != nil || ws.PaddingLen < 0 || ws.PaddingLen > 0xffff {
+				l.Error("invalid warp-plus padding length", "warp_padding", *wPadding)
+				fatal(l, fmt.Errorf("invalid warp-plus padding length %q (must be 0-65535)", *wPadding))
+			}
+		}
+		if *wRecSize != "" {
+			ws.RecordSize, err = strconv.Atoi(*wRecSize)
+			if err != nil || ws.RecordSize < 0 || ws.RecordSize > 16384 {
+				l.Error("invalid warp-plus record size", "warp_record_size", *wRecSize)
+				fatal(l, fmt.Errorf("invalid warp-plus record size %q (must be 0-16384)", *wRecSize))
+			}
+		}
+		warp = &ws
+		l.Debug("tuned warp-plus test", "settings", ws.String())
+	}
+
+	l.Debug("validating configuration",
 		"sni", *sni,
+		"host", *host,
 		"port", *port,
 		"ip", *ip,
 		"ipv4_only", *v4,
 		"ipv6_only", *v6,
 		"repeat", *repeat)
 
-	addr := netip.IPv4Unspecified()
-	if *ip != "" {
+	var source netip.Addr
+	if *srcIP != "" {
+		source, err = netip.ParseAddr(*srcIP)
+		if err != nil {
+			l.Error("failed to parse source IP address", "source_ip", *srcIP, "error", err)
+			fatal(l, err)
+		}
+		source = source.Unmap()
+	}
+
+	var addrs []netip.Addr
+	if len(*ip) > 0 {
 		if *v4 || *v6 {
 			l.Error("cannot specify both IP and IPv4/IPv6 flags")
 			fatal(l, errors.New("cannot set ip and -4 or -6"))
 		}
-		addr, err = netip.ParseAddr(*ip)
-		if err != nil {
-			l.Error("failed to parse IP address", "ip", *ip, "error", err)
-			fatal(l, err)
+		for _, v := range *ip {
+			for _, s := range strings.Split(v, ",") {
+				addr, err := netip.ParseAddr(strings.TrimSpace(s))
+				if err != nil {
+					l.Error("failed to parse IP address", "ip", s, "error", err)
+					fatal(l, err)
+				}
+				addr = addr.Unmap()
+				if source.IsValid() && source.Is4() != addr.Is4() {
+					l.Error("source IP and IP are of different families", "source_ip", source, "ip", addr)
+					fatal(l, errors.New("source-ip and ip must both be IPv4 or IPv6"))
+				}
+				if !slices.Contains(addrs, addr) {
+					addrs = append(addrs, addr)
+				}
+			}
 		}
-		l.Debug("using manual IP address", "ip", addr)
+		l.Debug("using manual IP addresses", "ips", addrs)
+	} else if source.IsValid() {
+		// Only the addresses of the source IP's family are reachable from it.
+		if (*v4 && source.Is6()) || (*v6 && source.Is4()) {
+			l.Error("source IP family conflicts with -4/-6", "source_ip", source)
+			fatal(l, errors.New("source-ip family conflicts with -4 or -6"))
+		}
+		*v4, *v6 = source.Is4(), source.Is6()
+		l.Debug("resolving only the source IP's address family", "source_ip", source)
 	} else if *v4 == *v6 {
 		// Essentially doing XNOR to make sure that if they are both false
 		// or both true, just set them both true.
@@ -128,23 +647,103 @@ func main() {
 		l.Debug("auto-detecting IPv4 and IPv6 addresses")
 	}
 
+	// Submissions are only useful with the network they came from.
+	if *submitTo != "" {
+		if u, err := url.Parse(*submitTo); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			l.Error("invalid collector endpoint", "submit", *submitTo)
+			fatal(l, fmt.Errorf("invalid collector endpoint %q, must be an http or https URL", *submitTo))
+		}
+		*netInfo = true
+	} else if *submitIP {
+		l.Error("cannot specify submit-ip without submit")
+		fatal(l, errors.New("--submit-ip needs --submit"))
+	}
+
+	flush := func() {}
+	if *otlp != "" {
+		shutdown, err := setupTracing(context.Background(), *otlp)
+		if err != nil {
+			l.Error("failed to set up tracing", "otlp_endpoint", *otlp, "error", err)
+			fatal(l, fmt.Errorf("invalid OTLP endpoint %q: %w", *otlp, err))
+		}
+		flush = func() { flushTracing(l, shutdown) }
+	}
+
 	l.Debug("setting up signal handling")
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
 	go func() {
+		defer close(done)
 		defer cancel()
 
 		to := TestOptions{
 			ResolveIPv4: *v4,
 			ResolveIPv6: *v6,
-			ManualIP:    addr.Unmap(),
+			ManualIPs:   addrs,
 			Port:        uint16(*port),
 			SNI:         *sni,
+			Host:        *host,
+			Targets:     targets,
+			Categories:  categories,
+			Tests:       tests,
 			Repeat:      *repeat,
+			Retries:     *retries,
+			EmitConfig:  *emitCfg,
+			Recipe:      rec,
+			PadSizes:    pads,
+			RecordSizes: recordSizes,
+			QUICSizes:   quicSizes,
+			SNISplitAt:  splitAt,
+			NFQueue:     uint16(*nfq),
+			Interface:   *iface,
+			SourceIP:    source,
+			DSCP:        dscpValue,
+			TTL:         int(*ttl),
+			ClientHello: hello,
+			WarpPlus:    warp,
+			GREASE:      greaseMode,
+			Ciphers:     cipherSuites,
+			Curves:      curveIDs,
+			ALPN:        tcpALPN,
+			QUICALPN:    quicALPN,
+			Custom:      cs,
+			Insecure:    *insecure,
+			Output:      *output,
+			OutputFile:  *outFile,
+			PrintBest:   *best,
+			Explain:     *explain,
+			ControlHost: *control,
+			NetworkInfo: *netInfo,
+			Stream:      *stream,
+			Pacer:       newPacer(*maxConns),
+			Shuffle:     *shuffle,
+			TCPTimeout:  *tcpTO,
+			TLSTimeout:  *tlsTO,
+			KeepAlive:   *kaPeriod,
+			History:     *histFile,
+			Labels:      *labels,
+			Submit:      *submitTo,
+			SubmitIP:    *submitIP,
+
+			KeepAliveSweep:      keepAliveSweep,
+			KeepAliveHold:       *kaHold,
+			ResolveEveryAttempt: *resolveE,
+			WarmUp:              *warmUp,
+			Cooldown:            *cooldown,
+			CooldownSNI:         *cdSNI,
+			FailureControls:     *failCtl,
+			BisectSNI:           *bisect,
+			Obfs4Bridges:        bridges,
+			RealityServers:      realityServers,
+			ECHOuterSNIs:        *echOuter,
+			Quick:               *quick,
+			Full:                *full,
 		}
 
 		l.Debug("starting test execution", "test_options", to)
 		if err := runTests(ctx, l, to); err != nil {
 			l.Error("test execution failed", "error", err)
+			flush()
 			fatal(l, err)
 		}
 		l.Debug("test execution completed successfully")
@@ -152,9 +751,91 @@ func main() {
 
 	l.Debug("waiting for completion or interruption")
 	<-ctx.Done()
+	// The tests stop and print what they have, and a second signal quits
+	// right away.
+	cancel()
+	<-done
+	flush()
 	l.Debug("application shutting down")
 }
 
+// parseIntList parses a comma separated list of integers within [min, max].
+func parseIntList(s string, min, max int) ([]int, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var list []int
+	for _, f := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil {
+			return nil, err
+		}
+		if n < min || n > max {
+			return nil, fmt.Errorf("%d is out of range [%d, %d]", n, min, max)
+		}
+		list = append(list, n)
+	}
+	return list, nil
+}
+
+// parseDurationList parses comma separated positive durations.
+func parseDurationList(s string) ([]time.Duration, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var list []time.Duration
+	for _, f := range strings.Split(s, ",") {
+		d, err := time.ParseDuration(strings.TrimSpace(f))
+		if err != nil {
+			return nil, err
+		}
+		// The kernel takes keepalive periods in whole seconds.
+		if d < time.Second {
+			return nil, fmt.Errorf("%v is shorter than a second", d)
+		}
+		list = append(list, d)
+	}
+	return list, nil
+}
+
+// newLogger returns a logger writing to w at the given level, INFO if it is
+// empty.
+func newLogger(w io.Writer, level string, json bool) *slog.Logger {
+	var lOpts *slog.HandlerOptions
+	switch level {
+	case slog.LevelDebug.String():
+		lOpts = &slog.HandlerOptions{Level: slog.LevelDebug}
+	case slog.LevelInfo.String():
+		lOpts = &slog.HandlerOptions{Level: slog.LevelInfo}
+	case slog.LevelWarn.String():
+		lOpts = &slog.HandlerOptions{Level: slog.LevelWarn}
+	case slog.LevelError.String():
+		lOpts = &slog.HandlerOptions{Level: slog.LevelError}
+	case levelTraceName:
+		lOpts = &slog.HandlerOptions{Level: tlsfrag.LevelTrace}
+	default:
+		// Default to INFO level if no log level specified
+		lOpts = &slog.HandlerOptions{Level: slog.LevelInfo}
+	}
+
+	lOpts.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+		if a.Key == slog.LevelKey && len(groups) == 0 && a.Value.Any() == tlsfrag.LevelTrace {
+			a.Value = slog.StringValue(levelTraceName)
+		}
+		return a
+	}
+
+	var lHandler slog.Handler
+	if json {
+		lHandler = slog.NewJSONHandler(w, lOpts)
+	} else {
+		lHandler = slog.NewTextHandler(w, lOpts)
+	}
+	return slog.New(lHandler)
+}
+
 func fatal(l *slog.Logger, err error) {
 	l.Error(err.Error())
 	os.Exit(1)
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/rodaine/table"
+)
+
+// printMatrix pivots the results when several SNIs were tested: one row per
+// SNI and one numbered column per test, with a legend of the numbers below.
+// A cell is ✓ with the mean latency (transport and TLS handshake) of the
+// successful attempts against any of the SNI's addresses, ✗ if none
+// succeeded, and - if the test didn't run or was skipped.
+func printMatrix(results map[string][]TestResult, order []string) {
+	var snis []string
+	for _, testName := range order {
+		for _, tr := range results[testName] {
+			if !slices.Contains(snis, tr.SNI) {
+				snis = append(snis, tr.SNI)
+			}
+		}
+	}
+	if len(snis) < 2 {
+		return
+	}
+
+	headerFmt := color.New(color.FgHiMagenta, color.Bold, color.Underline).SprintfFunc()
+	columnFmt := color.New(color.FgHiCyan, color.Bold).SprintfFunc()
+
+	columns := []any{"SNI"}
+	for i := range order {
+		columns = append(columns, strconv.Itoa(i+1))
+	}
+	tbl := table.New(columns...)
+	tbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt)
+
+	for _, sni := range snis {
+		row := []any{sni}
+		for _, testName := range order {
+			row = append(row, matrixCell(results[testName], sni))
+		}
+		tbl.AddRow(row...)
+	}
+
+	tbl.Print()
+	fmt.Println("")
+	for i, testName := range order {
+		fmt.Printf("%3d  %s\n", i+1, testName)
+	}
+	fmt.Println("")
+}
+
+// matrixCell returns the matrix cell for a test against sni, or against
+// any SNI if it's empty.
+func matrixCell(trs []TestResult, sni string) string {
+	var (
+		ran, successes int
+		latency        time.Duration
+	)
+	for _, tr := range trs {
+		if sni != "" && tr.SNI != sni {
+			continue
+		}
+		for _, attempt := range tr.Attempts {
+			if attempt.Err == nil {
+				ran++
+				successes++
+				latency += attempt.TransportEstablishDuration + attempt.TLSHandshakeDuration
+				continue
+			}
+			var skipErr *skipError
+			if !errors.As(attempt.Err, &skipErr) {
+				ran++
+			}
+		}
+	}
+	switch {
+	case ran == 0:
+		return "-"
+	case successes == 0:
+		return "✗"
+	default:
+		return fmt.Sprintf("✓ %.0fms", float64(latency/time.Duration(successes))/float64(time.Millisecond))
+	}
+}
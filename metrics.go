@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// influxLine formats an attempt as an InfluxDB line protocol point in the
+// "heybabe" measurement, tagged with what was tested and from where.
+func influxLine(r attemptRecord) string {
+	tags := []string{
+		"test=" + influxEscape(testID(r.Test)),
+		"sni=" + influxEscape(r.SNI),
+		"addr_port=" + influxEscape(r.AddrPort),
+	}
+	if r.ErrorClass != "" {
+		tags = append(tags, "error_class="+influxEscape(r.ErrorClass), "error_code="+influxEscape(r.ErrorCode))
+	}
+	if r.ASN != 0 {
+		tags = append(tags, "asn="+strconv.Itoa(r.ASN))
+	}
+	if r.Country != "" {
+		tags = append(tags, "country="+influxEscape(r.Country))
+	}
+
+	ms := func(v float64) string { return strconv.FormatFloat(v, 'f', -1, 64) }
+	success := 0
+	if r.Success {
+		success = 1
+	}
+	fields := []string{
+		fmt.Sprintf("success=%di", success),
+		fmt.Sprintf("attempt=%di", r.Attempt),
+		fmt.Sprintf("retries=%di", r.Retries),
+		"dns_ms=" + ms(r.DNSMs),
+		"setup_ms=" + ms(r.SetupMs),
+		"transport_ms=" + ms(r.TransportMs),
+		"tls_ms=" + ms(r.TLSMs),
+	}
+	if r.TTFBMs != 0 {
+		fields = append(fields, "ttfb_ms="+ms(r.TTFBMs))
+	}
+	if r.RetryMs != 0 {
+		fields = append(fields, "retry_ms="+ms(r.RetryMs))
+	}
+	if r.RSTMs != 0 {
+		fields = append(fields, "rst_ms="+ms(r.RSTMs))
+	}
+	if t := r.tcpRecord; t != nil {
+		fields = append(fields,
+			"tcp_rtt_ms="+ms(t.TCPRTTMs),
+			fmt.Sprintf("tcp_retransmits=%di", t.TCPRetransmits),
+			"tcp_reset="+strconv.FormatBool(t.TCPReset))
+	}
+	if w := r.wireRecord; w != nil {
+		fields = append(fields,
+			fmt.Sprintf("bytes_sent=%di", w.BytesSent),
+			fmt.Sprintf("bytes_received=%di", w.BytesReceived))
+	}
+	if r.Error != "" {
+		fields = append(fields, "error="+strconv.Quote(r.Error))
+	}
+
+	line := "heybabe," + strings.Join(tags, ",") + " " + strings.Join(fields, ",")
+	if !r.Time.IsZero() {
+		line += " " + strconv.FormatInt(r.Time.UnixNano(), 10)
+	}
+	return line
+}
+
+var influxEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+// influxEscape escapes a tag value, where empty values aren't allowed.
+func influxEscape(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return influxEscaper.Replace(s)
+}
+
+// statsdLines formats an attempt as statsd metrics named after the target
+// and test, as plain statsd has no tags: counters of attempts, successes
+// and failures, and timers for the phases of successful attempts.
+func statsdLines(r attemptRecord) []string {
+	prefix := "heybabe." + statsdName(r.SNI) + "." + statsdName(testID(r.Test)) + "."
+	lines := []string{prefix + "attempts:1|c"}
+	if t := r.tcpRecord; t != nil && t.TCPRetransmits > 0 {
+		lines = append(lines, prefix+"tcp_retransmits:"+strconv.Itoa(t.TCPRetransmits)+"|c")
+	}
+	if !r.Success {
+		return append(lines, prefix+"failures:1|c", prefix+"failures."+statsdName(r.ErrorClass)+":1|c")
+	}
+
+	ms := func(v float64) string { return strconv.FormatFloat(v, 'f', 3, 64) }
+	lines = append(lines,
+		prefix+"successes:1|c",
+		prefix+"dns_ms:"+ms(r.DNSMs)+"|ms",
+		prefix+"setup_ms:"+ms(r.SetupMs)+"|ms",
+		prefix+"transport_ms:"+ms(r.TransportMs)+"|ms",
+		prefix+"tls_ms:"+ms(r.TLSMs)+"|ms",
+	)
+	if r.TTFBMs != 0 {
+		lines = append(lines, prefix+"ttfb_ms:"+ms(r.TTFBMs)+"|ms")
+	}
+	if r.RetryMs != 0 {
+		lines = append(lines, prefix+"retry_ms:"+ms(r.RetryMs)+"|ms")
+	}
+	if r.RSTMs != 0 {
+		lines = append(lines, prefix+"rst_ms:"+ms(r.RSTMs)+"|ms")
+	}
+	if t := r.tcpRecord; t != nil {
+		lines = append(lines, prefix+"tcp_rtt_ms:"+ms(t.TCPRTTMs)+"|ms")
+	}
+	return lines
+}
+
+// statsdName makes s usable as one component of a statsd metric name.
+func statsdName(s string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' {
+			return r
+		}
+		return '_'
+	}, s)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	stdtls "crypto/tls"
+	"encoding/binary"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// Negotiated is what the server picked from what the ClientHello offered.
+type Negotiated struct {
+	Version     string
+	CipherSuite string
+	// ALPN is empty when no protocol was agreed on.
+	ALPN string
+	// Group is the key exchange group, only known for TLS 1.3 handshakes
+	// made with uTLS.
+	Group string
+}
+
+// negotiatedState returns the parameters of a uTLS or QUIC connection.
+func negotiatedState(state tls.ConnectionState) *Negotiated {
+	return &Negotiated{
+		Version:     tls.VersionName(state.Version),
+		CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+		ALPN:        state.NegotiatedProtocol,
+	}
+}
+
+// stdNegotiatedState returns the parameters of a connection made with Go's
+// TLS stack, which doesn't say which group it used.
+func stdNegotiatedState(state stdtls.ConnectionState) *Negotiated {
+	return &Negotiated{
+		Version:     stdtls.VersionName(state.Version),
+		CipherSuite: stdtls.CipherSuiteName(state.CipherSuite),
+		ALPN:        state.NegotiatedProtocol,
+	}
+}
+
+// uNegotiated returns the parameters of a uTLS connection, with the group
+// from the key share of the ServerHello.
+func uNegotiated(uconn *tls.UConn) *Negotiated {
+	n := negotiatedState(uconn.ConnectionState())
+	if sh := uconn.HandshakeState.ServerHello; sh != nil {
+		if group, ok := keyShareGroup(sh.Raw); ok {
+			n.Group = group.String()
+		}
+	}
+	return n
+}
+
+// keyShareGroup finds the group of the key_share extension in a raw
+// ServerHello, with its handshake header.
+func keyShareGroup(b []byte) (tls.CurveID, bool) {
+	// type, length, version and random
+	if len(b) < 4+2+32+1 {
+		return 0, false
+	}
+	b = b[4+2+32:]
+	// session ID, cipher suite and compression method
+	skip := 1 + int(b[0]) + 2 + 1
+	if len(b) < skip+2 {
+		return 0, false
+	}
+	b = b[skip+2:]
+	for len(b) >= 4 {
+		typ, n := binary.BigEndian.Uint16(b), int(binary.BigEndian.Uint16(b[2:]))
+		if len(b) < 4+n {
+			return 0, false
+		}
+		if typ == 51 && n >= 2 { // key_share
+			return tls.CurveID(binary.BigEndian.Uint16(b[4:])), true
+		}
+		b = b[4+n:]
+	}
+	return 0, false
+}
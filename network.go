@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// traceURL echoes the client's address and country back, one key=value
+// per line.
+const traceURL = "https://cloudflare.com/cdn-cgi/trace"
+
+// networkInfo describes the network a run was made from, so results from
+// different networks can be told apart.
+type networkInfo struct {
+	PublicIP netip.Addr `json:"public_ip"`
+	ASN      int        `json:"asn,omitempty"`
+	ASName   string     `json:"as_name,omitempty"`
+	Country  string     `json:"country,omitempty"`
+}
+
+func (ni networkInfo) String() string {
+	s := "public IP " + ni.PublicIP.String()
+	if ni.ASN != 0 {
+		s += fmt.Sprintf(", AS%d", ni.ASN)
+		if ni.ASName != "" {
+			s += " " + ni.ASName
+		}
+	}
+	if ni.Country != "" {
+		s += ", country " + ni.Country
+	}
+	return s
+}
+
+// discoverNetwork finds the public IP the tests leave from, with the
+// socket settings from ctx, and looks up its ASN over DNS. Only failing to
+// find the IP is an error.
+func discoverNetwork(ctx context.Context, l *slog.Logger) (networkInfo, error) {
+	var ni networkInfo
+
+	dialer := &net.Dialer{
+		Timeout:   5 * time.Second,
+		LocalAddr: localAddr(ctx),
+		Control:   dialControl(ctx),
+	}
+	client := &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &http.Transport{DialContext: dialer.DialContext},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, traceURL, nil)
+	if err != nil {
+		return ni, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return ni, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return ni, fmt.Errorf("%s returned %s", traceURL, resp.Status)
+	}
+
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		key, value, _ := strings.Cut(sc.Text(), "=")
+		switch key {
+		case "ip":
+			ni.PublicIP, err = netip.ParseAddr(value)
+			if err != nil {
+				return ni, fmt.Errorf("invalid IP from %s: %w", traceURL, err)
+			}
+		case "loc":
+			ni.Country = value
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return ni, err
+	}
+	if !ni.PublicIP.IsValid() {
+		return ni, fmt.Errorf("no IP from %s", traceURL)
+	}
+	ni.PublicIP = ni.PublicIP.Unmap()
+
+	// The ASN is nice to have, the run goes on without it.
+	ni.ASN, ni.ASName, err = lookupASN(ctx, ni.PublicIP)
+	if err != nil {
+		l.Warn("failed to look up ASN", "public_ip", ni.PublicIP, "error", err)
+	}
+	return ni, nil
+}
+
+// lookupASN finds the AS announcing addr and its name in Team Cymru's
+// IP to ASN mapping over DNS.
+func lookupASN(ctx context.Context, addr netip.Addr) (int, string, error) {
+	r := &net.Resolver{PreferGo: true}
+
+	// Answers look like "13335 | 1.1.1.0/24 | AU | apnic | 2011-08-11".
+	txts, err := r.LookupTXT(ctx, cymruOriginName(addr))
+	if err != nil {
+		return 0, "", err
+	}
+	if len(txts) == 0 {
+		return 0, "", errors.New("no origin record")
+	}
+	// Prefixes announced by several ASes list them all, take the first.
+	origins := strings.Fields(strings.Split(txts[0], "|")[0])
+	if len(origins) == 0 {
+		return 0, "", fmt.Errorf("invalid origin record %q", txts[0])
+	}
+	asn, err := strconv.Atoi(origins[0])
+	if err != nil {
+		return 0, "", fmt.Errorf("invalid origin record %q", txts[0])
+	}
+
+	// Answers look like "13335 | US | arin | 2010-07-14 | CLOUDFLARENET - Cloudflare, Inc., US".
+	txts, err = r.LookupTXT(ctx, fmt.Sprintf("AS%d.asn.cymru.com", asn))
+	if err != nil || len(txts) == 0 {
+		return asn, "", err
+	}
+	fields := strings.Split(txts[0], "|")
+	return asn, strings.TrimSpace(fields[len(fields)-1]), nil
+}
+
+// cymruOriginName returns the name to query for addr's origin AS: its
+// octets, or nibbles for IPv6, reversed.
+func cymruOriginName(addr netip.Addr) string {
+	var labels []string
+	if addr.Is4() {
+		for _, b := range addr.As4() {
+			labels = append([]string{strconv.Itoa(int(b))}, labels...)
+		}
+		return strings.Join(labels, ".") + ".origin.asn.cymru.com"
+	}
+	for _, b := range addr.As16() {
+		labels = append([]string{strconv.FormatUint(uint64(b&0xf), 16), strconv.FormatUint(uint64(b>>4), 16)}, labels...)
+	}
+	return strings.Join(labels, ".") + ".origin6.asn.cymru.com"
+}
@@ -0,0 +1,131 @@
+// Package nfqueue reshapes the packets of a TCP connection after the kernel
+// built them, for strategies that can't be carried out by writing to the
+// socket: the connection's outgoing packets are routed through a netfilter
+// queue, and the first one carrying data is cut up according to a
+// tlsfrag.Fragmenter and sent again as separate packets, each with its own
+// TTL and delay.
+//
+// The iptables rule doing the routing is scoped to the connection and
+// removed by Close. It needs iptables and root, on Linux only.
+package nfqueue
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+)
+
+var (
+	// ErrPermission is returned when the process can't set up the queue
+	// for lack of privileges.
+	ErrPermission = errors.New("nfqueue: requires root")
+	// ErrUnsupported is returned on platforms without netfilter.
+	ErrUnsupported = errors.New("nfqueue: unsupported platform")
+	// ErrNoIptables is returned when iptables isn't installed.
+	ErrNoIptables = errors.New("nfqueue: iptables not found")
+	// ErrMismatch is returned when the fragments of the plan don't add up
+	// to the packet, e.g. because they carry decoys: injecting extra data
+	// would throw the connection's sequence numbers off.
+	ErrMismatch = errors.New("nfqueue: fragments don't add up to the packet")
+)
+
+// maxPiece is the most payload put into a single packet, so the pieces fit
+// any MTU even when the kernel queued a GSO packet larger than one.
+const maxPiece = 1200
+
+// tcpPacket is an IP packet carrying a TCP segment, as the kernel queued it.
+type tcpPacket struct {
+	b       []byte
+	v6      bool
+	ipLen   int // length of the IP header
+	tcpLen  int // length of the TCP header, with options
+	payload []byte
+}
+
+// parseTCPPacket parses an IPv4 or IPv6 packet carrying TCP. IPv6 extension
+// headers aren't supported.
+func parseTCPPacket(b []byte) (tcpPacket, error) {
+	p := tcpPacket{b: b}
+	if len(b) < 1 {
+		return p, errors.New("empty packet")
+	}
+	switch b[0] >> 4 {
+	case 4:
+		p.ipLen = int(b[0]&0x0f) * 4
+		if len(b) < 20 || b[9] != 6 {
+			return p, errors.New("not a TCP packet")
+		}
+	case 6:
+		p.v6, p.ipLen = true, 40
+		if len(b) < 40 || b[6] != 6 {
+			return p, errors.New("not a TCP packet")
+		}
+	default:
+		return p, errors.New("not an IP packet")
+	}
+	if len(b) < p.ipLen+20 {
+		return p, errors.New("truncated TCP header")
+	}
+	p.tcpLen = int(b[p.ipLen+12]>>4) * 4
+	if p.tcpLen < 20 || len(b) < p.ipLen+p.tcpLen {
+		return p, errors.New("invalid TCP header")
+	}
+	p.payload = b[p.ipLen+p.tcpLen:]
+	return p, nil
+}
+
+func (p tcpPacket) addrs() (src, dst netip.Addr) {
+	if p.v6 {
+		return netip.AddrFrom16([16]byte(p.b[8:24])), netip.AddrFrom16([16]byte(p.b[24:40]))
+	}
+	return netip.AddrFrom4([4]byte(p.b[12:16])), netip.AddrFrom4([4]byte(p.b[16:20]))
+}
+
+// piece returns a copy of the packet carrying only the payload at off,
+// with the sequence number, lengths and checksums fixed up, and the given
+// TTL (or IPv6 hop limit) if it isn't 0.
+func (p tcpPacket) piece(off int, payload []byte, ttl int) []byte {
+	hdr := p.ipLen + p.tcpLen
+	b := make([]byte, hdr+len(payload))
+	copy(b, p.b[:hdr])
+	copy(b[hdr:], payload)
+
+	if p.v6 {
+		binary.BigEndian.PutUint16(b[4:], uint16(p.tcpLen+len(payload)))
+		if ttl > 0 {
+			b[7] = byte(ttl)
+		}
+	} else {
+		binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+		if ttl > 0 {
+			b[8] = byte(ttl)
+		}
+		b[10], b[11] = 0, 0
+		binary.BigEndian.PutUint16(b[10:], ^sum(0, b[:p.ipLen]))
+	}
+
+	tcp := b[p.ipLen:]
+	seq := binary.BigEndian.Uint32(tcp[4:])
+	binary.BigEndian.PutUint32(tcp[4:], seq+uint32(off))
+	tcp[16], tcp[17] = 0, 0
+	src, dst := p.addrs()
+	pseudo := sum(0, src.AsSlice())
+	pseudo = sum(uint32(pseudo), dst.AsSlice())
+	binary.BigEndian.PutUint16(tcp[16:], ^sum(uint32(pseudo)+6+uint32(len(tcp)), tcp))
+	return b
+}
+
+// sum adds b to the ones' complement sum acc.
+func sum(acc uint32, b []byte) uint16 {
+	for len(b) > 1 {
+		acc += uint32(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		acc += uint32(b[0]) << 8
+	}
+	for acc>>16 != 0 {
+		acc = acc&0xffff + acc>>16
+	}
+	return uint16(acc)
+}
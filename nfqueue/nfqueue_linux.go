@@ -0,0 +1,427 @@
+//go:build linux
+
+package nfqueue
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/markpash/heybabe/bepass/tlsfrag"
+)
+
+// Check reports whether queues can be set up.
+func Check() error {
+	if _, err := exec.LookPath("iptables"); err != nil {
+		return ErrNoIptables
+	}
+	if os.Geteuid() != 0 {
+		return ErrPermission
+	}
+	return nil
+}
+
+// From linux/netfilter/nfnetlink_queue.h.
+const (
+	nfnlSubsysQueue = 3
+
+	nfqnlMsgPacket  = nfnlSubsysQueue<<8 | 0
+	nfqnlMsgVerdict = nfnlSubsysQueue<<8 | 1
+	nfqnlMsgConfig  = nfnlSubsysQueue<<8 | 2
+
+	nfqaPacketHdr  = 1
+	nfqaVerdictHdr = 2
+	nfqaPayload    = 10
+
+	nfqaCfgCmd    = 1
+	nfqaCfgParams = 2
+	nfqaCfgMask   = 4
+	nfqaCfgFlags  = 5
+
+	nfqnlCfgCmdBind   = 1
+	nfqnlCfgCmdUnbind = 2
+	nfqnlCopyPacket   = 2
+	nfqaCfgFGSO       = 1 << 2
+
+	nfDrop   = 0
+	nfAccept = 1
+)
+
+// mark is the firewall mark of the packets sent by the Queue, which the
+// iptables rule lets through so they aren't queued again.
+const mark = 0x6862
+
+// Queue routes the packets of a connection through a netfilter queue.
+type Queue struct {
+	num    uint16
+	f      tlsfrag.Fragmenter
+	logger *slog.Logger
+
+	nl, raw  int // netlink and raw sockets, -1 until opened
+	iptables string
+	rule     []string
+	done     chan struct{}
+	wg       sync.WaitGroup
+
+	mu       sync.Mutex
+	reshaped bool
+	stats    *tlsfrag.Stats
+	err      error
+}
+
+// New returns a Queue for netfilter queue num, which reshapes the first
+// data packet of the connection dialed with its Control according to f.
+func New(num uint16, f tlsfrag.Fragmenter, logger *slog.Logger) *Queue {
+	return &Queue{num: num, f: f, logger: logger, nl: -1, raw: -1, done: make(chan struct{})}
+}
+
+// Control returns a net.Dialer Control function that binds the socket to
+// source (any address if it's invalid), so its port is known before it
+// connects, and routes the connection's packets through the queue. The
+// dialer must not have a LocalAddr.
+func (q *Queue) Control(source netip.Addr) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		remote, err := netip.ParseAddrPort(address)
+		if err != nil {
+			return err
+		}
+		remote = netip.AddrPortFrom(remote.Addr().Unmap(), remote.Port())
+		v6 := remote.Addr().Is6()
+		if !source.IsValid() {
+			source = netip.IPv4Unspecified()
+			if v6 {
+				source = netip.IPv6Unspecified()
+			}
+		}
+
+		var port int
+		var serr error
+		err = c.Control(func(fd uintptr) {
+			var sa syscall.Sockaddr = &syscall.SockaddrInet4{Addr: source.As4()}
+			if v6 {
+				sa = &syscall.SockaddrInet6{Addr: source.As16()}
+			}
+			if serr = syscall.Bind(int(fd), sa); serr != nil {
+				return
+			}
+			var local syscall.Sockaddr
+			if local, serr = syscall.Getsockname(int(fd)); serr != nil {
+				return
+			}
+			switch sa := local.(type) {
+			case *syscall.SockaddrInet4:
+				port = sa.Port
+			case *syscall.SockaddrInet6:
+				port = sa.Port
+			}
+		})
+		if err != nil {
+			return err
+		}
+		if serr != nil {
+			return serr
+		}
+		return q.open(uint16(port), remote)
+	}
+}
+
+// open binds the queue and adds the iptables rule for the connection from
+// the local port to remote.
+func (q *Queue) open(port uint16, remote netip.AddrPort) error {
+	family := syscall.AF_INET
+	q.iptables = "iptables"
+	if remote.Addr().Is6() {
+		family = syscall.AF_INET6
+		q.iptables = "ip6tables"
+	}
+
+	var err error
+	if q.nl, err = syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_NETFILTER); err != nil {
+		return wrapErr(err)
+	}
+	if err := syscall.Bind(q.nl, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return wrapErr(err)
+	}
+	// A timeout lets the reading loop notice Close.
+	tv := syscall.NsecToTimeval(int64(100 * time.Millisecond))
+	if err := syscall.SetsockoptTimeval(q.nl, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		return err
+	}
+
+	cmd := []byte{nfqnlCfgCmdBind, 0, 0, 0}
+	binary.BigEndian.PutUint16(cmd[2:], uint16(family))
+	if err := q.config(attr(nfqaCfgCmd, cmd)); err != nil {
+		return fmt.Errorf("binding queue %d: %w", q.num, err)
+	}
+	params := binary.BigEndian.AppendUint32(nil, 0xffff)
+	params = append(params, nfqnlCopyPacket)
+	flags := binary.BigEndian.AppendUint32(nil, nfqaCfgFGSO)
+	// Without GSO packets, a ClientHello larger than the MSS would be cut
+	// into segments before the Fragmenter sees it whole.
+	if err := q.config(attr(nfqaCfgParams, params), attr(nfqaCfgMask, flags), attr(nfqaCfgFlags, flags)); err != nil {
+		return fmt.Errorf("configuring queue %d: %w", q.num, err)
+	}
+
+	if q.raw, err = syscall.Socket(family, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.IPPROTO_RAW); err != nil {
+		return wrapErr(err)
+	}
+	if err := syscall.SetsockoptInt(q.raw, syscall.SOL_SOCKET, syscall.SO_MARK, mark); err != nil {
+		return wrapErr(err)
+	}
+
+	if _, err := exec.LookPath(q.iptables); err != nil {
+		return ErrNoIptables
+	}
+	// --queue-bypass lets the packets through if heybabe dies without
+	// removing the rule.
+	rule := []string{"OUTPUT", "-p", "tcp", "--sport", strconv.Itoa(int(port)),
+		"-d", remote.Addr().String(), "--dport", strconv.Itoa(int(remote.Port())),
+		"-m", "mark", "!", "--mark", strconv.Itoa(mark),
+		"-j", "NFQUEUE", "--queue-num", strconv.Itoa(int(q.num)), "--queue-bypass"}
+	if err := q.ipt("-I", rule); err != nil {
+		return err
+	}
+	q.rule = rule
+	q.logger.Debug("routing packets through netfilter queue", "queue", q.num, "local_port", port, "remote", remote)
+
+	q.wg.Add(1)
+	go q.loop()
+	return nil
+}
+
+func (q *Queue) ipt(op string, rule []string) error {
+	out, err := exec.Command(q.iptables, append([]string{"-w", op}, rule...)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %w: %s", q.iptables, op, err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+func wrapErr(err error) error {
+	if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EACCES) {
+		return ErrPermission
+	}
+	return err
+}
+
+// attr encodes a netlink attribute.
+func attr(typ uint16, data []byte) []byte {
+	b := binary.NativeEndian.AppendUint16(nil, uint16(4+len(data)))
+	b = binary.NativeEndian.AppendUint16(b, typ)
+	b = append(b, data...)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// send sends a nfnetlink message of type typ for the queue.
+func (q *Queue) send(typ, flags uint16, attrs ...[]byte) error {
+	body := []byte{syscall.AF_UNSPEC, 0} // family, version
+	body = binary.BigEndian.AppendUint16(body, q.num)
+	for _, a := range attrs {
+		body = append(body, a...)
+	}
+	b := binary.NativeEndian.AppendUint32(nil, uint32(syscall.NLMSG_HDRLEN+len(body)))
+	b = binary.NativeEndian.AppendUint16(b, typ)
+	b = binary.NativeEndian.AppendUint16(b, syscall.NLM_F_REQUEST|flags)
+	b = binary.NativeEndian.AppendUint32(b, 0) // sequence
+	b = binary.NativeEndian.AppendUint32(b, 0) // port ID, the kernel's
+	b = append(b, body...)
+	return syscall.Sendto(q.nl, b, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK})
+}
+
+// config sends a configuration message and waits for the kernel to ack it.
+func (q *Queue) config(attrs ...[]byte) error {
+	if err := q.send(nfqnlMsgConfig, syscall.NLM_F_ACK, attrs...); err != nil {
+		return wrapErr(err)
+	}
+	buf := make([]byte, 4096)
+	n, _, err := syscall.Recvfrom(q.nl, buf, 0)
+	if err != nil {
+		return err
+	}
+	msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+	if err != nil {
+		return err
+	}
+	for _, m := range msgs {
+		if m.Header.Type == syscall.NLMSG_ERROR && len(m.Data) >= 4 {
+			if errno := -int32(binary.NativeEndian.Uint32(m.Data)); errno != 0 {
+				return wrapErr(syscall.Errno(errno))
+			}
+			return nil
+		}
+	}
+	return errors.New("no ack from the kernel")
+}
+
+// loop hands the queued packets to handle until Close.
+func (q *Queue) loop() {
+	defer q.wg.Done()
+	buf := make([]byte, 1<<17)
+	for {
+		select {
+		case <-q.done:
+			return
+		default:
+		}
+
+		n, _, err := syscall.Recvfrom(q.nl, buf, 0)
+		if err != nil {
+			if errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EINTR) {
+				continue
+			}
+			q.fail(err)
+			return
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			continue
+		}
+		for _, m := range msgs {
+			if m.Header.Type != nfqnlMsgPacket || len(m.Data) < 4 {
+				continue
+			}
+			var id uint32
+			var payload []byte
+			for b := m.Data[4:]; len(b) >= 4; {
+				l := int(binary.NativeEndian.Uint16(b))
+				if l < 4 || l > len(b) {
+					break
+				}
+				switch binary.NativeEndian.Uint16(b[2:]) & 0x3fff {
+				case nfqaPacketHdr:
+					id = binary.BigEndian.Uint32(b[4:])
+				case nfqaPayload:
+					payload = b[4:l]
+				}
+				b = b[min((l+3)&^3, len(b)):]
+			}
+			q.handle(id, payload)
+		}
+	}
+}
+
+func (q *Queue) verdict(id, verdict uint32) {
+	hdr := binary.BigEndian.AppendUint32(nil, verdict)
+	hdr = binary.BigEndian.AppendUint32(hdr, id)
+	if err := q.send(nfqnlMsgVerdict, 0, attr(nfqaVerdictHdr, hdr)); err != nil {
+		q.logger.Debug("failed to send verdict", "error", err)
+	}
+}
+
+func (q *Queue) fail(err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err == nil {
+		q.err = err
+	}
+}
+
+// handle lets the packet through, unless it's the first one carrying data:
+// that one is dropped and sent again in pieces according to the plan.
+func (q *Queue) handle(id uint32, b []byte) {
+	q.mu.Lock()
+	reshaped := q.reshaped
+	q.mu.Unlock()
+	p, err := parseTCPPacket(b)
+	if reshaped || err != nil || len(p.payload) == 0 {
+		q.verdict(id, nfAccept)
+		return
+	}
+	q.mu.Lock()
+	q.reshaped = true
+	q.mu.Unlock()
+
+	plan := q.f.SplitPlan(p.payload)
+	var data [][]byte
+	for _, f := range plan {
+		data = append(data, f.Data)
+	}
+	if !bytes.Equal(bytes.Join(data, nil), p.payload) {
+		q.fail(ErrMismatch)
+		q.verdict(id, nfAccept)
+		return
+	}
+	q.verdict(id, nfDrop)
+
+	_, dst := p.addrs()
+	var sa syscall.Sockaddr = &syscall.SockaddrInet4{Addr: dst.As4()}
+	if p.v6 {
+		sa = &syscall.SockaddrInet6{Addr: dst.As16()}
+	}
+	stats := &tlsfrag.Stats{}
+	off := 0
+	for _, f := range plan {
+		for d := f.Data; len(d) > 0; {
+			n := min(len(d), maxPiece)
+			if err := syscall.Sendto(q.raw, p.piece(off, d[:n], f.TTL), 0, sa); err != nil {
+				// The kernel retransmits the dropped packet whole.
+				q.fail(err)
+				return
+			}
+			off += n
+			d = d[n:]
+		}
+		stats.Fragments++
+		stats.Sizes = append(stats.Sizes, len(f.Data))
+		stats.Delays = append(stats.Delays, f.Delay)
+		stats.TTLs = append(stats.TTLs, f.TTL)
+		q.mu.Lock()
+		q.stats = stats
+		q.mu.Unlock()
+
+		select {
+		case <-time.After(f.Delay):
+		case <-q.done:
+			return
+		}
+	}
+	q.logger.Debug("reshaped first data packet", "queue", q.num, "fragments", stats.Fragments, "sizes", stats.Sizes)
+}
+
+// Stats returns how the first data packet was sent, or nil if it wasn't
+// reshaped.
+func (q *Queue) Stats() *tlsfrag.Stats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.stats
+}
+
+// Err returns the error that kept the first data packet from being
+// reshaped.
+func (q *Queue) Err() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.err
+}
+
+// Close removes the iptables rule and releases the queue.
+func (q *Queue) Close() error {
+	var err error
+	if q.rule != nil {
+		err = q.ipt("-D", q.rule)
+		q.rule = nil
+	}
+	close(q.done)
+	q.wg.Wait()
+	if q.nl >= 0 {
+		cmd := []byte{nfqnlCfgCmdUnbind, 0, 0, 0}
+		q.send(nfqnlMsgConfig, 0, attr(nfqaCfgCmd, cmd))
+		syscall.Close(q.nl)
+	}
+	if q.raw >= 0 {
+		syscall.Close(q.raw)
+	}
+	return err
+}
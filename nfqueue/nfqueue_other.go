@@ -0,0 +1,44 @@
+//go:build !linux
+
+package nfqueue
+
+import (
+	"log/slog"
+	"net/netip"
+	"syscall"
+
+	"github.com/markpash/heybabe/bepass/tlsfrag"
+)
+
+// Check reports whether queues can be set up.
+func Check() error {
+	return ErrUnsupported
+}
+
+// Queue routes the packets of a connection through a netfilter queue.
+type Queue struct{}
+
+// New returns a Queue for netfilter queue num.
+func New(num uint16, f tlsfrag.Fragmenter, logger *slog.Logger) *Queue {
+	return &Queue{}
+}
+
+// Control returns a net.Dialer Control function that sets up the queue.
+func (q *Queue) Control(source netip.Addr) func(network, address string, c syscall.RawConn) error {
+	return func(string, string, syscall.RawConn) error { return ErrUnsupported }
+}
+
+// Stats returns how the first data packet was sent.
+func (q *Queue) Stats() *tlsfrag.Stats {
+	return nil
+}
+
+// Err returns the error that kept the first data packet from being reshaped.
+func (q *Queue) Err() error {
+	return nil
+}
+
+// Close removes the iptables rule and releases the queue.
+func (q *Queue) Close() error {
+	return nil
+}
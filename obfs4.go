@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Lengths of the obfs4 handshake, from its spec.
+const (
+	obfs4NodeIDLength         = 20
+	obfs4PublicKeyLength      = 32
+	obfs4RepresentativeLength = 32
+	obfs4AuthLength           = 32
+	obfs4MarkLength           = 16
+	obfs4MACLength            = 16
+	obfs4MaxHandshakeLength   = 8192
+	// The client pads its handshake to at least the server's, plus the
+	// frame carrying the server's PRNG seed.
+	obfs4ClientMinPadLength = 77
+	obfs4ClientMaxPadLength = obfs4MaxHandshakeLength - (obfs4RepresentativeLength + obfs4MarkLength + obfs4MACLength)
+)
+
+// obfs4Bridge is an obfs4 bridge from a Tor bridge line.
+type obfs4Bridge struct {
+	addrPort netip.AddrPort
+	nodeID   []byte
+	pubKey   []byte
+}
+
+// parseObfs4Bridge parses a bridge line, e.g.
+//
+//	obfs4 192.0.2.1:443 4352E58420E68F5E40BF7C74FADDCCD9D1349413 cert=... iat-mode=0
+//
+// where "Bridge", "obfs4" and the fingerprint may be left out.
+func parseObfs4Bridge(line string) (obfs4Bridge, error) {
+	var b obfs4Bridge
+	fields := strings.Fields(line)
+	if len(fields) > 0 && strings.EqualFold(fields[0], "bridge") {
+		fields = fields[1:]
+	}
+	if len(fields) > 0 && fields[0] == "obfs4" {
+		fields = fields[1:]
+	}
+	if len(fields) == 0 {
+		return b, errors.New("no bridge address")
+	}
+	addrPort, err := netip.ParseAddrPort(fields[0])
+	if err != nil {
+		return b, err
+	}
+	b.addrPort = netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port())
+
+	for _, f := range fields[1:] {
+		key, value, ok := strings.Cut(f, "=")
+		if !ok || key != "cert" {
+			// The fingerprint and iat-mode don't change the handshake.
+			continue
+		}
+		raw, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(value, "="))
+		if err != nil || len(raw) != obfs4NodeIDLength+obfs4PublicKeyLength {
+			return b, fmt.Errorf("invalid cert %q", value)
+		}
+		b.nodeID, b.pubKey = raw[:obfs4NodeIDLength], raw[obfs4NodeIDLength:]
+	}
+	if b.nodeID == nil {
+		return b, errors.New("no cert")
+	}
+	return b, nil
+}
+
+func (b obfs4Bridge) String() string {
+	return b.addrPort.String()
+}
+
+// mac returns the truncated HMAC of the parts, keyed with the bridge's
+// public key and node ID as the handshake is.
+func (b obfs4Bridge) mac(parts ...[]byte) []byte {
+	h := hmac.New(sha256.New, append(append([]byte{}, b.pubKey...), b.nodeID...))
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)[:obfs4MarkLength]
+}
+
+// obfs4ClientHandshake returns a client handshake for the bridge, with the
+// hour since the epoch it's for. The representative of the client's key
+// is random: the bridge can't tell, and answers without checking it, but
+// it means the session keys can't be derived, so the handshake only shows
+// that the bridge is reachable and answers as obfs4.
+func obfs4ClientHandshake(b obfs4Bridge) ([]byte, string, error) {
+	repr := make([]byte, obfs4RepresentativeLength)
+	if _, err := rand.Read(repr); err != nil {
+		return nil, "", err
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(obfs4ClientMaxPadLength-obfs4ClientMinPadLength+1))
+	if err != nil {
+		return nil, "", err
+	}
+	pad := make([]byte, obfs4ClientMinPadLength+int(n.Int64()))
+	if _, err := rand.Read(pad); err != nil {
+		return nil, "", err
+	}
+	epochHour := strconv.FormatInt(time.Now().Unix()/3600, 10)
+
+	var buf bytes.Buffer
+	buf.Write(repr)
+	buf.Write(pad)
+	buf.Write(b.mac(repr))
+	buf.Write(b.mac(buf.Bytes(), []byte(epochHour)))
+	return buf.Bytes(), epochHour, nil
+}
+
+// readObfs4ServerHandshake reads the bridge's answer to a client handshake
+// for epochHour, until its mark and MAC check out.
+func readObfs4ServerHandshake(r io.Reader, b obfs4Bridge, epochHour string) error {
+	var resp []byte
+	buf := make([]byte, 4096)
+	for {
+		n, err := r.Read(buf)
+		resp = append(resp, buf[:n]...)
+		if len(resp) >= obfs4RepresentativeLength+obfs4AuthLength+obfs4MarkLength+obfs4MACLength {
+			mark := b.mac(resp[:obfs4RepresentativeLength])
+			start := obfs4RepresentativeLength + obfs4AuthLength
+			if i := bytes.Index(resp[start:min(len(resp), obfs4MaxHandshakeLength)], mark); i >= 0 {
+				pos := start + i + obfs4MarkLength
+				if len(resp) >= pos+obfs4MACLength {
+					if !hmac.Equal(resp[pos:pos+obfs4MACLength], b.mac(resp[:pos], []byte(epochHour))) {
+						return errors.New("invalid server MAC, the cert may be wrong")
+					}
+					return nil
+				}
+			}
+		}
+		if len(resp) > obfs4MaxHandshakeLength {
+			return errors.New("no server handshake, the bridge may be something else")
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// obfs4Label is the label of the obfs4 tests, whatever the bridge.
+const obfs4Label = "obfs4 - TCP"
+
+// runObfs4 runs the obfs4 test against each of the bridges in turn, and
+// returns their results.
+func runObfs4(ctx context.Context, l *slog.Logger, to TestOptions) ([]TestResult, error) {
+	var results []TestResult
+	for _, b := range to.Obfs4Bridges {
+		bto := to
+		bto.SNI, bto.Host = "", ""
+		bto.ManualIPs = []netip.Addr{b.addrPort.Addr()}
+		bto.Port = b.addrPort.Port()
+		bto.ResolveEveryAttempt = false
+		// A bridge ignores the SNI, so controls changing it tell nothing.
+		bto.FailureControls = false
+		l.Info("testing obfs4 bridge", "bridge", b)
+		res, _, err := runCases(ctx, l, bto, []testCase{{fn: test_TCP_obfs4(b), label: obfs4Label}})
+		results = append(results, res[obfs4Label]...)
+		if err != nil {
+			return results, err
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// Values of the custom test ocsp setting.
+const (
+	ocspOff    = ""
+	ocspStaple = "staple" // request a stapled OCSP response and report it
+	ocspLive   = "live"   // also ask the CA whether the certificate is revoked
+)
+
+// revocationTimeout bounds each request of a live revocation check.
+const revocationTimeout = 10 * time.Second
+
+// ocspStatusName names the status of an OCSP response.
+func ocspStatusName(status int) string {
+	switch status {
+	case ocsp.Good:
+		return "good"
+	case ocsp.Revoked:
+		return "revoked"
+	}
+	return "unknown"
+}
+
+// stapleStatus describes the OCSP response stapled for the leaf of certs:
+// "none" if the server sent none, its status, or why it's invalid. Without
+// the issuer in certs, the staple's signature can't be checked.
+func stapleStatus(staple []byte, certs []*x509.Certificate) string {
+	if len(staple) == 0 {
+		return "none"
+	}
+	if len(certs) < 2 {
+		resp, err := ocsp.ParseResponse(staple, nil)
+		if err != nil {
+			return "invalid: " + err.Error()
+		}
+		return ocspStatusName(resp.Status) + " (unverified)"
+	}
+	resp, err := ocsp.ParseResponseForCert(staple, certs[0], certs[1])
+	if err != nil {
+		return "invalid: " + err.Error()
+	}
+	if time.Now().After(resp.NextUpdate) && !resp.NextUpdate.IsZero() {
+		return ocspStatusName(resp.Status) + " (expired)"
+	}
+	return ocspStatusName(resp.Status)
+}
+
+// checkRevocation asks the CA whether the leaf of certs is revoked, over
+// OCSP if it has a responder, or else by fetching its CRL. It returns the
+// status and where it's from, or why it couldn't be checked.
+func checkRevocation(ctx context.Context, certs []*x509.Certificate) string {
+	if len(certs) < 2 {
+		return "unchecked: server sent no issuer certificate"
+	}
+	leaf, issuer := certs[0], certs[1]
+
+	var errs []error
+	if len(leaf.OCSPServer) > 0 {
+		status, err := liveOCSP(ctx, leaf, issuer)
+		if err == nil {
+			return status + " (OCSP)"
+		}
+		errs = append(errs, fmt.Errorf("OCSP: %w", err))
+	}
+	if len(leaf.CRLDistributionPoints) > 0 {
+		status, err := liveCRL(ctx, leaf, issuer)
+		if err == nil {
+			return status + " (CRL)"
+		}
+		errs = append(errs, fmt.Errorf("CRL: %w", err))
+	}
+	if len(errs) == 0 {
+		return "unchecked: certificate has no OCSP responder or CRL"
+	}
+	return "unchecked: " + errors.Join(errs...).Error()
+}
+
+// liveOCSP asks the leaf's OCSP responder for its status.
+func liveOCSP(ctx context.Context, leaf, issuer *x509.Certificate) (string, error) {
+	req, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return "", err
+	}
+	body, err := revocationFetch(ctx, http.MethodPost, leaf.OCSPServer[0], req)
+	if err != nil {
+		return "", err
+	}
+	resp, err := ocsp.ParseResponseForCert(body, leaf, issuer)
+	if err != nil {
+		return "", err
+	}
+	return ocspStatusName(resp.Status), nil
+}
+
+// liveCRL fetches the leaf's CRL and looks for it there.
+func liveCRL(ctx context.Context, leaf, issuer *x509.Certificate) (string, error) {
+	body, err := revocationFetch(ctx, http.MethodGet, leaf.CRLDistributionPoints[0], nil)
+	if err != nil {
+		return "", err
+	}
+	crl, err := x509.ParseRevocationList(body)
+	if err != nil {
+		return "", err
+	}
+	if err := crl.CheckSignatureFrom(issuer); err != nil {
+		return "", err
+	}
+	for _, entry := range crl.RevokedCertificateEntries {
+		if entry.SerialNumber.Cmp(leaf.SerialNumber) == 0 {
+			return "revoked", nil
+		}
+	}
+	return "good", nil
+}
+
+// revocationFetch makes an HTTP request to a CA's OCSP responder or CRL
+// distribution point and returns the response body.
+func revocationFetch(ctx context.Context, method, url string, body []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, revocationTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if method == http.MethodPost {
+		req.Header.Set("Content-Type", "application/ocsp-request")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	// CRLs of big CAs run to tens of megabytes.
+	return io.ReadAll(io.LimitReader(resp.Body, 64<<20))
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Valid values for the --output flag.
+var outputFormats = []string{"json", "csv", "junit", "influx", "statsd"}
+
+// attemptRecord is one attempt of one test against one target, as written
+// by --output, with raw timings rather than the tables' averages.
+type attemptRecord struct {
+	Test            string    `json:"test"`
+	SNI             string    `json:"sni"`
+	AddrPort        string    `json:"addr_port"`
+	Attempt         int       `json:"attempt"`
+	Time            time.Time `json:"time"`
+	Success         bool      `json:"success"`
+	ErrorClass      string    `json:"error_class,omitempty"`
+	ErrorCode       string    `json:"error_code,omitempty"`
+	Error           string    `json:"error,omitempty"`
+	TLSAlert        *uint8    `json:"tls_alert,omitempty"`
+	Errno           int       `json:"errno,omitempty"`
+	DNSMs           float64   `json:"dns_ms"`
+	SetupMs         float64   `json:"setup_ms"`
+	TransportMs     float64   `json:"transport_ms"`
+	TLSMs           float64   `json:"tls_ms"`
+	TTFBMs          float64   `json:"ttfb_ms,omitempty"`
+	RetryMs         float64   `json:"retry_ms,omitempty"`
+	RSTMs           float64   `json:"rst_ms,omitempty"`
+	Retries         int       `json:"retries"`
+	CertError       string    `json:"cert_error,omitempty"`
+	OCSPStaple      string    `json:"ocsp_staple,omitempty"`
+	Revocation      string    `json:"revocation,omitempty"`
+	CertCompression string    `json:"cert_compression,omitempty"`
+	PublicIP        string    `json:"public_ip,omitempty"`
+	ASN             int       `json:"asn,omitempty"`
+	Country         string    `json:"country,omitempty"`
+	*tcpRecord
+	*negotiatedRecord
+	*wireRecord
+	*failureControlRecord
+	*runRecord
+}
+
+// tcpRecord is the TCP_INFO of an attempt's connection, left out where the
+// kernel doesn't offer it.
+type tcpRecord struct {
+	TCPRTTMs       float64 `json:"tcp_rtt_ms"`
+	TCPRetransmits int     `json:"tcp_retransmits"`
+	TCPReset       bool    `json:"tcp_reset"`
+}
+
+// negotiatedRecord is the TLS parameters of a successful attempt.
+type negotiatedRecord struct {
+	TLSVersion  string `json:"tls_version"`
+	CipherSuite string `json:"cipher_suite"`
+	ALPN        string `json:"alpn,omitempty"`
+	Group       string `json:"group,omitempty"`
+}
+
+// wireRecord is what an attempt wrote and read on its connection.
+type wireRecord struct {
+	BytesSent     int               `json:"bytes_sent"`
+	BytesReceived int               `json:"bytes_received"`
+	Writes        []wireWriteRecord `json:"writes"`
+}
+
+type wireWriteRecord struct {
+	Size int     `json:"size"`
+	Ms   float64 `json:"ms"`
+}
+
+// runRecord is the run an attempt was part of.
+type runRecord struct {
+	RunID    string     `json:"run_id"`
+	RunStart time.Time  `json:"run_start"`
+	RunEnd   *time.Time `json:"run_end,omitempty"`
+	Version  string     `json:"version"`
+	OS       string     `json:"os"`
+	Labels   []string   `json:"labels,omitempty"`
+}
+
+// failureControlRecord is how the controls after a failed attempt fared.
+type failureControlRecord struct {
+	ControlSameIP  bool   `json:"control_same_ip"`
+	ControlAddr    string `json:"control_addr,omitempty"`
+	ControlSameSNI *bool  `json:"control_same_sni,omitempty"`
+	ControlCause   string `json:"control_cause"`
+}
+
+var attemptRecordHeader = []string{"test", "sni", "addr_port", "attempt", "time", "success", "error_class", "error_code", "error", "tls_alert", "errno", "dns_ms", "setup_ms", "transport_ms", "tls_ms", "ttfb_ms", "retry_ms", "rst_ms", "retries", "cert_error", "ocsp_staple", "revocation", "cert_compression", "public_ip", "asn", "country", "tcp_rtt_ms", "tcp_retransmits", "tcp_reset", "tls_version", "cipher_suite", "alpn", "group", "bytes_sent", "bytes_received", "writes", "control_same_ip", "control_same_sni", "control_cause", "run_id", "run_start", "run_end", "version", "os", "labels"}
+
+func (r attemptRecord) csv() []string {
+	ms := func(v float64) string { return strconv.FormatFloat(v, 'f', -1, 64) }
+	var asn, alert, errno, rtt, retransmits, reset string
+	var n negotiatedRecord
+	var sent, received, writes string
+	var sameIP, sameSNI, cause string
+	var run runRecord
+	var runStart, runEnd string
+	if r.ASN != 0 {
+		asn = strconv.Itoa(r.ASN)
+	}
+	if r.TLSAlert != nil {
+		alert = strconv.Itoa(int(*r.TLSAlert))
+	}
+	if r.Errno != 0 {
+		errno = strconv.Itoa(r.Errno)
+	}
+	if t := r.tcpRecord; t != nil {
+		rtt, retransmits, reset = ms(t.TCPRTTMs), strconv.Itoa(t.TCPRetransmits), strconv.FormatBool(t.TCPReset)
+	}
+	if r.negotiatedRecord != nil {
+		n = *r.negotiatedRecord
+	}
+	if w := r.wireRecord; w != nil {
+		sent, received = strconv.Itoa(w.BytesSent), strconv.Itoa(w.BytesReceived)
+		// Each write as size@ms, in order.
+		sizes := make([]string, len(w.Writes))
+		for i, ww := range w.Writes {
+			sizes[i] = strconv.Itoa(ww.Size) + "@" + ms(ww.Ms)
+		}
+		writes = strings.Join(sizes, " ")
+	}
+	if c := r.failureControlRecord; c != nil {
+		sameIP, cause = strconv.FormatBool(c.ControlSameIP), c.ControlCause
+		if c.ControlSameSNI != nil {
+			sameSNI = strconv.FormatBool(*c.ControlSameSNI)
+		}
+	}
+	if r.runRecord != nil {
+		run = *r.runRecord
+		runStart = run.RunStart.Format(time.RFC3339Nano)
+		if run.RunEnd != nil {
+			runEnd = run.RunEnd.Format(time.RFC3339Nano)
+		}
+	}
+	return []string{
+		r.Test,
+		r.SNI,
+		r.AddrPort,
+		strconv.Itoa(r.Attempt),
+		r.Time.Format(time.RFC3339Nano),
+		strconv.FormatBool(r.Success),
+		r.ErrorClass,
+		r.ErrorCode,
+		r.Error,
+		alert,
+		errno,
+		ms(r.DNSMs),
+		ms(r.SetupMs),
+		ms(r.TransportMs),
+		ms(r.TLSMs),
+		ms(r.TTFBMs),
+		ms(r.RetryMs),
+		ms(r.RSTMs),
+		strconv.Itoa(r.Retries),
+		r.CertError,
+		r.OCSPStaple,
+		r.Revocation,
+		r.CertCompression,
+		r.PublicIP,
+		asn,
+		r.Country,
+		rtt,
+		retransmits,
+		reset,
+		n.TLSVersion,
+		n.CipherSuite,
+		n.ALPN,
+		n.Group,
+		sent,
+		received,
+		writes,
+		sameIP,
+		sameSNI,
+		cause,
+		run.RunID,
+		runStart,
+		runEnd,
+		run.Version,
+		run.OS,
+		strings.Join(run.Labels, " "),
+	}
+}
+
+// attemptRecords flattens the results into one record per attempt, in the
+// order the tests ran, with the network they ran from if known and the run
+// they were part of, if any.
+func attemptRecords(results map[string][]TestResult, order []string, ni *networkInfo, run *runInfo) []attemptRecord {
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+
+	var rr *runRecord
+	if run != nil {
+		rr = &runRecord{RunID: run.ID, RunStart: run.Start, Version: run.Version, OS: run.OS, Labels: run.Labels}
+		if !run.End.IsZero() {
+			rr.RunEnd = &run.End
+		}
+	}
+
+	var records []attemptRecord
+	for _, testName := range order {
+		for _, tr := range results[testName] {
+			for i, attempt := range tr.Attempts {
+				r := attemptRecord{
+					Test:            testName,
+					SNI:             tr.SNI,
+					AddrPort:        tr.AddrPort.String(),
+					Attempt:         i + 1,
+					Time:            attempt.Start,
+					Success:         attempt.Err == nil,
+					DNSMs:           ms(attempt.DNSDuration),
+					SetupMs:         ms(attempt.SetupDuration),
+					TransportMs:     ms(attempt.TransportEstablishDuration),
+					TLSMs:           ms(attempt.TLSHandshakeDuration),
+					TTFBMs:          ms(attempt.TTFBDuration),
+					RetryMs:         ms(attempt.RetryDuration),
+					RSTMs:           ms(attempt.TimeToRST),
+					Retries:         attempt.Retries,
+					OCSPStaple:      attempt.OCSPStaple,
+					Revocation:      attempt.Revocation,
+					CertCompression: attempt.CertCompression,
+				}
+				if attempt.AddrPort.IsValid() {
+					r.AddrPort = attempt.AddrPort.String()
+				}
+				if e := attempt.Err; e != nil {
+					r.ErrorClass, r.Error, r.Errno = string(e.Class), e.Error(), int(e.Errno)
+					r.ErrorCode = e.Code(attempt.TransportEstablishDuration > 0)
+					if e.Class == ErrorClassTLSAlert {
+						r.TLSAlert = &e.Alert
+					}
+				}
+				if attempt.CertError != nil {
+					r.CertError = attempt.CertError.Error()
+				}
+				if t := attempt.TCPInfo; t != nil {
+					r.tcpRecord = &tcpRecord{
+						TCPRTTMs:       ms(t.RTT),
+						TCPRetransmits: t.Retransmits,
+						TCPReset:       t.Closed && attempt.TransportEstablishDuration > 0,
+					}
+				}
+				if n := attempt.Negotiated; n != nil && attempt.Err == nil {
+					r.negotiatedRecord = &negotiatedRecord{
+						TLSVersion:  n.Version,
+						CipherSuite: n.CipherSuite,
+						ALPN:        n.ALPN,
+						Group:       n.Group,
+					}
+				}
+				if w := attempt.Wire; w != nil {
+					r.wireRecord = &wireRecord{BytesSent: w.BytesSent, BytesReceived: w.BytesReceived}
+					for _, ww := range w.Writes {
+						r.wireRecord.Writes = append(r.wireRecord.Writes, wireWriteRecord{Size: ww.Size, Ms: ms(ww.At)})
+					}
+				}
+				if fc := attempt.FailureControl; fc != nil {
+					r.failureControlRecord = &failureControlRecord{ControlSameIP: fc.SameIPReached, ControlCause: fc.Cause()}
+					if fc.ControlAddr.IsValid() {
+						r.failureControlRecord.ControlAddr = fc.ControlAddr.String()
+						r.failureControlRecord.ControlSameSNI = &fc.SameSNIReached
+					}
+				}
+				if ni != nil {
+					r.PublicIP, r.ASN, r.Country = ni.PublicIP.String(), ni.ASN, ni.Country
+				}
+				r.runRecord = rr
+				records = append(records, r)
+			}
+		}
+	}
+	return records
+}
+
+// attemptWriter writes attempt records in an --output format, flushing
+// them as it goes so they can be read while the tests run.
+type attemptWriter struct {
+	json *json.Encoder
+	csv  *csv.Writer
+	// lines formats a record for the line based metrics formats, which
+	// are written to w.
+	lines func(attemptRecord) []string
+	w     io.Writer
+}
+
+// newAttemptWriter returns an attemptWriter writing format to w, starting
+// with the header for CSV.
+func newAttemptWriter(w io.Writer, format string) (*attemptWriter, error) {
+	switch format {
+	case "json":
+		return &attemptWriter{json: json.NewEncoder(w)}, nil
+	case "csv":
+		aw := &attemptWriter{csv: csv.NewWriter(w)}
+		aw.csv.Write(attemptRecordHeader)
+		return aw, nil
+	case "influx":
+		return &attemptWriter{lines: func(r attemptRecord) []string { return []string{influxLine(r)} }, w: w}, nil
+	case "statsd":
+		return &attemptWriter{lines: statsdLines, w: w}, nil
+	default:
+		return nil, fmt.Errorf("unknown output format %q (valid values: %s)", format, strings.Join(outputFormats, ", "))
+	}
+}
+
+func (aw *attemptWriter) write(records []attemptRecord) error {
+	if aw.json != nil {
+		for _, r := range records {
+			if err := aw.json.Encode(r); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if aw.lines != nil {
+		var b strings.Builder
+		for _, r := range records {
+			for _, line := range aw.lines(r) {
+				b.WriteString(line)
+				b.WriteByte('\n')
+			}
+		}
+		_, err := io.WriteString(aw.w, b.String())
+		return err
+	}
+	for _, r := range records {
+		aw.csv.Write(r.csv())
+	}
+	aw.csv.Flush()
+	return aw.csv.Error()
+}
+
+// writeOutput writes every attempt to w in format, JSON lines, CSV or
+// InfluxDB line protocol or statsd metrics, or the results as JUnit XML.
+func writeOutput(w io.Writer, format string, results map[string][]TestResult, order []string, ni *networkInfo, run *runInfo) error {
+	if format == "junit" {
+		return writeJUnit(w, results, order, ni, run)
+	}
+	aw, err := newAttemptWriter(w, format)
+	if err != nil {
+		return err
+	}
+	return aw.write(attemptRecords(results, order, ni, run))
+}
+
+// writeOutputTo writes every attempt to the file at path, or to stdout if
+// path is empty.
+func writeOutputTo(path, format string, results map[string][]TestResult, order []string, ni *networkInfo, run *runInfo) error {
+	if path == "" {
+		return writeOutput(os.Stdout, format, results, order, ni, run)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := writeOutput(f, format, results, order, ni, run); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// testID turns a test label into a single word for scripts, e.g.
+// "bepass-fragment-tcp-tls-1.3-utls-chromeauto".
+func testID(label string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(label) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '.' {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+	return b.String()
+}
+
+// printBest writes one line for scripts to w: the ID of the best test, the
+// target it did best against and its average connection latency (transport
+// and TLS handshake) in milliseconds, e.g.
+//
+//	default-tcp-tls-1.3 104.244.42.1:443 87.3
+func printBest(w io.Writer, results map[string][]TestResult, suite []testCase) error {
+	tc, ok := bestTest(results, suite, nil)
+	if !ok {
+		return errors.New("no test succeeded")
+	}
+
+	// Of the targets, prefer the one with the most successes, then the
+	// fastest.
+	var (
+		best        TestResult
+		bestSuccess int
+		bestLatency time.Duration
+	)
+	for _, tr := range results[tc.label] {
+		var (
+			success int
+			total   time.Duration
+		)
+		for _, attempt := range tr.Attempts {
+			if attempt.Err == nil {
+				success++
+				total += attempt.TransportEstablishDuration + attempt.TLSHandshakeDuration
+			}
+		}
+		if success == 0 {
+			continue
+		}
+		latency := total / time.Duration(success)
+		if success > bestSuccess || (success == bestSuccess && latency < bestLatency) {
+			best, bestSuccess, bestLatency = tr, success, latency
+		}
+	}
+
+	_, err := fmt.Fprintf(w, "%s %s %.1f\n", testID(tc.label), best.AddrPort, float64(bestLatency)/float64(time.Millisecond))
+	return err
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// pacer spaces out connection attempts evenly, so that large runs don't
+// trigger rate based blocking or SYN flood protections themselves.
+type pacer struct {
+	interval time.Duration
+
+	mu   sync.Mutex
+	next time.Time // when the next attempt may start
+}
+
+// newPacer returns a pacer allowing perMinute attempts a minute, or nil,
+// which doesn't pace at all, if perMinute is 0.
+func newPacer(perMinute uint) *pacer {
+	if perMinute == 0 {
+		return nil
+	}
+	return &pacer{interval: time.Minute / time.Duration(perMinute)}
+}
+
+// wait blocks until the next attempt may start, or until ctx is done.
+func (p *pacer) wait(ctx context.Context) error {
+	if p == nil {
+		return nil
+	}
+
+	p.mu.Lock()
+	now := time.Now()
+	at := now
+	if p.next.After(now) {
+		at = p.next
+	}
+	p.next = at.Add(p.interval)
+	p.mu.Unlock()
+	return sleep(ctx, at.Sub(now))
+}
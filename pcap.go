@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// pcapngMagic starts the section header block of a pcapng file.
+var pcapngMagic = []byte{0x0a, 0x0d, 0x0d, 0x0a}
+
+// packetReader is what pcapgo's pcap and pcapng readers have in common.
+type packetReader interface {
+	gopacket.PacketDataSource
+	LinkType() layers.LinkType
+}
+
+// tcpFlow is one direction of a TCP connection.
+type tcpFlow struct {
+	net, transport gopacket.Flow
+}
+
+// tcpStream collects the payload of a flow from the first segment of a
+// ClientHello on, in sequence order.
+type tcpStream struct {
+	seq      uint32 // sequence number of data[0]
+	data     []byte
+	segments map[uint32][]byte // out of order segments by sequence number
+}
+
+// add adds a segment, and returns whether the stream has a whole TLS
+// record.
+func (s *tcpStream) add(seq uint32, payload []byte) bool {
+	if !s.merge(seq, payload) {
+		s.segments[seq] = bytes.Clone(payload)
+	}
+	// Fill in from the segments that arrived early.
+	for merged := true; merged; {
+		merged = false
+		for seq, payload := range s.segments {
+			if s.merge(seq, payload) {
+				delete(s.segments, seq)
+				merged = true
+			}
+		}
+	}
+	return len(s.data) >= 5 && len(s.data) >= 5+(int(s.data[3])<<8|int(s.data[4]))
+}
+
+// merge appends the part of a segment that isn't in data yet, and returns
+// false if it starts after the end of data.
+func (s *tcpStream) merge(seq uint32, payload []byte) bool {
+	off := int32(seq - s.seq) // wraps around with the sequence numbers
+	if off < 0 {
+		// Data from before the ClientHello.
+		return true
+	}
+	if int(off) > len(s.data) {
+		return false
+	}
+	// Skip what was already received, retransmissions overlap.
+	if end := int(off) + len(payload); end > len(s.data) {
+		s.data = append(s.data, payload[len(s.data)-int(off):]...)
+	}
+	return true
+}
+
+// readPcapClientHello returns the first TLS ClientHello record sent over
+// TCP in the pcap or pcapng file at path, reassembled if it spans several
+// segments.
+func readPcapClientHello(path string, l *slog.Logger) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	magic, err := br.Peek(4)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read capture: %w", err)
+	}
+	var r packetReader
+	if bytes.Equal(magic, pcapngMagic) {
+		l.Debug("reading pcapng capture", "path", path)
+		r, err = pcapgo.NewNgReader(br, pcapgo.DefaultNgReaderOptions)
+	} else {
+		l.Debug("reading pcap capture", "path", path)
+		r, err = pcapgo.NewReader(br)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read capture: %w", err)
+	}
+
+	streams := make(map[tcpFlow]*tcpStream)
+	src := gopacket.NewPacketSource(r, r.LinkType())
+	src.DecodeOptions = gopacket.DecodeOptions{Lazy: true, NoCopy: true}
+	for n := 1; ; n++ {
+		packet, err := src.NextPacket()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			l.Debug("skipping undecodable packet", "packet", n, "error", err)
+			continue
+		}
+		tcp, ok := packet.TransportLayer().(*layers.TCP)
+		if !ok || len(tcp.Payload) == 0 {
+			continue
+		}
+		flow := tcpFlow{packet.NetworkLayer().NetworkFlow(), tcp.TransportFlow()}
+		s, ok := streams[flow]
+		if !ok {
+			// A record of handshake type, holding a ClientHello.
+			p := tcp.Payload
+			if len(p) < 6 || p[0] != 22 || p[1] != 3 || p[5] != 1 {
+				continue
+			}
+			l.Debug("found start of ClientHello", "packet", n, "flow", fmt.Sprint(flow.net, " ", flow.transport))
+			s = &tcpStream{seq: tcp.Seq, segments: make(map[uint32][]byte)}
+			streams[flow] = s
+		}
+		if s.add(tcp.Seq, tcp.Payload) {
+			size := 5 + (int(s.data[3])<<8 | int(s.data[4]))
+			l.Debug("reassembled ClientHello", "packet", n, "size", size)
+			return s.data[:size], nil
+		}
+	}
+
+	if len(streams) > 0 {
+		return nil, errors.New("capture ends before the ClientHello does")
+	}
+	return nil, errors.New("no TLS ClientHello over TCP found in capture")
+}
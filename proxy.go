@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// parseProxyURL parses the URL of a SOCKS5 or HTTP CONNECT proxy.
+func parseProxyURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h", "http":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q (must be socks5 or http)", u.Scheme)
+	}
+	if u.Port() == "" {
+		return nil, fmt.Errorf("proxy %q has no port", u.Redacted())
+	}
+	return u, nil
+}
+
+// dialProxy connects to target through the proxy at u, using d to reach
+// the proxy.
+func dialProxy(ctx context.Context, d *net.Dialer, u *url.URL, target string) (net.Conn, error) {
+	if u.Scheme == "http" {
+		return dialHTTPConnect(ctx, d, u, target)
+	}
+
+	var auth *proxy.Auth
+	if u.User != nil {
+		password, _ := u.User.Password()
+		auth = &proxy.Auth{User: u.User.Username(), Password: password}
+	}
+	p, err := proxy.SOCKS5("tcp", u.Host, auth, d)
+	if err != nil {
+		return nil, err
+	}
+	return p.(proxy.ContextDialer).DialContext(ctx, "tcp", target)
+}
+
+// dialHTTPConnect opens a tunnel to target with an HTTP CONNECT request.
+func dialHTTPConnect(ctx context.Context, d *net.Dialer, u *url.URL, target string) (net.Conn, error) {
+	conn, err := d.DialContext(ctx, "tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: target},
+		Host:   target,
+		Header: make(http.Header),
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		req.SetBasicAuth(u.User.Username(), password)
+		req.Header["Proxy-Authorization"] = req.Header["Authorization"]
+		req.Header.Del("Authorization")
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy refused CONNECT: %s", resp.Status)
+	}
+	if br.Buffered() > 0 {
+		conn.Close()
+		return nil, errors.New("proxy sent data before the tunnel was used")
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// quickTests are the tests of --quick, enough to tell apart IP blocking,
+// SNI filtering that fragmenting gets around, and QUIC blocking. The TCP
+// connect of the Default test is timed on its own, so it tells whether TCP
+// gets through too.
+var quickTests = []string{
+	testID("Default - TCP - TLS 1.3"),
+	testID("Bepass Fragment - TCP - TLS 1.3 - uTLS ChromeAuto"),
+	testID("Default - QUIC - TLS 1.3 - uQUIC Chrome"),
+}
+
+// quickTimeout bounds the TCP connect and the TLS handshake of --quick's
+// attempts each, unless set.
+const quickTimeout = 3 * time.Second
+
+// quickGap is the pause between the tests of --quick, which has no repeats
+// for blocking left behind to skew.
+const quickGap = 500 * time.Millisecond
+
+// printVerdict prints what the results of --quick suggest.
+func printVerdict(results map[string][]TestResult, order []string, control *controlResult) {
+	fmt.Println("Verdict:")
+	switch findings := explainFindings(results, order); {
+	case control != nil && !control.ok():
+		fmt.Println("- The control host failed too, so this looks like a local connectivity problem rather than censorship.")
+	case len(findings) == 0:
+		fmt.Println("- Nothing conclusive, run without --quick for the whole suite.")
+	default:
+		for _, finding := range findings {
+			fmt.Printf("- %s\n", finding)
+		}
+	}
+	fmt.Println("")
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	quic "github.com/refraction-networking/uquic"
+	"github.com/refraction-networking/uquic/logging"
+)
+
+// retryTracer records when a QUIC connection gets a Retry packet from the
+// server, which costs the handshake a round trip before it can start.
+type retryTracer struct {
+	mu sync.Mutex
+	at time.Time
+}
+
+// config returns conf tracing Retry packets into rt.
+func (rt *retryTracer) config(conf *quic.Config) *quic.Config {
+	conf.Tracer = func(context.Context, logging.Perspective, quic.ConnectionID) *logging.ConnectionTracer {
+		return &logging.ConnectionTracer{
+			ReceivedRetry: func(*logging.Header) {
+				rt.mu.Lock()
+				defer rt.mu.Unlock()
+				if rt.at.IsZero() {
+					rt.at = time.Now()
+				}
+			},
+		}
+	}
+	return conf
+}
+
+// since returns how long after t0, when the dial started, the Retry came,
+// which is what it added to the handshake, or zero without a Retry.
+func (rt *retryTracer) since(t0 time.Time) time.Duration {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if rt.at.IsZero() {
+		return 0
+	}
+	return rt.at.Sub(t0)
+}
@@ -0,0 +1,224 @@
+// Package quicsplit splits the ClientHello carried by the first QUIC
+// Initial packet of a connection across several Initial packets.
+//
+// DPI engines that extract the SNI from QUIC decrypt the first Initial
+// packet they see, which anyone can do since its keys only depend on the
+// connection ID, and often expect the whole ClientHello in it. Servers, on
+// the other hand, reassemble the CRYPTO stream from as many packets as it
+// takes.
+//
+// Since the QUIC stack doesn't know about the extra packets, the packet
+// numbers of its later Initial packets, and the ACKs the server sends for
+// them, are rewritten to match. Connections that get a Retry from the
+// server are left alone after it, as their Initial keys change.
+package quicsplit
+
+import (
+	"bytes"
+	"log/slog"
+	"net"
+	"sync"
+)
+
+// minDatagram is the smallest datagram a server accepts an Initial in.
+const minDatagram = 1200
+
+// PacketConn is a net.PacketConn that splits the first Initial packet it
+// sends.
+type PacketConn struct {
+	net.PacketConn
+	// Coalesce sends the Initial packets the ClientHello is split into in a
+	// single datagram, instead of one datagram each.
+	Coalesce bool
+
+	host   string
+	logger *slog.Logger
+
+	mu         sync.Mutex
+	split      bool   // the first Initial has been split
+	firstPN    uint64 // packet number of the first Initial
+	shift      uint64 // packet numbers added by the split
+	dcid       []byte // DCID of the first Initial, which the keys derive from
+	nextClient uint64 // next packet number expected from the QUIC stack
+	nextServer uint64 // next packet number expected from the server
+}
+
+// Wrap returns a PacketConn that splits the ClientHello in the middle of
+// host, or in the middle if it does not contain host.
+func Wrap(conn net.PacketConn, host string, logger *slog.Logger) *PacketConn {
+	return &PacketConn{
+		PacketConn: conn,
+		host:       host,
+		logger:     logger,
+	}
+}
+
+// WriteTo writes a datagram, splitting it if it carries the first Initial
+// packet. Datagrams that can't be parsed are sent as is.
+func (c *PacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	datagrams, err := c.rewriteOutgoing(b)
+	if err != nil {
+		c.logger.Debug("quicsplit: sending datagram unchanged", "error", err)
+		return c.PacketConn.WriteTo(b, addr)
+	}
+	for _, d := range datagrams {
+		if _, err := c.PacketConn.WriteTo(d, addr); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// ReadFrom reads a datagram, fixing up the ACKs in the server's Initial
+// packets to match the packet numbers the QUIC stack knows about.
+func (c *PacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	if err != nil {
+		return n, addr, err
+	}
+	if rewritten, err := c.rewriteIncoming(b[:n]); err != nil {
+		c.logger.Debug("quicsplit: passing datagram unchanged", "error", err)
+	} else if len(rewritten) <= len(b) {
+		n = copy(b, rewritten)
+	}
+	return n, addr, nil
+}
+
+func (c *PacketConn) rewriteOutgoing(b []byte) ([][]byte, error) {
+	if !isInitial(b) {
+		return [][]byte{b}, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// The Initial keys stay the same when the client switches to the
+	// connection ID picked by the server.
+	if c.dcid == nil {
+		dcid, err := parseDCID(b)
+		if err != nil {
+			return nil, err
+		}
+		c.dcid = bytes.Clone(dcid)
+	}
+	k, err := initialKeys(c.dcid, "client in")
+	if err != nil {
+		return nil, err
+	}
+
+	p, rest, err := openInitial(b, k, c.nextClient)
+	if err != nil {
+		return nil, err
+	}
+	c.nextClient = p.pn + 1
+
+	if c.split {
+		if p.pn > c.firstPN {
+			p.pn += c.shift
+		}
+		return [][]byte{append(p.seal(k), rest...)}, nil
+	}
+
+	data, err := cryptoData(p.payload)
+	if err != nil {
+		return nil, err
+	}
+	cut := len(data) / 2
+	if i := bytes.Index(data, []byte(c.host)); c.host != "" && i >= 0 {
+		cut = i + len(c.host)/2
+	}
+	pieces := [][]byte{data[:cut], data[cut:]}
+
+	c.split, c.firstPN, c.shift = true, p.pn, uint64(len(pieces)-1)
+	c.logger.Debug("quicsplit: splitting first Initial",
+		"packet_number", p.pn,
+		"crypto_length", len(data),
+		"cut", cut,
+		"coalesce", c.Coalesce)
+
+	var (
+		datagrams [][]byte
+		offset    int
+	)
+	for i, piece := range pieces {
+		q := *p
+		q.pn = p.pn + uint64(i)
+		q.payload = appendCrypto(nil, uint64(offset), piece)
+		offset += len(piece)
+
+		// Each datagram carrying an Initial has to be padded, or only the
+		// last one when they are coalesced.
+		size := q.overhead(k) + len(q.payload)
+		if c.Coalesce && len(datagrams) > 0 {
+			size += len(datagrams[0])
+		}
+		if !c.Coalesce || i == len(pieces)-1 {
+			q.payload = append(q.payload, make([]byte, max(minDatagram-size, 0))...)
+		}
+
+		sealed := q.seal(k)
+		if c.Coalesce && len(datagrams) > 0 {
+			datagrams[0] = append(datagrams[0], sealed...)
+		} else {
+			datagrams = append(datagrams, sealed)
+		}
+	}
+
+	// Keep whatever was coalesced after the Initial, unless it is padding.
+	if bytes.ContainsFunc(rest, func(r rune) bool { return r != 0 }) {
+		last := len(datagrams) - 1
+		datagrams[last] = append(datagrams[last], rest...)
+	}
+	return datagrams, nil
+}
+
+func (c *PacketConn) rewriteIncoming(b []byte) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.split || !isInitial(b) {
+		return b, nil
+	}
+	k, err := initialKeys(c.dcid, "server in")
+	if err != nil {
+		return nil, err
+	}
+	p, rest, err := openInitial(b, k, c.nextServer)
+	if err != nil {
+		return nil, err
+	}
+	c.nextServer = p.pn + 1
+
+	if p.payload, err = rewriteACKs(p.payload, c.mapRange); err != nil {
+		return nil, err
+	}
+	return append(p.seal(k), rest...), nil
+}
+
+// mapRange turns a range of acknowledged packet numbers as sent on the wire
+// into the packet numbers the QUIC stack used. The first Initial only counts
+// as acknowledged if all the packets it was split into are.
+func (c *PacketConn) mapRange(ar ackRange) (ackRange, bool) {
+	first, last := c.firstPN, c.firstPN+c.shift
+
+	smallest := ar.smallest
+	switch {
+	case smallest > last:
+		smallest -= c.shift
+	case smallest > first:
+		smallest = first + 1
+	}
+
+	largest := ar.largest
+	switch {
+	case largest >= last:
+		largest -= c.shift
+	case largest >= first:
+		if first == 0 {
+			return ackRange{}, false
+		}
+		largest = first - 1
+	}
+
+	return ackRange{smallest, largest}, smallest <= largest
+}
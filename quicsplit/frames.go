@@ -0,0 +1,267 @@
+package quicsplit
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/refraction-networking/uquic/quicvarint"
+)
+
+// Frame types that may show up in Initial packets, RFC 9000 section 17.2.2.
+const (
+	framePadding         = 0x00
+	framePing            = 0x01
+	frameACK             = 0x02
+	frameACKECN          = 0x03
+	frameCrypto          = 0x06
+	frameConnectionClose = 0x1c
+)
+
+var errFrame = errors.New("quicsplit: malformed frame")
+
+// frameReader walks the frames of a packet payload.
+type frameReader struct {
+	b   []byte
+	off int
+}
+
+func (r *frameReader) varint() (uint64, error) {
+	v, n, err := quicvarint.Parse(r.b[r.off:])
+	if err != nil {
+		return 0, errFrame
+	}
+	r.off += n
+	return v, nil
+}
+
+func (r *frameReader) bytes(n uint64) ([]byte, error) {
+	if n > uint64(len(r.b)-r.off) {
+		return nil, errFrame
+	}
+	b := r.b[r.off : r.off+int(n)]
+	r.off += int(n)
+	return b, nil
+}
+
+// ackRange is an inclusive range of acknowledged packet numbers.
+type ackRange struct {
+	smallest, largest uint64
+}
+
+// readACK reads the body of an ACK frame. The ranges are in descending
+// order, like on the wire.
+func (r *frameReader) readACK(ecn bool) (delay uint64, ranges []ackRange, ecnCounts [3]uint64, err error) {
+	largest, err := r.varint()
+	if err != nil {
+		return
+	}
+	if delay, err = r.varint(); err != nil {
+		return
+	}
+	count, err := r.varint()
+	if err != nil {
+		return
+	}
+	first, err := r.varint()
+	if err != nil {
+		return
+	}
+	if first > largest {
+		return 0, nil, ecnCounts, errFrame
+	}
+	ranges = append(ranges, ackRange{largest - first, largest})
+
+	for range count {
+		var gap, length uint64
+		if gap, err = r.varint(); err != nil {
+			return
+		}
+		if length, err = r.varint(); err != nil {
+			return
+		}
+		smallest := ranges[len(ranges)-1].smallest
+		if gap+2+length > smallest {
+			return 0, nil, ecnCounts, errFrame
+		}
+		largest := smallest - gap - 2
+		ranges = append(ranges, ackRange{largest - length, largest})
+	}
+
+	if ecn {
+		for i := range ecnCounts {
+			if ecnCounts[i], err = r.varint(); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// appendACK encodes an ACK frame. ranges must be in descending order and
+// must not touch.
+func appendACK(b []byte, ecn bool, delay uint64, ranges []ackRange, ecnCounts [3]uint64) []byte {
+	typ := byte(frameACK)
+	if ecn {
+		typ = frameACKECN
+	}
+	b = append(b, typ)
+	b = quicvarint.Append(b, ranges[0].largest)
+	b = quicvarint.Append(b, delay)
+	b = quicvarint.Append(b, uint64(len(ranges)-1))
+	b = quicvarint.Append(b, ranges[0].largest-ranges[0].smallest)
+	for i := 1; i < len(ranges); i++ {
+		b = quicvarint.Append(b, ranges[i-1].smallest-ranges[i].largest-2)
+		b = quicvarint.Append(b, ranges[i].largest-ranges[i].smallest)
+	}
+	if ecn {
+		for _, c := range ecnCounts {
+			b = quicvarint.Append(b, c)
+		}
+	}
+	return b
+}
+
+// skipFrame skips the body of a frame of type typ that carries nothing of
+// interest.
+func (r *frameReader) skipFrame(typ uint64) error {
+	switch typ {
+	case framePadding, framePing:
+		return nil
+	case frameACK, frameACKECN:
+		_, _, _, err := r.readACK(typ == frameACKECN)
+		return err
+	case frameCrypto:
+		if _, err := r.varint(); err != nil {
+			return err
+		}
+		n, err := r.varint()
+		if err != nil {
+			return err
+		}
+		_, err = r.bytes(n)
+		return err
+	case frameConnectionClose:
+		if _, err := r.varint(); err != nil {
+			return err
+		}
+		if _, err := r.varint(); err != nil {
+			return err
+		}
+		n, err := r.varint()
+		if err != nil {
+			return err
+		}
+		_, err = r.bytes(n)
+		return err
+	}
+	return fmt.Errorf("quicsplit: unexpected frame type %#x in Initial packet", typ)
+}
+
+// cryptoData reassembles the CRYPTO frames of a payload. It fails if they
+// don't make up a contiguous stream starting at offset 0, as they do in the
+// first Initial of a connection, or if the payload carries other frames
+// than CRYPTO, PADDING and PING.
+func cryptoData(payload []byte) ([]byte, error) {
+	var (
+		r    = frameReader{b: payload}
+		data []byte
+		seen int
+	)
+	for r.off < len(r.b) {
+		typ, err := r.varint()
+		if err != nil {
+			return nil, err
+		}
+		switch typ {
+		case framePadding, framePing:
+			continue
+		case frameCrypto:
+		default:
+			return nil, fmt.Errorf("quicsplit: unexpected frame type %#x in first Initial packet", typ)
+		}
+
+		off, err := r.varint()
+		if err != nil {
+			return nil, err
+		}
+		n, err := r.varint()
+		if err != nil {
+			return nil, err
+		}
+		chunk, err := r.bytes(n)
+		if err != nil {
+			return nil, err
+		}
+		if end := int(off) + len(chunk); end > len(data) {
+			data = append(data, make([]byte, end-len(data))...)
+		}
+		copy(data[off:], chunk)
+		seen += len(chunk)
+	}
+	if len(data) == 0 || seen < len(data) {
+		return nil, errors.New("quicsplit: CRYPTO frames don't cover the ClientHello")
+	}
+	return data, nil
+}
+
+// appendCrypto encodes a CRYPTO frame.
+func appendCrypto(b []byte, offset uint64, data []byte) []byte {
+	b = append(b, frameCrypto)
+	b = quicvarint.Append(b, offset)
+	b = quicvarint.Append(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// rewriteACKs passes the ranges of every ACK frame in payload through
+// mapRange, which must keep them in order and may drop them. The rewritten
+// frames are never longer than the original ones, and are padded to the
+// same size so the payload length doesn't change. An ACK frame left without
+// ranges is replaced by padding.
+func rewriteACKs(payload []byte, mapRange func(ackRange) (ackRange, bool)) ([]byte, error) {
+	r := frameReader{b: payload}
+	out := make([]byte, 0, len(payload))
+	for r.off < len(r.b) {
+		start := r.off
+		typ, err := r.varint()
+		if err != nil {
+			return nil, err
+		}
+		if typ != frameACK && typ != frameACKECN {
+			if err := r.skipFrame(typ); err != nil {
+				return nil, err
+			}
+			out = append(out, r.b[start:r.off]...)
+			continue
+		}
+
+		delay, ranges, ecnCounts, err := r.readACK(typ == frameACKECN)
+		if err != nil {
+			return nil, err
+		}
+		var mapped []ackRange
+		for _, ar := range ranges {
+			ar, ok := mapRange(ar)
+			if !ok {
+				continue
+			}
+			// merge with the previous (higher) range if they now touch
+			if n := len(mapped); n > 0 && mapped[n-1].smallest <= ar.largest+1 {
+				mapped[n-1].smallest = min(mapped[n-1].smallest, ar.smallest)
+				continue
+			}
+			mapped = append(mapped, ar)
+		}
+
+		var frame []byte
+		if len(mapped) > 0 {
+			frame = appendACK(nil, typ == frameACKECN, delay, mapped, ecnCounts)
+		}
+		pad := r.off - start - len(frame)
+		if pad < 0 {
+			return nil, errors.New("quicsplit: rewritten ACK frame grew")
+		}
+		out = append(out, frame...)
+		out = append(out, make([]byte, pad)...)
+	}
+	return out, nil
+}
@@ -0,0 +1,237 @@
+package quicsplit
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+
+	"github.com/refraction-networking/uquic/quicvarint"
+)
+
+// version1 is the only QUIC version handled, others are passed through.
+const version1 = 0x00000001
+
+// initialSaltV1 is the salt Initial secrets are derived with, RFC 9001
+// section 5.2.
+var initialSaltV1 = []byte{
+	0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17,
+	0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a,
+}
+
+var errNotInitial = errors.New("quicsplit: not a QUIC v1 Initial packet")
+
+// keys protect the Initial packets sent in one direction.
+type keys struct {
+	aead cipher.AEAD
+	iv   []byte
+	hp   cipher.Block
+}
+
+// initialKeys derives the keys for the Initial packets sent by the client
+// (label "client in") or the server (label "server in"). They only depend
+// on the Destination Connection ID of the client's first Initial, so anyone
+// on the path can compute them.
+func initialKeys(dcid []byte, label string) (*keys, error) {
+	initial, err := hkdf.Extract(sha256.New, dcid, initialSaltV1)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := expandLabel(initial, label, 32)
+	if err != nil {
+		return nil, err
+	}
+	key, err := expandLabel(secret, "quic key", 16)
+	if err != nil {
+		return nil, err
+	}
+	iv, err := expandLabel(secret, "quic iv", 12)
+	if err != nil {
+		return nil, err
+	}
+	hpKey, err := expandLabel(secret, "quic hp", 16)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	hp, err := aes.NewCipher(hpKey)
+	if err != nil {
+		return nil, err
+	}
+	return &keys{aead: aead, iv: iv, hp: hp}, nil
+}
+
+// expandLabel is HKDF-Expand-Label from TLS 1.3 with an empty context.
+func expandLabel(secret []byte, label string, n int) ([]byte, error) {
+	label = "tls13 " + label
+	info := make([]byte, 0, 4+len(label))
+	info = append(info, byte(n>>8), byte(n), byte(len(label)))
+	info = append(info, label...)
+	info = append(info, 0)
+	return hkdf.Expand(sha256.New, secret, string(info), n)
+}
+
+func (k *keys) nonce(pn uint64) []byte {
+	nonce := make([]byte, len(k.iv))
+	copy(nonce, k.iv)
+	for i := range 8 {
+		nonce[len(nonce)-1-i] ^= byte(pn >> (8 * i))
+	}
+	return nonce
+}
+
+// mask returns the header protection mask for the sample.
+func (k *keys) mask(sample []byte) []byte {
+	mask := make([]byte, aes.BlockSize)
+	k.hp.Encrypt(mask, sample)
+	return mask
+}
+
+// initialPacket is a decrypted Initial packet.
+type initialPacket struct {
+	dcid    []byte
+	scid    []byte
+	token   []byte
+	pn      uint64
+	pnLen   int
+	payload []byte // plaintext frames
+}
+
+// isInitial reports whether b starts with a QUIC v1 Initial packet.
+func isInitial(b []byte) bool {
+	return len(b) >= 5 && b[0]&0xf0 == 0xc0 &&
+		binary.BigEndian.Uint32(b[1:5]) == version1
+}
+
+// parseDCID returns the DCID of the Initial packet at the start of b.
+func parseDCID(b []byte) ([]byte, error) {
+	if !isInitial(b) || len(b) < 6 || len(b) < 6+int(b[5]) {
+		return nil, errNotInitial
+	}
+	return b[6 : 6+int(b[5])], nil
+}
+
+// openInitial decrypts the Initial packet at the start of b. next is the
+// packet number expected from the sender, one more than the largest received
+// so far, needed to recover the full packet number. It returns the packet and the remaining
+// bytes of the datagram, which may hold coalesced packets.
+func openInitial(b []byte, k *keys, next uint64) (*initialPacket, []byte, error) {
+	if !isInitial(b) {
+		return nil, nil, errNotInitial
+	}
+
+	p := &initialPacket{}
+	off := 5
+	readCID := func() ([]byte, error) {
+		if off >= len(b) || off+1+int(b[off]) > len(b) {
+			return nil, errNotInitial
+		}
+		cid := b[off+1 : off+1+int(b[off])]
+		off += 1 + int(b[off])
+		return cid, nil
+	}
+	readVarint := func() (uint64, error) {
+		v, n, err := quicvarint.Parse(b[off:])
+		off += n
+		return v, err
+	}
+
+	var err error
+	if p.dcid, err = readCID(); err != nil {
+		return nil, nil, err
+	}
+	if p.scid, err = readCID(); err != nil {
+		return nil, nil, err
+	}
+	tokenLen, err := readVarint()
+	if err != nil || off+int(tokenLen) > len(b) {
+		return nil, nil, errNotInitial
+	}
+	p.token = b[off : off+int(tokenLen)]
+	off += int(tokenLen)
+	length, err := readVarint()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pnOffset, end := off, off+int(length)
+	if end > len(b) || pnOffset+4+16 > end {
+		return nil, nil, errNotInitial
+	}
+
+	hdr := make([]byte, end)
+	copy(hdr, b[:end])
+	mask := k.mask(hdr[pnOffset+4 : pnOffset+4+16])
+	hdr[0] ^= mask[0] & 0x0f
+	p.pnLen = int(hdr[0]&0x03) + 1
+	var truncated uint64
+	for i := range p.pnLen {
+		hdr[pnOffset+i] ^= mask[1+i]
+		truncated = truncated<<8 | uint64(hdr[pnOffset+i])
+	}
+	p.pn = decodePacketNumber(next, truncated, p.pnLen)
+
+	payloadOffset := pnOffset + p.pnLen
+	p.payload, err = k.aead.Open(nil, k.nonce(p.pn), hdr[payloadOffset:end], hdr[:payloadOffset])
+	if err != nil {
+		return nil, nil, err
+	}
+	return p, b[end:], nil
+}
+
+// seal encrypts p into an Initial packet. The Length field is always two
+// bytes long, so the packet size only depends on the payload.
+func (p *initialPacket) seal(k *keys) []byte {
+	b := []byte{0xc0 | byte(p.pnLen-1), 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(b[1:], version1)
+	b = append(b, byte(len(p.dcid)))
+	b = append(b, p.dcid...)
+	b = append(b, byte(len(p.scid)))
+	b = append(b, p.scid...)
+	b = quicvarint.Append(b, uint64(len(p.token)))
+	b = append(b, p.token...)
+	b = quicvarint.AppendWithLen(b, uint64(p.pnLen+len(p.payload)+k.aead.Overhead()), 2)
+
+	pnOffset := len(b)
+	for i := p.pnLen - 1; i >= 0; i-- {
+		b = append(b, byte(p.pn>>(8*i)))
+	}
+	b = k.aead.Seal(b, k.nonce(p.pn), p.payload, b)
+
+	mask := k.mask(b[pnOffset+4 : pnOffset+4+16])
+	b[0] ^= mask[0] & 0x0f
+	for i := range p.pnLen {
+		b[pnOffset+i] ^= mask[1+i]
+	}
+	return b
+}
+
+// overhead is the size of the sealed packet minus the payload.
+func (p *initialPacket) overhead(k *keys) int {
+	return 7 + len(p.dcid) + len(p.scid) + quicvarint.Len(uint64(len(p.token))) +
+		len(p.token) + 2 + p.pnLen + k.aead.Overhead()
+}
+
+// decodePacketNumber recovers a full packet number, RFC 9000 appendix A.3.
+func decodePacketNumber(expected, truncated uint64, pnLen int) uint64 {
+	win := uint64(1) << (8 * pnLen)
+	hwin, mask := win/2, win-1
+	candidate := (expected &^ mask) | truncated
+	switch {
+	case candidate+hwin <= expected && candidate < (1<<62)-win:
+		return candidate + win
+	case candidate > expected+hwin && candidate >= win:
+		return candidate - win
+	}
+	return candidate
+}
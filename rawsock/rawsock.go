@@ -0,0 +1,123 @@
+// Package rawsock injects hand crafted TCP segments into an existing
+// connection, for desync strategies that need packets the kernel would never
+// send on its own (low TTL, bad checksum, ...).
+//
+// Injection needs raw sockets, so it works on Linux as root or with
+// CAP_NET_RAW, and on Windows as Administrator through the WinDivert driver.
+// Check reports whether it is available.
+package rawsock
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+)
+
+var (
+	// ErrPermission is returned when raw sockets can't be opened because
+	// the process lacks privileges.
+	ErrPermission = errors.New("rawsock: requires root or CAP_NET_RAW")
+	// ErrNoDriver is returned on Windows when WinDivert isn't installed.
+	ErrNoDriver = errors.New("rawsock: WinDivert.dll or its driver not found")
+	// ErrUnsupported is returned on platforms without raw socket support.
+	ErrUnsupported = errors.New("rawsock: unsupported platform")
+	// ErrNoHandshake is returned when the SYN-ACK of the connection was not
+	// seen, so the sequence numbers are unknown.
+	ErrNoHandshake = errors.New("rawsock: did not see the TCP handshake")
+)
+
+// SendOptions controls how a segment is injected.
+type SendOptions struct {
+	// TTL is the IP TTL (or IPv6 hop limit) of the segment, 0 means the
+	// system default.
+	TTL int
+	// BadChecksum corrupts the TCP checksum so the server drops the segment.
+	BadChecksum bool
+}
+
+// segment holds what is needed to build a TCP segment that fits into the
+// connection's sequence space.
+type segment struct {
+	src, dst netip.AddrPort
+	seq, ack uint32
+	window   uint16
+}
+
+const (
+	tcpFlagSYN = 0x02
+	tcpFlagPSH = 0x08
+	tcpFlagACK = 0x10
+)
+
+// marshal builds a PSH/ACK TCP segment carrying payload.
+func (s segment) marshal(payload []byte, badChecksum bool) []byte {
+	b := make([]byte, 20+len(payload))
+	binary.BigEndian.PutUint16(b[0:], s.src.Port())
+	binary.BigEndian.PutUint16(b[2:], s.dst.Port())
+	binary.BigEndian.PutUint32(b[4:], s.seq)
+	binary.BigEndian.PutUint32(b[8:], s.ack)
+	b[12] = 5 << 4 // data offset, no options
+	b[13] = tcpFlagPSH | tcpFlagACK
+	binary.BigEndian.PutUint16(b[14:], s.window)
+	copy(b[20:], payload)
+
+	sum := checksum(s.src.Addr(), s.dst.Addr(), b)
+	if badChecksum {
+		sum ^= 0xffff
+	}
+	binary.BigEndian.PutUint16(b[16:], sum)
+	return b
+}
+
+// checksum computes the TCP checksum, including the pseudo header.
+func checksum(src, dst netip.Addr, seg []byte) uint16 {
+	var sum uint32
+	add := func(b []byte) {
+		for len(b) > 1 {
+			sum += uint32(binary.BigEndian.Uint16(b))
+			b = b[2:]
+		}
+		if len(b) == 1 {
+			sum += uint32(b[0]) << 8
+		}
+	}
+
+	add(src.AsSlice())
+	add(dst.AsSlice())
+	sum += 6 // protocol
+	sum += uint32(len(seg))
+	add(seg)
+
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// Conn calls Inject with payload right before the first write on the
+// wrapped connection, so the injected segment lands just ahead of the real
+// data on the wire.
+type Conn struct {
+	net.Conn
+	inj     *Injector
+	payload []byte
+	opts    SendOptions
+	once    sync.Once
+}
+
+// Wrap returns a connection that injects payload before its first write.
+func (inj *Injector) Wrap(c net.Conn, payload []byte, opts SendOptions) *Conn {
+	return &Conn{Conn: c, inj: inj, payload: payload, opts: opts}
+}
+
+// Write writes data to the connection.
+func (c *Conn) Write(b []byte) (int, error) {
+	var err error
+	c.once.Do(func() { err = c.inj.Inject(c.payload, c.opts) })
+	if err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
@@ -0,0 +1,154 @@
+//go:build linux
+
+package rawsock
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"syscall"
+	"time"
+)
+
+// Check reports whether raw sockets can be opened.
+func Check() error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.IPPROTO_TCP)
+	if err != nil {
+		return wrapErr(err)
+	}
+	return syscall.Close(fd)
+}
+
+func wrapErr(err error) error {
+	if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EACCES) {
+		return ErrPermission
+	}
+	return err
+}
+
+// Injector watches a connection's handshake and injects segments into it.
+type Injector struct {
+	fd     int
+	remote netip.AddrPort
+	seg    segment
+}
+
+// Listen prepares an Injector for a connection to remote. It must be called
+// before dialing, so the SYN-ACK can be observed.
+func Listen(remote netip.AddrPort) (*Injector, error) {
+	family := syscall.AF_INET
+	if remote.Addr().Is6() {
+		family = syscall.AF_INET6
+	}
+
+	fd, err := syscall.Socket(family, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.IPPROTO_TCP)
+	if err != nil {
+		return nil, wrapErr(err)
+	}
+	return &Injector{fd: fd, remote: remote}, nil
+}
+
+// Close releases the raw socket.
+func (inj *Injector) Close() error {
+	return syscall.Close(inj.fd)
+}
+
+// Sync waits for the SYN-ACK of the connection from local to the remote and
+// records the sequence numbers the next injected segment has to use.
+func (inj *Injector) Sync(local netip.AddrPort, timeout time.Duration) error {
+	tv := syscall.NsecToTimeval(int64(100 * time.Millisecond))
+	if err := syscall.SetsockoptTimeval(inj.fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		return err
+	}
+
+	v6 := inj.remote.Addr().Is6()
+	buf := make([]byte, 65535)
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		n, from, err := syscall.Recvfrom(inj.fd, buf, 0)
+		if err != nil {
+			if errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EINTR) {
+				continue
+			}
+			return err
+		}
+
+		pkt := buf[:n]
+		var src netip.Addr
+		switch sa := from.(type) {
+		case *syscall.SockaddrInet4:
+			src = netip.AddrFrom4(sa.Addr)
+		case *syscall.SockaddrInet6:
+			src = netip.AddrFrom16(sa.Addr)
+		default:
+			continue
+		}
+		if src != inj.remote.Addr() {
+			continue
+		}
+
+		// IPv4 raw sockets hand over the IP header, IPv6 ones don't.
+		if !v6 {
+			if len(pkt) < 20 {
+				continue
+			}
+			pkt = pkt[int(pkt[0]&0x0f)*4:]
+		}
+		if len(pkt) < 20 {
+			continue
+		}
+
+		srcPort := binary.BigEndian.Uint16(pkt[0:])
+		dstPort := binary.BigEndian.Uint16(pkt[2:])
+		flags := pkt[13]
+		if srcPort != inj.remote.Port() || dstPort != local.Port() || flags&(tcpFlagSYN|tcpFlagACK) != tcpFlagSYN|tcpFlagACK {
+			continue
+		}
+
+		inj.seg = segment{
+			src:    local,
+			dst:    inj.remote,
+			seq:    binary.BigEndian.Uint32(pkt[8:]),
+			ack:    binary.BigEndian.Uint32(pkt[4:]) + 1,
+			window: 502, // what Linux advertises early on with the default scaling
+		}
+		return nil
+	}
+
+	return ErrNoHandshake
+}
+
+// Inject sends payload as if it was the next data segment of the
+// connection. The kernel doesn't know about it, so the real data that
+// follows uses the same sequence numbers.
+func (inj *Injector) Inject(payload []byte, opts SendOptions) error {
+	if inj.seg.src == (netip.AddrPort{}) {
+		return ErrNoHandshake
+	}
+
+	v6 := inj.remote.Addr().Is6()
+	if opts.TTL > 0 {
+		level, opt := syscall.IPPROTO_IP, syscall.IP_TTL
+		if v6 {
+			level, opt = syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS
+		}
+		if err := syscall.SetsockoptInt(inj.fd, level, opt, opts.TTL); err != nil {
+			return err
+		}
+	}
+
+	var src, dst syscall.Sockaddr
+	if v6 {
+		src = &syscall.SockaddrInet6{Addr: inj.seg.src.Addr().As16()}
+		dst = &syscall.SockaddrInet6{Addr: inj.remote.Addr().As16()}
+	} else {
+		src = &syscall.SockaddrInet4{Addr: inj.seg.src.Addr().As4()}
+		dst = &syscall.SockaddrInet4{Addr: inj.remote.Addr().As4()}
+	}
+	// Binding makes the kernel use the connection's source address.
+	if err := syscall.Bind(inj.fd, src); err != nil && !errors.Is(err, syscall.EINVAL) {
+		return err
+	}
+
+	return syscall.Sendto(inj.fd, inj.seg.marshal(payload, opts.BadChecksum), 0, dst)
+}
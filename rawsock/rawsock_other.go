@@ -0,0 +1,36 @@
+//go:build !linux && !(windows && (amd64 || arm64))
+
+package rawsock
+
+import (
+	"net/netip"
+	"time"
+)
+
+// Check reports whether raw sockets can be opened.
+func Check() error {
+	return ErrUnsupported
+}
+
+// Injector watches a connection's handshake and injects segments into it.
+type Injector struct{}
+
+// Listen prepares an Injector for a connection to remote.
+func Listen(remote netip.AddrPort) (*Injector, error) {
+	return nil, ErrUnsupported
+}
+
+// Close releases the raw socket.
+func (inj *Injector) Close() error {
+	return ErrUnsupported
+}
+
+// Sync waits for the SYN-ACK of the connection.
+func (inj *Injector) Sync(local netip.AddrPort, timeout time.Duration) error {
+	return ErrUnsupported
+}
+
+// Inject sends payload as if it was the next data segment of the connection.
+func (inj *Injector) Inject(payload []byte, opts SendOptions) error {
+	return ErrUnsupported
+}
@@ -0,0 +1,255 @@
+//go:build windows && (amd64 || arm64)
+
+package rawsock
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"strconv"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Windows has no raw TCP sockets, so packets go through the WinDivert
+// driver instead: WinDivert.dll and WinDivert64.sys have to be next to the
+// executable or in the PATH, and opening the driver needs Administrator.
+
+var (
+	winDivert         = syscall.NewLazyDLL("WinDivert.dll")
+	winDivertOpen     = winDivert.NewProc("WinDivertOpen")
+	winDivertRecv     = winDivert.NewProc("WinDivertRecv")
+	winDivertSend     = winDivert.NewProc("WinDivertSend")
+	winDivertShutdown = winDivert.NewProc("WinDivertShutdown")
+	winDivertClose    = winDivert.NewProc("WinDivertClose")
+)
+
+const (
+	winDivertLayerNetwork = 0
+
+	winDivertFlagSniff    = 0x0001
+	winDivertFlagSendOnly = 0x0008
+
+	winDivertShutdownRecv = 0x1
+)
+
+// winDivertAddress is WINDIVERT_ADDRESS, for the network layer.
+type winDivertAddress struct {
+	Timestamp int64
+	Flags     uint32 // layer, event, then one bit each for sniffed, outbound, ...
+	_         uint32
+	IfIdx     uint32
+	SubIfIdx  uint32
+	_         [56]byte
+}
+
+const (
+	winDivertAddressOutbound    = 1 << 17
+	winDivertAddressIPv6        = 1 << 20
+	winDivertAddressIPChecksum  = 1 << 21
+	winDivertAddressTCPChecksum = 1 << 22
+)
+
+// openWinDivert opens a WinDivert handle at the network layer for the
+// packets matching filter.
+func openWinDivert(filter string, flags uint64) (syscall.Handle, error) {
+	if err := winDivertOpen.Find(); err != nil {
+		return syscall.InvalidHandle, ErrNoDriver
+	}
+	f, err := syscall.BytePtrFromString(filter)
+	if err != nil {
+		return syscall.InvalidHandle, err
+	}
+	h, _, err := winDivertOpen.Call(uintptr(unsafe.Pointer(f)), winDivertLayerNetwork, 0, uintptr(flags))
+	if syscall.Handle(h) == syscall.InvalidHandle {
+		return syscall.InvalidHandle, wrapErr(err)
+	}
+	return syscall.Handle(h), nil
+}
+
+// Check reports whether the WinDivert driver can be opened.
+func Check() error {
+	h, err := openWinDivert("false", winDivertFlagSendOnly)
+	if err != nil {
+		return err
+	}
+	winDivertClose.Call(uintptr(h))
+	return nil
+}
+
+func wrapErr(err error) error {
+	switch {
+	case errors.Is(err, syscall.ERROR_ACCESS_DENIED):
+		return ErrPermission
+	case errors.Is(err, syscall.ERROR_FILE_NOT_FOUND):
+		// The driver's .sys file is missing.
+		return ErrNoDriver
+	}
+	return err
+}
+
+// Injector watches a connection's handshake and injects segments into it.
+type Injector struct {
+	h      syscall.Handle
+	remote netip.AddrPort
+	seg    segment
+	ifIdx  uint32
+}
+
+// Listen prepares an Injector for a connection to remote. It must be called
+// before dialing, so the SYN-ACK can be observed.
+func Listen(remote netip.AddrPort) (*Injector, error) {
+	ip := "ip"
+	if remote.Addr().Is6() {
+		ip = "ipv6"
+	}
+	filter := "inbound and tcp.Syn and tcp.Ack and " +
+		ip + ".SrcAddr == " + remote.Addr().String() +
+		" and tcp.SrcPort == " + strconv.Itoa(int(remote.Port()))
+
+	// Sniffing leaves the SYN-ACK to the stack, only a copy is queued.
+	h, err := openWinDivert(filter, winDivertFlagSniff)
+	if err != nil {
+		return nil, err
+	}
+	return &Injector{h: h, remote: remote}, nil
+}
+
+// Close releases the WinDivert handle.
+func (inj *Injector) Close() error {
+	r, _, err := winDivertClose.Call(uintptr(inj.h))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+// Sync waits for the SYN-ACK of the connection from local to the remote and
+// records the sequence numbers the next injected segment has to use.
+func (inj *Injector) Sync(local netip.AddrPort, timeout time.Duration) error {
+	// WinDivertRecv can't time out, shutting down receiving makes it return.
+	timer := time.AfterFunc(timeout, func() {
+		winDivertShutdown.Call(uintptr(inj.h), winDivertShutdownRecv)
+	})
+	defer timer.Stop()
+
+	buf := make([]byte, 65535)
+	for {
+		var n uint32
+		var addr winDivertAddress
+		r, _, _ := winDivertRecv.Call(uintptr(inj.h),
+			uintptr(unsafe.Pointer(&buf[0])), uintptr(len(buf)),
+			uintptr(unsafe.Pointer(&n)), uintptr(unsafe.Pointer(&addr)))
+		if r == 0 {
+			return ErrNoHandshake
+		}
+
+		// WinDivert hands over the IP header in both families.
+		pkt := buf[:n]
+		if len(pkt) < 1 {
+			continue
+		}
+		hdrLen := 40
+		if pkt[0]>>4 == 4 {
+			hdrLen = int(pkt[0]&0x0f) * 4
+		}
+		if len(pkt) < hdrLen+20 {
+			continue
+		}
+		pkt = pkt[hdrLen:]
+
+		if binary.BigEndian.Uint16(pkt[2:]) != local.Port() {
+			continue
+		}
+
+		inj.seg = segment{
+			src:    local,
+			dst:    inj.remote,
+			seq:    binary.BigEndian.Uint32(pkt[8:]),
+			ack:    binary.BigEndian.Uint32(pkt[4:]) + 1,
+			window: 513, // what Windows advertises early on with the default scaling
+		}
+		inj.ifIdx = addr.IfIdx
+		return nil
+	}
+}
+
+// Inject sends payload as if it was the next data segment of the
+// connection. The stack doesn't know about it, so the real data that
+// follows uses the same sequence numbers.
+func (inj *Injector) Inject(payload []byte, opts SendOptions) error {
+	if inj.seg.src == (netip.AddrPort{}) {
+		return ErrNoHandshake
+	}
+
+	ttl := opts.TTL
+	if ttl == 0 {
+		ttl = 128 // the Windows default
+	}
+	tcp := inj.seg.marshal(payload, opts.BadChecksum)
+
+	addr := winDivertAddress{
+		Flags: winDivertLayerNetwork | winDivertAddressOutbound | winDivertAddressIPChecksum,
+		IfIdx: inj.ifIdx,
+	}
+	if !opts.BadChecksum {
+		addr.Flags |= winDivertAddressTCPChecksum
+	}
+	var pkt []byte
+	if inj.remote.Addr().Is6() {
+		addr.Flags |= winDivertAddressIPv6
+		pkt = ipv6Header(inj.seg.src.Addr(), inj.remote.Addr(), ttl, len(tcp))
+	} else {
+		pkt = ipv4Header(inj.seg.src.Addr(), inj.remote.Addr(), ttl, len(tcp))
+	}
+	pkt = append(pkt, tcp...)
+
+	r, _, err := winDivertSend.Call(uintptr(inj.h),
+		uintptr(unsafe.Pointer(&pkt[0])), uintptr(len(pkt)),
+		0, uintptr(unsafe.Pointer(&addr)))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+// ipv4Header builds the header of an IPv4 packet carrying a TCP segment of
+// length n, which the kernel would otherwise add.
+func ipv4Header(src, dst netip.Addr, ttl, n int) []byte {
+	b := make([]byte, 20)
+	b[0] = 4<<4 | 5
+	binary.BigEndian.PutUint16(b[2:], uint16(20+n))
+	rand.Read(b[4:6])                         // identification
+	binary.BigEndian.PutUint16(b[6:], 0x4000) // don't fragment
+	b[8] = byte(ttl)
+	b[9] = 6 // TCP
+	s, d := src.As4(), dst.As4()
+	copy(b[12:], s[:])
+	copy(b[16:], d[:])
+
+	var sum uint32
+	for i := 0; i < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	binary.BigEndian.PutUint16(b[10:], ^uint16(sum))
+	return b
+}
+
+// ipv6Header builds the header of an IPv6 packet carrying a TCP segment of
+// length n.
+func ipv6Header(src, dst netip.Addr, hopLimit, n int) []byte {
+	b := make([]byte, 40)
+	b[0] = 6 << 4
+	binary.BigEndian.PutUint16(b[4:], uint16(n))
+	b[6] = 6 // TCP
+	b[7] = byte(hopLimit)
+	s, d := src.As16(), dst.As16()
+	copy(b[8:], s[:])
+	copy(b[24:], d[:])
+	return b
+}
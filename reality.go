@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// realityClientVersion is the Xray version put in the session ID, as servers
+// may only let recent clients in.
+var realityClientVersion = [3]byte{25, 10, 15}
+
+// realityProbe is where the VLESS request after the handshake goes through
+// the server, a page answering any HTTP request with an empty 204.
+const (
+	realityProbeHost = "www.gstatic.com"
+	realityProbePort = 80
+)
+
+const visionFlow = "xtls-rprx-vision"
+
+// realityServer is a VLESS server behind REALITY, from its share link.
+type realityServer struct {
+	name      string
+	host      string
+	port      uint16
+	sni       string
+	publicKey []byte
+	shortID   []byte
+	id        []byte
+	flow      string
+	network   string
+	hello     tls.ClientHelloID
+}
+
+// realityFingerprints are the uTLS fingerprints for the fp of a share link.
+var realityFingerprints = map[string]tls.ClientHelloID{
+	"":        tls.HelloChrome_Auto,
+	"chrome":  tls.HelloChrome_Auto,
+	"firefox": tls.HelloFirefox_Auto,
+	"safari":  tls.HelloSafari_Auto,
+	"ios":     tls.HelloIOS_Auto,
+	"edge":    tls.HelloEdge_Auto,
+}
+
+// parseRealityLink parses a VLESS share link with REALITY security, e.g.
+//
+//	vless://UUID@192.0.2.1:443?security=reality&sni=www.example.com&pbk=...&sid=...&flow=xtls-rprx-vision&type=tcp#name
+func parseRealityLink(link string) (realityServer, error) {
+	var s realityServer
+	u, err := url.Parse(link)
+	if err != nil {
+		return s, err
+	}
+	if u.Scheme != "vless" {
+		return s, errors.New("not a vless:// link")
+	}
+	q := u.Query()
+	if q.Get("security") != "reality" {
+		return s, errors.New("not a REALITY server, security isn't reality")
+	}
+
+	s.name = u.Fragment
+	s.host = u.Hostname()
+	port, err := strconv.ParseUint(u.Port(), 10, 16)
+	if err != nil || port == 0 {
+		return s, fmt.Errorf("invalid port %q", u.Port())
+	}
+	s.port = uint16(port)
+
+	if u.User == nil {
+		return s, errors.New("no UUID")
+	}
+	s.id, err = hex.DecodeString(strings.ReplaceAll(u.User.Username(), "-", ""))
+	if err != nil || len(s.id) != 16 {
+		return s, fmt.Errorf("invalid UUID %q", u.User.Username())
+	}
+
+	s.sni = q.Get("sni")
+	if s.sni == "" {
+		return s, errors.New("no sni")
+	}
+	s.publicKey, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(q.Get("pbk"), "="))
+	if err != nil || len(s.publicKey) != 32 {
+		return s, fmt.Errorf("invalid public key %q", q.Get("pbk"))
+	}
+	s.shortID, err = hex.DecodeString(q.Get("sid"))
+	if err != nil || len(s.shortID) > 8 {
+		return s, fmt.Errorf("invalid short ID %q", q.Get("sid"))
+	}
+
+	s.flow = q.Get("flow")
+	if s.flow != "" && s.flow != visionFlow {
+		return s, fmt.Errorf("unsupported flow %q", s.flow)
+	}
+	s.network = q.Get("type")
+	if s.network == "" {
+		s.network = "tcp"
+	}
+	var ok bool
+	if s.hello, ok = realityFingerprints[q.Get("fp")]; !ok {
+		return s, fmt.Errorf("unsupported fingerprint %q", q.Get("fp"))
+	}
+	return s, nil
+}
+
+func (s realityServer) String() string {
+	if s.name != "" {
+		return s.name
+	}
+	return net.JoinHostPort(s.host, strconv.Itoa(int(s.port)))
+}
+
+// sealRealitySessionID puts the REALITY authentication in the session ID
+// of hello, built but not sent yet: the client version, the time and the
+// short ID, sealed with a key shared with the server from the client's
+// X25519 key share. It returns that key, which the server signs its
+// temporary certificate with.
+func sealRealitySessionID(s realityServer, hello *tls.PubClientHelloMsg, ecdhe *ecdh.PrivateKey) ([]byte, error) {
+	// The session ID is at a fixed place: after the handshake header, the
+	// version, the random and its length.
+	if len(hello.Raw) < 39+32 || hello.Raw[38] != 32 {
+		return nil, errors.New("the ClientHello has no 32 byte session ID")
+	}
+	pub, err := ecdh.X25519().NewPublicKey(s.publicKey)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := ecdhe.ECDH(pub)
+	if err != nil {
+		return nil, err
+	}
+	authKey, err := hkdf.Key(sha256.New, shared, hello.Random[:20], "REALITY", 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(authKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	sessionID := make([]byte, 32)
+	copy(hello.Raw[39:], sessionID)
+	copy(sessionID, realityClientVersion[:])
+	binary.BigEndian.PutUint32(sessionID[4:], uint32(time.Now().Unix()))
+	copy(sessionID[8:], s.shortID)
+	aead.Seal(sessionID[:0], hello.Random[20:], sessionID[:16], hello.Raw)
+	copy(hello.Raw[39:], sessionID)
+	hello.SessionId = sessionID
+	return authKey, nil
+}
+
+// realityCertificate reports whether the leaf certificate is the temporary
+// one of a REALITY server that authenticated the client, rather than the
+// fronted site's: an ed25519 key "signed" with the HMAC of the shared key.
+func realityCertificate(rawCerts [][]byte, authKey []byte) bool {
+	if len(rawCerts) == 0 {
+		return false
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return false
+	}
+	pub, ok := cert.PublicKey.(ed25519.PublicKey)
+	if !ok {
+		return false
+	}
+	h := hmac.New(sha512.New, authKey)
+	h.Write(pub)
+	return hmac.Equal(h.Sum(nil), cert.Signature)
+}
+
+// vlessRequest returns a VLESS request for the HTTP probe through the
+// server, padded as the first frame of the flow if it's Vision.
+func vlessRequest(s realityServer) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte(0) // version
+	buf.Write(s.id)
+	if s.flow != "" {
+		// The addons are a protobuf, with the flow as field 1.
+		buf.Write([]byte{byte(2 + len(s.flow)), 0x0a, byte(len(s.flow))})
+		buf.WriteString(s.flow)
+	} else {
+		buf.WriteByte(0)
+	}
+	buf.WriteByte(1) // TCP
+	buf.Write(binary.BigEndian.AppendUint16(nil, realityProbePort))
+	buf.WriteByte(2) // domain
+	buf.WriteByte(byte(len(realityProbeHost)))
+	buf.WriteString(realityProbeHost)
+
+	payload := []byte("GET /generate_204 HTTP/1.1\r\nHost: " + realityProbeHost + "\r\nConnection: close\r\n\r\n")
+	if s.flow != visionFlow {
+		buf.Write(payload)
+		return buf.Bytes(), nil
+	}
+	// A Vision frame: the UUID, the command ending the padding, and the
+	// lengths of the content and the padding that follow.
+	n, err := rand.Int(rand.Reader, big.NewInt(256))
+	if err != nil {
+		return nil, err
+	}
+	padding := int(n.Int64())
+	buf.Write(s.id)
+	buf.WriteByte(1)
+	buf.Write(binary.BigEndian.AppendUint16(nil, uint16(len(payload))))
+	buf.Write(binary.BigEndian.AppendUint16(nil, uint16(padding)))
+	buf.Write(payload)
+	buf.Write(make([]byte, padding))
+	return buf.Bytes(), nil
+}
+
+// readVLESSResponse reads the header of the server's VLESS response, which
+// it sends along with the first bytes from the probe.
+func readVLESSResponse(r io.Reader) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if errors.Is(err, io.EOF) {
+			return errors.New("the server closed the connection, the UUID or flow may be wrong")
+		}
+		return err
+	}
+	if header[0] != 0 {
+		return fmt.Errorf("unexpected VLESS response version %d", header[0])
+	}
+	_, err := io.CopyN(io.Discard, r, int64(header[1]))
+	return err
+}
+
+// realityLabel is the label of the REALITY tests, whatever the server.
+const realityLabel = "REALITY - TCP"
+
+// runReality runs the REALITY test against each of the servers in turn,
+// and returns their results.
+func runReality(ctx context.Context, l *slog.Logger, to TestOptions) ([]TestResult, error) {
+	var results []TestResult
+	for _, s := range to.RealityServers {
+		sto := to
+		sto.SNI, sto.Host = s.sni, s.host
+		sto.ManualIPs = nil
+		if addr, err := netip.ParseAddr(s.host); err == nil {
+			sto.ManualIPs = []netip.Addr{addr.Unmap()}
+		}
+		sto.Port = s.port
+		// Only the server's own SNI authenticates, so controls changing it
+		// tell nothing.
+		sto.FailureControls = false
+		l.Info("testing REALITY server", "server", s)
+		res, _, err := runCases(ctx, l, sto, []testCase{{fn: test_TCP_reality(s), label: realityLabel}})
+		results = append(results, res[realityLabel]...)
+		if err != nil {
+			return results, err
+		}
+	}
+	return results, nil
+}
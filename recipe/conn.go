@@ -0,0 +1,102 @@
+package recipe
+
+import (
+	"bytes"
+	"log/slog"
+	"math/rand"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/markpash/heybabe/bepass/sni"
+	"github.com/markpash/heybabe/bepass/tlsfrag"
+)
+
+// fragmenter is a tlsfrag.Fragmenter carrying out a recipe.
+type fragmenter struct {
+	recipe *Recipe
+	fakes  [][]byte
+}
+
+// Fragmenter returns a tlsfrag.Fragmenter that applies r to the first
+// packet. The decoy ClientHellos are built up front.
+func (r *Recipe) Fragmenter() (tlsfrag.Fragmenter, error) {
+	f := &fragmenter{recipe: r}
+	for _, fake := range r.Fakes {
+		b, err := FakeClientHello(fake.Host, fake.BadVersion)
+		if err != nil {
+			return nil, err
+		}
+		f.fakes = append(f.fakes, b)
+	}
+	return f, nil
+}
+
+// Wrap returns a connection that applies r to the first write on conn.
+func (r *Recipe) Wrap(conn net.Conn, logger *slog.Logger) (*tlsfrag.Adapter, error) {
+	logger.Debug("creating recipe connection", "recipe", r.String())
+	f, err := r.Fragmenter()
+	if err != nil {
+		return nil, err
+	}
+	return tlsfrag.NewWithFragmenter(conn, f, logger), nil
+}
+
+// SplitPlan implements tlsfrag.Fragmenter. Split positions relative to the
+// SNI are ignored when the packet carries none.
+func (f *fragmenter) SplitPlan(b []byte) []tlsfrag.Fragment {
+	var plan []tlsfrag.Fragment
+	for _, fake := range f.fakes {
+		plan = append(plan, tlsfrag.Fragment{Data: fake, Delay: f.delay()})
+	}
+
+	segments := f.segments(b)
+	for i, seg := range segments {
+		frag := tlsfrag.Fragment{Data: seg, Delay: f.delay()}
+		// The first segment is sent with a TTL of 1 so it is dropped on the
+		// first hop, and the kernel retransmits it with the normal TTL once
+		// the later segments are out.
+		if i == 0 && f.recipe.Reorder && len(segments) > 1 {
+			frag.TTL = 1
+		}
+		plan = append(plan, frag)
+	}
+	return plan
+}
+
+// segments cuts b at the recipe's split positions.
+func (f *fragmenter) segments(b []byte) [][]byte {
+	sniStart, sniLen := -1, 0
+	if hello, err := sni.ReadClientHello(bytes.NewReader(b), slog.New(slog.DiscardHandler)); err == nil && hello.ServerName != "" {
+		sniStart, sniLen = bytes.Index(b, []byte(hello.ServerName)), len(hello.ServerName)
+	}
+
+	cuts := make([]int, 0, len(f.recipe.Splits))
+	for _, p := range f.recipe.Splits {
+		off, err := p.Resolve(sniStart, sniLen)
+		if err != nil {
+			continue
+		}
+		if off > 0 && off < len(b) {
+			cuts = append(cuts, off)
+		}
+	}
+	slices.Sort(cuts)
+	cuts = slices.Compact(cuts)
+
+	segments := make([][]byte, 0, len(cuts)+1)
+	prev := 0
+	for _, cut := range cuts {
+		segments = append(segments, b[prev:cut])
+		prev = cut
+	}
+	return append(segments, b[prev:])
+}
+
+func (f *fragmenter) delay() time.Duration {
+	d := f.recipe.Delay[0]
+	if f.recipe.Delay[1] > d {
+		d += rand.Intn(f.recipe.Delay[1] - d)
+	}
+	return time.Duration(d) * time.Millisecond
+}
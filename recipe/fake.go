@@ -0,0 +1,26 @@
+package recipe
+
+import (
+	tls "github.com/refraction-networking/utls"
+)
+
+// FakeClientHello builds a complete TLS record holding a Chrome-like
+// ClientHello for host. It is only meant as a decoy and is never followed
+// by the rest of a handshake. The record version is set to 0x0000 when
+// badVersion is true.
+func FakeClientHello(host string, badVersion bool) ([]byte, error) {
+	uconn := tls.UClient(nil, &tls.Config{ServerName: host}, tls.HelloChrome_Auto)
+	if err := uconn.BuildHandshakeState(); err != nil {
+		return nil, err
+	}
+
+	hello := uconn.HandshakeState.Hello.Raw
+	major, minor := byte(0x03), byte(0x01)
+	if badVersion {
+		major, minor = 0x00, 0x00
+	}
+
+	record := make([]byte, 0, 5+len(hello))
+	record = append(record, 0x16, major, minor, byte(len(hello)>>8), byte(len(hello)))
+	return append(record, hello...), nil
+}
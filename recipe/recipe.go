@@ -0,0 +1,294 @@
+// Package recipe implements a small strategy description language for
+// reshaping the first packet (the TLS ClientHello) of a connection.
+//
+// A recipe is a list of primitives separated by whitespace, newlines or
+// semicolons. Everything after a '#' up to the end of the line is a comment.
+//
+//	split(pos, ...)   cut the ClientHello at each position
+//	delay(ms)         sleep between segments (delay(min, max) for a range)
+//	fake(host)        send a decoy ClientHello for host before the real one
+//	fake(host, badversion)
+//	                  same, but in a record with an invalid version
+//	reorder           send the first segment last
+//
+// A position is either a byte offset into the ClientHello record, or one of
+// the markers "sni", "midsni" and "sniend" with an optional "+N" or "-N"
+// suffix, e.g. split(sni+1) separates the first character of the hostname.
+package recipe
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Op is a recipe primitive.
+type Op string
+
+const (
+	OpSplit   Op = "split"
+	OpDelay   Op = "delay"
+	OpFake    Op = "fake"
+	OpReorder Op = "reorder"
+)
+
+// Step is a single primitive and its arguments.
+type Step struct {
+	Op   Op
+	Args []string
+}
+
+func (s Step) String() string {
+	if len(s.Args) == 0 {
+		return string(s.Op)
+	}
+	return fmt.Sprintf("%s(%s)", s.Op, strings.Join(s.Args, ", "))
+}
+
+// Recipe is a parsed strategy.
+type Recipe struct {
+	Splits  []Position
+	Delay   [2]int // milliseconds
+	Fakes   []Fake
+	Reorder bool
+
+	steps []Step
+}
+
+// String returns the canonical form of the recipe, which parses back into
+// the same recipe.
+func (r *Recipe) String() string {
+	s := make([]string, len(r.steps))
+	for i, step := range r.steps {
+		s[i] = step.String()
+	}
+	return strings.Join(s, " ")
+}
+
+// Fake is a decoy ClientHello sent ahead of the real one.
+type Fake struct {
+	Host string
+	// BadVersion sends the decoy in a record with version 0x0000, which a
+	// TLS server rejects but a lenient middlebox may still parse.
+	BadVersion bool
+}
+
+// Marker is a reference point for a Position.
+type Marker string
+
+const (
+	MarkerStart  Marker = ""
+	MarkerSNI    Marker = "sni"
+	MarkerMidSNI Marker = "midsni"
+	MarkerSNIEnd Marker = "sniend"
+)
+
+// Position is an offset relative to a marker.
+type Position struct {
+	Marker Marker
+	Offset int
+}
+
+// Resolve turns p into an absolute offset, given where the hostname is
+// within the packet. sniStart is -1 when the packet carries no SNI.
+func (p Position) Resolve(sniStart, sniLen int) (int, error) {
+	base := 0
+	if p.Marker != MarkerStart {
+		if sniStart < 0 {
+			return 0, fmt.Errorf("position %q needs an SNI", p)
+		}
+		switch p.Marker {
+		case MarkerSNI:
+			base = sniStart
+		case MarkerMidSNI:
+			base = sniStart + sniLen/2
+		case MarkerSNIEnd:
+			base = sniStart + sniLen
+		}
+	}
+	return base + p.Offset, nil
+}
+
+func (p Position) String() string {
+	switch {
+	case p.Marker == MarkerStart:
+		return strconv.Itoa(p.Offset)
+	case p.Offset > 0:
+		return fmt.Sprintf("%s+%d", p.Marker, p.Offset)
+	case p.Offset < 0:
+		return fmt.Sprintf("%s%d", p.Marker, p.Offset)
+	default:
+		return string(p.Marker)
+	}
+}
+
+func parsePosition(s string) (Position, error) {
+	if n, err := strconv.Atoi(s); err == nil {
+		if n < 0 {
+			return Position{}, fmt.Errorf("negative offset %d", n)
+		}
+		return Position{Offset: n}, nil
+	}
+
+	name, off, sign := s, "", 1
+	if i := strings.IndexAny(s, "+-"); i >= 0 {
+		name, off = s[:i], s[i+1:]
+		if s[i] == '-' {
+			sign = -1
+		}
+	}
+
+	p := Position{Marker: Marker(name)}
+	switch p.Marker {
+	case MarkerSNI, MarkerMidSNI, MarkerSNIEnd:
+	default:
+		return Position{}, fmt.Errorf("unknown marker %q", name)
+	}
+
+	if off != "" {
+		n, err := strconv.Atoi(off)
+		if err != nil || n < 0 {
+			return Position{}, fmt.Errorf("invalid offset %q", off)
+		}
+		p.Offset = sign * n
+	}
+	return p, nil
+}
+
+// MustParse is like Parse but panics on error. It is meant for recipes
+// built into the program.
+func MustParse(src string) *Recipe {
+	r, err := Parse(src)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// Parse parses a recipe.
+func Parse(src string) (*Recipe, error) {
+	steps, err := tokenize(src)
+	if err != nil {
+		return nil, err
+	}
+	if len(steps) == 0 {
+		return nil, errors.New("recipe: empty recipe")
+	}
+
+	r := &Recipe{steps: steps}
+	for _, step := range steps {
+		if err := r.apply(step); err != nil {
+			return nil, fmt.Errorf("recipe: %s: %w", step, err)
+		}
+	}
+	return r, nil
+}
+
+func (r *Recipe) apply(step Step) error {
+	switch step.Op {
+	case OpSplit:
+		if len(step.Args) == 0 {
+			return errors.New("needs at least one position")
+		}
+		for _, arg := range step.Args {
+			p, err := parsePosition(arg)
+			if err != nil {
+				return err
+			}
+			r.Splits = append(r.Splits, p)
+		}
+	case OpDelay:
+		if len(step.Args) != 1 && len(step.Args) != 2 {
+			return errors.New("needs one or two durations in milliseconds")
+		}
+		for i, arg := range step.Args {
+			n, err := strconv.Atoi(arg)
+			if err != nil || n < 0 {
+				return fmt.Errorf("invalid duration %q", arg)
+			}
+			r.Delay[i] = n
+		}
+		if len(step.Args) == 1 {
+			r.Delay[1] = r.Delay[0]
+		}
+		if r.Delay[1] < r.Delay[0] {
+			return errors.New("max delay is smaller than min delay")
+		}
+	case OpFake:
+		if len(step.Args) != 1 && len(step.Args) != 2 {
+			return errors.New("needs a hostname and an optional \"badversion\" flag")
+		}
+		f := Fake{Host: step.Args[0]}
+		if len(step.Args) == 2 {
+			if step.Args[1] != "badversion" {
+				return fmt.Errorf("unknown flag %q", step.Args[1])
+			}
+			f.BadVersion = true
+		}
+		r.Fakes = append(r.Fakes, f)
+	case OpReorder:
+		if len(step.Args) != 0 {
+			return errors.New("takes no arguments")
+		}
+		r.Reorder = true
+	default:
+		return fmt.Errorf("unknown primitive %q", step.Op)
+	}
+	return nil
+}
+
+// tokenize splits the source into steps, without validating them.
+func tokenize(src string) ([]Step, error) {
+	var (
+		steps []Step
+		line  = 1
+	)
+
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+		case c == ';' || unicode.IsSpace(rune(c)):
+			i++
+		case c == '#':
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case isIdent(c):
+			start := i
+			for i < len(src) && isIdent(src[i]) {
+				i++
+			}
+			step := Step{Op: Op(src[start:i])}
+
+			if i < len(src) && src[i] == '(' {
+				end := strings.IndexByte(src[i:], ')')
+				if end < 0 {
+					return nil, fmt.Errorf("recipe: line %d: missing ')'", line)
+				}
+				for _, arg := range strings.Split(src[i+1:i+end], ",") {
+					arg = strings.TrimSpace(arg)
+					if arg == "" {
+						return nil, fmt.Errorf("recipe: line %d: empty argument to %s", line, step.Op)
+					}
+					step.Args = append(step.Args, arg)
+				}
+				i += end + 1
+			}
+			steps = append(steps, step)
+		default:
+			return nil, fmt.Errorf("recipe: line %d: unexpected character %q", line, c)
+		}
+	}
+
+	return steps, nil
+}
+
+func isIdent(c byte) bool {
+	return c == '_' || c == '.' || c == '+' || c == '-' ||
+		('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+}
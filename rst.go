@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// helloClock notes when an attempt's TLS handshake started, which is when
+// its ClientHello went out, and when the handshake failed, to tell how long
+// a reset took to come. Resets injected by a middlebox on seeing the
+// ClientHello typically come sooner than the server could answer.
+type helloClock struct {
+	mu     sync.Mutex
+	sent   time.Time
+	failed time.Time
+}
+
+type helloClockKey struct{}
+
+func (c *helloClock) hello() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sent, c.failed = time.Now(), time.Time{}
+}
+
+func (c *helloClock) fail() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failed = time.Now()
+}
+
+// addTimeToRST records how long after the ClientHello the attempt's
+// connection was reset, if it failed with a reset during the handshake.
+func (res *TestAttemptResult) addTimeToRST(c *helloClock) {
+	if res.Err == nil || res.Err.Class != ErrorClassReset {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sent.IsZero() || c.failed.IsZero() {
+		return
+	}
+	res.TimeToRST = c.failed.Sub(c.sent)
+}
+
+// rstCell returns the results table cell for the average time to RST of
+// the attempts that were reset, or "-" if none were.
+func rstCell(testResult TestResult) string {
+	var (
+		total time.Duration
+		n     int
+	)
+	for _, attempt := range testResult.Attempts {
+		if attempt.TimeToRST > 0 {
+			total += attempt.TimeToRST
+			n++
+		}
+	}
+	if n == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f ms", float64(total/time.Duration(n))/float64(time.Millisecond))
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"runtime"
+	"time"
+
+	"github.com/carlmjohnson/versioninfo"
+)
+
+// runInfo describes a run in the reports, so that archived results can
+// still be told apart and interpreted.
+type runInfo struct {
+	ID      string
+	Start   time.Time
+	End     time.Time // zero while the run goes on, as when streaming
+	Version string
+	OS      string
+	Labels  []string // from --label, e.g. "office-wifi"
+}
+
+// newRunInfo returns the runInfo of a run starting now.
+func newRunInfo(labels []string) *runInfo {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return &runInfo{
+		ID:      hex.EncodeToString(id),
+		Start:   time.Now(),
+		Version: heybabeVersion(),
+		OS:      runtime.GOOS + "/" + runtime.GOARCH,
+		Labels:  labels,
+	}
+}
+
+// heybabeVersion is the version set at build time, or else the one from
+// the build info.
+func heybabeVersion() string {
+	if version != "" {
+		return version
+	}
+	return versioninfo.Short()
+}
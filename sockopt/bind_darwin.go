@@ -0,0 +1,19 @@
+//go:build darwin
+
+package sockopt
+
+import (
+	"net"
+	"syscall"
+)
+
+func bindToDevice(fd uintptr, v6 bool, name string) error {
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return err
+	}
+	if v6 {
+		return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_BOUND_IF, ifi.Index)
+	}
+	return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_BOUND_IF, ifi.Index)
+}
@@ -0,0 +1,9 @@
+//go:build linux
+
+package sockopt
+
+import "syscall"
+
+func bindToDevice(fd uintptr, v6 bool, name string) error {
+	return syscall.BindToDevice(int(fd), name)
+}
@@ -0,0 +1,7 @@
+//go:build !linux && !darwin && !windows
+
+package sockopt
+
+func bindToDevice(fd uintptr, v6 bool, name string) error {
+	return ErrUnsupported
+}
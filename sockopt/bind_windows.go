@@ -0,0 +1,30 @@
+//go:build windows
+
+package sockopt
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+)
+
+// Not defined by the syscall package.
+const (
+	ipUnicastIf   = 31
+	ipv6UnicastIf = 31
+)
+
+func bindToDevice(fd uintptr, v6 bool, name string) error {
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return err
+	}
+	if v6 {
+		return syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IPV6, ipv6UnicastIf, ifi.Index)
+	}
+
+	// IP_UNICAST_IF takes the index in network byte order.
+	var idx [4]byte
+	binary.BigEndian.PutUint32(idx[:], uint32(ifi.Index))
+	return syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IP, ipUnicastIf, int(binary.NativeEndian.Uint32(idx[:])))
+}
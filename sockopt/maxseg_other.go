@@ -0,0 +1,7 @@
+//go:build !unix || aix
+
+package sockopt
+
+func setMaxSeg(fd uintptr, mss int) error {
+	return ErrUnsupported
+}
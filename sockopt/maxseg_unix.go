@@ -0,0 +1,9 @@
+//go:build unix && !aix
+
+package sockopt
+
+import "syscall"
+
+func setMaxSeg(fd uintptr, mss int) error {
+	return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_MAXSEG, mss)
+}
@@ -0,0 +1,134 @@
+// Package sockopt sets socket options on already established connections,
+// for strategies that need to change how the kernel sends a few packets.
+package sockopt
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// ErrUnsupported is returned when the connection does not expose a file
+// descriptor, or the platform does not support the option.
+var ErrUnsupported = errors.New("sockopt: unsupported connection or platform")
+
+// control runs fn against the file descriptor backing c.
+func control(c net.Conn, fn func(fd uintptr) error) error {
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		return ErrUnsupported
+	}
+
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var opErr error
+	if err := rc.Control(func(fd uintptr) { opErr = fn(fd) }); err != nil {
+		return err
+	}
+	return opErr
+}
+
+// isIPv6 reports whether c is talking to an IPv6 peer, which decides whether
+// IPv4 or IPv6 level options apply.
+func isIPv6(c net.Conn) bool {
+	var ip net.IP
+	switch a := c.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	default:
+		return false
+	}
+	return ip.To4() == nil
+}
+
+// Option is a socket option that can be applied to a socket before it
+// connects, through DialControl.
+type Option func(fd uintptr, v6 bool) error
+
+// DialControl returns a function for net.Dialer.Control (or
+// net.ListenConfig.Control) that applies opts to the socket.
+func DialControl(opts ...Option) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		v6 := strings.HasSuffix(network, "6")
+		var opErr error
+		err := c.Control(func(fd uintptr) {
+			for _, opt := range opts {
+				if opErr = opt(fd, v6); opErr != nil {
+					return
+				}
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return opErr
+	}
+}
+
+// MaxSeg limits the TCP maximum segment size, so the kernel itself splits
+// writes into segments of at most mss bytes. Linux doesn't accept values
+// below 88.
+func MaxSeg(mss int) Option {
+	return func(fd uintptr, v6 bool) error { return setMaxSeg(fd, mss) }
+}
+
+// BindToDevice makes the socket send through the named network interface,
+// whatever the routing table says. It uses SO_BINDTODEVICE on Linux,
+// IP_BOUND_IF on macOS and IP_UNICAST_IF on Windows.
+func BindToDevice(name string) Option {
+	return func(fd uintptr, v6 bool) error { return bindToDevice(fd, v6, name) }
+}
+
+// DSCP marks the packets sent on the socket with the given DiffServ code
+// point, through the TOS byte (or IPv6 traffic class).
+func DSCP(dscp int) Option {
+	return func(fd uintptr, v6 bool) error {
+		if err := setTOS(fd, v6, dscp<<2); err != nil {
+			return err
+		}
+		if v6 {
+			// IPv4 traffic on a dual-stack socket goes by the TOS instead.
+			// IPv6-only sockets may refuse it, which is fine.
+			_ = setTOS(fd, false, dscp<<2)
+		}
+		return nil
+	}
+}
+
+// HopLimit sets the IP TTL (or IPv6 hop limit) of the packets sent on the
+// socket.
+func HopLimit(ttl int) Option {
+	return func(fd uintptr, v6 bool) error {
+		if err := setTTL(fd, v6, ttl); err != nil {
+			return err
+		}
+		if v6 {
+			// Same as for DSCP, IPv4 traffic on a dual-stack socket.
+			_ = setTTL(fd, false, ttl)
+		}
+		return nil
+	}
+}
+
+// SetTTL sets the IP TTL (or IPv6 hop limit) of packets sent on c.
+func SetTTL(c net.Conn, ttl int) error {
+	v6 := isIPv6(c)
+	return control(c, func(fd uintptr) error { return setTTL(fd, v6, ttl) })
+}
+
+// TTL returns the IP TTL (or IPv6 hop limit) of packets sent on c.
+func TTL(c net.Conn) (int, error) {
+	var ttl int
+	v6 := isIPv6(c)
+	err := control(c, func(fd uintptr) (err error) {
+		ttl, err = getTTL(fd, v6)
+		return err
+	})
+	return ttl, err
+}
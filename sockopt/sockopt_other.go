@@ -0,0 +1,15 @@
+//go:build !unix && !windows
+
+package sockopt
+
+func setTTL(fd uintptr, v6 bool, ttl int) error {
+	return ErrUnsupported
+}
+
+func getTTL(fd uintptr, v6 bool) (int, error) {
+	return 0, ErrUnsupported
+}
+
+func setTOS(fd uintptr, v6 bool, tos int) error {
+	return ErrUnsupported
+}
@@ -0,0 +1,37 @@
+//go:build windows
+
+package sockopt
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+func setTTL(fd uintptr, v6 bool, ttl int) error {
+	if v6 {
+		return syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS, ttl)
+	}
+	return syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IP, syscall.IP_TTL, ttl)
+}
+
+func getTTL(fd uintptr, v6 bool) (int, error) {
+	level, opt := syscall.IPPROTO_IP, syscall.IP_TTL
+	if v6 {
+		level, opt = syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS
+	}
+
+	var ttl int32
+	l := int32(unsafe.Sizeof(ttl))
+	err := syscall.Getsockopt(syscall.Handle(fd), int32(level), int32(opt), (*byte)(unsafe.Pointer(&ttl)), &l)
+	return int(ttl), err
+}
+
+// Not defined by the syscall package.
+const ipv6TClass = 39
+
+func setTOS(fd uintptr, v6 bool, tos int) error {
+	if v6 {
+		return syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IPV6, ipv6TClass, tos)
+	}
+	return syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+}
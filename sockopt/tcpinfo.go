@@ -0,0 +1,57 @@
+package sockopt
+
+import (
+	"sync"
+	"time"
+)
+
+// TCPInfo is what the kernel knows about a TCP connection, from TCP_INFO.
+type TCPInfo struct {
+	RTT    time.Duration // smoothed round trip time
+	RTTVar time.Duration // its variation
+	// Retransmits is how many segments were retransmitted over the
+	// connection's life.
+	Retransmits int
+	// Closed is set when the kernel tore the connection down before the
+	// program closed it. Once connected, that means a RST came.
+	Closed bool
+}
+
+// TCPInfoWatcher keeps a duplicate of a socket's file descriptor, so
+// TCP_INFO can still be read once the program is done with the connection,
+// even after closing it. It only works on Linux.
+type TCPInfoWatcher struct {
+	mu sync.Mutex
+	fd uintptr
+	ok bool
+}
+
+// Watch duplicates fd to read TCP_INFO from later, replacing the socket
+// watched so far.
+func (w *TCPInfoWatcher) Watch(fd uintptr) error {
+	dup, err := dupFD(fd)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.ok {
+		closeFD(w.fd)
+	}
+	w.fd, w.ok = dup, true
+	return nil
+}
+
+// Release reads TCP_INFO of the watched socket, and lets it go. It returns
+// false if no socket was watched or TCP_INFO couldn't be read.
+func (w *TCPInfoWatcher) Release() (TCPInfo, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.ok {
+		return TCPInfo{}, false
+	}
+	info, err := tcpInfo(w.fd)
+	closeFD(w.fd)
+	w.ok = false
+	return info, err == nil
+}
@@ -0,0 +1,45 @@
+//go:build linux
+
+package sockopt
+
+import (
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// tcpClose is TCP_CLOSE, the state of a connection torn down by the kernel.
+const tcpClose = 7
+
+func dupFD(fd uintptr) (uintptr, error) {
+	// Like the os package, hold the fork lock so that the descriptor
+	// doesn't leak into a child before it's marked close-on-exec.
+	syscall.ForkLock.RLock()
+	defer syscall.ForkLock.RUnlock()
+	dup, err := syscall.Dup(int(fd))
+	if err != nil {
+		return 0, err
+	}
+	syscall.CloseOnExec(dup)
+	return uintptr(dup), nil
+}
+
+func closeFD(fd uintptr) {
+	syscall.Close(int(fd))
+}
+
+func tcpInfo(fd uintptr) (TCPInfo, error) {
+	var ti syscall.TCPInfo
+	l := uint32(unsafe.Sizeof(ti))
+	_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.IPPROTO_TCP, syscall.TCP_INFO,
+		uintptr(unsafe.Pointer(&ti)), uintptr(unsafe.Pointer(&l)), 0)
+	if errno != 0 {
+		return TCPInfo{}, errno
+	}
+	return TCPInfo{
+		RTT:         time.Duration(ti.Rtt) * time.Microsecond,
+		RTTVar:      time.Duration(ti.Rttvar) * time.Microsecond,
+		Retransmits: int(ti.Total_retrans),
+		Closed:      ti.State == tcpClose,
+	}, nil
+}
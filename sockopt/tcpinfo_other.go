@@ -0,0 +1,13 @@
+//go:build !linux
+
+package sockopt
+
+func dupFD(fd uintptr) (uintptr, error) {
+	return 0, ErrUnsupported
+}
+
+func closeFD(fd uintptr) {}
+
+func tcpInfo(fd uintptr) (TCPInfo, error) {
+	return TCPInfo{}, ErrUnsupported
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/fatih/color"
+)
+
+// streamer prints the results of each test as soon as it finishes, for
+// --stream.
+type streamer struct {
+	l       *slog.Logger
+	network *networkInfo
+	run     *runInfo
+	table   *streamTable   // nil when the attempts are written to stdout instead
+	out     *attemptWriter // nil without --output
+	outFile *os.File       // nil when the attempts are written to stdout
+}
+
+// newStreamer opens the --output destination for to, if any, and sizes the
+// table for the tests to run.
+func newStreamer(l *slog.Logger, to TestOptions, network *networkInfo, run *runInfo) (*streamer, error) {
+	s := &streamer{l: l, network: network, run: run}
+	if to.Output != "" {
+		w := os.Stdout
+		if to.OutputFile != "" {
+			f, err := os.Create(to.OutputFile)
+			if err != nil {
+				return nil, err
+			}
+			w, s.outFile = f, f
+		}
+		aw, err := newAttemptWriter(w, to.Output)
+		if err != nil {
+			s.close()
+			return nil, err
+		}
+		s.out = aw
+	}
+	if to.Output == "" || to.OutputFile != "" {
+		var labels []string
+		for _, tc := range buildSuite(to) {
+			labels = append(labels, tc.label)
+		}
+		s.table = newStreamTable(labels)
+	}
+	return s, nil
+}
+
+// writeControl writes the control host's attempts, which run before the
+// tests and aren't part of the streamed table.
+func (s *streamer) writeControl(cr controlResult) {
+	if s.out == nil {
+		return
+	}
+	results, order := withControl(cr, nil, nil)
+	if err := s.out.write(attemptRecords(results, order, s.network, s.run)); err != nil {
+		s.l.Warn("failed to write output", "error", err)
+	}
+}
+
+// testDone prints the results of a test that finished, as TestOptions'
+// OnTestDone.
+func (s *streamer) testDone(label string, results []TestResult) {
+	if s.table != nil {
+		for _, tr := range results {
+			s.table.printRow(tr, label)
+		}
+	}
+	if s.out != nil {
+		records := attemptRecords(map[string][]TestResult{label: results}, []string{label}, s.network, s.run)
+		if err := s.out.write(records); err != nil {
+			s.l.Warn("failed to write output", "error", err)
+		}
+	}
+}
+
+func (s *streamer) close() error {
+	if s.table != nil && s.table.widths != nil {
+		fmt.Println("")
+	}
+	if s.outFile != nil {
+		return s.outFile.Close()
+	}
+	return nil
+}
+
+// streamTable prints the results table a row at a time. Unlike printTable
+// it can't size the columns from all the rows, so the Test Method column is
+// sized from all the labels up front and the others from the first row.
+// There's no TTFB column, as whether any test probes isn't known up front.
+type streamTable struct {
+	labelWidth int
+	widths     []int // set when the header is printed
+}
+
+var streamColumns = []string{"Test Method", "SNI", "IP:Port", "Handshake Status", "DNS Time", "Setup Time", "Transport Time", "TLS Handshake Time"}
+
+func newStreamTable(labels []string) *streamTable {
+	st := &streamTable{labelWidth: len(streamColumns[0])}
+	for _, label := range labels {
+		st.labelWidth = max(st.labelWidth, len(label))
+	}
+	return st
+}
+
+func (st *streamTable) printRow(tr TestResult, label string) {
+	row, _ := tableRow(label, tr)
+	cells := make([]string, len(row))
+	for i, v := range row {
+		cells[i] = fmt.Sprint(v)
+	}
+
+	if st.widths == nil {
+		headerFmt := color.New(color.FgHiMagenta, color.Bold, color.Underline).SprintfFunc()
+		st.widths = make([]int, len(streamColumns))
+		st.widths[0] = st.labelWidth
+		for i := 1; i < len(streamColumns); i++ {
+			st.widths[i] = max(len(streamColumns[i]), len(cells[i]))
+		}
+
+		var header []string
+		for i, h := range streamColumns {
+			header = append(header, headerFmt("%-*s", st.widths[i], h))
+		}
+		fmt.Printf("\n%s\n", strings.Join(header, "  "))
+	}
+
+	columnFmt := color.New(color.FgHiCyan, color.Bold).SprintfFunc()
+	for i, c := range cells {
+		cells[i] = fmt.Sprintf("%-*s", st.widths[i], c)
+	}
+	cells[0] = columnFmt("%s", cells[0])
+	fmt.Println(strings.Join(cells, "  "))
+}
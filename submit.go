@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// submission is the anonymized record of a run that --submit uploads: how
+// each test fared against each SNI, from which AS and country. The client's
+// IP is only in it when consented to, and the labels, which may name
+// places, never are.
+type submission struct {
+	RunID    string             `json:"run_id"`
+	Start    time.Time          `json:"start"`
+	End      time.Time          `json:"end"`
+	Version  string             `json:"version"`
+	OS       string             `json:"os"`
+	ASN      int                `json:"asn,omitempty"`
+	ASName   string             `json:"as_name,omitempty"`
+	Country  string             `json:"country,omitempty"`
+	PublicIP string             `json:"public_ip,omitempty"`
+	Results  []submissionResult `json:"results"`
+}
+
+// submissionResult is how a test fared against an SNI, leaving out the
+// server addresses and the errors, which may reveal the client's.
+type submissionResult struct {
+	Test      string `json:"test"`
+	SNI       string `json:"sni"`
+	Successes int    `json:"successes"`
+	Attempts  int    `json:"attempts"`
+}
+
+// newSubmission returns the submission of a run's results, with the
+// public IP only if shareIP.
+func newSubmission(run *runInfo, ni *networkInfo, shareIP bool, results map[string][]TestResult, order []string) submission {
+	s := submission{
+		RunID:   run.ID,
+		Start:   run.Start,
+		End:     run.End,
+		Version: run.Version,
+		OS:      run.OS,
+		Results: []submissionResult{},
+	}
+	if ni != nil {
+		s.ASN, s.ASName, s.Country = ni.ASN, ni.ASName, ni.Country
+		if shareIP {
+			s.PublicIP = ni.PublicIP.String()
+		}
+	}
+	for _, r := range historyRecords(results, order, run.End) {
+		s.Results = append(s.Results, submissionResult{
+			Test:      testID(r.Test),
+			SNI:       r.SNI,
+			Successes: r.Successes,
+			Attempts:  r.Attempts,
+		})
+	}
+	return s
+}
+
+// submit uploads s to the collector at url as JSON, with the socket
+// settings from ctx.
+func submit(ctx context.Context, url string, s submission) error {
+	body, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	dialer := &net.Dialer{
+		Timeout:   5 * time.Second,
+		LocalAddr: localAddr(ctx),
+		Control:   dialControl(ctx),
+	}
+	client := &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &http.Transport{DialContext: dialer.DialContext},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// targetURL is a target given as a URL, like https://example.com:8443/path.
+type targetURL struct {
+	host string     // hostname, empty if the URL has an IP
+	addr netip.Addr // IP, if the URL has one instead of a hostname
+	port uint16
+	path string
+}
+
+// parseTargetURL parses an https URL, or a bare host[:port] taken as one.
+func parseTargetURL(s string) (targetURL, error) {
+	if !strings.Contains(s, "://") {
+		s = "https://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return targetURL{}, err
+	}
+	if u.Scheme != "https" {
+		return targetURL{}, fmt.Errorf("unsupported scheme %q, only https", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return targetURL{}, errors.New("no host")
+	}
+
+	t := targetURL{port: 443, path: u.EscapedPath()}
+	if p := u.Port(); p != "" {
+		port, err := strconv.ParseUint(p, 10, 16)
+		if err != nil || port == 0 {
+			return targetURL{}, fmt.Errorf("invalid port %q", p)
+		}
+		t.port = uint16(port)
+	}
+	if addr, err := netip.ParseAddr(u.Hostname()); err == nil {
+		t.addr = addr.Unmap()
+	} else {
+		t.host = u.Hostname()
+	}
+	return t, nil
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"github.com/markpash/heybabe/sockopt"
+)
+
+// tcpInfoKey is the context key of the sockopt.TCPInfoWatcher that
+// dialControl hands an attempt's TCP sockets to.
+type tcpInfoKey struct{}
+
+// addTCPInfo records what the kernel knew about the attempt's connection.
+// An EOF or unclassified failure on a connection the kernel tore down was
+// really a reset the error didn't let through.
+func (res *TestAttemptResult) addTCPInfo(info sockopt.TCPInfo) {
+	res.TCPInfo = &info
+	if res.TransportEstablishDuration == 0 || !info.Closed || res.Err == nil {
+		return
+	}
+	if res.Err.Class == ErrorClassEOF || res.Err.Class == ErrorClassOther {
+		res.Err.Class = ErrorClassReset
+	}
+}
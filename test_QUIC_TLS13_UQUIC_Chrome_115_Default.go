@@ -21,7 +21,7 @@ func test_QUIC_TLS13_UQUIC_Chrome_115_Default(ctx context.Context, l *slog.Logge
 	counter, _, _, _ := runtime.Caller(0)
 	l = l.With("test", strings.Split(runtime.FuncForPC(counter).Name(), ".")[1], "ip", addrPort.Addr().String())
 
-	l.Debug("starting QUIC TLS13 UQUIC Chrome 115 Default test", 
+	l.Debug("starting QUIC TLS13 UQUIC Chrome 115 Default test",
 		"target", addrPort.String(),
 		"sni", sni)
 
@@ -30,31 +30,34 @@ func test_QUIC_TLS13_UQUIC_Chrome_115_Default(ctx context.Context, l *slog.Logge
 	l.Debug("configuring TLS and QUIC connection")
 	tlsConfig := tls.Config{
 		ServerName:         sni,
-		InsecureSkipVerify: false,
+		InsecureSkipVerify: insecure(ctx),
 		CipherSuites:       nil,
 		MinVersion:         tls.VersionTLS13,
 		MaxVersion:         tls.VersionTLS13,
 		CurvePreferences:   nil,
-		NextProtos:         []string{"h3"},
+		NextProtos:         quicNextProtos(ctx),
 	}
 
-	quicConf := &quic.Config{}
+	retry := &retryTracer{}
+	quicConf := wireTracer(ctx, retry.config(&quic.Config{}))
 
 	l.Debug("creating UDP socket for QUIC")
-	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4zero, Port: 0})
+	udpConn, err := listenUDP(ctx)
 	if err != nil {
 		l.Error("failed to create UDP socket", "error", err)
-		res.err = err
+		res.Err = newTestError(err)
 		return res
 	}
+	defer udpConn.Close()
 
 	l.Debug("getting QUIC spec for Chrome 115")
 	quicSpec, err := quic.QUICID2Spec(quic.QUICChrome_115)
 	if err != nil {
 		l.Error("failed to get QUIC spec", "error", err)
-		res.err = err
+		res.Err = newTestError(err)
 		return res
 	}
+	setALPN(quicSpec.ClientHelloSpec, tlsConfig.NextProtos)
 
 	ut := &quic.UTransport{
 		Transport: &quic.Transport{Conn: udpConn},
@@ -64,17 +67,21 @@ func test_QUIC_TLS13_UQUIC_Chrome_115_Default(ctx context.Context, l *slog.Logge
 	t0 := time.Now()
 	l.Debug("dialing QUIC connection")
 	quicConn, err := ut.Dial(ctx, net.UDPAddrFromAddrPort(addrPort), &tlsConfig, quicConf)
+	res.RetryDuration = retry.since(t0)
 	if err != nil {
-		l.Error("failed to establish QUIC connection", "error", err)
-		res.err = err
+		l.Error("failed to establish QUIC connection", "error", err, "retry_duration", res.RetryDuration)
+		res.Err = newTestError(err)
 		return res
 	}
 	defer quicConn.CloseWithError(quic.ApplicationErrorCode(quic.NoError), "")
 	res.TransportEstablishDuration = time.Since(t0)
 	l.Debug("QUIC connection established", "duration", res.TransportEstablishDuration)
+	res.CertError = verifyPeer(ctx, l, sni, quicConn.ConnectionState().TLS.PeerCertificates)
+	res.Negotiated = negotiatedState(quicConn.ConnectionState().TLS)
 
-	l.Info("test completed successfully", 
+	l.Info("test completed successfully",
 		"handshake_complete", quicConn.ConnectionState().TLS.HandshakeComplete,
-		"transport_duration", res.TransportEstablishDuration)
+		"transport_duration", res.TransportEstablishDuration,
+		"retry_duration", res.RetryDuration)
 	return res
 }
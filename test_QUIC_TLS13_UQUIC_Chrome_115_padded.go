@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/netip"
+	"runtime"
+	"strings"
+	"time"
+
+	// This is for systems that don't have a good set of roots. (update often)
+	_ "golang.org/x/crypto/x509roots/fallback"
+
+	quic "github.com/refraction-networking/uquic"
+	tls "github.com/refraction-networking/utls"
+)
+
+// quicMaxDatagram is the largest UDP payload uQUIC sends, which fits a 1500
+// byte MTU over both IPv4 and IPv6.
+const quicMaxDatagram = 1452
+
+// quicMinDatagram is the smallest datagram a client may carry its Initial
+// in (RFC 9000 section 14.1).
+const quicMinDatagram = 1200
+
+// quicChaffCount is how many decoy datagrams are sent ahead of the Initial.
+const quicChaffCount = 3
+
+// test_QUIC_TLS13_UQUIC_Chrome_115_padded pads the Initial to the max size.
+var test_QUIC_TLS13_UQUIC_Chrome_115_padded = test_QUIC_TLS13_UQUIC_Chrome_115_pad(quicMaxDatagram, 0)
+
+// test_QUIC_TLS13_UQUIC_Chrome_115_padded_chaff also sends decoy datagrams
+// first, for DPI that only looks at the first datagram of a flow.
+var test_QUIC_TLS13_UQUIC_Chrome_115_padded_chaff = test_QUIC_TLS13_UQUIC_Chrome_115_pad(quicMaxDatagram, quicChaffCount)
+
+// quicSizeLabel is the label of the QUIC datagram size sweep test for size.
+func quicSizeLabel(size int) string {
+	return fmt.Sprintf("Padded Initial %dB - QUIC - TLS 1.3 - uQUIC Chrome 115", size)
+}
+
+// test_QUIC_TLS13_UQUIC_Chrome_115_pad returns a uQUIC connection test with
+// the Chrome 115 spec, where the datagram carrying the Initial is padded to
+// size bytes instead of Chrome's size, after sending chaff random datagrams
+// to the server.
+func test_QUIC_TLS13_UQUIC_Chrome_115_pad(size, chaff int) testFunc {
+	return func(ctx context.Context, l *slog.Logger, addrPort netip.AddrPort, sni string) TestAttemptResult {
+		counter, _, _, _ := runtime.Caller(0)
+		l = l.With("test", strings.Split(runtime.FuncForPC(counter).Name(), ".")[1], "ip", addrPort.Addr().String())
+
+		l.Debug("starting QUIC TLS13 UQUIC Chrome 115 padded test",
+			"target", addrPort.String(),
+			"sni", sni,
+			"size", size,
+			"chaff", chaff)
+
+		res := TestAttemptResult{}
+
+		l.Debug("configuring TLS and QUIC connection")
+		tlsConfig := tls.Config{
+			ServerName:         sni,
+			InsecureSkipVerify: insecure(ctx),
+			CipherSuites:       nil,
+			MinVersion:         tls.VersionTLS13,
+			MaxVersion:         tls.VersionTLS13,
+			CurvePreferences:   nil,
+			NextProtos:         quicNextProtos(ctx),
+		}
+
+		retry := &retryTracer{}
+		quicConf := wireTracer(ctx, retry.config(&quic.Config{}))
+
+		l.Debug("creating UDP socket for QUIC")
+		udpConn, err := listenUDP(ctx)
+		if err != nil {
+			l.Error("failed to create UDP socket", "error", err)
+			res.Err = newTestError(err)
+			return res
+		}
+		defer udpConn.Close()
+
+		l.Debug("getting QUIC spec for Chrome 115")
+		quicSpec, err := quic.QUICID2Spec(quic.QUICChrome_115)
+		if err != nil {
+			l.Error("failed to get QUIC spec", "error", err)
+			res.Err = newTestError(err)
+			return res
+		}
+		setALPN(quicSpec.ClientHelloSpec, tlsConfig.NextProtos)
+		quicSpec.UDPDatagramMinSize = size
+
+		ut := &quic.UTransport{
+			Transport: &quic.Transport{Conn: udpConn},
+			QUICSpec:  &quicSpec,
+		}
+
+		t0 := time.Now()
+		for i := range chaff {
+			datagram, err := quicChaff()
+			if err != nil {
+				l.Error("failed to generate chaff datagram", "error", err)
+				res.Err = newTestError(err)
+				return res
+			}
+			l.Debug("sending chaff datagram", "index", i, "length", len(datagram))
+			if _, err := udpConn.WriteToUDPAddrPort(datagram, addrPort); err != nil {
+				l.Error("failed to send chaff datagram", "error", err)
+				res.Err = newTestError(err)
+				return res
+			}
+			wireDatagram(ctx, len(datagram), true)
+		}
+
+		l.Debug("dialing QUIC connection")
+		quicConn, err := ut.Dial(ctx, net.UDPAddrFromAddrPort(addrPort), &tlsConfig, quicConf)
+		res.RetryDuration = retry.since(t0)
+		if err != nil {
+			l.Error("failed to establish QUIC connection", "error", err, "retry_duration", res.RetryDuration)
+			res.Err = newTestError(err)
+			return res
+		}
+		defer quicConn.CloseWithError(quic.ApplicationErrorCode(quic.NoError), "")
+		res.TransportEstablishDuration = time.Since(t0)
+		l.Debug("QUIC connection established", "duration", res.TransportEstablishDuration)
+		res.CertError = verifyPeer(ctx, l, sni, quicConn.ConnectionState().TLS.PeerCertificates)
+		res.Negotiated = negotiatedState(quicConn.ConnectionState().TLS)
+
+		l.Info("test completed successfully",
+			"handshake_complete", quicConn.ConnectionState().TLS.HandshakeComplete,
+			"transport_duration", res.TransportEstablishDuration,
+			"retry_duration", res.RetryDuration)
+		return res
+	}
+}
+
+// quicChaff returns a random datagram of a random size up to
+// quicMaxDatagram. The first byte has the long header and fixed bits set so
+// it passes a quick look as a QUIC packet, but servers drop it since nothing
+// else in it parses.
+func quicChaff() ([]byte, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(quicMaxDatagram-100))
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 100+n.Int64())
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	b[0] |= 0xc0
+	return b, nil
+}
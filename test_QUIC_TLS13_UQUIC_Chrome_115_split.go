@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/netip"
+	"runtime"
+	"strings"
+	"time"
+
+	// This is for systems that don't have a good set of roots. (update often)
+	_ "golang.org/x/crypto/x509roots/fallback"
+
+	"github.com/markpash/heybabe/quicsplit"
+	quic "github.com/refraction-networking/uquic"
+	tls "github.com/refraction-networking/utls"
+)
+
+// test_QUIC_TLS13_UQUIC_Chrome_115_split sends each half of the
+// ClientHello in its own datagram.
+var test_QUIC_TLS13_UQUIC_Chrome_115_split = test_QUIC_TLS13_UQUIC_Chrome_115_split_initial(false)
+
+// test_QUIC_TLS13_UQUIC_Chrome_115_split_coalesced sends both halves in a
+// single datagram, as two coalesced Initial packets.
+var test_QUIC_TLS13_UQUIC_Chrome_115_split_coalesced = test_QUIC_TLS13_UQUIC_Chrome_115_split_initial(true)
+
+// test_QUIC_TLS13_UQUIC_Chrome_115_split_initial returns a uQUIC connection
+// test with the Chrome 115 spec, where the ClientHello is split in the
+// middle of the SNI across two Initial packets, so DPI that only decrypts
+// the first one can't read the SNI.
+func test_QUIC_TLS13_UQUIC_Chrome_115_split_initial(coalesce bool) testFunc {
+	return func(ctx context.Context, l *slog.Logger, addrPort netip.AddrPort, sni string) TestAttemptResult {
+		counter, _, _, _ := runtime.Caller(0)
+		l = l.With("test", strings.Split(runtime.FuncForPC(counter).Name(), ".")[1], "ip", addrPort.Addr().String())
+
+		l.Debug("starting QUIC TLS13 UQUIC Chrome 115 split Initial test",
+			"target", addrPort.String(),
+			"sni", sni,
+			"coalesce", coalesce)
+
+		res := TestAttemptResult{}
+
+		l.Debug("configuring TLS and QUIC connection")
+		tlsConfig := tls.Config{
+			ServerName:         sni,
+			InsecureSkipVerify: insecure(ctx),
+			CipherSuites:       nil,
+			MinVersion:         tls.VersionTLS13,
+			MaxVersion:         tls.VersionTLS13,
+			CurvePreferences:   nil,
+			NextProtos:         quicNextProtos(ctx),
+		}
+
+		retry := &retryTracer{}
+		quicConf := wireTracer(ctx, retry.config(&quic.Config{}))
+
+		l.Debug("creating UDP socket for QUIC")
+		udpConn, err := listenUDP(ctx)
+		if err != nil {
+			l.Error("failed to create UDP socket", "error", err)
+			res.Err = newTestError(err)
+			return res
+		}
+		defer udpConn.Close()
+
+		splitConn := quicsplit.Wrap(udpConn, sni, l)
+		splitConn.Coalesce = coalesce
+
+		l.Debug("getting QUIC spec for Chrome 115")
+		quicSpec, err := quic.QUICID2Spec(quic.QUICChrome_115)
+		if err != nil {
+			l.Error("failed to get QUIC spec", "error", err)
+			res.Err = newTestError(err)
+			return res
+		}
+		setALPN(quicSpec.ClientHelloSpec, tlsConfig.NextProtos)
+
+		ut := &quic.UTransport{
+			Transport: &quic.Transport{Conn: splitConn},
+			QUICSpec:  &quicSpec,
+		}
+
+		t0 := time.Now()
+		l.Debug("dialing QUIC connection")
+		quicConn, err := ut.Dial(ctx, net.UDPAddrFromAddrPort(addrPort), &tlsConfig, quicConf)
+		res.RetryDuration = retry.since(t0)
+		if err != nil {
+			l.Error("failed to establish QUIC connection", "error", err, "retry_duration", res.RetryDuration)
+			res.Err = newTestError(err)
+			return res
+		}
+		defer quicConn.CloseWithError(quic.ApplicationErrorCode(quic.NoError), "")
+		res.TransportEstablishDuration = time.Since(t0)
+		l.Debug("QUIC connection established", "duration", res.TransportEstablishDuration)
+		res.CertError = verifyPeer(ctx, l, sni, quicConn.ConnectionState().TLS.PeerCertificates)
+		res.Negotiated = negotiatedState(quicConn.ConnectionState().TLS)
+
+		l.Info("test completed successfully",
+			"handshake_complete", quicConn.ConnectionState().TLS.HandshakeComplete,
+			"transport_duration", res.TransportEstablishDuration,
+			"retry_duration", res.RetryDuration)
+		return res
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// greasedQUICVersion is a reserved QUIC version, of the 0x?a?a?a?a form
+// that no server may support (RFC 9000 section 15).
+const greasedQUICVersion = 0x1a2a3a4a
+
+// versionProbeInterval is how long to wait for a Version Negotiation
+// packet before sending the probe again, as UDP may lose either.
+const versionProbeInterval = time.Second
+
+// test_QUIC_version_negotiation sends an Initial packet with a reserved
+// QUIC version, which servers must answer with a Version Negotiation
+// packet, to find middleboxes that drop QUIC versions they don't know
+// rather than QUIC altogether. There's no TLS handshake, so the transport
+// duration is the time to the Version Negotiation packet.
+func test_QUIC_version_negotiation(ctx context.Context, l *slog.Logger, addrPort netip.AddrPort, sni string) TestAttemptResult {
+	counter, _, _, _ := runtime.Caller(0)
+	l = l.With("test", strings.Split(runtime.FuncForPC(counter).Name(), ".")[1], "ip", addrPort.Addr().String())
+
+	l.Debug("starting QUIC version negotiation test",
+		"target", addrPort.String(),
+		"sni", sni,
+		"version", fmt.Sprintf("0x%08x", greasedQUICVersion))
+
+	res := TestAttemptResult{}
+
+	l.Debug("creating UDP socket for QUIC")
+	udpConn, err := listenUDP(ctx)
+	if err != nil {
+		l.Error("failed to create UDP socket", "error", err)
+		res.Err = newTestError(err)
+		return res
+	}
+	defer udpConn.Close()
+
+	dcid, scid := make([]byte, 8), make([]byte, 8)
+	rand.Read(dcid)
+	rand.Read(scid)
+	probe := versionProbe(dcid, scid)
+
+	t0 := time.Now()
+	buf := make([]byte, 1500)
+	for {
+		l.Debug("sending Initial with reserved version")
+		if _, err := udpConn.WriteToUDPAddrPort(probe, addrPort); err != nil {
+			l.Error("failed to send Initial", "error", err)
+			res.Err = newTestError(err)
+			return res
+		}
+		wireDatagram(ctx, len(probe), true)
+
+		deadline, last := time.Now().Add(versionProbeInterval), false
+		if d, ok := ctx.Deadline(); ok && !d.After(deadline) {
+			deadline, last = d, true
+		}
+		udpConn.SetReadDeadline(deadline)
+		n, from, err := udpConn.ReadFromUDPAddrPort(buf)
+		if errors.Is(err, os.ErrDeadlineExceeded) && !last && ctx.Err() == nil {
+			continue
+		}
+		if err != nil {
+			l.Error("no Version Negotiation packet", "error", err)
+			res.Err = newTestError(err)
+			return res
+		}
+		wireDatagram(ctx, n, false)
+		if from.Addr().Unmap() != addrPort.Addr().Unmap() {
+			l.Debug("ignoring datagram from another address", "from", from)
+			continue
+		}
+
+		versions, err := parseVersionNegotiation(buf[:n], dcid, scid)
+		if err != nil {
+			l.Error("invalid Version Negotiation packet", "error", err)
+			res.Err = newTestError(err)
+			return res
+		}
+		res.TransportEstablishDuration = time.Since(t0)
+
+		l.Info("test completed successfully",
+			"transport_duration", res.TransportEstablishDuration,
+			"versions", versions)
+		return res
+	}
+}
+
+// versionProbe returns an Initial packet with the reserved version, dcid
+// and scid, padded to the 1200 bytes servers need to answer it. Since no
+// server can parse the rest, the packet number and payload are random.
+func versionProbe(dcid, scid []byte) []byte {
+	const size = 1200
+	b := []byte{0xc3} // long header, Initial, 4 byte packet number
+	b = binary.BigEndian.AppendUint32(b, greasedQUICVersion)
+	b = append(b, byte(len(dcid)))
+	b = append(b, dcid...)
+	b = append(b, byte(len(scid)))
+	b = append(b, scid...)
+	b = append(b, 0) // token length
+	rest := size - len(b) - 2
+	b = binary.BigEndian.AppendUint16(b, 0x4000|uint16(rest)) // 2 byte varint length
+	payload := make([]byte, rest)
+	rand.Read(payload)
+	return append(b, payload...)
+}
+
+// parseVersionNegotiation parses a Version Negotiation packet answering a
+// probe with dcid and scid, which it must echo swapped, and returns the
+// versions the server supports.
+func parseVersionNegotiation(b, dcid, scid []byte) ([]string, error) {
+	if len(b) < 7 || b[0]&0x80 == 0 {
+		return nil, errors.New("not a long header packet")
+	}
+	if v := binary.BigEndian.Uint32(b[1:]); v != 0 {
+		return nil, fmt.Errorf("long header packet with version 0x%08x", v)
+	}
+	b = b[5:]
+
+	readCID := func() ([]byte, error) {
+		if len(b) < 1 || len(b) < 1+int(b[0]) {
+			return nil, errors.New("truncated connection ID")
+		}
+		cid := b[1 : 1+b[0]]
+		b = b[1+b[0]:]
+		return cid, nil
+	}
+	gotDCID, err := readCID()
+	if err != nil {
+		return nil, err
+	}
+	gotSCID, err := readCID()
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(gotDCID, scid) || !bytes.Equal(gotSCID, dcid) {
+		return nil, errors.New("connection IDs don't match the probe")
+	}
+	if len(b) == 0 || len(b)%4 != 0 {
+		return nil, fmt.Errorf("version list of %d bytes", len(b))
+	}
+
+	var versions []string
+	for ; len(b) > 0; b = b[4:] {
+		versions = append(versions, quicVersionName(binary.BigEndian.Uint32(b)))
+	}
+	return versions, nil
+}
+
+// quicVersionName names a QUIC version for the logs.
+func quicVersionName(v uint32) string {
+	switch {
+	case v == 0x00000001:
+		return "v1"
+	case v == 0x6b3343cf:
+		return "v2"
+	case v&0xffffff00 == 0xff000000:
+		return fmt.Sprintf("draft-%d", v&0xff)
+	case v&0x0f0f0f0f == 0x0a0a0a0a:
+		return "reserved"
+	}
+	return fmt.Sprintf("0x%08x", v)
+}
@@ -23,7 +23,7 @@ func test_TCP_TLS12_Default(ctx context.Context, l *slog.Logger, addrPort netip.
 	counter, _, _, _ := runtime.Caller(0)
 	l = l.With("test", strings.Split(runtime.FuncForPC(counter).Name(), ".")[1], "ip", addrPort.Addr().String())
 
-	l.Debug("starting TCP TLS12 Default test", 
+	l.Debug("starting TCP TLS12 Default test",
 		"target", addrPort.String(),
 		"sni", sni)
 
@@ -32,11 +32,12 @@ func test_TCP_TLS12_Default(ctx context.Context, l *slog.Logger, addrPort netip.
 	// Initiate TCP connection
 	l.Debug("initiating TCP connection")
 	tcpDialer := net.Dialer{
-		Timeout:       5 * time.Second,
-		LocalAddr:     nil,
+		Timeout:       dialTimeout(ctx),
+		LocalAddr:     localAddr(ctx),
 		FallbackDelay: -1, // disable happy-eyeballs
-		KeepAlive:     15, // default
+		KeepAlive:     keepAlive(ctx),
 		Resolver:      &net.Resolver{PreferGo: true},
+		Control:       dialControl(ctx),
 	}
 	tcpDialer.SetMultipathTCP(false)
 
@@ -44,21 +45,23 @@ func test_TCP_TLS12_Default(ctx context.Context, l *slog.Logger, addrPort netip.
 	tcpConn, err := tcpDialer.DialContext(ctx, "tcp", addrPort.String())
 	if err != nil {
 		l.Error("failed to establish TCP connection", "error", err)
-		res.err = err
+		res.Err = newTestError(err)
 		return res
 	}
 	defer tcpConn.Close()
+	tcpConn = wire(ctx, tcpConn)
 	res.TransportEstablishDuration = time.Since(t0)
 	l.Debug("TCP connection established", "duration", res.TransportEstablishDuration)
 
 	l.Debug("configuring TLS connection")
 	tlsConfig := tls.Config{
 		ServerName:         sni,
-		InsecureSkipVerify: false,
+		InsecureSkipVerify: insecure(ctx),
 		CipherSuites:       nil,
 		MinVersion:         tls.VersionTLS12,
 		MaxVersion:         tls.VersionTLS12,
-		CurvePreferences:   nil,
+		CurvePreferences:   curvePreferences(ctx),
+		NextProtos:         nextProtos(ctx),
 	}
 
 	tlsConn := tls.Client(tcpConn, &tlsConfig)
@@ -67,16 +70,18 @@ func test_TCP_TLS12_Default(ctx context.Context, l *slog.Logger, addrPort netip.
 	// Explicitly run the handshake
 	l.Debug("starting TLS handshake")
 	t0 = time.Now()
-	if err := tlsConn.HandshakeContext(ctx); err != nil {
+	if err := handshake(ctx, tlsConn); err != nil {
 		l.Error("TLS handshake failed", "error", err)
-		res.err = err
+		res.Err = newTestError(err)
 		return res
 	}
 	res.TLSHandshakeDuration = time.Since(t0)
 	l.Debug("TLS handshake completed", "duration", res.TLSHandshakeDuration)
 
 	tlsState := tlsConn.ConnectionState()
-	l.Info("test completed successfully", 
+	res.CertError = verifyPeer(ctx, l, sni, tlsState.PeerCertificates)
+	res.Negotiated = stdNegotiatedState(tlsState)
+	l.Info("test completed successfully",
 		"handshake_complete", tlsState.HandshakeComplete,
 		"transport_duration", res.TransportEstablishDuration,
 		"tls_duration", res.TLSHandshakeDuration)
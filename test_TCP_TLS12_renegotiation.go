@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"runtime"
+	"strings"
+	"time"
+
+	// This is for systems that don't have a good set of roots. (update often)
+	_ "golang.org/x/crypto/x509roots/fallback"
+)
+
+// test_TCP_TLS12_renegotiation is a go crypto/tls connection using:
+// TCP
+// ECDHE AES-GCM cipher suites
+// forced TLS1.2
+// default elliptic curve preferences
+// And, once the handshake is done, a client initiated secure renegotiation,
+// to find middleboxes that kill renegotiating connections. crypto/tls can't
+// renegotiate as a client, so the new ClientHello is encrypted by hand with
+// the keys from the key log. The server may refuse it with an alert, which
+// still counts as a success: only a connection that dies fails.
+func test_TCP_TLS12_renegotiation(ctx context.Context, l *slog.Logger, addrPort netip.AddrPort, sni string) TestAttemptResult {
+	counter, _, _, _ := runtime.Caller(0)
+	l = l.With("test", strings.Split(runtime.FuncForPC(counter).Name(), ".")[1], "ip", addrPort.Addr().String())
+
+	l.Debug("starting TCP TLS12 renegotiation test",
+		"target", addrPort.String(),
+		"sni", sni)
+
+	res := TestAttemptResult{}
+
+	// Initiate TCP connection
+	l.Debug("initiating TCP connection")
+	tcpDialer := net.Dialer{
+		Timeout:       dialTimeout(ctx),
+		LocalAddr:     localAddr(ctx),
+		FallbackDelay: -1, // disable happy-eyeballs
+		KeepAlive:     keepAlive(ctx),
+		Resolver:      &net.Resolver{PreferGo: true},
+		Control:       dialControl(ctx),
+	}
+	tcpDialer.SetMultipathTCP(false)
+
+	t0 := time.Now()
+	tcpConn, err := tcpDialer.DialContext(ctx, "tcp", addrPort.String())
+	if err != nil {
+		l.Error("failed to establish TCP connection", "error", err)
+		res.Err = newTestError(err)
+		return res
+	}
+	defer tcpConn.Close()
+	tcpConn = wire(ctx, tcpConn)
+	res.TransportEstablishDuration = time.Since(t0)
+	l.Debug("TCP connection established", "duration", res.TransportEstablishDuration)
+
+	l.Debug("configuring TLS connection")
+	var keyLog bytes.Buffer
+	tlsConfig := tls.Config{
+		ServerName:         sni,
+		InsecureSkipVerify: insecure(ctx),
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		},
+		MinVersion:       tls.VersionTLS12,
+		MaxVersion:       tls.VersionTLS12,
+		CurvePreferences: curvePreferences(ctx),
+		NextProtos:       nextProtos(ctx),
+		KeyLogWriter:     &keyLog,
+	}
+
+	// The server random isn't in the connection state, so it's taken
+	// from the ServerHello as it's read.
+	recorder := &handshakeRecorder{Conn: tcpConn}
+	tlsConn := tls.Client(recorder, &tlsConfig)
+
+	// Explicitly run the handshake
+	l.Debug("starting TLS handshake")
+	t0 = time.Now()
+	if err := handshake(ctx, tlsConn); err != nil {
+		l.Error("TLS handshake failed", "error", err)
+		res.Err = newTestError(err)
+		return res
+	}
+	res.TLSHandshakeDuration = time.Since(t0)
+	l.Debug("TLS handshake completed", "duration", res.TLSHandshakeDuration)
+
+	tlsState := tlsConn.ConnectionState()
+	res.CertError = verifyPeer(ctx, l, sni, tlsState.PeerCertificates)
+	res.Negotiated = stdNegotiatedState(tlsState)
+
+	record, err := renegotiationRecord(tlsState, keyLog.String(), serverRandom(recorder.stop()), sni)
+	if err != nil {
+		l.Error("failed to build renegotiation ClientHello", "error", err)
+		res.Err = newTestError(err)
+		return res
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		tcpConn.SetDeadline(deadline)
+	}
+	l.Debug("starting renegotiation")
+	t0 = time.Now()
+	if _, err := tcpConn.Write(record); err != nil {
+		l.Error("failed to send renegotiation ClientHello", "error", err)
+		res.Err = newTestError(err)
+		return res
+	}
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(tcpConn, header); err != nil {
+		l.Error("connection died after renegotiation ClientHello", "error", err)
+		res.Err = newTestError(err)
+		return res
+	}
+	res.TTFBDuration = time.Since(t0)
+
+	outcome := fmt.Sprintf("record type %d", header[0])
+	switch header[0] {
+	case 0x16:
+		outcome = "accepted"
+	case 0x15:
+		outcome = "refused with an alert"
+	}
+	l.Info("test completed successfully",
+		"handshake_complete", tlsState.HandshakeComplete,
+		"transport_duration", res.TransportEstablishDuration,
+		"tls_duration", res.TLSHandshakeDuration,
+		"renegotiation", outcome,
+		"renegotiation_duration", res.TTFBDuration)
+	return res
+}
+
+// serverRandom returns the random of the ServerHello at the start of read,
+// or nil if it's too short. The record header, handshake header and
+// version come before it.
+func serverRandom(read []byte) []byte {
+	const offset = 5 + 4 + 2
+	if len(read) < offset+32 {
+		return nil
+	}
+	return read[offset : offset+32]
+}
+
+// renegotiationRecord returns a ClientHello for a secure renegotiation of the
+// connection in state, encrypted as the client's second record with the keys
+// derived from the master secret in keyLog.
+func renegotiationRecord(state tls.ConnectionState, keyLog string, serverRandom []byte, sni string) ([]byte, error) {
+	if serverRandom == nil {
+		return nil, errors.New("no ServerHello recorded")
+	}
+	clientRandom, masterSecret := keyLogSecret(keyLog, "CLIENT_RANDOM")
+	if clientRandom == nil || masterSecret == nil {
+		return nil, errors.New("no master secret in the key log")
+	}
+
+	newHash, keyLen := sha256.New, 16
+	switch state.CipherSuite {
+	case tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384, tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384:
+		newHash, keyLen = sha512.New384, 32
+	}
+	// key_block is client and server write keys, then client and server
+	// implicit IVs.
+	keyBlock := prf12(newHash, masterSecret, "key expansion", append(bytes.Clone(serverRandom), clientRandom...), 2*keyLen+2*4)
+	key, iv := keyBlock[:keyLen], keyBlock[2*keyLen:2*keyLen+4]
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// The Finished message was record 0 under these keys.
+	const seq = 1
+	plaintext := renegotiationHello(state.CipherSuite, state.TLSUnique, sni)
+	explicit := binary.BigEndian.AppendUint64(nil, seq)
+	nonce := append(bytes.Clone(iv), explicit...)
+	ad := binary.BigEndian.AppendUint64(nil, seq)
+	ad = append(ad, 0x16, 0x03, 0x03, byte(len(plaintext)>>8), byte(len(plaintext)))
+
+	payload := aead.Seal(explicit, nonce, plaintext, ad)
+	record := []byte{0x16, 0x03, 0x03, byte(len(payload) >> 8), byte(len(payload))}
+	return append(record, payload...), nil
+}
+
+// renegotiationHello returns a TLS 1.2 ClientHello handshake message
+// offering suite, with the renegotiation_info extension carrying
+// clientVerifyData, the verify_data of the client's Finished message.
+func renegotiationHello(suite uint16, clientVerifyData []byte, sni string) []byte {
+	ext := func(b []byte, id uint16, data []byte) []byte {
+		b = binary.BigEndian.AppendUint16(b, id)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(data)))
+		return append(b, data...)
+	}
+
+	var exts []byte
+	exts = ext(exts, 0xff01, append([]byte{byte(len(clientVerifyData))}, clientVerifyData...)) // renegotiation_info
+	name := []byte{0}
+	name = binary.BigEndian.AppendUint16(name, uint16(len(sni)))
+	name = append(name, sni...)
+	exts = ext(exts, 0x0000, append(binary.BigEndian.AppendUint16(nil, uint16(len(name))), name...)) // server_name
+	exts = ext(exts, 0x000a, []byte{0x00, 0x04, 0x00, 0x1d, 0x00, 0x17})                             // supported_groups: X25519, P-256
+	exts = ext(exts, 0x000b, []byte{0x01, 0x00})                                                     // ec_point_formats: uncompressed
+	exts = ext(exts, 0x000d, []byte{0x00, 0x08, 0x04, 0x03, 0x08, 0x04, 0x04, 0x01, 0x05, 0x01})     // signature_algorithms
+	exts = ext(exts, 0x0017, nil)                                                                    // extended_master_secret
+
+	body := []byte{0x03, 0x03}
+	random := make([]byte, 32)
+	rand.Read(random)
+	body = append(body, random...)
+	body = append(body, 0)                        // session_id
+	body = binary.BigEndian.AppendUint16(body, 2) // cipher_suites
+	body = binary.BigEndian.AppendUint16(body, suite)
+	body = append(body, 1, 0) // compression_methods: null
+	body = binary.BigEndian.AppendUint16(body, uint16(len(exts)))
+	body = append(body, exts...)
+
+	msg := []byte{0x01, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}
+	return append(msg, body...)
+}
+
+// prf12 is the TLS 1.2 PRF of RFC 5246 section 5, P_hash with HMAC.
+func prf12(newHash func() hash.Hash, secret []byte, label string, seed []byte, n int) []byte {
+	seed = append([]byte(label), seed...)
+	mac := hmac.New(newHash, secret)
+	var out []byte
+	a := seed
+	for len(out) < n {
+		mac.Reset()
+		mac.Write(a)
+		a = mac.Sum(nil)
+		mac.Reset()
+		mac.Write(a)
+		mac.Write(seed)
+		out = mac.Sum(out)
+	}
+	return out[:n]
+}
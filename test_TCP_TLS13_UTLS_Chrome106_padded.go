@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"runtime"
+	"strings"
+	"time"
+
+	// This is for systems that don't have a good set of roots. (update often)
+	_ "golang.org/x/crypto/x509roots/fallback"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// test_TCP_TLS13_UTLS_Chrome106_padded returns a uTLS connection test using:
+// TCP
+// default cipher suites
+// forced TLS1.3
+// default elliptic curve preferences
+// utls.HelloChrome_106_Shuffle
+// And the ClientHello padded to size bytes with the padding extension, to
+// find out if the DPI only inspects hellos within some size range. Chrome 106
+// is used because it is the newest Chrome fingerprint small enough (no
+// post-quantum key share) to be padded to around 512 bytes.
+func test_TCP_TLS13_UTLS_Chrome106_padded(size int) testFunc {
+	return func(ctx context.Context, l *slog.Logger, addrPort netip.AddrPort, sni string) TestAttemptResult {
+		counter, _, _, _ := runtime.Caller(0)
+		l = l.With("test", strings.Split(runtime.FuncForPC(counter).Name(), ".")[1], "ip", addrPort.Addr().String())
+
+		l.Debug("starting TCP TLS13 UTLS Chrome106 padded test",
+			"target", addrPort.String(),
+			"sni", sni,
+			"size", size)
+
+		res := TestAttemptResult{}
+
+		// Initiate TCP connection
+		l.Debug("initiating TCP connection")
+		tcpDialer := net.Dialer{
+			Timeout:       dialTimeout(ctx),
+			LocalAddr:     localAddr(ctx),
+			FallbackDelay: -1, // disable happy-eyeballs
+			KeepAlive:     keepAlive(ctx),
+			Resolver:      &net.Resolver{PreferGo: true},
+			Control:       dialControl(ctx),
+		}
+		tcpDialer.SetMultipathTCP(false)
+
+		t0 := time.Now()
+		tcpConn, err := tcpDialer.DialContext(ctx, "tcp", addrPort.String())
+		if err != nil {
+			l.Error("failed to establish TCP connection", "error", err)
+			res.Err = newTestError(err)
+			return res
+		}
+		defer tcpConn.Close()
+		tcpConn = wire(ctx, tcpConn)
+		res.TransportEstablishDuration = time.Since(t0)
+		l.Debug("TCP connection established", "duration", res.TransportEstablishDuration)
+
+		l.Debug("configuring TLS connection")
+		tlsConfig := tls.Config{
+			ServerName:         sni,
+			InsecureSkipVerify: insecure(ctx),
+			CipherSuites:       nil,
+			MinVersion:         tls.VersionTLS13,
+			MaxVersion:         tls.VersionTLS13,
+			CurvePreferences:   nil,
+		}
+
+		tlsConn, err := uClient(ctx, tcpConn, &tlsConfig, tls.HelloChrome_106_Shuffle)
+		if err != nil {
+			l.Error("failed to create uTLS client", "error", err)
+			res.Err = newTestError(err)
+			return res
+		}
+		defer tlsConn.Close()
+
+		l.Debug("padding ClientHello", "size", size)
+		if err := padClientHello(tlsConn, size); err != nil {
+			l.Warn("can't pad ClientHello to size, skipping test", "error", err)
+			res.Err = newTestError(&skipError{reason: "hello too large", err: err})
+			return res
+		}
+
+		// Explicitly run the handshake
+		l.Debug("starting TLS handshake")
+		t0 = time.Now()
+		if err := handshake(ctx, tlsConn); err != nil {
+			l.Error("TLS handshake failed", "error", err)
+			res.Err = newTestError(err)
+			return res
+		}
+		res.TLSHandshakeDuration = time.Since(t0)
+		l.Debug("TLS handshake completed", "duration", res.TLSHandshakeDuration)
+
+		tlsState := tlsConn.ConnectionState()
+		res.CertError = verifyPeer(ctx, l, sni, tlsState.PeerCertificates)
+		res.Negotiated = uNegotiated(tlsConn)
+		l.Info("test completed successfully",
+			"handshake_complete", tlsState.HandshakeComplete,
+			"transport_duration", res.TransportEstablishDuration,
+			"tls_duration", res.TLSHandshakeDuration)
+		return res
+	}
+}
+
+// padClientHello makes the ClientHello message of uconn exactly size bytes
+// long, using its padding extension.
+func padClientHello(uconn *tls.UConn, size int) error {
+	if err := uconn.BuildHandshakeState(); err != nil {
+		return err
+	}
+
+	var padding *tls.UtlsPaddingExtension
+	for _, ext := range uconn.Extensions {
+		if p, ok := ext.(*tls.UtlsPaddingExtension); ok {
+			padding = p
+		}
+	}
+	if padding == nil {
+		return errors.New("fingerprint has no padding extension")
+	}
+	padding.GetPaddingLen = tls.AlwaysPadToLen(size)
+
+	// Marshal again with the new padding.
+	if err := uconn.BuildHandshakeState(); err != nil {
+		return err
+	}
+	if n := len(uconn.HandshakeState.Hello.Raw); n != size {
+		return fmt.Errorf("ClientHello is %d bytes, can't pad to %d", n, size)
+	}
+	return nil
+}
@@ -25,7 +25,7 @@ func test_TCP_TLS13_UTLS_ChromeAuto_Default(ctx context.Context, l *slog.Logger,
 	counter, _, _, _ := runtime.Caller(0)
 	l = l.With("test", strings.Split(runtime.FuncForPC(counter).Name(), ".")[1], "ip", addrPort.Addr().String())
 
-	l.Debug("starting TCP TLS13 UTLS ChromeAuto Default test", 
+	l.Debug("starting TCP TLS13 UTLS ChromeAuto Default test",
 		"target", addrPort.String(),
 		"sni", sni)
 
@@ -34,11 +34,12 @@ func test_TCP_TLS13_UTLS_ChromeAuto_Default(ctx context.Context, l *slog.Logger,
 	// Initiate TCP connection
 	l.Debug("initiating TCP connection")
 	tcpDialer := net.Dialer{
-		Timeout:       5 * time.Second,
-		LocalAddr:     nil,
+		Timeout:       dialTimeout(ctx),
+		LocalAddr:     localAddr(ctx),
 		FallbackDelay: -1, // disable happy-eyeballs
-		KeepAlive:     15, // default
+		KeepAlive:     keepAlive(ctx),
 		Resolver:      &net.Resolver{PreferGo: true},
+		Control:       dialControl(ctx),
 	}
 	tcpDialer.SetMultipathTCP(false)
 
@@ -46,39 +47,47 @@ func test_TCP_TLS13_UTLS_ChromeAuto_Default(ctx context.Context, l *slog.Logger,
 	tcpConn, err := tcpDialer.DialContext(ctx, "tcp", addrPort.String())
 	if err != nil {
 		l.Error("failed to establish TCP connection", "error", err)
-		res.err = err
+		res.Err = newTestError(err)
 		return res
 	}
 	defer tcpConn.Close()
+	tcpConn = wire(ctx, tcpConn)
 	res.TransportEstablishDuration = time.Since(t0)
 	l.Debug("TCP connection established", "duration", res.TransportEstablishDuration)
 
 	l.Debug("configuring TLS connection")
 	tlsConfig := tls.Config{
 		ServerName:         sni,
-		InsecureSkipVerify: false,
+		InsecureSkipVerify: insecure(ctx),
 		CipherSuites:       nil,
 		MinVersion:         tls.VersionTLS13,
 		MaxVersion:         tls.VersionTLS13,
 		CurvePreferences:   nil,
 	}
 
-	tlsConn := tls.UClient(tcpConn, &tlsConfig, tls.HelloChrome_Auto)
+	tlsConn, err := uClient(ctx, tcpConn, &tlsConfig, tls.HelloChrome_Auto)
+	if err != nil {
+		l.Error("failed to create uTLS client", "error", err)
+		res.Err = newTestError(err)
+		return res
+	}
 	defer tlsConn.Close()
 
 	// Explicitly run the handshake
 	l.Debug("starting TLS handshake")
 	t0 = time.Now()
-	if err := tlsConn.HandshakeContext(ctx); err != nil {
+	if err := handshake(ctx, tlsConn); err != nil {
 		l.Error("TLS handshake failed", "error", err)
-		res.err = err
+		res.Err = newTestError(err)
 		return res
 	}
 	res.TLSHandshakeDuration = time.Since(t0)
 	l.Debug("TLS handshake completed", "duration", res.TLSHandshakeDuration)
 
 	tlsState := tlsConn.ConnectionState()
-	l.Info("test completed successfully", 
+	res.CertError = verifyPeer(ctx, l, sni, tlsState.PeerCertificates)
+	res.Negotiated = uNegotiated(tlsConn)
+	l.Info("test completed successfully",
 		"handshake_complete", tlsState.HandshakeComplete,
 		"transport_duration", res.TransportEstablishDuration,
 		"tls_duration", res.TLSHandshakeDuration)
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/netip"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+
+	// This is for systems that don't have a good set of roots. (update often)
+	_ "golang.org/x/crypto/x509roots/fallback"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// Codepoints of the application_settings (ALPS) extension. Chrome moved to
+// the new one in version 131, which HelloChrome_Auto already sends.
+const (
+	extensionALPS    = 17513
+	extensionALPSNew = 17613
+)
+
+// test_TCP_TLS13_UTLS_ChromeAuto_alps_old sends ALPS with the codepoint of
+// Chrome 130 and earlier, which most browsers in the wild still use.
+var test_TCP_TLS13_UTLS_ChromeAuto_alps_old = test_TCP_TLS13_UTLS_ChromeAuto_alps(extensionALPS)
+
+// test_TCP_TLS13_UTLS_ChromeAuto_no_alps leaves ALPS out, to find DPI keyed
+// on its presence.
+var test_TCP_TLS13_UTLS_ChromeAuto_no_alps = test_TCP_TLS13_UTLS_ChromeAuto_alps(0)
+
+// test_TCP_TLS13_UTLS_ChromeAuto_alps returns a uTLS connection test using:
+// TCP
+// default cipher suites
+// forced TLS1.3
+// default elliptic curve preferences
+// utls.HelloChrome_Auto
+// And the ALPS extension sent with codepoint, or left out if it's 0.
+func test_TCP_TLS13_UTLS_ChromeAuto_alps(codepoint uint16) testFunc {
+	return func(ctx context.Context, l *slog.Logger, addrPort netip.AddrPort, sni string) TestAttemptResult {
+		counter, _, _, _ := runtime.Caller(0)
+		l = l.With("test", strings.Split(runtime.FuncForPC(counter).Name(), ".")[1], "ip", addrPort.Addr().String())
+
+		l.Debug("starting TCP TLS13 UTLS ChromeAuto ALPS test",
+			"target", addrPort.String(),
+			"sni", sni,
+			"codepoint", codepoint)
+
+		res := TestAttemptResult{}
+
+		// Initiate TCP connection
+		l.Debug("initiating TCP connection")
+		tcpDialer := net.Dialer{
+			Timeout:       dialTimeout(ctx),
+			LocalAddr:     localAddr(ctx),
+			FallbackDelay: -1, // disable happy-eyeballs
+			KeepAlive:     keepAlive(ctx),
+			Resolver:      &net.Resolver{PreferGo: true},
+			Control:       dialControl(ctx),
+		}
+		tcpDialer.SetMultipathTCP(false)
+
+		t0 := time.Now()
+		tcpConn, err := tcpDialer.DialContext(ctx, "tcp", addrPort.String())
+		if err != nil {
+			l.Error("failed to establish TCP connection", "error", err)
+			res.Err = newTestError(err)
+			return res
+		}
+		defer tcpConn.Close()
+		tcpConn = wire(ctx, tcpConn)
+		res.TransportEstablishDuration = time.Since(t0)
+		l.Debug("TCP connection established", "duration", res.TransportEstablishDuration)
+
+		l.Debug("configuring TLS connection")
+		tlsConfig := tls.Config{
+			ServerName:         sni,
+			InsecureSkipVerify: insecure(ctx),
+			CipherSuites:       nil,
+			MinVersion:         tls.VersionTLS13,
+			MaxVersion:         tls.VersionTLS13,
+			CurvePreferences:   nil,
+		}
+
+		tlsConn, err := uClient(ctx, tcpConn, &tlsConfig, tls.HelloChrome_Auto)
+		if err != nil {
+			l.Error("failed to create uTLS client", "error", err)
+			res.Err = newTestError(err)
+			return res
+		}
+		defer tlsConn.Close()
+
+		l.Debug("setting ALPS extension")
+		if err := setALPS(tlsConn, codepoint); err != nil {
+			l.Error("failed to set ALPS extension", "error", err)
+			res.Err = newTestError(err)
+			return res
+		}
+
+		// Explicitly run the handshake
+		l.Debug("starting TLS handshake")
+		t0 = time.Now()
+		if err := handshake(ctx, tlsConn); err != nil {
+			l.Error("TLS handshake failed", "error", err)
+			res.Err = newTestError(err)
+			return res
+		}
+		res.TLSHandshakeDuration = time.Since(t0)
+		l.Debug("TLS handshake completed", "duration", res.TLSHandshakeDuration)
+
+		tlsState := tlsConn.ConnectionState()
+		res.CertError = verifyPeer(ctx, l, sni, tlsState.PeerCertificates)
+		res.Negotiated = uNegotiated(tlsConn)
+		l.Info("test completed successfully",
+			"handshake_complete", tlsState.HandshakeComplete,
+			"transport_duration", res.TransportEstablishDuration,
+			"tls_duration", res.TLSHandshakeDuration,
+			"alpn", tlsState.NegotiatedProtocol,
+			"alps_negotiated", tlsState.PeerApplicationSettings != nil)
+		return res
+	}
+}
+
+// setALPS replaces the ALPS extension of uconn with one using codepoint and
+// the same protocols, or removes it if codepoint is 0. Like moveSNILast,
+// this has to happen before uTLS marshals the ClientHello.
+func setALPS(uconn *tls.UConn, codepoint uint16) error {
+	if err := uconn.BuildHandshakeState(); err != nil {
+		return err
+	}
+
+	protocols := []string{"h2"}
+	i := slices.IndexFunc(uconn.Extensions, func(e tls.TLSExtension) bool {
+		switch e := e.(type) {
+		case *tls.ApplicationSettingsExtension:
+			protocols = e.SupportedProtocols
+			return true
+		case *tls.ApplicationSettingsExtensionNew:
+			protocols = e.SupportedProtocols
+			return true
+		}
+		return false
+	})
+
+	var alps tls.TLSExtension
+	switch codepoint {
+	case extensionALPS:
+		alps = &tls.ApplicationSettingsExtension{SupportedProtocols: protocols}
+	case extensionALPSNew:
+		alps = &tls.ApplicationSettingsExtensionNew{SupportedProtocols: protocols}
+	}
+	switch {
+	case alps == nil && i >= 0:
+		uconn.Extensions = slices.Delete(uconn.Extensions, i, i+1)
+	case alps != nil && i >= 0:
+		uconn.Extensions[i] = alps
+	case alps != nil:
+		uconn.Extensions = appendExtension(uconn.Extensions, alps)
+	}
+
+	// Marshal again with the new extension.
+	return uconn.BuildHandshakeState()
+}
@@ -16,82 +16,134 @@ import (
 	tls "github.com/refraction-networking/utls"
 )
 
-// test_TCP_TLS13_UTLS_ChromeAuto_bepass_fragment is a uTLS connection using:
+// bepass frag settings
+var bepassFragment = fragmentSettings{
+	BSL:   [2]int{2000, 2000}, // ChunksLengthBeforeSni
+	SL:    [2]int{1, 2},       // SniChunksLength
+	ASL:   [2]int{1, 2},       // ChunksLengthAfterSni
+	Delay: [2]int{10, 20},     // DelayBetweenChunks
+}
+
+// bepassDisorder is bepassFragment with the before-SNI chunk sent last.
+var bepassDisorder = fragmentSettings{
+	BSL:      bepassFragment.BSL,
+	SL:       bepassFragment.SL,
+	ASL:      bepassFragment.ASL,
+	Delay:    bepassFragment.Delay,
+	Disorder: true,
+}
+
+// fragmenter returns the tlsfrag.Fragmenter for fs.
+func (fs fragmentSettings) fragmenter() tlsfrag.Fragmenter {
+	var f tlsfrag.Fragmenter = &tlsfrag.SNIFragmenter{
+		BSL:        fs.BSL,
+		SL:         fs.SL,
+		ASL:        fs.ASL,
+		Delay:      fs.Delay,
+		SNISplitAt: fs.SNISplitAt,
+	}
+	if fs.Disorder {
+		f = &tlsfrag.Disorder{Fragmenter: f}
+	}
+	return f
+}
+
+// test_TCP_TLS13_UTLS_ChromeAuto_bepass_fragment uses the default bepass
+// fragment settings.
+var test_TCP_TLS13_UTLS_ChromeAuto_bepass_fragment = test_TCP_TLS13_UTLS_ChromeAuto_bepass(bepassFragment)
+
+// test_TCP_TLS13_UTLS_ChromeAuto_bepass_disorder sends the before-SNI chunk
+// out of order, because some DPI engines fail to reassemble that.
+var test_TCP_TLS13_UTLS_ChromeAuto_bepass_disorder = test_TCP_TLS13_UTLS_ChromeAuto_bepass(bepassDisorder)
+
+// test_TCP_TLS13_UTLS_ChromeAuto_bepass returns a uTLS connection test using:
 // TCP
 // default cipher suites
 // forced TLS1.3
 // default elliptic curve preferences
 // utls.HelloChrome_Auto
 // And the bepass fragmenting TCP connection!
-func test_TCP_TLS13_UTLS_ChromeAuto_bepass_fragment(ctx context.Context, l *slog.Logger, addrPort netip.AddrPort, sni string) TestAttemptResult {
-	counter, _, _, _ := runtime.Caller(0)
-	l = l.With("test", strings.Split(runtime.FuncForPC(counter).Name(), ".")[1], "ip", addrPort.Addr().String())
-
-	l.Debug("starting TCP TLS13 UTLS ChromeAuto bepass fragment test", 
-		"target", addrPort.String(),
-		"sni", sni)
-
-	res := TestAttemptResult{}
-
-	// Initiate TCP connection
-	l.Debug("initiating TCP connection")
-	tcpDialer := net.Dialer{
-		Timeout:       5 * time.Second,
-		LocalAddr:     nil,
-		FallbackDelay: -1, // disable happy-eyeballs
-		KeepAlive:     15, // default
-		Resolver:      &net.Resolver{PreferGo: true},
-	}
-	tcpDialer.SetMultipathTCP(false)
+func test_TCP_TLS13_UTLS_ChromeAuto_bepass(fs fragmentSettings) testFunc {
+	return func(ctx context.Context, l *slog.Logger, addrPort netip.AddrPort, sni string) TestAttemptResult {
+		counter, _, _, _ := runtime.Caller(0)
+		l = l.With("test", strings.Split(runtime.FuncForPC(counter).Name(), ".")[1], "ip", addrPort.Addr().String())
 
-	t0 := time.Now()
-	tcpConn, err := tcpDialer.DialContext(ctx, "tcp", addrPort.String())
-	if err != nil {
-		l.Error("failed to establish TCP connection", "error", err)
-		res.err = err
-		return res
-	}
-	defer tcpConn.Close()
-	res.TransportEstablishDuration = time.Since(t0)
-	l.Debug("TCP connection established", "duration", res.TransportEstablishDuration)
-
-	// bepass frag settings
-	bsl := [2]int{2000, 2000} // ChunksLengthBeforeSni
-	sl := [2]int{1, 2}        // SniChunksLength
-	asl := [2]int{1, 2}       // ChunksLengthAfterSni
-	delay := [2]int{10, 20}   // DelayBetweenChunks
-
-	l.Debug("creating TLS fragmentation adapter", "bsl", bsl, "sl", sl, "asl", asl, "delay", delay)
-	tcpTlsFragConn := tlsfrag.New(tcpConn, bsl, sl, asl, delay, l)
-
-	l.Debug("configuring TLS connection")
-	tlsConfig := tls.Config{
-		ServerName:         sni,
-		InsecureSkipVerify: false,
-		CipherSuites:       nil,
-		MinVersion:         tls.VersionTLS13,
-		MaxVersion:         tls.VersionTLS13,
-		CurvePreferences:   nil,
-	}
+		l.Debug("starting TCP TLS13 UTLS ChromeAuto bepass test",
+			"target", addrPort.String(),
+			"sni", sni)
+
+		res := TestAttemptResult{}
+
+		// Initiate TCP connection
+		l.Debug("initiating TCP connection")
+		tcpDialer := net.Dialer{
+			Timeout:       dialTimeout(ctx),
+			LocalAddr:     localAddr(ctx),
+			FallbackDelay: -1, // disable happy-eyeballs
+			KeepAlive:     keepAlive(ctx),
+			Resolver:      &net.Resolver{PreferGo: true},
+			Control:       dialControl(ctx),
+		}
+		tcpDialer.SetMultipathTCP(false)
+
+		t0 := time.Now()
+		tcpConn, err := tcpDialer.DialContext(ctx, "tcp", addrPort.String())
+		if err != nil {
+			l.Error("failed to establish TCP connection", "error", err)
+			res.Err = newTestError(err)
+			return res
+		}
+		defer tcpConn.Close()
+		tcpConn = wire(ctx, tcpConn)
+		res.TransportEstablishDuration = time.Since(t0)
+		l.Debug("TCP connection established", "duration", res.TransportEstablishDuration)
+
+		l.Debug("creating TLS fragmentation adapter", "bsl", fs.BSL, "sl", fs.SL, "asl", fs.ASL, "delay", fs.Delay,
+			"disorder", fs.Disorder, "sni_split_at", fs.SNISplitAt)
+		tcpTlsFragConn := tlsfrag.NewWithFragmenter(tcpConn, fs.fragmenter(), l)
+		tcpTlsFragConn.OnFirstWrite = func(s tlsfrag.Stats) { res.Fragments = &s }
+		tcpTlsFragConn.Context = ctx
+
+		l.Debug("configuring TLS connection")
+		tlsConfig := tls.Config{
+			ServerName:         sni,
+			InsecureSkipVerify: insecure(ctx),
+			CipherSuites:       nil,
+			MinVersion:         tls.VersionTLS13,
+			MaxVersion:         tls.VersionTLS13,
+			CurvePreferences:   nil,
+		}
+
+		tlsConn, err := uClient(ctx, tcpTlsFragConn, &tlsConfig, tls.HelloChrome_Auto)
+		if err != nil {
+			l.Error("failed to create uTLS client", "error", err)
+			res.Err = newTestError(err)
+			return res
+		}
+		defer tlsConn.Close()
 
-	tlsConn := tls.UClient(tcpTlsFragConn, &tlsConfig, tls.HelloChrome_Auto)
-	defer tlsConn.Close()
+		// Explicitly run the handshake
+		l.Debug("starting TLS handshake")
+		t0 = time.Now()
+		err = handshake(ctx, tlsConn)
+		res.SplitPositions = tcpTlsFragConn.SplitPositions()
+		if err != nil {
+			l.Error("TLS handshake failed", "error", err, "split_positions", res.SplitPositions, "fragments", res.Fragments)
+			res.Err = newTestError(err)
+			return res
+		}
+		res.TLSHandshakeDuration = time.Since(t0)
+		l.Debug("TLS handshake completed", "duration", res.TLSHandshakeDuration)
 
-	// Explicitly run the handshake
-	l.Debug("starting TLS handshake")
-	t0 = time.Now()
-	if err := tlsConn.HandshakeContext(ctx); err != nil {
-		l.Error("TLS handshake failed", "error", err)
-		res.err = err
+		tlsState := tlsConn.ConnectionState()
+		res.CertError = verifyPeer(ctx, l, sni, tlsState.PeerCertificates)
+		res.Negotiated = uNegotiated(tlsConn)
+		l.Info("test completed successfully",
+			"handshake_complete", tlsState.HandshakeComplete,
+			"transport_duration", res.TransportEstablishDuration,
+			"tls_duration", res.TLSHandshakeDuration,
+			"split_positions", res.SplitPositions,
+			"fragments", res.Fragments)
 		return res
 	}
-	res.TLSHandshakeDuration = time.Since(t0)
-	l.Debug("TLS handshake completed", "duration", res.TLSHandshakeDuration)
-
-	tlsState := tlsConn.ConnectionState()
-	l.Info("test completed successfully", 
-		"handshake_complete", tlsState.HandshakeComplete,
-		"transport_duration", res.TransportEstablishDuration,
-		"tls_duration", res.TLSHandshakeDuration)
-	return res
 }
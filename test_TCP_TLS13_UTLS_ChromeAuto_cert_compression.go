@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"log/slog"
+	"net"
+	"net/netip"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+
+	// This is for systems that don't have a good set of roots. (update often)
+	_ "golang.org/x/crypto/x509roots/fallback"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// test_TCP_TLS13_UTLS_ChromeAuto_cert_compression offers brotli and zlib
+// certificate compression (RFC 8879), to see whether the server compresses
+// its certificate, which changes the size of its flight.
+var test_TCP_TLS13_UTLS_ChromeAuto_cert_compression = test_TCP_TLS13_UTLS_ChromeAuto_compress_cert([]tls.CertCompressionAlgo{tls.CertCompressionBrotli, tls.CertCompressionZlib})
+
+// test_TCP_TLS13_UTLS_ChromeAuto_no_cert_compression doesn't offer
+// certificate compression, to find DPI keyed on the extension.
+var test_TCP_TLS13_UTLS_ChromeAuto_no_cert_compression = test_TCP_TLS13_UTLS_ChromeAuto_compress_cert(nil)
+
+// test_TCP_TLS13_UTLS_ChromeAuto_compress_cert returns a uTLS connection
+// test using:
+// TCP
+// default cipher suites
+// forced TLS1.3
+// default elliptic curve preferences
+// utls.HelloChrome_Auto
+// And the compress_certificate extension offering algs, or left out if
+// there are none.
+func test_TCP_TLS13_UTLS_ChromeAuto_compress_cert(algs []tls.CertCompressionAlgo) testFunc {
+	return func(ctx context.Context, l *slog.Logger, addrPort netip.AddrPort, sni string) TestAttemptResult {
+		counter, _, _, _ := runtime.Caller(0)
+		l = l.With("test", strings.Split(runtime.FuncForPC(counter).Name(), ".")[1], "ip", addrPort.Addr().String())
+
+		l.Debug("starting TCP TLS13 UTLS ChromeAuto cert compression test",
+			"target", addrPort.String(),
+			"sni", sni,
+			"algorithms", algs)
+
+		res := TestAttemptResult{}
+
+		// Initiate TCP connection
+		l.Debug("initiating TCP connection")
+		tcpDialer := net.Dialer{
+			Timeout:       dialTimeout(ctx),
+			LocalAddr:     localAddr(ctx),
+			FallbackDelay: -1, // disable happy-eyeballs
+			KeepAlive:     keepAlive(ctx),
+			Resolver:      &net.Resolver{PreferGo: true},
+			Control:       dialControl(ctx),
+		}
+		tcpDialer.SetMultipathTCP(false)
+
+		t0 := time.Now()
+		tcpConn, err := tcpDialer.DialContext(ctx, "tcp", addrPort.String())
+		if err != nil {
+			l.Error("failed to establish TCP connection", "error", err)
+			res.Err = newTestError(err)
+			return res
+		}
+		defer tcpConn.Close()
+		tcpConn = wire(ctx, tcpConn)
+		res.TransportEstablishDuration = time.Since(t0)
+		l.Debug("TCP connection established", "duration", res.TransportEstablishDuration)
+
+		l.Debug("configuring TLS connection")
+		var keyLog bytes.Buffer
+		tlsConfig := tls.Config{
+			ServerName:         sni,
+			InsecureSkipVerify: insecure(ctx),
+			CipherSuites:       nil,
+			MinVersion:         tls.VersionTLS13,
+			MaxVersion:         tls.VersionTLS13,
+			CurvePreferences:   nil,
+			KeyLogWriter:       &keyLog,
+		}
+
+		// The server's flight is encrypted, so it's recorded and
+		// decrypted with the handshake secret from the key log to see
+		// which certificate message it sent.
+		recorder := &handshakeRecorder{Conn: tcpConn}
+		tlsConn, err := uClient(ctx, recorder, &tlsConfig, tls.HelloChrome_Auto)
+		if err != nil {
+			l.Error("failed to create uTLS client", "error", err)
+			res.Err = newTestError(err)
+			return res
+		}
+		defer tlsConn.Close()
+
+		l.Debug("setting certificate compression algorithms")
+		if err := setCertCompression(tlsConn, algs); err != nil {
+			l.Error("failed to set certificate compression", "error", err)
+			res.Err = newTestError(err)
+			return res
+		}
+
+		// Explicitly run the handshake
+		l.Debug("starting TLS handshake")
+		t0 = time.Now()
+		if err := handshake(ctx, tlsConn); err != nil {
+			l.Error("TLS handshake failed", "error", err)
+			res.Err = newTestError(err)
+			return res
+		}
+		res.TLSHandshakeDuration = time.Since(t0)
+		l.Debug("TLS handshake completed", "duration", res.TLSHandshakeDuration)
+
+		tlsState := tlsConn.ConnectionState()
+		res.CertError = verifyPeer(ctx, l, sni, tlsState.PeerCertificates)
+		res.Negotiated = uNegotiated(tlsConn)
+		if algs != nil {
+			_, secret := keyLogSecret(keyLog.String(), "SERVER_HANDSHAKE_TRAFFIC_SECRET")
+			res.CertCompression, err = certCompression(recorder.stop(), tlsState.CipherSuite, secret)
+			if err != nil {
+				l.Warn("failed to find the certificate message", "error", err)
+				res.CertCompression = "unknown"
+			}
+		}
+		l.Info("test completed successfully",
+			"handshake_complete", tlsState.HandshakeComplete,
+			"transport_duration", res.TransportEstablishDuration,
+			"tls_duration", res.TLSHandshakeDuration,
+			"cert_compression", res.CertCompression)
+		return res
+	}
+}
+
+// setCertCompression makes the compress_certificate extension of uconn offer
+// algs, or removes it if there are none. Like moveSNILast, this has to
+// happen before uTLS marshals the ClientHello.
+func setCertCompression(uconn *tls.UConn, algs []tls.CertCompressionAlgo) error {
+	if err := uconn.BuildHandshakeState(); err != nil {
+		return err
+	}
+
+	i := slices.IndexFunc(uconn.Extensions, func(e tls.TLSExtension) bool {
+		_, ok := e.(*tls.UtlsCompressCertExtension)
+		return ok
+	})
+	switch {
+	case algs == nil && i >= 0:
+		uconn.Extensions = slices.Delete(uconn.Extensions, i, i+1)
+	case algs != nil && i >= 0:
+		uconn.Extensions[i] = &tls.UtlsCompressCertExtension{Algorithms: algs}
+	case algs != nil:
+		uconn.Extensions = appendExtension(uconn.Extensions, &tls.UtlsCompressCertExtension{Algorithms: algs})
+	}
+
+	// Marshal again with the new extensions.
+	return uconn.BuildHandshakeState()
+}
+
+// certCompressionNames name the RFC 8879 algorithms.
+var certCompressionNames = map[uint16]string{
+	uint16(tls.CertCompressionZlib):   "zlib",
+	uint16(tls.CertCompressionBrotli): "brotli",
+	uint16(tls.CertCompressionZstd):   "zstd",
+}
+
+// certCompression decrypts the server's TLS 1.3 flight in read with its
+// handshake traffic secret and returns the algorithm it compressed its
+// certificate with, or "none" if it sent it uncompressed.
+func certCompression(read []byte, suite uint16, secret []byte) (string, error) {
+	if secret == nil {
+		return "", errors.New("no handshake secret in the key log")
+	}
+	aead, iv, err := tls13AEAD(suite, secret)
+	if err != nil {
+		return "", err
+	}
+
+	var msgs []byte
+	var seq uint64
+	for _, record := range tlsRecords(read) {
+		if record[0] != 0x17 {
+			continue // ServerHello and ChangeCipherSpec are in the clear
+		}
+		nonce := bytes.Clone(iv)
+		for i := range 8 {
+			nonce[len(nonce)-1-i] ^= byte(seq >> (8 * i))
+		}
+		seq++
+		plaintext, err := aead.Open(nil, nonce, record[5:], record[:5])
+		if err != nil {
+			break // past the handshake, under the application keys
+		}
+		plaintext = bytes.TrimRight(plaintext, "\x00")
+		if len(plaintext) > 0 && plaintext[len(plaintext)-1] == 0x16 {
+			msgs = append(msgs, plaintext[:len(plaintext)-1]...)
+		}
+	}
+
+	for len(msgs) >= 4 {
+		n := 4 + (int(msgs[1])<<16 | int(msgs[2])<<8 | int(msgs[3]))
+		switch msgs[0] {
+		case 11: // certificate
+			return "none", nil
+		case 25: // compressed_certificate
+			if len(msgs) < 6 {
+				return "", errors.New("truncated compressed_certificate")
+			}
+			alg := binary.BigEndian.Uint16(msgs[4:])
+			if name, ok := certCompressionNames[alg]; ok {
+				return name, nil
+			}
+			return fmt.Sprintf("0x%04x", alg), nil
+		}
+		if len(msgs) < n {
+			break
+		}
+		msgs = msgs[n:]
+	}
+	return "", errors.New("no certificate message in the server's flight")
+}
+
+// tls13AEAD returns the AEAD and IV of a TLS 1.3 traffic secret for suite.
+func tls13AEAD(suite uint16, secret []byte) (cipher.AEAD, []byte, error) {
+	var (
+		newHash func() hash.Hash
+		keyLen  int
+	)
+	switch suite {
+	case tls.TLS_AES_128_GCM_SHA256:
+		newHash, keyLen = sha256.New, 16
+	case tls.TLS_AES_256_GCM_SHA384:
+		newHash, keyLen = sha512.New384, 32
+	case tls.TLS_CHACHA20_POLY1305_SHA256:
+		newHash, keyLen = sha256.New, chacha20poly1305.KeySize
+	default:
+		return nil, nil, fmt.Errorf("unknown TLS 1.3 cipher suite 0x%04x", suite)
+	}
+	key := hkdfExpandLabel(newHash, secret, "key", keyLen)
+	iv := hkdfExpandLabel(newHash, secret, "iv", 12)
+
+	if suite == tls.TLS_CHACHA20_POLY1305_SHA256 {
+		aead, err := chacha20poly1305.New(key)
+		return aead, iv, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	return aead, iv, err
+}
+
+// hkdfExpandLabel is HKDF-Expand-Label of RFC 8446 section 7.1, with an
+// empty context.
+func hkdfExpandLabel(newHash func() hash.Hash, secret []byte, label string, n int) []byte {
+	label = "tls13 " + label
+	info := binary.BigEndian.AppendUint16(nil, uint16(n))
+	info = append(info, byte(len(label)))
+	info = append(info, label...)
+	info = append(info, 0)
+	out := make([]byte, n)
+	hkdf.Expand(newHash, secret, info).Read(out)
+	return out
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"github.com/markpash/heybabe/recipe"
+)
+
+// decoySNI is the benign hostname used in decoy ClientHellos.
+const decoySNI = "www.example.com"
+
+// test_TCP_TLS13_UTLS_ChromeAuto_decoy_hello is the uTLS ChromeAuto test with
+// a throwaway ClientHello for decoySNI sent ahead of the real one on the same
+// connection, to confuse stateful DPI that only inspects the first handshake
+// message. A strict server will reject the second ClientHello, so a failure
+// here is only interesting next to the other results.
+var test_TCP_TLS13_UTLS_ChromeAuto_decoy_hello = test_TCP_TLS13_UTLS_ChromeAuto_recipe(
+	recipe.MustParse("fake(" + decoySNI + ")"),
+)
+
+// test_TCP_TLS13_UTLS_ChromeAuto_decoy_bad_version is like
+// test_TCP_TLS13_UTLS_ChromeAuto_decoy_hello, but the decoy is sent in a
+// record with an invalid version, which a DPI engine may parse while the
+// server does not.
+var test_TCP_TLS13_UTLS_ChromeAuto_decoy_bad_version = test_TCP_TLS13_UTLS_ChromeAuto_recipe(
+	recipe.MustParse("fake(" + decoySNI + ", badversion)"),
+)
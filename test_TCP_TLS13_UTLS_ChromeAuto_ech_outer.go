@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"runtime"
+	"strings"
+	"time"
+
+	// This is for systems that don't have a good set of roots. (update often)
+	_ "golang.org/x/crypto/x509roots/fallback"
+
+	"golang.org/x/crypto/cryptobyte"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// test_TCP_TLS13_UTLS_ChromeAuto_ech_outer returns a uTLS connection test using:
+// TCP
+// default cipher suites
+// forced TLS1.3
+// default elliptic curve preferences
+// utls.HelloChrome_Auto
+// And a real ECH extension, with the SNI in the encrypted inner ClientHello
+// and outer as the public name on the wire. The inner one is sealed to a
+// throwaway key rather than the server's, so the server completes the outer
+// handshake for outer and rejects ECH, which is the success: it shows
+// whether outer itself gets through, as it's all DPI sees of real ECH.
+func test_TCP_TLS13_UTLS_ChromeAuto_ech_outer(outer string) testFunc {
+	return func(ctx context.Context, l *slog.Logger, addrPort netip.AddrPort, sni string) TestAttemptResult {
+		counter, _, _, _ := runtime.Caller(0)
+		l = l.With("test", strings.Split(runtime.FuncForPC(counter).Name(), ".")[1], "ip", addrPort.Addr().String())
+
+		l.Debug("starting TCP TLS13 UTLS ChromeAuto ECH outer SNI test",
+			"target", addrPort.String(),
+			"sni", sni,
+			"outer_sni", outer)
+
+		res := TestAttemptResult{}
+
+		configList, err := echConfigList(outer)
+		if err != nil {
+			l.Error("failed to build ECH config", "error", err)
+			res.Err = newTestError(err)
+			return res
+		}
+
+		// Initiate TCP connection
+		l.Debug("initiating TCP connection")
+		tcpDialer := net.Dialer{
+			Timeout:       dialTimeout(ctx),
+			LocalAddr:     localAddr(ctx),
+			FallbackDelay: -1, // disable happy-eyeballs
+			KeepAlive:     keepAlive(ctx),
+			Resolver:      &net.Resolver{PreferGo: true},
+			Control:       dialControl(ctx),
+		}
+		tcpDialer.SetMultipathTCP(false)
+
+		t0 := time.Now()
+		tcpConn, err := tcpDialer.DialContext(ctx, "tcp", addrPort.String())
+		if err != nil {
+			l.Error("failed to establish TCP connection", "error", err)
+			res.Err = newTestError(err)
+			return res
+		}
+		defer tcpConn.Close()
+		tcpConn = wire(ctx, tcpConn)
+		res.TransportEstablishDuration = time.Since(t0)
+		l.Debug("TCP connection established", "duration", res.TransportEstablishDuration)
+
+		l.Debug("configuring TLS connection")
+		tlsConfig := tls.Config{
+			ServerName:                     sni,
+			CipherSuites:                   nil,
+			MinVersion:                     tls.VersionTLS13,
+			MaxVersion:                     tls.VersionTLS13,
+			CurvePreferences:               nil,
+			EncryptedClientHelloConfigList: configList,
+			// The certificates aren't in the state yet when ECH is rejected,
+			// they're checked against outer after the handshake instead.
+			EncryptedClientHelloRejectionVerify: func(tls.ConnectionState) error { return nil },
+		}
+
+		tlsConn, err := uClient(ctx, tcpConn, &tlsConfig, tls.HelloChrome_Auto)
+		if err != nil {
+			l.Error("failed to create uTLS client", "error", err)
+			res.Err = newTestError(err)
+			return res
+		}
+		defer tlsConn.Close()
+
+		// Explicitly run the handshake
+		l.Debug("starting TLS handshake")
+		t0 = time.Now()
+		err = handshake(ctx, tlsConn)
+		var rejected *tls.ECHRejectionError
+		if !errors.As(err, &rejected) {
+			if err == nil {
+				err = errors.New("ECH accepted with a throwaway key")
+			}
+			l.Error("TLS handshake failed", "error", err)
+			res.Err = newTestError(err)
+			return res
+		}
+		certs := tlsConn.ConnectionState().PeerCertificates
+		if !insecure(ctx) {
+			if err := verifyChain(outer, certs); err != nil {
+				l.Error("TLS handshake failed", "error", err)
+				res.Err = newTestError(err)
+				return res
+			}
+		}
+		res.TLSHandshakeDuration = time.Since(t0)
+		l.Debug("TLS handshake completed with ECH rejected",
+			"duration", res.TLSHandshakeDuration,
+			"retry_configs", len(rejected.RetryConfigList) > 0)
+
+		res.CertError = verifyPeer(ctx, l, outer, certs)
+		res.Negotiated = uNegotiated(tlsConn)
+		l.Info("test completed successfully",
+			"transport_duration", res.TransportEstablishDuration,
+			"tls_duration", res.TLSHandshakeDuration)
+		return res
+	}
+}
+
+// echConfigList returns an ECHConfigList with a single config for
+// publicName, with a fresh X25519 key whose private half is thrown away.
+func echConfigList(publicName string) ([]byte, error) {
+	if !validOuterSNI(publicName) {
+		return nil, fmt.Errorf("invalid ECH public name %q", publicName)
+	}
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	configID := make([]byte, 1)
+	if _, err := rand.Read(configID); err != nil {
+		return nil, err
+	}
+
+	var b cryptobyte.Builder
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint16(0xfe0d) // version
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddUint8(configID[0])
+			b.AddUint16(0x0020) // DHKEM(X25519, HKDF-SHA256)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddBytes(key.PublicKey().Bytes())
+			})
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint16(0x0001) // HKDF-SHA256
+				b.AddUint16(0x0001) // AES-256-GCM
+			})
+			b.AddUint8(0) // maximum_name_length
+			b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddBytes([]byte(publicName))
+			})
+			b.AddUint16(0) // extensions
+		})
+	})
+	return b.Bytes()
+}
+
+// validOuterSNI reports whether name can be the public name of an ECH
+// config, which has to be a hostname rather than an IP.
+func validOuterSNI(name string) bool {
+	if len(name) == 0 || len(name) > 253 {
+		return false
+	}
+	if _, err := netip.ParseAddr(name); err == nil {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return false
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// verifyChain verifies certs against the system roots for name.
+func verifyChain(name string, certs []*x509.Certificate) error {
+	if len(certs) == 0 {
+		return errors.New("server sent no certificate")
+	}
+	opts := x509.VerifyOptions{
+		DNSName:       name,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(opts)
+	return err
+}
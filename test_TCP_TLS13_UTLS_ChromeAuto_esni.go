@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"log/slog"
+	"net"
+	"net/netip"
+	"runtime"
+	"strings"
+	"time"
+
+	// This is for systems that don't have a good set of roots. (update often)
+	_ "golang.org/x/crypto/x509roots/fallback"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// test_TCP_TLS13_UTLS_ChromeAuto_esni is a uTLS connection using:
+// TCP
+// default cipher suites
+// forced TLS1.3
+// default elliptic curve preferences
+// utls.HelloChrome_Auto
+// And a draft ESNI extension added next to the real server_name, since
+// some middleboxes still block on its presence. The fingerprint's GREASE
+// ECH extension stays, so the Default uTLS test is the ECH comparison.
+func test_TCP_TLS13_UTLS_ChromeAuto_esni(ctx context.Context, l *slog.Logger, addrPort netip.AddrPort, sni string) TestAttemptResult {
+	counter, _, _, _ := runtime.Caller(0)
+	l = l.With("test", strings.Split(runtime.FuncForPC(counter).Name(), ".")[1], "ip", addrPort.Addr().String())
+
+	l.Debug("starting TCP TLS13 UTLS ChromeAuto ESNI test",
+		"target", addrPort.String(),
+		"sni", sni)
+
+	res := TestAttemptResult{}
+
+	// Initiate TCP connection
+	l.Debug("initiating TCP connection")
+	tcpDialer := net.Dialer{
+		Timeout:       dialTimeout(ctx),
+		LocalAddr:     localAddr(ctx),
+		FallbackDelay: -1, // disable happy-eyeballs
+		KeepAlive:     keepAlive(ctx),
+		Resolver:      &net.Resolver{PreferGo: true},
+		Control:       dialControl(ctx),
+	}
+	tcpDialer.SetMultipathTCP(false)
+
+	t0 := time.Now()
+	tcpConn, err := tcpDialer.DialContext(ctx, "tcp", addrPort.String())
+	if err != nil {
+		l.Error("failed to establish TCP connection", "error", err)
+		res.Err = newTestError(err)
+		return res
+	}
+	defer tcpConn.Close()
+	tcpConn = wire(ctx, tcpConn)
+	res.TransportEstablishDuration = time.Since(t0)
+	l.Debug("TCP connection established", "duration", res.TransportEstablishDuration)
+
+	l.Debug("configuring TLS connection")
+	tlsConfig := tls.Config{
+		ServerName:         sni,
+		InsecureSkipVerify: insecure(ctx),
+		CipherSuites:       nil,
+		MinVersion:         tls.VersionTLS13,
+		MaxVersion:         tls.VersionTLS13,
+		CurvePreferences:   nil,
+	}
+
+	tlsConn, err := uClient(ctx, tcpConn, &tlsConfig, tls.HelloChrome_Auto)
+	if err != nil {
+		l.Error("failed to create uTLS client", "error", err)
+		res.Err = newTestError(err)
+		return res
+	}
+	defer tlsConn.Close()
+
+	l.Debug("adding encrypted_server_name extension")
+	if err := addESNI(tlsConn); err != nil {
+		l.Error("failed to add ESNI extension", "error", err)
+		res.Err = newTestError(err)
+		return res
+	}
+
+	// Explicitly run the handshake
+	l.Debug("starting TLS handshake")
+	t0 = time.Now()
+	if err := handshake(ctx, tlsConn); err != nil {
+		l.Error("TLS handshake failed", "error", err)
+		res.Err = newTestError(err)
+		return res
+	}
+	res.TLSHandshakeDuration = time.Since(t0)
+	l.Debug("TLS handshake completed", "duration", res.TLSHandshakeDuration)
+
+	tlsState := tlsConn.ConnectionState()
+	res.CertError = verifyPeer(ctx, l, sni, tlsState.PeerCertificates)
+	res.Negotiated = uNegotiated(tlsConn)
+	l.Info("test completed successfully",
+		"handshake_complete", tlsState.HandshakeComplete,
+		"transport_duration", res.TransportEstablishDuration,
+		"tls_duration", res.TLSHandshakeDuration)
+	return res
+}
+
+// extensionESNI is the encrypted_server_name extension of the ESNI drafts
+// (draft-ietf-tls-esni-01 to -03), as deployed by Cloudflare and Firefox.
+const extensionESNI = 0xffce
+
+// addESNI adds an encrypted_server_name extension to uconn, with random
+// contents shaped like a real one: TLS_AES_128_GCM_SHA256, an X25519 key
+// share, a SHA-256 record digest and the SNI padded to 260 bytes, as no
+// server can decrypt it anymore anyway.
+func addESNI(uconn *tls.UConn) error {
+	if err := uconn.BuildHandshakeState(); err != nil {
+		return err
+	}
+
+	var (
+		keyShare     = make([]byte, 32)
+		recordDigest = make([]byte, 32)
+		encSNI       = make([]byte, 16+260+16) // nonce, padded SNI, AEAD tag
+	)
+	for _, b := range [][]byte{keyShare, recordDigest, encSNI} {
+		if _, err := rand.Read(b); err != nil {
+			return err
+		}
+	}
+
+	var data []byte
+	data = binary.BigEndian.AppendUint16(data, tls.TLS_AES_128_GCM_SHA256)
+	data = binary.BigEndian.AppendUint16(data, uint16(tls.X25519))
+	for _, b := range [][]byte{keyShare, recordDigest, encSNI} {
+		data = binary.BigEndian.AppendUint16(data, uint16(len(b)))
+		data = append(data, b...)
+	}
+	uconn.Extensions = appendExtension(uconn.Extensions, &tls.GenericExtension{Id: extensionESNI, Data: data})
+
+	// Marshal again with the extension.
+	return uconn.BuildHandshakeState()
+}
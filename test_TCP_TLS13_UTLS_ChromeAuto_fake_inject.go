@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/netip"
+	"runtime"
+	"strings"
+	"time"
+
+	// This is for systems that don't have a good set of roots. (update often)
+	_ "golang.org/x/crypto/x509roots/fallback"
+
+	"github.com/markpash/heybabe/rawsock"
+	"github.com/markpash/heybabe/recipe"
+	tls "github.com/refraction-networking/utls"
+)
+
+// fakeTTL is the TTL of injected fake segments. It has to be high enough to
+// pass the DPI box but low enough to expire before reaching the server.
+const fakeTTL = 4
+
+// test_TCP_TLS13_UTLS_ChromeAuto_fake_ttl injects the fake ClientHello with
+// a low TTL, so it dies before the server but after the DPI box. This is the
+// classic TTL desync.
+var test_TCP_TLS13_UTLS_ChromeAuto_fake_ttl = test_TCP_TLS13_UTLS_ChromeAuto_fake_inject(rawsock.SendOptions{TTL: fakeTTL})
+
+// test_TCP_TLS13_UTLS_ChromeAuto_fake_badsum injects the fake ClientHello
+// with an invalid TCP checksum, so the server drops it. It passes when the
+// middlebox inspects payloads without validating checksums.
+var test_TCP_TLS13_UTLS_ChromeAuto_fake_badsum = test_TCP_TLS13_UTLS_ChromeAuto_fake_inject(rawsock.SendOptions{BadChecksum: true})
+
+// test_TCP_TLS13_UTLS_ChromeAuto_fake_inject returns a uTLS connection test using:
+// TCP
+// default cipher suites
+// forced TLS1.3
+// default elliptic curve preferences
+// utls.HelloChrome_Auto
+// And a fake ClientHello for decoySNI injected through a raw socket right
+// before the real one. The options decide how the fake avoids reaching the
+// server. Needs raw sockets.
+func test_TCP_TLS13_UTLS_ChromeAuto_fake_inject(opts rawsock.SendOptions) testFunc {
+	return func(ctx context.Context, l *slog.Logger, addrPort netip.AddrPort, sni string) TestAttemptResult {
+		counter, _, _, _ := runtime.Caller(0)
+		l = l.With("test", strings.Split(runtime.FuncForPC(counter).Name(), ".")[1], "ip", addrPort.Addr().String())
+
+		l.Debug("starting TCP TLS13 UTLS ChromeAuto fake inject test",
+			"target", addrPort.String(),
+			"sni", sni,
+			"fake_ttl", opts.TTL,
+			"fake_bad_checksum", opts.BadChecksum)
+
+		res := TestAttemptResult{}
+
+		l.Debug("checking raw socket support")
+		if err := rawsock.Check(); err != nil {
+			l.Warn("raw sockets not available, skipping test", "error", err)
+			res.Err = newTestError(newSkipError(err))
+			return res
+		}
+
+		inj, err := rawsock.Listen(addrPort)
+		if err != nil {
+			l.Error("failed to open raw socket", "error", err)
+			res.Err = newTestError(err)
+			return res
+		}
+		defer inj.Close()
+
+		fake, err := recipe.FakeClientHello(decoySNI, false)
+		if err != nil {
+			l.Error("failed to build fake ClientHello", "error", err)
+			res.Err = newTestError(err)
+			return res
+		}
+
+		// Initiate TCP connection
+		l.Debug("initiating TCP connection")
+		tcpDialer := net.Dialer{
+			Timeout:       dialTimeout(ctx),
+			LocalAddr:     localAddr(ctx),
+			FallbackDelay: -1, // disable happy-eyeballs
+			KeepAlive:     keepAlive(ctx),
+			Resolver:      &net.Resolver{PreferGo: true},
+			Control:       dialControl(ctx),
+		}
+		tcpDialer.SetMultipathTCP(false)
+
+		t0 := time.Now()
+		tcpConn, err := tcpDialer.DialContext(ctx, "tcp", addrPort.String())
+		if err != nil {
+			l.Error("failed to establish TCP connection", "error", err)
+			res.Err = newTestError(err)
+			return res
+		}
+		defer tcpConn.Close()
+		tcpConn = wire(ctx, tcpConn)
+		res.TransportEstablishDuration = time.Since(t0)
+		l.Debug("TCP connection established", "duration", res.TransportEstablishDuration)
+
+		local, err := netip.ParseAddrPort(tcpConn.LocalAddr().String())
+		if err != nil {
+			res.Err = newTestError(err)
+			return res
+		}
+		l.Debug("waiting for handshake sequence numbers", "local", local)
+		if err := inj.Sync(netip.AddrPortFrom(local.Addr().Unmap(), local.Port()), time.Second); err != nil {
+			l.Error("failed to sync with TCP handshake", "error", err)
+			res.Err = newTestError(err)
+			return res
+		}
+		fakeConn := inj.Wrap(tcpConn, fake, opts)
+
+		l.Debug("configuring TLS connection")
+		tlsConfig := tls.Config{
+			ServerName:         sni,
+			InsecureSkipVerify: insecure(ctx),
+			CipherSuites:       nil,
+			MinVersion:         tls.VersionTLS13,
+			MaxVersion:         tls.VersionTLS13,
+			CurvePreferences:   nil,
+		}
+
+		tlsConn, err := uClient(ctx, fakeConn, &tlsConfig, tls.HelloChrome_Auto)
+		if err != nil {
+			l.Error("failed to create uTLS client", "error", err)
+			res.Err = newTestError(err)
+			return res
+		}
+		defer tlsConn.Close()
+
+		// Explicitly run the handshake
+		l.Debug("starting TLS handshake")
+		t0 = time.Now()
+		if err := handshake(ctx, tlsConn); err != nil {
+			l.Error("TLS handshake failed", "error", err)
+			res.Err = newTestError(err)
+			return res
+		}
+		res.TLSHandshakeDuration = time.Since(t0)
+		l.Debug("TLS handshake completed", "duration", res.TLSHandshakeDuration)
+
+		tlsState := tlsConn.ConnectionState()
+		res.CertError = verifyPeer(ctx, l, sni, tlsState.PeerCertificates)
+		res.Negotiated = uNegotiated(tlsConn)
+		l.Info("test completed successfully",
+			"handshake_complete", tlsState.HandshakeComplete,
+			"transport_duration", res.TransportEstablishDuration,
+			"tls_duration", res.TLSHandshakeDuration)
+		return res
+	}
+}
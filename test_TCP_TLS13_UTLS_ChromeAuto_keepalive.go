@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	// This is for systems that don't have a good set of roots. (update often)
+	_ "golang.org/x/crypto/x509roots/fallback"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// keepAliveProbeTimeout is how long the server has to answer the request
+// sent after holding the connection.
+const keepAliveProbeTimeout = 10 * time.Second
+
+// test_TCP_TLS13_UTLS_ChromeAuto_keepalive returns a uTLS connection test using:
+// TCP, with keepalive probes every period
+// default cipher suites
+// forced TLS1.3
+// default elliptic curve preferences
+// utls.HelloChrome_Auto
+// And the connection held idle for hold after the handshake, then checked
+// with a request, to find middleboxes dropping idle connections whose
+// keepalives come too rarely. The TTFB is the time to the answer.
+func test_TCP_TLS13_UTLS_ChromeAuto_keepalive(period, hold time.Duration) testFunc {
+	return func(ctx context.Context, l *slog.Logger, addrPort netip.AddrPort, sni string) TestAttemptResult {
+		counter, _, _, _ := runtime.Caller(0)
+		l = l.With("test", strings.Split(runtime.FuncForPC(counter).Name(), ".")[1], "ip", addrPort.Addr().String())
+
+		l.Debug("starting TCP TLS13 UTLS ChromeAuto keepalive test",
+			"target", addrPort.String(),
+			"sni", sni,
+			"keepalive", period,
+			"hold", hold)
+
+		res := TestAttemptResult{}
+
+		// Initiate TCP connection
+		l.Debug("initiating TCP connection")
+		tcpDialer := net.Dialer{
+			Timeout:       dialTimeout(ctx),
+			LocalAddr:     localAddr(ctx),
+			FallbackDelay: -1, // disable happy-eyeballs
+			KeepAliveConfig: net.KeepAliveConfig{
+				Enable:   true,
+				Idle:     period,
+				Interval: period,
+				Count:    3,
+			},
+			Resolver: &net.Resolver{PreferGo: true},
+			Control:  dialControl(ctx),
+		}
+		tcpDialer.SetMultipathTCP(false)
+
+		t0 := time.Now()
+		tcpConn, err := tcpDialer.DialContext(ctx, "tcp", addrPort.String())
+		if err != nil {
+			l.Error("failed to establish TCP connection", "error", err)
+			res.Err = newTestError(err)
+			return res
+		}
+		defer tcpConn.Close()
+		tcpConn = wire(ctx, tcpConn)
+		res.TransportEstablishDuration = time.Since(t0)
+		l.Debug("TCP connection established", "duration", res.TransportEstablishDuration)
+
+		l.Debug("configuring TLS connection")
+		tlsConfig := tls.Config{
+			ServerName:         sni,
+			InsecureSkipVerify: insecure(ctx),
+			CipherSuites:       nil,
+			MinVersion:         tls.VersionTLS13,
+			MaxVersion:         tls.VersionTLS13,
+			CurvePreferences:   nil,
+		}
+
+		tlsConn, err := uClient(ctx, tcpConn, &tlsConfig, tls.HelloChrome_Auto)
+		if err != nil {
+			l.Error("failed to create uTLS client", "error", err)
+			res.Err = newTestError(err)
+			return res
+		}
+		defer tlsConn.Close()
+
+		// Explicitly run the handshake
+		l.Debug("starting TLS handshake")
+		t0 = time.Now()
+		if err := handshake(ctx, tlsConn); err != nil {
+			l.Error("TLS handshake failed", "error", err)
+			res.Err = newTestError(err)
+			return res
+		}
+		res.TLSHandshakeDuration = time.Since(t0)
+		l.Debug("TLS handshake completed", "duration", res.TLSHandshakeDuration)
+
+		tlsState := tlsConn.ConnectionState()
+		res.CertError = verifyPeer(ctx, l, sni, tlsState.PeerCertificates)
+		res.Negotiated = uNegotiated(tlsConn)
+
+		// Reads don't watch ctx, so cut them short when it's done.
+		stop := context.AfterFunc(ctx, func() { tcpConn.SetDeadline(time.Now()) })
+		defer stop()
+
+		l.Debug("holding idle connection", "hold", hold)
+		held := time.Now()
+		tlsConn.SetReadDeadline(held.Add(hold))
+		buf := make([]byte, 512)
+		for {
+			// Anything the server sends on its own, like session tickets,
+			// is read and ignored.
+			_, err = tlsConn.Read(buf)
+			if err != nil {
+				break
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			res.Err = newTestError(err)
+			return res
+		}
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			idle := time.Since(held).Round(time.Second)
+			l.Error("idle connection lost", "idle", idle, "error", err)
+			if errors.Is(err, io.EOF) {
+				err = fmt.Errorf("server closed the connection after %v idle: %w", idle, err)
+			} else {
+				err = fmt.Errorf("connection lost after %v idle: %w", idle, err)
+			}
+			res.Err = newTestError(err)
+			return res
+		}
+
+		// Any answer, even an error or the server closing the connection,
+		// shows the path still carries it.
+		l.Debug("sending request on held connection")
+		t0 = time.Now()
+		tlsConn.SetDeadline(t0.Add(keepAliveProbeTimeout))
+		req := "HEAD / HTTP/1.1\r\nHost: " + sni + "\r\nConnection: close\r\n\r\n"
+		if _, err := io.WriteString(tlsConn, req); err != nil {
+			l.Error("failed to send request after holding", "error", err)
+			res.Err = newTestError(fmt.Errorf("connection lost after %v idle: %w", hold, err))
+			return res
+		}
+		if _, err := tlsConn.Read(buf[:1]); err != nil && !errors.Is(err, io.EOF) {
+			l.Error("no answer after holding", "error", err)
+			res.Err = newTestError(fmt.Errorf("connection lost after %v idle: %w", hold, err))
+			return res
+		}
+		res.TTFBDuration = time.Since(t0)
+
+		l.Info("test completed successfully",
+			"handshake_complete", tlsState.HandshakeComplete,
+			"transport_duration", res.TransportEstablishDuration,
+			"tls_duration", res.TLSHandshakeDuration,
+			"ttfb_duration", res.TTFBDuration)
+		return res
+	}
+}
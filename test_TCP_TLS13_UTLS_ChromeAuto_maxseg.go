@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/netip"
+	"runtime"
+	"strings"
+	"time"
+
+	// This is for systems that don't have a good set of roots. (update often)
+	_ "golang.org/x/crypto/x509roots/fallback"
+
+	"github.com/markpash/heybabe/sockopt"
+	tls "github.com/refraction-networking/utls"
+)
+
+// tinyMSS is the smallest MSS Linux accepts for TCP_MAXSEG.
+const tinyMSS = 88
+
+// test_TCP_TLS13_UTLS_ChromeAuto_maxseg is a uTLS connection using:
+// TCP
+// default cipher suites
+// forced TLS1.3
+// default elliptic curve preferences
+// utls.HelloChrome_Auto
+// And a tiny MSS set with TCP_MAXSEG, so the kernel itself splits the
+// ClientHello into many segments. Some DPI handles this differently from
+// userspace fragmentation, where every write is its own segment.
+func test_TCP_TLS13_UTLS_ChromeAuto_maxseg(ctx context.Context, l *slog.Logger, addrPort netip.AddrPort, sni string) TestAttemptResult {
+	counter, _, _, _ := runtime.Caller(0)
+	l = l.With("test", strings.Split(runtime.FuncForPC(counter).Name(), ".")[1], "ip", addrPort.Addr().String())
+
+	l.Debug("starting TCP TLS13 UTLS ChromeAuto maxseg test",
+		"target", addrPort.String(),
+		"sni", sni,
+		"mss", tinyMSS)
+
+	res := TestAttemptResult{}
+
+	// Initiate TCP connection
+	l.Debug("initiating TCP connection")
+	tcpDialer := net.Dialer{
+		Timeout:       dialTimeout(ctx),
+		LocalAddr:     localAddr(ctx),
+		FallbackDelay: -1, // disable happy-eyeballs
+		KeepAlive:     keepAlive(ctx),
+		Resolver:      &net.Resolver{PreferGo: true},
+		Control:       dialControl(ctx, sockopt.MaxSeg(tinyMSS)),
+	}
+	tcpDialer.SetMultipathTCP(false)
+
+	t0 := time.Now()
+	tcpConn, err := tcpDialer.DialContext(ctx, "tcp", addrPort.String())
+	if errors.Is(err, sockopt.ErrUnsupported) {
+		l.Warn("TCP_MAXSEG not supported, skipping test", "error", err)
+		res.Err = newTestError(newSkipError(err))
+		return res
+	}
+	if err != nil {
+		l.Error("failed to establish TCP connection", "error", err)
+		res.Err = newTestError(err)
+		return res
+	}
+	defer tcpConn.Close()
+	tcpConn = wire(ctx, tcpConn)
+	res.TransportEstablishDuration = time.Since(t0)
+	l.Debug("TCP connection established", "duration", res.TransportEstablishDuration)
+
+	l.Debug("configuring TLS connection")
+	tlsConfig := tls.Config{
+		ServerName:         sni,
+		InsecureSkipVerify: insecure(ctx),
+		CipherSuites:       nil,
+		MinVersion:         tls.VersionTLS13,
+		MaxVersion:         tls.VersionTLS13,
+		CurvePreferences:   nil,
+	}
+
+	tlsConn, err := uClient(ctx, tcpConn, &tlsConfig, tls.HelloChrome_Auto)
+	if err != nil {
+		l.Error("failed to create uTLS client", "error", err)
+		res.Err = newTestError(err)
+		return res
+	}
+	defer tlsConn.Close()
+
+	// Explicitly run the handshake
+	l.Debug("starting TLS handshake")
+	t0 = time.Now()
+	if err := handshake(ctx, tlsConn); err != nil {
+		l.Error("TLS handshake failed", "error", err)
+		res.Err = newTestError(err)
+		return res
+	}
+	res.TLSHandshakeDuration = time.Since(t0)
+	l.Debug("TLS handshake completed", "duration", res.TLSHandshakeDuration)
+
+	tlsState := tlsConn.ConnectionState()
+	res.CertError = verifyPeer(ctx, l, sni, tlsState.PeerCertificates)
+	res.Negotiated = uNegotiated(tlsConn)
+	l.Info("test completed successfully",
+		"handshake_complete", tlsState.HandshakeComplete,
+		"transport_duration", res.TransportEstablishDuration,
+		"tls_duration", res.TLSHandshakeDuration)
+	return res
+}
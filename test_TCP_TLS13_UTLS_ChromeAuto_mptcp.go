@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/netip"
+	"runtime"
+	"strings"
+	"time"
+
+	// This is for systems that don't have a good set of roots. (update often)
+	_ "golang.org/x/crypto/x509roots/fallback"
+
+	"github.com/markpash/heybabe/bepass/tlsfrag"
+	tls "github.com/refraction-networking/utls"
+)
+
+// test_TCP_TLS13_UTLS_ChromeAuto_mptcp is the ChromeAuto test over MPTCP.
+var test_TCP_TLS13_UTLS_ChromeAuto_mptcp = test_TCP_TLS13_UTLS_ChromeAuto_multipath(nil)
+
+// test_TCP_TLS13_UTLS_ChromeAuto_mptcp_bepass_fragment is the bepass
+// fragment test over MPTCP.
+var test_TCP_TLS13_UTLS_ChromeAuto_mptcp_bepass_fragment = test_TCP_TLS13_UTLS_ChromeAuto_multipath(&bepassFragment)
+
+// test_TCP_TLS13_UTLS_ChromeAuto_multipath returns a uTLS connection test
+// using:
+// MPTCP
+// default cipher suites
+// forced TLS1.3
+// default elliptic curve preferences
+// utls.HelloChrome_Auto
+// And the bepass fragmenting connection if fs is not nil. Some DPI can't
+// follow MPTCP subflows. MPTCP silently falls back to TCP when the kernel or
+// the server doesn't support it, which is logged and recorded in the result.
+func test_TCP_TLS13_UTLS_ChromeAuto_multipath(fs *fragmentSettings) testFunc {
+	return func(ctx context.Context, l *slog.Logger, addrPort netip.AddrPort, sni string) TestAttemptResult {
+		counter, _, _, _ := runtime.Caller(0)
+		l = l.With("test", strings.Split(runtime.FuncForPC(counter).Name(), ".")[1], "ip", addrPort.Addr().String())
+
+		l.Debug("starting TCP TLS13 UTLS ChromeAuto MPTCP test",
+			"target", addrPort.String(),
+			"sni", sni,
+			"fragment", fs != nil)
+
+		res := TestAttemptResult{}
+
+		// Initiate MPTCP connection
+		l.Debug("initiating MPTCP connection")
+		tcpDialer := net.Dialer{
+			Timeout:       dialTimeout(ctx),
+			LocalAddr:     localAddr(ctx),
+			FallbackDelay: -1, // disable happy-eyeballs
+			KeepAlive:     keepAlive(ctx),
+			Resolver:      &net.Resolver{PreferGo: true},
+			Control:       dialControl(ctx),
+		}
+		tcpDialer.SetMultipathTCP(true)
+
+		t0 := time.Now()
+		tcpConn, err := tcpDialer.DialContext(ctx, "tcp", addrPort.String())
+		if err != nil {
+			l.Error("failed to establish MPTCP connection", "error", err)
+			res.Err = newTestError(err)
+			return res
+		}
+		defer tcpConn.Close()
+		res.TransportEstablishDuration = time.Since(t0)
+
+		// This is only known once the handshake with the server is done.
+		res.MPTCP, _ = tcpConn.(*net.TCPConn).MultipathTCP()
+		l.Debug("MPTCP connection established", "duration", res.TransportEstablishDuration, "mptcp", res.MPTCP)
+
+		conn := wire(ctx, tcpConn)
+		var fragConn *tlsfrag.Adapter
+		if fs != nil {
+			l.Debug("creating TLS fragmentation adapter", "bsl", fs.BSL, "sl", fs.SL, "asl", fs.ASL, "delay", fs.Delay)
+			fragConn = tlsfrag.NewWithFragmenter(conn, fs.fragmenter(), l)
+			fragConn.OnFirstWrite = func(s tlsfrag.Stats) { res.Fragments = &s }
+			fragConn.Context = ctx
+			conn = fragConn
+		}
+
+		l.Debug("configuring TLS connection")
+		tlsConfig := tls.Config{
+			ServerName:         sni,
+			InsecureSkipVerify: insecure(ctx),
+			CipherSuites:       nil,
+			MinVersion:         tls.VersionTLS13,
+			MaxVersion:         tls.VersionTLS13,
+			CurvePreferences:   nil,
+		}
+
+		tlsConn, err := uClient(ctx, conn, &tlsConfig, tls.HelloChrome_Auto)
+		if err != nil {
+			l.Error("failed to create uTLS client", "error", err)
+			res.Err = newTestError(err)
+			return res
+		}
+		defer tlsConn.Close()
+
+		// Explicitly run the handshake
+		l.Debug("starting TLS handshake")
+		t0 = time.Now()
+		err = handshake(ctx, tlsConn)
+		if fragConn != nil {
+			res.SplitPositions = fragConn.SplitPositions()
+		}
+		if err != nil {
+			l.Error("TLS handshake failed", "error", err, "mptcp", res.MPTCP)
+			res.Err = newTestError(err)
+			return res
+		}
+		res.TLSHandshakeDuration = time.Since(t0)
+		l.Debug("TLS handshake completed", "duration", res.TLSHandshakeDuration)
+
+		tlsState := tlsConn.ConnectionState()
+		res.CertError = verifyPeer(ctx, l, sni, tlsState.PeerCertificates)
+		res.Negotiated = uNegotiated(tlsConn)
+		l.Info("test completed successfully",
+			"handshake_complete", tlsState.HandshakeComplete,
+			"transport_duration", res.TransportEstablishDuration,
+			"tls_duration", res.TLSHandshakeDuration,
+			"mptcp", res.MPTCP)
+		return res
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/netip"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+
+	// This is for systems that don't have a good set of roots. (update often)
+	_ "golang.org/x/crypto/x509roots/fallback"
+
+	"github.com/markpash/heybabe/bepass/tlsfrag"
+	"github.com/markpash/heybabe/nfqueue"
+	tls "github.com/refraction-networking/utls"
+)
+
+// test_TCP_TLS13_UTLS_ChromeAuto_nfqueue returns a uTLS connection test using:
+// TCP
+// default cipher suites
+// forced TLS1.3
+// default elliptic curve preferences
+// utls.HelloChrome_Auto
+// And the packet carrying the ClientHello cut up by newFragmenter's plan
+// after the kernel built it, through netfilter queue num. Unlike writing
+// the fragments to the socket, this keeps the kernel from coalescing them
+// and the TTLs from leaking to other packets. Needs iptables and root.
+func test_TCP_TLS13_UTLS_ChromeAuto_nfqueue(num uint16, newFragmenter func() (tlsfrag.Fragmenter, error)) testFunc {
+	return func(ctx context.Context, l *slog.Logger, addrPort netip.AddrPort, sni string) TestAttemptResult {
+		counter, _, _, _ := runtime.Caller(0)
+		l = l.With("test", strings.Split(runtime.FuncForPC(counter).Name(), ".")[1], "ip", addrPort.Addr().String())
+
+		l.Debug("starting TCP TLS13 UTLS ChromeAuto nfqueue test",
+			"target", addrPort.String(),
+			"sni", sni,
+			"queue", num)
+
+		res := TestAttemptResult{}
+
+		l.Debug("checking netfilter queue support")
+		if err := nfqueue.Check(); err != nil {
+			l.Warn("netfilter queues not available, skipping test", "error", err)
+			res.Err = newTestError(newSkipError(err))
+			return res
+		}
+
+		f, err := newFragmenter()
+		if err != nil {
+			l.Error("failed to build fragmenter", "error", err)
+			res.Err = newTestError(err)
+			return res
+		}
+		q := nfqueue.New(num, f, l)
+		defer func() {
+			if err := q.Close(); err != nil {
+				l.Warn("failed to remove iptables rule", "error", err)
+			}
+		}()
+
+		// Initiate TCP connection. The queue binds the socket itself, to
+		// scope its iptables rule to the connection before the SYN is out.
+		l.Debug("initiating TCP connection")
+		control := dialControl(ctx)
+		queueControl := q.Control(socketSettingsFrom(ctx).source)
+		tcpDialer := net.Dialer{
+			Timeout:       dialTimeout(ctx),
+			FallbackDelay: -1, // disable happy-eyeballs
+			KeepAlive:     keepAlive(ctx),
+			Resolver:      &net.Resolver{PreferGo: true},
+			Control: func(network, address string, c syscall.RawConn) error {
+				if err := control(network, address, c); err != nil {
+					return err
+				}
+				return queueControl(network, address, c)
+			},
+		}
+		tcpDialer.SetMultipathTCP(false)
+
+		t0 := time.Now()
+		tcpConn, err := tcpDialer.DialContext(ctx, "tcp", addrPort.String())
+		if err != nil {
+			l.Error("failed to establish TCP connection", "error", err)
+			res.Err = newTestError(err)
+			return res
+		}
+		defer tcpConn.Close()
+		tcpConn = wire(ctx, tcpConn)
+		res.TransportEstablishDuration = time.Since(t0)
+		l.Debug("TCP connection established", "duration", res.TransportEstablishDuration)
+
+		l.Debug("configuring TLS connection")
+		tlsConfig := tls.Config{
+			ServerName:         sni,
+			InsecureSkipVerify: insecure(ctx),
+			CipherSuites:       nil,
+			MinVersion:         tls.VersionTLS13,
+			MaxVersion:         tls.VersionTLS13,
+			CurvePreferences:   nil,
+		}
+
+		tlsConn, err := uClient(ctx, tcpConn, &tlsConfig, tls.HelloChrome_Auto)
+		if err != nil {
+			l.Error("failed to create uTLS client", "error", err)
+			res.Err = newTestError(err)
+			return res
+		}
+		defer tlsConn.Close()
+
+		// Explicitly run the handshake
+		l.Debug("starting TLS handshake")
+		t0 = time.Now()
+		err = handshake(ctx, tlsConn)
+		res.Fragments = q.Stats()
+		if qerr := q.Err(); qerr != nil {
+			// The ClientHello didn't go out as planned, so the result
+			// wouldn't say anything about the strategy.
+			l.Error("failed to reshape ClientHello", "error", qerr)
+			res.Err = newTestError(qerr)
+			return res
+		}
+		if err != nil {
+			l.Error("TLS handshake failed", "error", err, "fragments", res.Fragments)
+			res.Err = newTestError(err)
+			return res
+		}
+		res.TLSHandshakeDuration = time.Since(t0)
+		l.Debug("TLS handshake completed", "duration", res.TLSHandshakeDuration)
+
+		tlsState := tlsConn.ConnectionState()
+		res.CertError = verifyPeer(ctx, l, sni, tlsState.PeerCertificates)
+		res.Negotiated = uNegotiated(tlsConn)
+		l.Info("test completed successfully",
+			"handshake_complete", tlsState.HandshakeComplete,
+			"transport_duration", res.TransportEstablishDuration,
+			"tls_duration", res.TLSHandshakeDuration,
+			"fragments", res.Fragments)
+		return res
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/netip"
+	"runtime"
+	"strings"
+	"time"
+
+	// This is for systems that don't have a good set of roots. (update often)
+	_ "golang.org/x/crypto/x509roots/fallback"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// test_TCP_TLS13_UTLS_ChromeAuto_no_compat is a uTLS connection using:
+// TCP
+// default cipher suites
+// forced TLS1.3
+// default elliptic curve preferences
+// utls.HelloChrome_Auto
+// And without the middlebox compatibility mode of RFC 8446 appendix D.4: an
+// empty legacy_session_id, so the server sends no ChangeCipherSpec, and the
+// client's ChangeCipherSpec dropped, to see whether "pure" TLS 1.3
+// handshakes are treated differently.
+func test_TCP_TLS13_UTLS_ChromeAuto_no_compat(ctx context.Context, l *slog.Logger, addrPort netip.AddrPort, sni string) TestAttemptResult {
+	counter, _, _, _ := runtime.Caller(0)
+	l = l.With("test", strings.Split(runtime.FuncForPC(counter).Name(), ".")[1], "ip", addrPort.Addr().String())
+
+	l.Debug("starting TCP TLS13 UTLS ChromeAuto no compat test",
+		"target", addrPort.String(),
+		"sni", sni)
+
+	res := TestAttemptResult{}
+
+	// Initiate TCP connection
+	l.Debug("initiating TCP connection")
+	tcpDialer := net.Dialer{
+		Timeout:       dialTimeout(ctx),
+		LocalAddr:     localAddr(ctx),
+		FallbackDelay: -1, // disable happy-eyeballs
+		KeepAlive:     keepAlive(ctx),
+		Resolver:      &net.Resolver{PreferGo: true},
+		Control:       dialControl(ctx),
+	}
+	tcpDialer.SetMultipathTCP(false)
+
+	t0 := time.Now()
+	tcpConn, err := tcpDialer.DialContext(ctx, "tcp", addrPort.String())
+	if err != nil {
+		l.Error("failed to establish TCP connection", "error", err)
+		res.Err = newTestError(err)
+		return res
+	}
+	defer tcpConn.Close()
+	tcpConn = wire(ctx, tcpConn)
+	res.TransportEstablishDuration = time.Since(t0)
+	l.Debug("TCP connection established", "duration", res.TransportEstablishDuration)
+
+	l.Debug("configuring TLS connection")
+	tlsConfig := tls.Config{
+		ServerName:         sni,
+		InsecureSkipVerify: insecure(ctx),
+		CipherSuites:       nil,
+		MinVersion:         tls.VersionTLS13,
+		MaxVersion:         tls.VersionTLS13,
+		CurvePreferences:   nil,
+	}
+
+	tlsConn, err := uClient(ctx, &noCCSConn{Conn: tcpConn}, &tlsConfig, tls.HelloChrome_Auto)
+	if err != nil {
+		l.Error("failed to create uTLS client", "error", err)
+		res.Err = newTestError(err)
+		return res
+	}
+	defer tlsConn.Close()
+
+	l.Debug("clearing legacy_session_id")
+	if err := clearSessionID(tlsConn); err != nil {
+		l.Error("failed to clear session ID", "error", err)
+		res.Err = newTestError(err)
+		return res
+	}
+
+	// Explicitly run the handshake
+	l.Debug("starting TLS handshake")
+	t0 = time.Now()
+	if err := handshake(ctx, tlsConn); err != nil {
+		l.Error("TLS handshake failed", "error", err)
+		res.Err = newTestError(err)
+		return res
+	}
+	res.TLSHandshakeDuration = time.Since(t0)
+	l.Debug("TLS handshake completed", "duration", res.TLSHandshakeDuration)
+
+	tlsState := tlsConn.ConnectionState()
+	res.CertError = verifyPeer(ctx, l, sni, tlsState.PeerCertificates)
+	res.Negotiated = uNegotiated(tlsConn)
+	l.Info("test completed successfully",
+		"handshake_complete", tlsState.HandshakeComplete,
+		"transport_duration", res.TransportEstablishDuration,
+		"tls_duration", res.TLSHandshakeDuration)
+	return res
+}
+
+// clearSessionID empties the legacy_session_id of uconn's ClientHello,
+// which TLS 1.3 clients fill in for middlebox compatibility.
+func clearSessionID(uconn *tls.UConn) error {
+	if err := uconn.BuildHandshakeState(); err != nil {
+		return err
+	}
+	uconn.HandshakeState.Hello.SessionId = nil
+	return uconn.MarshalClientHello()
+}
+
+// noCCSConn drops the ChangeCipherSpec records written to it, which TLS 1.3
+// clients only send for middlebox compatibility. Handshake records are
+// written whole, so each write is a sequence of complete records.
+type noCCSConn struct {
+	net.Conn
+}
+
+func (c *noCCSConn) Write(b []byte) (int, error) {
+	const headerLen = 5
+	out := make([]byte, 0, len(b))
+	for rest := b; len(rest) > 0; {
+		if len(rest) < headerLen {
+			out = append(out, rest...)
+			break
+		}
+		n := min(headerLen+(int(rest[3])<<8|int(rest[4])), len(rest))
+		if rest[0] != 0x14 { // change_cipher_spec
+			out = append(out, rest[:n]...)
+		}
+		rest = rest[n:]
+	}
+	if _, err := c.Conn.Write(out); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
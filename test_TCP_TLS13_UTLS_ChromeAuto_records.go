@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"runtime"
+	"strings"
+	"time"
+
+	// This is for systems that don't have a good set of roots. (update often)
+	_ "golang.org/x/crypto/x509roots/fallback"
+
+	"github.com/markpash/heybabe/bepass/tlsfrag"
+	tls "github.com/refraction-networking/utls"
+)
+
+// recordSizeLabel is the label of the record size sweep test for size.
+func recordSizeLabel(size int) string {
+	return fmt.Sprintf("Record Size %dB - TCP - TLS 1.3 - uTLS ChromeAuto", size)
+}
+
+// test_TCP_TLS13_UTLS_ChromeAuto_record_size splits the ClientHello into TLS
+// records of at most size bytes, to find the record sizes the DPI
+// reassembles.
+func test_TCP_TLS13_UTLS_ChromeAuto_record_size(size int) testFunc {
+	return test_TCP_TLS13_UTLS_ChromeAuto_records(&tlsfrag.RecordSplit{Size: size})
+}
+
+// test_TCP_TLS13_UTLS_ChromeAuto_record_version_ssl3 sends the ClientHello
+// record with an SSL 3.0 legacy_record_version.
+var test_TCP_TLS13_UTLS_ChromeAuto_record_version_ssl3 = test_TCP_TLS13_UTLS_ChromeAuto_records(&tlsfrag.RecordVersion{Version: 0x0300})
+
+// test_TCP_TLS13_UTLS_ChromeAuto_record_version_tls13 sends the ClientHello
+// record with a TLS 1.3 legacy_record_version, which real clients never do.
+var test_TCP_TLS13_UTLS_ChromeAuto_record_version_tls13 = test_TCP_TLS13_UTLS_ChromeAuto_records(&tlsfrag.RecordVersion{Version: 0x0304})
+
+// test_TCP_TLS13_UTLS_ChromeAuto_records returns a uTLS connection test using:
+// TCP
+// default cipher suites
+// forced TLS1.3
+// default elliptic curve preferences
+// utls.HelloChrome_Auto
+// And the ClientHello record reshaped by f, which works on whole records.
+func test_TCP_TLS13_UTLS_ChromeAuto_records(f tlsfrag.Fragmenter) testFunc {
+	return func(ctx context.Context, l *slog.Logger, addrPort netip.AddrPort, sni string) TestAttemptResult {
+		counter, _, _, _ := runtime.Caller(0)
+		l = l.With("test", strings.Split(runtime.FuncForPC(counter).Name(), ".")[1], "ip", addrPort.Addr().String())
+
+		l.Debug("starting TCP TLS13 UTLS ChromeAuto records test",
+			"target", addrPort.String(),
+			"sni", sni,
+			"fragmenter", fmt.Sprintf("%+v", f))
+
+		res := TestAttemptResult{}
+
+		// Initiate TCP connection
+		l.Debug("initiating TCP connection")
+		tcpDialer := net.Dialer{
+			Timeout:       dialTimeout(ctx),
+			LocalAddr:     localAddr(ctx),
+			FallbackDelay: -1, // disable happy-eyeballs
+			KeepAlive:     keepAlive(ctx),
+			Resolver:      &net.Resolver{PreferGo: true},
+			Control:       dialControl(ctx),
+		}
+		tcpDialer.SetMultipathTCP(false)
+
+		t0 := time.Now()
+		tcpConn, err := tcpDialer.DialContext(ctx, "tcp", addrPort.String())
+		if err != nil {
+			l.Error("failed to establish TCP connection", "error", err)
+			res.Err = newTestError(err)
+			return res
+		}
+		defer tcpConn.Close()
+		tcpConn = wire(ctx, tcpConn)
+		res.TransportEstablishDuration = time.Since(t0)
+		l.Debug("TCP connection established", "duration", res.TransportEstablishDuration)
+
+		l.Debug("wrapping TCP connection with record fragmenter")
+		recordConn := tlsfrag.NewWithFragmenter(tcpConn, f, l)
+		recordConn.OnFirstWrite = func(s tlsfrag.Stats) { res.Fragments = &s }
+		recordConn.Context = ctx
+
+		l.Debug("configuring TLS connection")
+		tlsConfig := tls.Config{
+			ServerName:         sni,
+			InsecureSkipVerify: insecure(ctx),
+			CipherSuites:       nil,
+			MinVersion:         tls.VersionTLS13,
+			MaxVersion:         tls.VersionTLS13,
+			CurvePreferences:   nil,
+		}
+
+		tlsConn, err := uClient(ctx, recordConn, &tlsConfig, tls.HelloChrome_Auto)
+		if err != nil {
+			l.Error("failed to create uTLS client", "error", err)
+			res.Err = newTestError(err)
+			return res
+		}
+		defer tlsConn.Close()
+
+		// Explicitly run the handshake
+		l.Debug("starting TLS handshake")
+		t0 = time.Now()
+		if err := handshake(ctx, tlsConn); err != nil {
+			l.Error("TLS handshake failed", "error", err, "fragments", res.Fragments)
+			res.Err = newTestError(err)
+			return res
+		}
+		res.TLSHandshakeDuration = time.Since(t0)
+		l.Debug("TLS handshake completed", "duration", res.TLSHandshakeDuration)
+
+		tlsState := tlsConn.ConnectionState()
+		res.CertError = verifyPeer(ctx, l, sni, tlsState.PeerCertificates)
+		res.Negotiated = uNegotiated(tlsConn)
+		l.Info("test completed successfully",
+			"handshake_complete", tlsState.HandshakeComplete,
+			"transport_duration", res.TransportEstablishDuration,
+			"tls_duration", res.TLSHandshakeDuration,
+			"fragments", res.Fragments)
+		return res
+	}
+}
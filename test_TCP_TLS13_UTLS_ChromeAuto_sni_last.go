@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/netip"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+
+	// This is for systems that don't have a good set of roots. (update often)
+	_ "golang.org/x/crypto/x509roots/fallback"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// test_TCP_TLS13_UTLS_ChromeAuto_sni_last is a uTLS connection using:
+// TCP
+// default cipher suites
+// forced TLS1.3
+// default elliptic curve preferences
+// utls.HelloChrome_Auto
+// And the server_name extension moved to the end of the extension list,
+// since some DPI stops parsing after a fixed byte offset.
+func test_TCP_TLS13_UTLS_ChromeAuto_sni_last(ctx context.Context, l *slog.Logger, addrPort netip.AddrPort, sni string) TestAttemptResult {
+	counter, _, _, _ := runtime.Caller(0)
+	l = l.With("test", strings.Split(runtime.FuncForPC(counter).Name(), ".")[1], "ip", addrPort.Addr().String())
+
+	l.Debug("starting TCP TLS13 UTLS ChromeAuto SNI last test",
+		"target", addrPort.String(),
+		"sni", sni)
+
+	res := TestAttemptResult{}
+
+	// Initiate TCP connection
+	l.Debug("initiating TCP connection")
+	tcpDialer := net.Dialer{
+		Timeout:       dialTimeout(ctx),
+		LocalAddr:     localAddr(ctx),
+		FallbackDelay: -1, // disable happy-eyeballs
+		KeepAlive:     keepAlive(ctx),
+		Resolver:      &net.Resolver{PreferGo: true},
+		Control:       dialControl(ctx),
+	}
+	tcpDialer.SetMultipathTCP(false)
+
+	t0 := time.Now()
+	tcpConn, err := tcpDialer.DialContext(ctx, "tcp", addrPort.String())
+	if err != nil {
+		l.Error("failed to establish TCP connection", "error", err)
+		res.Err = newTestError(err)
+		return res
+	}
+	defer tcpConn.Close()
+	tcpConn = wire(ctx, tcpConn)
+	res.TransportEstablishDuration = time.Since(t0)
+	l.Debug("TCP connection established", "duration", res.TransportEstablishDuration)
+
+	l.Debug("configuring TLS connection")
+	tlsConfig := tls.Config{
+		ServerName:         sni,
+		InsecureSkipVerify: insecure(ctx),
+		CipherSuites:       nil,
+		MinVersion:         tls.VersionTLS13,
+		MaxVersion:         tls.VersionTLS13,
+		CurvePreferences:   nil,
+	}
+
+	tlsConn, err := uClient(ctx, tcpConn, &tlsConfig, tls.HelloChrome_Auto)
+	if err != nil {
+		l.Error("failed to create uTLS client", "error", err)
+		res.Err = newTestError(err)
+		return res
+	}
+	defer tlsConn.Close()
+
+	l.Debug("moving server_name extension last")
+	if err := moveSNILast(tlsConn); err != nil {
+		l.Error("failed to reorder extensions", "error", err)
+		res.Err = newTestError(err)
+		return res
+	}
+
+	// Explicitly run the handshake
+	l.Debug("starting TLS handshake")
+	t0 = time.Now()
+	if err := handshake(ctx, tlsConn); err != nil {
+		l.Error("TLS handshake failed", "error", err)
+		res.Err = newTestError(err)
+		return res
+	}
+	res.TLSHandshakeDuration = time.Since(t0)
+	l.Debug("TLS handshake completed", "duration", res.TLSHandshakeDuration)
+
+	tlsState := tlsConn.ConnectionState()
+	res.CertError = verifyPeer(ctx, l, sni, tlsState.PeerCertificates)
+	res.Negotiated = uNegotiated(tlsConn)
+	l.Info("test completed successfully",
+		"handshake_complete", tlsState.HandshakeComplete,
+		"transport_duration", res.TransportEstablishDuration,
+		"tls_duration", res.TLSHandshakeDuration)
+	return res
+}
+
+// moveSNILast moves the server_name extension of uconn to the end of the
+// extension list, or right before pre_shared_key which has to stay last.
+// This has to happen before uTLS marshals the ClientHello, rewriting the
+// bytes on the wire would break the handshake transcript.
+func moveSNILast(uconn *tls.UConn) error {
+	if err := uconn.BuildHandshakeState(); err != nil {
+		return err
+	}
+
+	exts := uconn.Extensions
+	i := slices.IndexFunc(exts, func(e tls.TLSExtension) bool {
+		_, ok := e.(*tls.SNIExtension)
+		return ok
+	})
+	if i < 0 {
+		return errors.New("fingerprint has no server_name extension")
+	}
+	sniExt := exts[i]
+	exts = slices.Delete(exts, i, i+1)
+
+	end := len(exts)
+	if end > 0 {
+		if _, ok := exts[end-1].(tls.PreSharedKeyExtension); ok {
+			end--
+		}
+	}
+	uconn.Extensions = slices.Insert(exts, end, sniExt)
+
+	// Marshal again with the new order.
+	return uconn.BuildHandshakeState()
+}
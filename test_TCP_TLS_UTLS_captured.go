@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/netip"
+	"runtime"
+	"strings"
+	"time"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// test_TCP_TLS_UTLS_captured returns a uTLS test mimicking the fingerprint
+// of a captured ClientHello, using:
+// TCP
+// the captured cipher suites, extensions and their order
+// the TLS versions the captured hello supports
+// fresh keys, so unlike a replay the handshake completes
+func test_TCP_TLS_UTLS_captured(hello []byte) testFunc {
+	return func(ctx context.Context, l *slog.Logger, addrPort netip.AddrPort, sni string) TestAttemptResult {
+		counter, _, _, _ := runtime.Caller(0)
+		l = l.With("test", strings.Split(runtime.FuncForPC(counter).Name(), ".")[1], "ip", addrPort.Addr().String())
+
+		l.Debug("starting TCP TLS UTLS captured fingerprint test",
+			"target", addrPort.String(),
+			"sni", sni)
+
+		res := TestAttemptResult{}
+
+		// Unknown extensions are copied as is rather than rejected, as
+		// captures come from all sorts of clients.
+		f := tls.Fingerprinter{AllowBluntMimicry: true}
+		spec, err := f.FingerprintClientHello(hello)
+		if err != nil {
+			l.Error("failed to fingerprint captured ClientHello", "error", err)
+			res.Err = newTestError(err)
+			return res
+		}
+
+		// Initiate TCP connection
+		l.Debug("initiating TCP connection")
+		tcpDialer := net.Dialer{
+			Timeout:       dialTimeout(ctx),
+			LocalAddr:     localAddr(ctx),
+			FallbackDelay: -1, // disable happy-eyeballs
+			KeepAlive:     keepAlive(ctx),
+			Resolver:      &net.Resolver{PreferGo: true},
+			Control:       dialControl(ctx),
+		}
+		tcpDialer.SetMultipathTCP(false)
+
+		t0 := time.Now()
+		tcpConn, err := tcpDialer.DialContext(ctx, "tcp", addrPort.String())
+		if err != nil {
+			l.Error("failed to establish TCP connection", "error", err)
+			res.Err = newTestError(err)
+			return res
+		}
+		defer tcpConn.Close()
+		tcpConn = wire(ctx, tcpConn)
+		res.TransportEstablishDuration = time.Since(t0)
+		l.Debug("TCP connection established", "duration", res.TransportEstablishDuration)
+
+		l.Debug("configuring TLS connection")
+		tlsConfig := tls.Config{
+			ServerName:         sni,
+			InsecureSkipVerify: insecure(ctx),
+		}
+
+		tlsConn := tls.UClient(tcpConn, &tlsConfig, tls.HelloCustom)
+		defer tlsConn.Close()
+		if err := tlsConn.ApplyPreset(applyTLSSettings(ctx, spec)); err != nil {
+			l.Error("failed to apply captured fingerprint", "error", err)
+			res.Err = newTestError(err)
+			return res
+		}
+
+		// Explicitly run the handshake
+		l.Debug("starting TLS handshake")
+		t0 = time.Now()
+		if err := handshake(ctx, tlsConn); err != nil {
+			l.Error("TLS handshake failed", "error", err)
+			res.Err = newTestError(err)
+			return res
+		}
+		res.TLSHandshakeDuration = time.Since(t0)
+		l.Debug("TLS handshake completed", "duration", res.TLSHandshakeDuration)
+
+		tlsState := tlsConn.ConnectionState()
+		res.CertError = verifyPeer(ctx, l, sni, tlsState.PeerCertificates)
+		res.Negotiated = uNegotiated(tlsConn)
+		l.Info("test completed successfully",
+			"handshake_complete", tlsState.HandshakeComplete,
+			"tls_version", tls.VersionName(tlsState.Version),
+			"transport_duration", res.TransportEstablishDuration,
+			"tls_duration", res.TLSHandshakeDuration)
+		return res
+	}
+}
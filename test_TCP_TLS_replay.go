@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/markpash/heybabe/bepass/sni"
+	"github.com/markpash/heybabe/bepass/tlsfrag"
+)
+
+// parseClientHello takes a captured ClientHello, either raw or hex encoded,
+// as a TLS record or a bare handshake message, and returns it as a TLS
+// record along with the parsed message.
+func parseClientHello(b []byte) ([]byte, *sni.ClientHelloMsg, error) {
+	if s := strings.Join(strings.Fields(string(b)), ""); s != "" {
+		if decoded, err := hex.DecodeString(s); err == nil {
+			b = decoded
+		}
+	}
+	if len(b) > 0 && b[0] == 1 {
+		// A bare handshake message, as in Wireshark's "Handshake Protocol".
+		if len(b) > 0xffff {
+			return nil, nil, errors.New("ClientHello doesn't fit in a single record")
+		}
+		b = append([]byte{22, 3, 1, byte(len(b) >> 8), byte(len(b))}, b...)
+	}
+
+	hello, err := sni.ReadClientHello(bytes.NewReader(b), slog.New(slog.DiscardHandler))
+	if err != nil {
+		return nil, nil, fmt.Errorf("not a ClientHello: %w", err)
+	}
+	return b, hello, nil
+}
+
+// readServerHello reads the start of the server's answer, which should be
+// a handshake record starting with a ServerHello (or a HelloRetryRequest,
+// which looks the same on the wire).
+func readServerHello(r io.Reader) error {
+	// The record header, followed by the handshake message type, or the
+	// alert level and description.
+	b := make([]byte, 7)
+	if _, err := io.ReadFull(r, b[:6]); err != nil {
+		return err
+	}
+	switch b[0] {
+	case 22:
+		if b[5] != 2 {
+			return fmt.Errorf("server sent handshake message type %d instead of a ServerHello", b[5])
+		}
+		return nil
+	case 21:
+		if _, err := io.ReadFull(r, b[6:]); err != nil {
+			return errors.New("server sent a truncated alert")
+		}
+		return fmt.Errorf("server sent alert %d", b[6])
+	}
+	return fmt.Errorf("server sent record type %d instead of a ServerHello", b[0])
+}
+
+// test_TCP_TLS_replay returns a test that sends a captured ClientHello as
+// is, through the fragmenter made by newFragmenter if it isn't nil, and
+// waits for the ServerHello. The handshake can't go further, as the keys
+// of the captured hello are unknown, but getting an answer shows the hello
+// went through. This lets users test clients they can't modify.
+func test_TCP_TLS_replay(hello []byte, newFragmenter func() (tlsfrag.Fragmenter, error)) testFunc {
+	return func(ctx context.Context, l *slog.Logger, addrPort netip.AddrPort, sni string) TestAttemptResult {
+		counter, _, _, _ := runtime.Caller(0)
+		l = l.With("test", strings.Split(runtime.FuncForPC(counter).Name(), ".")[1], "ip", addrPort.Addr().String())
+
+		l.Debug("starting TCP TLS replay test",
+			"target", addrPort.String(),
+			"sni", sni,
+			"hello_size", len(hello),
+			"fragmented", newFragmenter != nil)
+
+		res := TestAttemptResult{}
+
+		// Initiate TCP connection
+		l.Debug("initiating TCP connection")
+		tcpDialer := net.Dialer{
+			Timeout:       dialTimeout(ctx),
+			LocalAddr:     localAddr(ctx),
+			FallbackDelay: -1, // disable happy-eyeballs
+			KeepAlive:     keepAlive(ctx),
+			Resolver:      &net.Resolver{PreferGo: true},
+			Control:       dialControl(ctx),
+		}
+		tcpDialer.SetMultipathTCP(false)
+
+		t0 := time.Now()
+		tcpConn, err := tcpDialer.DialContext(ctx, "tcp", addrPort.String())
+		if err != nil {
+			l.Error("failed to establish TCP connection", "error", err)
+			res.Err = newTestError(err)
+			return res
+		}
+		defer tcpConn.Close()
+		tcpConn = wire(ctx, tcpConn)
+		res.TransportEstablishDuration = time.Since(t0)
+		l.Debug("TCP connection established", "duration", res.TransportEstablishDuration)
+
+		if deadline, ok := handshakeDeadline(ctx); ok {
+			tcpConn.SetDeadline(deadline)
+		}
+
+		conn := tcpConn
+		if newFragmenter != nil {
+			f, err := newFragmenter()
+			if err != nil {
+				l.Error("failed to create fragmenter", "error", err)
+				res.Err = newTestError(err)
+				return res
+			}
+			fragConn := tlsfrag.NewWithFragmenter(tcpConn, f, l)
+			fragConn.OnFirstWrite = func(s tlsfrag.Stats) { res.Fragments = &s }
+			fragConn.Context = ctx
+			conn = fragConn
+		}
+
+		l.Debug("sending captured ClientHello")
+		t0 = time.Now()
+		if _, err := conn.Write(hello); err != nil {
+			l.Error("failed to send ClientHello", "error", err, "fragments", res.Fragments)
+			res.Err = newTestError(err)
+			return res
+		}
+		if err := readServerHello(conn); err != nil {
+			l.Error("no ServerHello received", "error", err, "fragments", res.Fragments)
+			res.Err = newTestError(err)
+			return res
+		}
+		res.TLSHandshakeDuration = time.Since(t0)
+
+		l.Info("test completed successfully",
+			"transport_duration", res.TransportEstablishDuration,
+			"server_hello_duration", res.TLSHandshakeDuration,
+			"fragments", res.Fragments)
+		return res
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"log/slog"
 	"net"
@@ -13,128 +14,184 @@ import (
 	// This is for systems that don't have a good set of roots. (update often)
 	_ "golang.org/x/crypto/x509roots/fallback"
 
+	"github.com/markpash/heybabe/bepass/tlsfrag"
 	tls "github.com/refraction-networking/utls"
 )
 
-// test_TCP_TLS_warp_plus_custom is a uTLS connection using:
-// warp-plus settings from from warp-plus v1.2.1
-// NOTE: the version of uTLS used in warp-plus is much older than here.
-func test_TCP_TLS_warp_plus_custom(ctx context.Context, l *slog.Logger, addrPort netip.AddrPort, sni string) TestAttemptResult {
-	counter, _, _, _ := runtime.Caller(0)
-	l = l.With("test", strings.Split(runtime.FuncForPC(counter).Name(), ".")[1], "ip", addrPort.Addr().String())
-
-	l.Debug("starting TCP TLS warp plus custom test", 
-		"target", addrPort.String(),
-		"sni", sni)
-
-	res := TestAttemptResult{}
-
-	// Initiate TCP connection
-	l.Debug("initiating TCP connection")
-	tcpDialer := net.Dialer{
-		Timeout:       5 * time.Second,
-		LocalAddr:     nil,
-		FallbackDelay: -1, // disable happy-eyeballs
-		KeepAlive:     15, // default
-		Resolver:      &net.Resolver{PreferGo: true},
-	}
-	tcpDialer.SetMultipathTCP(false)
+// warpPlusSettings are the knobs of the warp-plus ClientHello.
+type warpPlusSettings struct {
+	CipherSuites []uint16 // in the order they are offered
+	PaddingLen   int      // length of the padding extension, 0 to leave it out
+	RecordSize   int      // split the ClientHello into TLS records of this size, 0 for one record
+}
 
-	t0 := time.Now()
-	tcpConn, err := tcpDialer.DialContext(ctx, "tcp", addrPort.String())
-	if err != nil {
-		l.Error("failed to establish TCP connection", "error", err)
-		res.err = err
-		return res
-	}
-	defer tcpConn.Close()
-	res.TransportEstablishDuration = time.Since(t0)
-	l.Debug("TCP connection established", "duration", res.TransportEstablishDuration)
-
-	l.Debug("configuring TLS connection")
-	tlsConfig := tls.Config{
-		ServerName:         sni,
-		InsecureSkipVerify: false,
-		CipherSuites:       nil,
-		MinVersion:         tls.VersionTLS10,
-		CurvePreferences:   nil,
+// String describes ws for test labels.
+func (ws warpPlusSettings) String() string {
+	s := fmt.Sprintf("(%d ciphers, %dB padding", len(ws.CipherSuites), ws.PaddingLen)
+	if ws.RecordSize > 0 {
+		s += fmt.Sprintf(", %dB records", ws.RecordSize)
 	}
+	return s + ")"
+}
 
-	tlsConn := tls.UClient(tcpConn, &tlsConfig, tls.HelloCustom)
-	defer tlsConn.Close()
-
-	SNICurveSize := 1200
-	spec := tls.ClientHelloSpec{
-		TLSVersMax: tls.VersionTLS12,
-		TLSVersMin: tls.VersionTLS12,
-		CipherSuites: []uint16{
-			tls.GREASE_PLACEHOLDER,
-			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
-			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
-			tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
-			tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
-			tls.TLS_AES_128_GCM_SHA256, // tls 1.3
-			tls.FAKE_TLS_DHE_RSA_WITH_AES_256_CBC_SHA,
-			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
-			tls.TLS_RSA_WITH_AES_256_CBC_SHA,
-		},
-		Extensions: []tls.TLSExtension{
-			&SNICurveExtension{
-				SNICurveLen: SNICurveSize,
-				WillPad:     true,
-			},
-			&tls.SupportedCurvesExtension{Curves: []tls.CurveID{tls.X25519, tls.CurveP256}},
-			&tls.SupportedPointsExtension{SupportedPoints: []byte{0}}, // uncompressed
-			&tls.SessionTicketExtension{},
-			&tls.ALPNExtension{AlpnProtocols: []string{"http/1.1"}},
-			&tls.SignatureAlgorithmsExtension{
-				SupportedSignatureAlgorithms: []tls.SignatureScheme{
-					tls.ECDSAWithP256AndSHA256,
-					tls.ECDSAWithP384AndSHA384,
-					tls.ECDSAWithP521AndSHA512,
-					tls.PSSWithSHA256,
-					tls.PSSWithSHA384,
-					tls.PSSWithSHA512,
-					tls.PKCS1WithSHA256,
-					tls.PKCS1WithSHA384,
-					tls.PKCS1WithSHA512,
-					tls.ECDSAWithSHA1,
-					tls.PKCS1WithSHA1,
+// warpPlusCustom are the settings from warp-plus v1.2.1.
+var warpPlusCustom = warpPlusSettings{
+	CipherSuites: []uint16{
+		tls.GREASE_PLACEHOLDER,
+		tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+		tls.TLS_AES_128_GCM_SHA256, // tls 1.3
+		tls.FAKE_TLS_DHE_RSA_WITH_AES_256_CBC_SHA,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	},
+	PaddingLen: 1200,
+}
+
+// warpPlusRecordSplit is warpPlusCustom with the padded ClientHello spread
+// over small TLS records, so no single record holds all of it.
+var warpPlusRecordSplit = warpPlusSettings{
+	CipherSuites: warpPlusCustom.CipherSuites,
+	PaddingLen:   warpPlusCustom.PaddingLen,
+	RecordSize:   256,
+}
+
+// test_TCP_TLS_warp_plus_custom uses the warp-plus v1.2.1 settings.
+var test_TCP_TLS_warp_plus_custom = test_TCP_TLS_warp_plus(warpPlusCustom)
+
+// test_TCP_TLS_warp_plus_record_split splits the warp-plus ClientHello into
+// several TLS records.
+var test_TCP_TLS_warp_plus_record_split = test_TCP_TLS_warp_plus(warpPlusRecordSplit)
+
+// test_TCP_TLS_warp_plus returns a uTLS connection test using:
+// warp-plus settings from from warp-plus v1.2.1, with the tunables from ws
+// NOTE: the version of uTLS used in warp-plus is much older than here.
+func test_TCP_TLS_warp_plus(ws warpPlusSettings) testFunc {
+	return func(ctx context.Context, l *slog.Logger, addrPort netip.AddrPort, sni string) TestAttemptResult {
+		counter, _, _, _ := runtime.Caller(0)
+		l = l.With("test", strings.Split(runtime.FuncForPC(counter).Name(), ".")[1], "ip", addrPort.Addr().String())
+
+		l.Debug("starting TCP TLS warp plus test",
+			"target", addrPort.String(),
+			"sni", sni,
+			"cipher_suites", len(ws.CipherSuites),
+			"padding_len", ws.PaddingLen,
+			"record_size", ws.RecordSize)
+
+		res := TestAttemptResult{}
+
+		// Initiate TCP connection
+		l.Debug("initiating TCP connection")
+		tcpDialer := net.Dialer{
+			Timeout:       dialTimeout(ctx),
+			LocalAddr:     localAddr(ctx),
+			FallbackDelay: -1, // disable happy-eyeballs
+			KeepAlive:     keepAlive(ctx),
+			Resolver:      &net.Resolver{PreferGo: true},
+			Control:       dialControl(ctx),
+		}
+		tcpDialer.SetMultipathTCP(false)
+
+		t0 := time.Now()
+		tcpConn, err := tcpDialer.DialContext(ctx, "tcp", addrPort.String())
+		if err != nil {
+			l.Error("failed to establish TCP connection", "error", err)
+			res.Err = newTestError(err)
+			return res
+		}
+		defer tcpConn.Close()
+		tcpConn = wire(ctx, tcpConn)
+		res.TransportEstablishDuration = time.Since(t0)
+		l.Debug("TCP connection established", "duration", res.TransportEstablishDuration)
+
+		conn := tcpConn
+		if ws.RecordSize > 0 {
+			l.Debug("wrapping TCP connection with record splitter", "record_size", ws.RecordSize)
+			fragConn := tlsfrag.NewWithFragmenter(tcpConn, &tlsfrag.RecordSplit{Size: ws.RecordSize}, l)
+			fragConn.OnFirstWrite = func(s tlsfrag.Stats) { res.Fragments = &s }
+			fragConn.Context = ctx
+			conn = fragConn
+		}
+
+		l.Debug("configuring TLS connection")
+		tlsConfig := tls.Config{
+			ServerName:         sni,
+			InsecureSkipVerify: insecure(ctx),
+			CipherSuites:       nil,
+			MinVersion:         tls.VersionTLS10,
+			CurvePreferences:   nil,
+		}
+
+		tlsConn := tls.UClient(conn, &tlsConfig, tls.HelloCustom)
+		defer tlsConn.Close()
+
+		spec := tls.ClientHelloSpec{
+			TLSVersMax:   tls.VersionTLS12,
+			TLSVersMin:   tls.VersionTLS12,
+			CipherSuites: ws.CipherSuites,
+			Extensions: []tls.TLSExtension{
+				&SNICurveExtension{
+					SNICurveLen: ws.PaddingLen,
+					WillPad:     ws.PaddingLen > 0,
+				},
+				&tls.SupportedCurvesExtension{Curves: []tls.CurveID{tls.X25519, tls.CurveP256}},
+				&tls.SupportedPointsExtension{SupportedPoints: []byte{0}}, // uncompressed
+				&tls.SessionTicketExtension{},
+				&tls.ALPNExtension{AlpnProtocols: []string{"http/1.1"}},
+				&tls.SignatureAlgorithmsExtension{
+					SupportedSignatureAlgorithms: []tls.SignatureScheme{
+						tls.ECDSAWithP256AndSHA256,
+						tls.ECDSAWithP384AndSHA384,
+						tls.ECDSAWithP521AndSHA512,
+						tls.PSSWithSHA256,
+						tls.PSSWithSHA384,
+						tls.PSSWithSHA512,
+						tls.PKCS1WithSHA256,
+						tls.PKCS1WithSHA384,
+						tls.PKCS1WithSHA512,
+						tls.ECDSAWithSHA1,
+						tls.PKCS1WithSHA1,
+					},
 				},
+				&tls.KeyShareExtension{KeyShares: []tls.KeyShare{
+					{Group: tls.CurveID(tls.GREASE_PLACEHOLDER), Data: []byte{0}},
+					{Group: tls.X25519},
+				}},
+				&tls.PSKKeyExchangeModesExtension{Modes: []uint8{1}}, // pskModeDHE
+				&tls.SNIExtension{ServerName: sni},
 			},
-			&tls.KeyShareExtension{KeyShares: []tls.KeyShare{
-				{Group: tls.CurveID(tls.GREASE_PLACEHOLDER), Data: []byte{0}},
-				{Group: tls.X25519},
-			}},
-			&tls.PSKKeyExchangeModesExtension{Modes: []uint8{1}}, // pskModeDHE
-			&tls.SNIExtension{ServerName: sni},
-		},
-		GetSessionID: nil,
-	}
-	l.Debug("applying uTLS preset for warp-plus custom spec")
-	if err := tlsConn.ApplyPreset(&spec); err != nil {
-		l.Error("failed to apply uTLS preset", "error", err)
-		res.err = err
-		return res
-	}
-
-	// Explicitly run the handshake
-	l.Debug("starting TLS handshake")
-	t0 = time.Now()
-	if err := tlsConn.HandshakeContext(ctx); err != nil {
-		l.Error("TLS handshake failed", "error", err)
-		res.err = err
+			GetSessionID: nil,
+		}
+		l.Debug("applying uTLS preset for warp-plus custom spec")
+		if err := tlsConn.ApplyPreset(applyTLSSettings(ctx, &spec)); err != nil {
+			l.Error("failed to apply uTLS preset", "error", err)
+			res.Err = newTestError(err)
+			return res
+		}
+
+		// Explicitly run the handshake
+		l.Debug("starting TLS handshake")
+		t0 = time.Now()
+		if err := handshake(ctx, tlsConn); err != nil {
+			l.Error("TLS handshake failed", "error", err, "fragments", res.Fragments)
+			res.Err = newTestError(err)
+			return res
+		}
+		res.TLSHandshakeDuration = time.Since(t0)
+		l.Debug("TLS handshake completed", "duration", res.TLSHandshakeDuration)
+
+		tlsState := tlsConn.ConnectionState()
+		res.CertError = verifyPeer(ctx, l, sni, tlsState.PeerCertificates)
+		res.Negotiated = uNegotiated(tlsConn)
+		l.Info("test completed successfully",
+			"handshake_complete", tlsState.HandshakeComplete,
+			"transport_duration", res.TransportEstablishDuration,
+			"tls_duration", res.TLSHandshakeDuration,
+			"fragments", res.Fragments)
 		return res
 	}
-	res.TLSHandshakeDuration = time.Since(t0)
-	l.Debug("TLS handshake completed", "duration", res.TLSHandshakeDuration)
-
-	tlsState := tlsConn.ConnectionState()
-	l.Info("test completed successfully", 
-		"handshake_complete", tlsState.HandshakeComplete,
-		"transport_duration", res.TransportEstablishDuration,
-		"tls_duration", res.TLSHandshakeDuration)
-	return res
 }
 
 // Weird extension added in warp-plus that I don't understand (I think
@@ -169,7 +226,6 @@ func (e *SNICurveExtension) Read(b []byte) (n int, err error) {
 	b[1] = byte(utlsExtensionSNICurve)
 	b[2] = byte(e.SNICurveLen >> 8)
 	b[3] = byte(e.SNICurveLen)
-	y := make([]byte, 1200)
-	copy(b[4:], y)
+	clear(b[4:e.Len()])
 	return e.Len(), io.EOF
 }
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// test_TCP_obfs4 returns a test of an obfs4 bridge:
+// TCP, to the bridge rather than the SNI's address
+// obfs4 client handshake, for the bridge's cert
+// It succeeds when the bridge answers with a valid server handshake, so
+// failing means obfs4 itself, or the bridge, is blocked.
+func test_TCP_obfs4(b obfs4Bridge) testFunc {
+	return func(ctx context.Context, l *slog.Logger, addrPort netip.AddrPort, sni string) TestAttemptResult {
+		counter, _, _, _ := runtime.Caller(0)
+		l = l.With("test", strings.Split(runtime.FuncForPC(counter).Name(), ".")[1], "ip", addrPort.Addr().String())
+
+		l.Debug("starting TCP obfs4 test",
+			"target", addrPort.String(),
+			"bridge", b)
+
+		res := TestAttemptResult{}
+
+		// Initiate TCP connection
+		l.Debug("initiating TCP connection")
+		tcpDialer := net.Dialer{
+			Timeout:       dialTimeout(ctx),
+			LocalAddr:     localAddr(ctx),
+			FallbackDelay: -1, // disable happy-eyeballs
+			KeepAlive:     keepAlive(ctx),
+			Control:       dialControl(ctx),
+		}
+		tcpDialer.SetMultipathTCP(false)
+
+		t0 := time.Now()
+		tcpConn, err := tcpDialer.DialContext(ctx, "tcp", addrPort.String())
+		if err != nil {
+			l.Error("failed to establish TCP connection", "error", err)
+			res.Err = newTestError(err)
+			return res
+		}
+		defer tcpConn.Close()
+		tcpConn = wire(ctx, tcpConn)
+		res.TransportEstablishDuration = time.Since(t0)
+		l.Debug("TCP connection established", "duration", res.TransportEstablishDuration)
+
+		hello, epochHour, err := obfs4ClientHandshake(b)
+		if err != nil {
+			l.Error("failed to build obfs4 handshake", "error", err)
+			res.Err = newTestError(err)
+			return res
+		}
+
+		l.Debug("starting obfs4 handshake", "size", len(hello))
+		if deadline, ok := handshakeDeadline(ctx); ok {
+			tcpConn.SetDeadline(deadline)
+		}
+		t0 = time.Now()
+		if _, err := tcpConn.Write(hello); err != nil {
+			l.Error("failed to send obfs4 handshake", "error", err)
+			res.Err = newTestError(err)
+			return res
+		}
+		if err := readObfs4ServerHandshake(tcpConn, b, epochHour); err != nil {
+			l.Error("obfs4 handshake failed", "error", err)
+			res.Err = newTestError(fmt.Errorf("obfs4 handshake: %w", err))
+			return res
+		}
+		res.TLSHandshakeDuration = time.Since(t0)
+
+		l.Info("test completed successfully",
+			"transport_duration", res.TransportEstablishDuration,
+			"handshake_duration", res.TLSHandshakeDuration)
+		return res
+	}
+}
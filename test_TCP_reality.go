@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"runtime"
+	"strings"
+	"time"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// test_TCP_reality returns a test of a REALITY server:
+// TCP
+// the fingerprint of the server's share link, with the REALITY session ID
+// a VLESS request through the server, for TCP transports
+// It succeeds when the server authenticates the client with its temporary
+// certificate and proxies the request, so it fails both when REALITY is
+// blocked and when the server only looks like the site it fronts.
+func test_TCP_reality(s realityServer) testFunc {
+	return func(ctx context.Context, l *slog.Logger, addrPort netip.AddrPort, sni string) TestAttemptResult {
+		counter, _, _, _ := runtime.Caller(0)
+		l = l.With("test", strings.Split(runtime.FuncForPC(counter).Name(), ".")[1], "ip", addrPort.Addr().String())
+
+		l.Debug("starting TCP REALITY test",
+			"target", addrPort.String(),
+			"sni", sni,
+			"server", s)
+
+		res := TestAttemptResult{}
+
+		// Initiate TCP connection
+		l.Debug("initiating TCP connection")
+		tcpDialer := net.Dialer{
+			Timeout:       dialTimeout(ctx),
+			LocalAddr:     localAddr(ctx),
+			FallbackDelay: -1, // disable happy-eyeballs
+			KeepAlive:     keepAlive(ctx),
+			Control:       dialControl(ctx),
+		}
+		tcpDialer.SetMultipathTCP(false)
+
+		t0 := time.Now()
+		tcpConn, err := tcpDialer.DialContext(ctx, "tcp", addrPort.String())
+		if err != nil {
+			l.Error("failed to establish TCP connection", "error", err)
+			res.Err = newTestError(err)
+			return res
+		}
+		defer tcpConn.Close()
+		tcpConn = wire(ctx, tcpConn)
+		res.TransportEstablishDuration = time.Since(t0)
+		l.Debug("TCP connection established", "duration", res.TransportEstablishDuration)
+
+		// The server's certificate is checked against the shared key
+		// instead of the CAs.
+		var (
+			authKey       []byte
+			authenticated bool
+		)
+		tlsConfig := tls.Config{
+			ServerName:         sni,
+			InsecureSkipVerify: true,
+			MinVersion:         tls.VersionTLS13,
+			MaxVersion:         tls.VersionTLS13,
+			VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+				authenticated = realityCertificate(rawCerts, authKey)
+				return nil
+			},
+		}
+
+		tlsConn, err := uClient(ctx, tcpConn, &tlsConfig, s.hello)
+		if err != nil {
+			l.Error("failed to create uTLS client", "error", err)
+			res.Err = newTestError(err)
+			return res
+		}
+		defer tlsConn.Close()
+
+		if err := tlsConn.BuildHandshakeState(); err != nil {
+			l.Error("failed to build ClientHello", "error", err)
+			res.Err = newTestError(err)
+			return res
+		}
+		keys := tlsConn.HandshakeState.State13.KeyShareKeys
+		if keys == nil || keys.Ecdhe == nil {
+			res.Err = newTestError(errors.New("the fingerprint has no X25519 key share"))
+			return res
+		}
+		authKey, err = sealRealitySessionID(s, tlsConn.HandshakeState.Hello, keys.Ecdhe)
+		if err != nil {
+			l.Error("failed to seal REALITY session ID", "error", err)
+			res.Err = newTestError(err)
+			return res
+		}
+
+		l.Debug("starting TLS handshake")
+		t0 = time.Now()
+		if err := handshake(ctx, tlsConn); err != nil {
+			l.Error("TLS handshake failed", "error", err)
+			res.Err = newTestError(err)
+			return res
+		}
+		res.TLSHandshakeDuration = time.Since(t0)
+		l.Debug("TLS handshake completed", "duration", res.TLSHandshakeDuration)
+		res.Negotiated = uNegotiated(tlsConn)
+
+		if !authenticated {
+			l.Error("REALITY authentication failed")
+			res.Err = newTestError(errors.New("REALITY authentication failed, the server answered as the site it fronts: the public key or short ID may be wrong"))
+			return res
+		}
+
+		// Other transports run their own protocol over REALITY first.
+		if s.network != "tcp" && s.network != "raw" {
+			l.Info("test completed successfully, without VLESS request", "network", s.network)
+			return res
+		}
+
+		req, err := vlessRequest(s)
+		if err != nil {
+			res.Err = newTestError(err)
+			return res
+		}
+		if deadline, ok := handshakeDeadline(ctx); ok {
+			tlsConn.SetDeadline(deadline)
+		}
+		t0 = time.Now()
+		if _, err := tlsConn.Write(req); err != nil {
+			l.Error("failed to send VLESS request", "error", err)
+			res.Err = newTestError(fmt.Errorf("VLESS: %w", err))
+			return res
+		}
+		if err := readVLESSResponse(tlsConn); err != nil {
+			l.Error("VLESS request failed", "error", err)
+			res.Err = newTestError(fmt.Errorf("VLESS: %w", err))
+			return res
+		}
+		res.TTFBDuration = time.Since(t0)
+
+		l.Info("test completed successfully",
+			"transport_duration", res.TransportEstablishDuration,
+			"tls_duration", res.TLSHandshakeDuration,
+			"ttfb_duration", res.TTFBDuration)
+		return res
+	}
+}
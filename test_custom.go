@@ -0,0 +1,465 @@
+package main
+
+import (
+	"context"
+	stdtls "crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"net/url"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+
+	// This is for systems that don't have a good set of roots. (update often)
+	_ "golang.org/x/crypto/x509roots/fallback"
+
+	"github.com/markpash/heybabe/bepass/tlsfrag"
+	quic "github.com/refraction-networking/uquic"
+	tls "github.com/refraction-networking/utls"
+)
+
+// customFingerprints are the fingerprints a custom test can use over TCP.
+// "go" is crypto/tls, as in the Default tests.
+var customFingerprints = map[string]tls.ClientHelloID{
+	"chrome":  tls.HelloChrome_Auto,
+	"firefox": tls.HelloFirefox_Auto,
+	"safari":  tls.HelloSafari_Auto,
+	"edge":    tls.HelloEdge_Auto,
+	"ios":     tls.HelloIOS_Auto,
+	"android": tls.HelloAndroid_11_OkHttp,
+}
+
+// customQUICFingerprints are the fingerprints a custom test can use over
+// QUIC.
+var customQUICFingerprints = map[string]quic.QUICID{
+	"chrome":  quic.QUICChrome_115,
+	"firefox": quic.QUICFirefox_116,
+}
+
+// customSettings describe a test assembled from the --custom flag.
+type customSettings struct {
+	Transport              string            // "tcp" or "quic"
+	MinVersion, MaxVersion uint16            // TLS versions to offer
+	Fingerprint            string            // key of customFingerprints or "go"
+	ALPN                   []string          // replaces the fingerprint's ALPN protocols, if set
+	Fragment               *fragmentSettings // fragment the ClientHello with these, if set
+	Proxy                  *url.URL          // connect through this proxy, if set
+	OCSP                   string            // ocspOff, ocspStaple or ocspLive
+}
+
+// parseCustom parses space separated key=value settings, e.g.
+// "transport=tcp tls=1.2-1.3 fingerprint=firefox alpn=h2,http/1.1
+// fragment=on proxy=socks5://127.0.0.1:1080 ocsp=staple". Settings left
+// out keep the defaults of a uTLS Chrome test over TCP.
+func parseCustom(s string) (customSettings, error) {
+	cs := customSettings{
+		Transport:   "tcp",
+		MinVersion:  tls.VersionTLS12,
+		MaxVersion:  tls.VersionTLS13,
+		Fingerprint: "chrome",
+	}
+	for _, f := range strings.Fields(s) {
+		key, value, ok := strings.Cut(f, "=")
+		if !ok || value == "" {
+			return cs, fmt.Errorf("setting %q must be key=value", f)
+		}
+		switch key {
+		case "transport":
+			if value != "tcp" && value != "quic" {
+				return cs, fmt.Errorf("unknown transport %q (must be tcp or quic)", value)
+			}
+			cs.Transport = value
+		case "tls":
+			lo, hi, _ := strings.Cut(value, "-")
+			if hi == "" {
+				hi = lo
+			}
+			var err error
+			if cs.MinVersion, err = parseTLSVersion(lo); err != nil {
+				return cs, err
+			}
+			if cs.MaxVersion, err = parseTLSVersion(hi); err != nil {
+				return cs, err
+			}
+			if cs.MinVersion > cs.MaxVersion {
+				return cs, fmt.Errorf("invalid TLS version range %q", value)
+			}
+		case "fingerprint":
+			cs.Fingerprint = value
+		case "alpn":
+			cs.ALPN = strings.Split(value, ",")
+		case "fragment":
+			switch value {
+			case "on":
+				cs.Fragment = &bepassFragment
+			case "disorder":
+				cs.Fragment = &bepassDisorder
+			case "off":
+				cs.Fragment = nil
+			default:
+				return cs, fmt.Errorf("fragment must be on, disorder or off, got %q", value)
+			}
+		case "proxy":
+			u, err := parseProxyURL(value)
+			if err != nil {
+				return cs, err
+			}
+			cs.Proxy = u
+		case "ocsp":
+			switch value {
+			case ocspStaple, ocspLive:
+				cs.OCSP = value
+			case "off":
+				cs.OCSP = ocspOff
+			default:
+				return cs, fmt.Errorf("ocsp must be staple, live or off, got %q", value)
+			}
+		default:
+			return cs, fmt.Errorf("unknown setting %q", key)
+		}
+	}
+
+	if cs.Transport == "quic" {
+		switch {
+		case cs.MaxVersion < tls.VersionTLS13:
+			return cs, errors.New("QUIC requires TLS 1.3")
+		case cs.Fragment != nil:
+			return cs, errors.New("fragmentation is only supported over TCP")
+		case cs.Proxy != nil:
+			return cs, errors.New("proxies are only supported over TCP")
+		}
+		if _, ok := customQUICFingerprints[cs.Fingerprint]; !ok {
+			return cs, fmt.Errorf("unknown QUIC fingerprint %q (valid values: %s)", cs.Fingerprint, mapKeys(customQUICFingerprints))
+		}
+		cs.MinVersion = tls.VersionTLS13
+	} else if _, ok := customFingerprints[cs.Fingerprint]; !ok && cs.Fingerprint != "go" {
+		return cs, fmt.Errorf("unknown fingerprint %q (valid values: go %s)", cs.Fingerprint, mapKeys(customFingerprints))
+	}
+	return cs, nil
+}
+
+// parseTLSVersion parses a TLS version such as 1.2.
+func parseTLSVersion(s string) (uint16, error) {
+	switch s {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version %q", s)
+}
+
+// mapKeys returns the sorted keys of m, for error messages.
+func mapKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// String describes cs for the test label.
+func (cs customSettings) String() string {
+	versions := strings.TrimPrefix(tls.VersionName(cs.MinVersion), "TLS ")
+	if cs.MaxVersion != cs.MinVersion {
+		versions += "-" + strings.TrimPrefix(tls.VersionName(cs.MaxVersion), "TLS ")
+	}
+	parts := []string{strings.ToUpper(cs.Transport), "TLS " + versions}
+	if cs.Fingerprint == "go" {
+		parts = append(parts, "crypto/tls")
+	} else {
+		parts = append(parts, "uTLS "+cs.Fingerprint)
+	}
+	if cs.ALPN != nil {
+		parts = append(parts, "ALPN "+strings.Join(cs.ALPN, ","))
+	}
+	switch {
+	case cs.Fragment == nil:
+	case cs.Fragment.Disorder:
+		parts = append(parts, "Bepass Disorder")
+	default:
+		parts = append(parts, "Bepass Fragment")
+	}
+	if cs.Proxy != nil {
+		parts = append(parts, "via "+cs.Proxy.Scheme+"://"+cs.Proxy.Host)
+	}
+	if cs.OCSP != ocspOff {
+		parts = append(parts, "OCSP "+cs.OCSP)
+	}
+	return strings.Join(parts, " - ")
+}
+
+// strategy returns what the custom test puts on the wire. Through a proxy,
+// the test says nothing about the direct path the emitted configs use.
+func (cs customSettings) strategy() strategy {
+	if cs.Proxy != nil {
+		return strategy{}
+	}
+	s := strategy{Transport: cs.Transport, Fingerprint: cs.Fingerprint}
+	if cs.Fingerprint == "go" {
+		s.Fingerprint = ""
+	}
+	s.Fragment = cs.Fragment
+	return s
+}
+
+// applyTo sets the TLS versions and ALPN protocols of cs in spec, and
+// requests OCSP stapling if cs asks for it.
+func (cs customSettings) applyTo(spec *tls.ClientHelloSpec) {
+	spec.TLSVersMin, spec.TLSVersMax = cs.MinVersion, cs.MaxVersion
+	hasStatusRequest := false
+	for _, e := range spec.Extensions {
+		switch e := e.(type) {
+		case *tls.SupportedVersionsExtension:
+			e.Versions = slices.DeleteFunc(slices.Clone(e.Versions), func(v uint16) bool {
+				return !isGREASE(v) && (v < cs.MinVersion || v > cs.MaxVersion)
+			})
+		case *tls.StatusRequestExtension:
+			hasStatusRequest = true
+		}
+	}
+	if cs.ALPN != nil {
+		setALPN(spec, cs.ALPN)
+	}
+	if cs.OCSP != ocspOff && !hasStatusRequest {
+		spec.Extensions = appendExtension(slices.Clone(spec.Extensions), &tls.StatusRequestExtension{})
+	}
+}
+
+// test_custom returns a test assembled from cs, so one-off experiments
+// don't need a new test file.
+func test_custom(cs customSettings) testFunc {
+	return func(ctx context.Context, l *slog.Logger, addrPort netip.AddrPort, sni string) TestAttemptResult {
+		counter, _, _, _ := runtime.Caller(0)
+		l = l.With("test", strings.Split(runtime.FuncForPC(counter).Name(), ".")[1], "ip", addrPort.Addr().String())
+
+		l.Debug("starting custom test",
+			"target", addrPort.String(),
+			"sni", sni,
+			"settings", cs.String())
+
+		if cs.Transport == "quic" {
+			return customQUIC(ctx, l, addrPort, sni, cs)
+		}
+		return customTCP(ctx, l, addrPort, sni, cs)
+	}
+}
+
+// customTCP runs a custom test over TCP.
+func customTCP(ctx context.Context, l *slog.Logger, addrPort netip.AddrPort, sni string, cs customSettings) TestAttemptResult {
+	res := TestAttemptResult{}
+
+	// Initiate TCP connection
+	l.Debug("initiating TCP connection", "proxy", cs.Proxy != nil)
+	tcpDialer := net.Dialer{
+		Timeout:       dialTimeout(ctx),
+		LocalAddr:     localAddr(ctx),
+		FallbackDelay: -1, // disable happy-eyeballs
+		KeepAlive:     keepAlive(ctx),
+		Resolver:      &net.Resolver{PreferGo: true},
+		Control:       dialControl(ctx),
+	}
+	tcpDialer.SetMultipathTCP(false)
+
+	t0 := time.Now()
+	var tcpConn net.Conn
+	var err error
+	if cs.Proxy != nil {
+		tcpConn, err = dialProxy(ctx, &tcpDialer, cs.Proxy, addrPort.String())
+	} else {
+		tcpConn, err = tcpDialer.DialContext(ctx, "tcp", addrPort.String())
+	}
+	if err != nil {
+		l.Error("failed to establish TCP connection", "error", err)
+		res.Err = newTestError(err)
+		return res
+	}
+	defer tcpConn.Close()
+	tcpConn = wire(ctx, tcpConn)
+	res.TransportEstablishDuration = time.Since(t0)
+	l.Debug("TCP connection established", "duration", res.TransportEstablishDuration)
+
+	conn := tcpConn
+	if cs.Fragment != nil {
+		l.Debug("creating TLS fragmentation adapter")
+		fragConn := tlsfrag.NewWithFragmenter(tcpConn, cs.Fragment.fragmenter(), l)
+		fragConn.OnFirstWrite = func(s tlsfrag.Stats) { res.Fragments = &s }
+		fragConn.Context = ctx
+		conn = fragConn
+	}
+
+	type handshaker interface {
+		HandshakeContext(context.Context) error
+		Close() error
+	}
+	var (
+		tlsConn    handshaker
+		peerCerts  func() []*x509.Certificate
+		staple     func() []byte
+		negotiated func() *Negotiated
+	)
+	if cs.Fingerprint == "go" {
+		l.Debug("configuring crypto/tls connection")
+		alpn := nextProtos(ctx)
+		if cs.ALPN != nil {
+			alpn = cs.ALPN
+		}
+		tlsConfig := stdtls.Config{
+			ServerName:         sni,
+			InsecureSkipVerify: insecure(ctx),
+			MinVersion:         cs.MinVersion,
+			MaxVersion:         cs.MaxVersion,
+			CurvePreferences:   curvePreferences(ctx),
+			NextProtos:         alpn,
+		}
+		c := stdtls.Client(conn, &tlsConfig)
+		tlsConn = c
+		peerCerts = func() []*x509.Certificate { return c.ConnectionState().PeerCertificates }
+		staple = func() []byte { return c.ConnectionState().OCSPResponse }
+		negotiated = func() *Negotiated { return stdNegotiatedState(c.ConnectionState()) }
+	} else {
+		l.Debug("configuring uTLS connection", "fingerprint", cs.Fingerprint)
+		tlsConfig := tls.Config{
+			ServerName:         sni,
+			InsecureSkipVerify: insecure(ctx),
+			MinVersion:         cs.MinVersion,
+			MaxVersion:         cs.MaxVersion,
+		}
+		spec, err := tls.UTLSIdToSpec(customFingerprints[cs.Fingerprint])
+		if err != nil {
+			l.Error("failed to get uTLS spec", "error", err)
+			res.Err = newTestError(err)
+			return res
+		}
+		// The settings' own ALPN wins over the one from ctx.
+		cs.applyTo(applyTLSSettings(ctx, &spec))
+		uconn := tls.UClient(conn, &tlsConfig, tls.HelloCustom)
+		if err := uconn.ApplyPreset(&spec); err != nil {
+			l.Error("failed to apply uTLS preset", "error", err)
+			res.Err = newTestError(err)
+			return res
+		}
+		tlsConn = uconn
+		peerCerts = func() []*x509.Certificate { return uconn.ConnectionState().PeerCertificates }
+		staple = func() []byte { return uconn.ConnectionState().OCSPResponse }
+		negotiated = func() *Negotiated { return uNegotiated(uconn) }
+	}
+	defer tlsConn.Close()
+
+	// Explicitly run the handshake
+	l.Debug("starting TLS handshake")
+	t0 = time.Now()
+	if err := handshake(ctx, tlsConn); err != nil {
+		l.Error("TLS handshake failed", "error", err, "fragments", res.Fragments)
+		res.Err = newTestError(err)
+		return res
+	}
+	res.TLSHandshakeDuration = time.Since(t0)
+	l.Debug("TLS handshake completed", "duration", res.TLSHandshakeDuration)
+	res.CertError = verifyPeer(ctx, l, sni, peerCerts())
+	res.Negotiated = negotiated()
+	checkOCSP(ctx, l, cs, &res, staple(), peerCerts())
+
+	l.Info("test completed successfully",
+		"transport_duration", res.TransportEstablishDuration,
+		"tls_duration", res.TLSHandshakeDuration,
+		"fragments", res.Fragments,
+		"ocsp_staple", res.OCSPStaple,
+		"revocation", res.Revocation)
+	return res
+}
+
+// customQUIC runs a custom test over QUIC.
+func customQUIC(ctx context.Context, l *slog.Logger, addrPort netip.AddrPort, sni string, cs customSettings) TestAttemptResult {
+	res := TestAttemptResult{}
+
+	l.Debug("configuring TLS and QUIC connection")
+	alpn := quicNextProtos(ctx)
+	if cs.ALPN != nil {
+		alpn = cs.ALPN
+	}
+	tlsConfig := tls.Config{
+		ServerName:         sni,
+		InsecureSkipVerify: insecure(ctx),
+		MinVersion:         tls.VersionTLS13,
+		MaxVersion:         tls.VersionTLS13,
+		NextProtos:         alpn,
+	}
+
+	retry := &retryTracer{}
+	quicConf := wireTracer(ctx, retry.config(&quic.Config{}))
+
+	l.Debug("creating UDP socket for QUIC")
+	udpConn, err := listenUDP(ctx)
+	if err != nil {
+		l.Error("failed to create UDP socket", "error", err)
+		res.Err = newTestError(err)
+		return res
+	}
+	defer udpConn.Close()
+
+	l.Debug("getting QUIC spec", "fingerprint", cs.Fingerprint)
+	quicSpec, err := quic.QUICID2Spec(customQUICFingerprints[cs.Fingerprint])
+	if err != nil {
+		l.Error("failed to get QUIC spec", "error", err)
+		res.Err = newTestError(err)
+		return res
+	}
+	setALPN(quicSpec.ClientHelloSpec, alpn)
+	cs.applyTo(quicSpec.ClientHelloSpec)
+
+	ut := &quic.UTransport{
+		Transport: &quic.Transport{Conn: udpConn},
+		QUICSpec:  &quicSpec,
+	}
+
+	t0 := time.Now()
+	l.Debug("dialing QUIC connection")
+	quicConn, err := ut.Dial(ctx, net.UDPAddrFromAddrPort(addrPort), &tlsConfig, quicConf)
+	res.RetryDuration = retry.since(t0)
+	if err != nil {
+		l.Error("failed to establish QUIC connection", "error", err, "retry_duration", res.RetryDuration)
+		res.Err = newTestError(err)
+		return res
+	}
+	defer quicConn.CloseWithError(quic.ApplicationErrorCode(quic.NoError), "")
+	res.TransportEstablishDuration = time.Since(t0)
+	l.Debug("QUIC connection established", "duration", res.TransportEstablishDuration)
+	tlsState := quicConn.ConnectionState().TLS
+	res.CertError = verifyPeer(ctx, l, sni, tlsState.PeerCertificates)
+	res.Negotiated = negotiatedState(tlsState)
+	checkOCSP(ctx, l, cs, &res, tlsState.OCSPResponse, tlsState.PeerCertificates)
+
+	l.Info("test completed successfully",
+		"handshake_complete", tlsState.HandshakeComplete,
+		"transport_duration", res.TransportEstablishDuration,
+		"retry_duration", res.RetryDuration,
+		"ocsp_staple", res.OCSPStaple,
+		"revocation", res.Revocation)
+	return res
+}
+
+// checkOCSP reports the OCSP staple in res, and the live revocation status,
+// as far as cs asks for them.
+func checkOCSP(ctx context.Context, l *slog.Logger, cs customSettings, res *TestAttemptResult, staple []byte, certs []*x509.Certificate) {
+	if cs.OCSP == ocspOff {
+		return
+	}
+	res.OCSPStaple = stapleStatus(staple, certs)
+	l.Debug("OCSP staple", "status", res.OCSPStaple)
+	if cs.OCSP == ocspLive {
+		l.Debug("checking revocation")
+		res.Revocation = checkRevocation(ctx, certs)
+		l.Debug("revocation checked", "status", res.Revocation)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/rodaine/table"
+)
+
+// testListURL is where the Citizen Lab test lists are, by name: "global" or
+// a lowercase country code.
+const testListURL = "https://raw.githubusercontent.com/citizenlab/test-lists/master/lists/%s.csv"
+
+var testListName = regexp.MustCompile(`^(global|[a-z]{2})$`)
+
+// testListTests are the tests run against the hostnames of a test list,
+// enough to classify each without running the whole suite hundreds of
+// times.
+var testListTests = []string{
+	testID("Default - TCP - TLS 1.3"),
+	testID("Default - TCP - TLS 1.3 - uTLS ChromeAuto"),
+	testID("Bepass Fragment - TCP - TLS 1.3 - uTLS ChromeAuto"),
+	testID("Default - QUIC - TLS 1.3 - uQUIC Chrome"),
+}
+
+// fetchTestList downloads the Citizen Lab test list name, and returns a
+// target for each hostname in it, running testListTests, and the category
+// of each hostname.
+func fetchTestList(ctx context.Context, name string) ([]batchTarget, map[string]string, error) {
+	name = strings.ToLower(name)
+	if !testListName.MatchString(name) {
+		return nil, nil, fmt.Errorf("invalid test list %q (global or a country code)", name)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf(testListURL, name), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, nil, fmt.Errorf("no test list for %q", name)
+	case resp.StatusCode != http.StatusOK:
+		return nil, nil, fmt.Errorf("%s returned %s", req.URL, resp.Status)
+	}
+	return parseTestList(resp.Body)
+}
+
+// parseTestList reads a test list CSV, with url and category_description
+// columns. URLs whose host is an IP are left out, as there's no SNI to test.
+func parseTestList(r io.Reader) ([]batchTarget, map[string]string, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return nil, nil, err
+	}
+	urlCol := slices.Index(header, "url")
+	catCol := slices.Index(header, "category_description")
+	if urlCol < 0 {
+		return nil, nil, errors.New("no url column")
+	}
+
+	var targets []batchTarget
+	categories := make(map[string]string)
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if urlCol >= len(record) {
+			continue
+		}
+		u, err := url.Parse(strings.TrimSpace(record[urlCol]))
+		if err != nil {
+			continue
+		}
+		host := strings.ToLower(u.Hostname())
+		if _, err := netip.ParseAddr(host); err == nil || host == "" {
+			continue
+		}
+		if _, ok := categories[host]; ok {
+			continue
+		}
+		categories[host] = "Uncategorized"
+		if catCol >= 0 && catCol < len(record) && record[catCol] != "" {
+			categories[host] = record[catCol]
+		}
+		targets = append(targets, batchTarget{SNI: host, Tests: testListTests})
+	}
+	if len(targets) == 0 {
+		return nil, nil, errors.New("no hostnames")
+	}
+	return targets, categories, nil
+}
+
+// printSnapshot sums up the targets of a test list by category: how many
+// hostnames are open, filtered, blocked or unreachable. A hostname counts
+// as its best address.
+func printSnapshot(results map[string][]TestResult, order []string, categories map[string]string) {
+	best := make(map[string]*targetScore)
+	for _, s := range targetScores(results, order) {
+		if b, ok := best[s.sni]; !ok || s.passed > b.passed {
+			best[s.sni] = s
+		}
+	}
+	if len(best) == 0 {
+		return
+	}
+
+	type tally struct{ hosts, open, filtered, blocked, unreachable int }
+	tallies := make(map[string]*tally)
+	var total tally
+	for sni, s := range best {
+		category := categories[sni]
+		t, ok := tallies[category]
+		if !ok {
+			t = &tally{}
+			tallies[category] = t
+		}
+		for _, t := range []*tally{t, &total} {
+			t.hosts++
+			switch s.class() {
+			case "open":
+				t.open++
+			case "filtered, some tests work":
+				t.filtered++
+			case "blocked":
+				t.blocked++
+			case "unreachable":
+				t.unreachable++
+			}
+		}
+	}
+
+	headerFmt := color.New(color.FgHiMagenta, color.Bold, color.Underline).SprintfFunc()
+	columnFmt := color.New(color.FgHiCyan, color.Bold).SprintfFunc()
+
+	tbl := table.New("Category", "Hostnames", "Open", "Filtered", "Blocked", "Unreachable")
+	tbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt)
+	names := make([]string, 0, len(tallies))
+	for name := range tallies {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range append(names, "Total") {
+		t := tallies[name]
+		if name == "Total" {
+			t = &total
+		}
+		tbl.AddRow(name, t.hosts, t.open, t.filtered, t.blocked, t.unreachable)
+	}
+
+	tbl.Print()
+	fmt.Println("")
+}
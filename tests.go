@@ -2,26 +2,365 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log/slog"
+	"math/rand/v2"
 	"net"
 	"net/netip"
+	"os"
 	"reflect"
 	"runtime"
+	"slices"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/fatih/color"
+	"github.com/markpash/heybabe/bepass/tlsfrag"
+	"github.com/markpash/heybabe/nfqueue"
+	"github.com/markpash/heybabe/rawsock"
+	"github.com/markpash/heybabe/recipe"
+	"github.com/markpash/heybabe/sockopt"
 	"github.com/rodaine/table"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type TestOptions struct {
 	ResolveIPv4 bool
 	ResolveIPv6 bool
-	ManualIP    netip.Addr
+	ManualIPs   []netip.Addr // addresses to test instead of resolving the SNI, if any
 	Port        uint16
 	SNI         string
+	Host        string            // name to resolve for the targets, if not the SNI
+	Targets     []batchTarget     // targets to test in turn instead of SNI, if any
+	Categories  map[string]string // category of each target's SNI, for test lists
+	Tests       []string          // IDs of the tests to run, all if empty
 	Repeat      uint
+	EmitConfig  string
+	Recipe      *recipe.Recipe
+	PadSizes    []int
+	RecordSizes []int // TLS record sizes to split the ClientHello into, one test each
+	QUICSizes   []int // datagram sizes to pad the QUIC Initial to, one test each
+	SNISplitAt  []int
+	NFQueue     uint16 // netfilter queue to add the packet level fragment tests for, 0 for none
+	Interface   string
+	SourceIP    netip.Addr
+	DSCP        int               // -1 to leave the default marking
+	TTL         int               // 0 for the system default
+	ClientHello []byte            // captured ClientHello record to replay, if any
+	WarpPlus    *warpPlusSettings // tuned warp-plus test to add, if any
+	GREASE      greaseMode        // GREASE in the uTLS tests' ClientHellos
+	Ciphers     []uint16          // cipher suites for the uTLS tests, in order
+	Curves      []uint16          // supported groups for the tests, in order
+	ALPN        []string          // ALPN protocols for the TCP tests, in order
+	QUICALPN    []string          // ALPN protocols for the QUIC tests, in order
+	Custom      *customSettings   // test assembled from flags to add, if any
+	Insecure    bool              // verify certificates after the handshake
+	Output      string            // format to write every attempt in, if any
+	OutputFile  string            // file to write them to, instead of the tables
+	PrintBest   bool              // print only the best test, target and latency
+	Explain     bool              // print what the tests do and what the results suggest
+	ControlHost string            // host to check local connectivity with, if any
+	NetworkInfo bool              // discover the public IP, ASN and country first
+	Retries     uint              // times to retry an attempt on transient errors
+	Stream      bool              // print each test's results as soon as it finishes
+	Pacer       *pacer            // spaces out the attempts, if set
+	Shuffle     bool              // run the tests and targets in random order
+	TCPTimeout  time.Duration     // bounds the TCP connect, 0 for the default
+	TLSTimeout  time.Duration     // bounds the TLS handshake, 0 for no own limit
+	KeepAlive   time.Duration     // TCP keepalive period, negative to disable
+	History     string            // file of past results to show trends of and append to, if any
+	Labels      []string          // labels to describe the run with in the reports
+	Submit      string            // collector to upload an anonymized summary to, if any
+	SubmitIP    bool              // include the public IP in the summary
+	// KeepAliveSweep are keepalive periods to hold an idle connection open
+	// with for KeepAliveHold, one test each.
+	KeepAliveSweep []time.Duration
+	KeepAliveHold  time.Duration
+	// ResolveEveryAttempt resolves the SNI again before every attempt,
+	// rather than once per run.
+	ResolveEveryAttempt bool
+	// WarmUp runs an attempt of each test against each target before the
+	// counted ones, and throws its result away.
+	WarmUp bool
+	// Cooldown, if set, replaces the tests with measuring how long the
+	// block triggered by the SNI lasts, probing with CooldownSNI for up
+	// to this long.
+	Cooldown    time.Duration
+	CooldownSNI string
+	// FailureControls runs controls after each failed attempt, with
+	// CooldownSNI to the same address and the SNI to the control host.
+	FailureControls bool
+	// Obfs4Bridges are obfs4 bridges to test after the SNI, if any.
+	Obfs4Bridges []obfs4Bridge
+	// RealityServers are REALITY servers to test after the SNI, if any.
+	RealityServers []realityServer
+	// ECHOuterSNIs are public names to send as the outer SNI of an ECH
+	// ClientHello, one test each.
+	ECHOuterSNIs []string
+	// Quick runs a single attempt of quickTests with shorter timeouts and
+	// pauses, and prints a verdict.
+	Quick bool
+	// Full adds the tests of fullMatrix and prints their matrix.
+	Full bool
+	// BisectSNI replaces the tests with finding which part of the SNI
+	// triggers the blocking.
+	BisectSNI bool
+	// OnTestDone, if set, is called with the results of each test as soon
+	// as it finishes.
+	OnTestDone func(label string, results []TestResult)
+}
+
+// socketSettings are applied to every socket the tests open.
+type socketSettings struct {
+	opts        []sockopt.Option
+	source      netip.Addr    // local address to send from, if valid
+	dialTimeout time.Duration // bounds the TCP connect, if set
+	keepAlive   time.Duration // TCP keepalive period, if set
+}
+
+func (to TestOptions) socketSettings() socketSettings {
+	var s socketSettings
+	if to.Interface != "" {
+		s.opts = append(s.opts, sockopt.BindToDevice(to.Interface))
+	}
+	if to.DSCP >= 0 {
+		s.opts = append(s.opts, sockopt.DSCP(to.DSCP))
+	}
+	if to.TTL > 0 {
+		s.opts = append(s.opts, sockopt.HopLimit(to.TTL))
+	}
+	s.source = to.SourceIP
+	s.dialTimeout = to.TCPTimeout
+	s.keepAlive = to.KeepAlive
+	return s
+}
+
+// resolveHost returns the name to resolve for the targets.
+func (to TestOptions) resolveHost() string {
+	if to.Host != "" {
+		return to.Host
+	}
+	return to.SNI
+}
+
+// attemptTimeout bounds a whole attempt: 10 seconds, or longer if the TCP
+// and TLS timeouts add up to more, or just their sum for --quick, plus the
+// time the keepalive sweep tests hold their connection.
+func (to TestOptions) attemptTimeout() time.Duration {
+	d := max(10*time.Second, to.TCPTimeout+to.TLSTimeout)
+	if to.Quick && to.TLSTimeout > 0 {
+		d = to.TCPTimeout + to.TLSTimeout
+	}
+	if len(to.KeepAliveSweep) > 0 {
+		d += to.KeepAliveHold
+	}
+	return d
+}
+
+// testGap is the pause between one test and the next.
+func (to TestOptions) testGap() time.Duration {
+	if to.Quick {
+		return quickGap
+	}
+	return 2 * time.Second
+}
+
+type socketSettingsKey struct{}
+
+// withSocketSettings returns a context carrying s to the tests.
+func withSocketSettings(ctx context.Context, s socketSettings) context.Context {
+	return context.WithValue(ctx, socketSettingsKey{}, s)
+}
+
+func socketSettingsFrom(ctx context.Context) socketSettings {
+	s, _ := ctx.Value(socketSettingsKey{}).(socketSettings)
+	return s
+}
+
+// dialControl returns a net.Dialer.Control function applying the socket
+// options from ctx, followed by extra. It also notes the first socket on
+// the setupClock from ctx, and hands TCP sockets to the TCP_INFO watcher
+// from ctx, if any.
+func dialControl(ctx context.Context, extra ...sockopt.Option) func(network, address string, c syscall.RawConn) error {
+	opts := socketSettingsFrom(ctx).opts
+	control := sockopt.DialControl(append(slices.Clone(opts), extra...)...)
+	clock, _ := ctx.Value(setupClockKey{}).(*setupClock)
+	watcher, _ := ctx.Value(tcpInfoKey{}).(*sockopt.TCPInfoWatcher)
+	if clock == nil && watcher == nil {
+		return control
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		if clock != nil {
+			clock.mark()
+		}
+		if watcher != nil && strings.HasPrefix(network, "tcp") {
+			// Not being able to watch just leaves the stats out.
+			c.Control(func(fd uintptr) { watcher.Watch(fd) })
+		}
+		return control(network, address, c)
+	}
+}
+
+// setupClock notes when an attempt's first socket was created, so the time
+// the test and the kernel spent getting ready to send is reported apart
+// from the network phases.
+type setupClock struct {
+	mu sync.Mutex
+	at time.Time
+}
+
+type setupClockKey struct{}
+
+func (c *setupClock) mark() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.at.IsZero() {
+		c.at = time.Now()
+	}
+}
+
+// since returns how long after start the first socket was created, or zero
+// if the attempt created none.
+func (c *setupClock) since(start time.Time) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.at.IsZero() {
+		return 0
+	}
+	return c.at.Sub(start)
+}
+
+// localAddr returns the net.Dialer.LocalAddr for the source address from
+// ctx, or nil to let the kernel pick.
+func localAddr(ctx context.Context) net.Addr {
+	source := socketSettingsFrom(ctx).source
+	if !source.IsValid() {
+		return nil
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(source, 0))
+}
+
+// dialTimeout returns the net.Dialer.Timeout for the TCP tests from ctx.
+func dialTimeout(ctx context.Context) time.Duration {
+	if d := socketSettingsFrom(ctx).dialTimeout; d > 0 {
+		return d
+	}
+	return 5 * time.Second
+}
+
+// keepAlive returns the net.Dialer.KeepAlive for the TCP tests from ctx.
+func keepAlive(ctx context.Context) time.Duration {
+	if d := socketSettingsFrom(ctx).keepAlive; d != 0 {
+		return d
+	}
+	return 15 * time.Second
+}
+
+// listenUDP opens the UDP socket for a QUIC test, with the socket settings
+// from ctx.
+func listenUDP(ctx context.Context) (*net.UDPConn, error) {
+	s := socketSettingsFrom(ctx)
+	addr := netip.AddrPortFrom(netip.IPv4Unspecified(), 0)
+	if s.source.IsValid() {
+		addr = netip.AddrPortFrom(s.source, 0)
+	}
+
+	lc := net.ListenConfig{Control: dialControl(ctx)}
+	pc, err := lc.ListenPacket(ctx, "udp", addr.String())
+	if err != nil {
+		return nil, err
+	}
+	return pc.(*net.UDPConn), nil
+}
+
+// tlsSettings change the ClientHellos of the tests that support them.
+type tlsSettings struct {
+	grease       greaseMode
+	cipherSuites []uint16 // replace the fingerprint's cipher suites, if set
+	curves       []uint16 // replace the supported groups, if set
+	alpn         []string // replace the ALPN protocols of the TCP tests, if set
+	quicALPN     []string // replace the ALPN protocols of the QUIC tests, if set
+	insecure     bool     // don't fail the handshake on a bad certificate
+	// handshakeTimeout bounds the TLS handshake on its own, if set, so
+	// a stalled handshake fails without waiting for the whole attempt.
+	handshakeTimeout time.Duration
+}
+
+func (to TestOptions) tlsSettings() tlsSettings {
+	return tlsSettings{grease: to.GREASE, cipherSuites: to.Ciphers, curves: to.Curves, alpn: to.ALPN, quicALPN: to.QUICALPN, insecure: to.Insecure, handshakeTimeout: to.TLSTimeout}
+}
+
+type tlsSettingsKey struct{}
+
+// withTLSSettings returns a context carrying s to the tests.
+func withTLSSettings(ctx context.Context, s tlsSettings) context.Context {
+	return context.WithValue(ctx, tlsSettingsKey{}, s)
+}
+
+func tlsSettingsFrom(ctx context.Context) tlsSettings {
+	s, _ := ctx.Value(tlsSettingsKey{}).(tlsSettings)
+	return s
+}
+
+// handshake runs conn's TLS handshake within the handshake timeout from ctx,
+// noting it on the helloClock from ctx, if any.
+func handshake(ctx context.Context, conn interface{ HandshakeContext(context.Context) error }) error {
+	clock, _ := ctx.Value(helloClockKey{}).(*helloClock)
+	if d := tlsSettingsFrom(ctx).handshakeTimeout; d > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+	if clock != nil {
+		clock.hello()
+	}
+	err := conn.HandshakeContext(ctx)
+	if err != nil && clock != nil {
+		clock.fail()
+	}
+	return err
+}
+
+// handshakeDeadline returns the deadline for a handshake starting now, for
+// tests that read and write the handshake themselves.
+func handshakeDeadline(ctx context.Context) (time.Time, bool) {
+	deadline, ok := ctx.Deadline()
+	if d := tlsSettingsFrom(ctx).handshakeTimeout; d > 0 {
+		if t := time.Now().Add(d); !ok || t.Before(deadline) {
+			return t, true
+		}
+	}
+	return deadline, ok
+}
+
+// curvePreferences returns the crypto/tls.Config.CurvePreferences for the
+// curves from ctx, or nil for the defaults.
+func curvePreferences(ctx context.Context) []tls.CurveID {
+	var prefs []tls.CurveID
+	for _, c := range tlsSettingsFrom(ctx).curves {
+		prefs = append(prefs, tls.CurveID(c))
+	}
+	return prefs
+}
+
+// nextProtos returns the crypto/tls.Config.NextProtos of the TCP tests for
+// the ALPN protocols from ctx, or nil for none.
+func nextProtos(ctx context.Context) []string {
+	return tlsSettingsFrom(ctx).alpn
+}
+
+// quicNextProtos returns the ALPN protocols of the QUIC tests from ctx, or
+// h3. The QUIC fingerprints have their own, so they're set in the spec too.
+func quicNextProtos(ctx context.Context) []string {
+	if alpn := tlsSettingsFrom(ctx).quicALPN; alpn != nil {
+		return alpn
+	}
+	return []string{"h3"}
 }
 
 type TestResult struct {
@@ -30,52 +369,515 @@ type TestResult struct {
 	Attempts []TestAttemptResult
 }
 
+// TestAttemptResult is the outcome of one attempt. Its durations are all
+// taken with time.Since on time.Now readings, which use the monotonic clock,
+// so clock adjustments during a run don't skew them.
 type TestAttemptResult struct {
+	// Start is when the attempt began.
+	Start time.Time
+	// DNSDuration is how long resolving the SNI took, shared by all the
+	// tests as it's resolved once per run unless resolved for every
+	// attempt, and zero with a manual IP.
+	DNSDuration time.Duration
+	// SetupDuration is how long the attempt took to create its first
+	// socket, which the transport duration of some tests includes.
+	SetupDuration time.Duration
+	// AddrPort is where the attempt went when the SNI was resolved for it
+	// to another address than the TestResult's.
+	AddrPort                   netip.AddrPort
 	TransportEstablishDuration time.Duration
 	TLSHandshakeDuration       time.Duration
-	err                        error
+	// TTFBDuration is the time to the first byte of the response, for
+	// tests that probe the server after the handshake.
+	TTFBDuration time.Duration
+	// RetryDuration is how long it took a QUIC server's Retry packet to
+	// come, which the handshake had to wait for, or zero without one.
+	RetryDuration time.Duration
+	// SplitPositions are the offsets at which the ClientHello was cut, for
+	// fragmenting tests.
+	SplitPositions []int
+	// Fragments is what was actually put on the wire for the ClientHello,
+	// for fragmenting tests.
+	Fragments *tlsfrag.Stats
+	// Wire is what the test wrote and read on its connection, if it got
+	// to write anything.
+	Wire *Wire
+	// FailureControl is how the controls run after the attempt failed
+	// fared, with FailureControls.
+	FailureControl *FailureControl
+	// MPTCP is set when the connection actually uses MPTCP, for MPTCP
+	// tests.
+	MPTCP bool
+	// CertError is why the server's certificate isn't valid for the SNI,
+	// for handshakes that went ahead anyway in insecure mode.
+	CertError error
+	// OCSPStaple is the status of the OCSP response stapled by the server,
+	// or "none", for tests requesting one.
+	OCSPStaple string
+	// Revocation is whether the CA says the certificate is revoked, for
+	// tests checking it live.
+	Revocation string
+	// CertCompression is the algorithm the server compressed its
+	// certificate with, or "none", for tests offering compression.
+	CertCompression string
+	// Negotiated is the TLS parameters the server picked, for successful
+	// attempts.
+	Negotiated *Negotiated
+	// TimeToRST is how long after the ClientHello the connection was
+	// reset, for attempts reset during the TLS handshake.
+	TimeToRST time.Duration
+	// TCPInfo is what the kernel knew about the attempt's last TCP
+	// connection once the test was done with it, on Linux.
+	TCPInfo *sockopt.TCPInfo
+	// Retries is how many times the attempt was retried after transient
+	// errors.
+	Retries int
+	// Err is why the attempt failed, nil if it succeeded.
+	Err *TestError
+}
+
+// skipError is returned by tests that can't run in this environment, as
+// opposed to tests that ran and failed.
+type skipError struct {
+	reason string
+	err    error
+}
+
+func (e *skipError) Error() string { return "skipped: " + e.err.Error() }
+func (e *skipError) Unwrap() error { return e.err }
+
+// newSkipError turns errors about missing privileges or platform support
+// into a skip with a short reason for the results table.
+func newSkipError(err error) error {
+	reason := err.Error()
+	switch {
+	case errors.Is(err, rawsock.ErrPermission) && runtime.GOOS == "windows":
+		reason = "requires administrator"
+	case errors.Is(err, rawsock.ErrPermission):
+		reason = "requires root"
+	case errors.Is(err, rawsock.ErrNoDriver):
+		reason = "requires WinDivert"
+	case errors.Is(err, nfqueue.ErrPermission):
+		reason = "requires root"
+	case errors.Is(err, nfqueue.ErrNoIptables):
+		reason = "requires iptables"
+	case errors.Is(err, rawsock.ErrUnsupported), errors.Is(err, sockopt.ErrUnsupported), errors.Is(err, nfqueue.ErrUnsupported):
+		reason = "unsupported platform"
+	}
+	return &skipError{reason: reason, err: err}
 }
 
 type testFunc func(context.Context, *slog.Logger, netip.AddrPort, string) TestAttemptResult
 
 // Represents a single test function and its label.
 type testCase struct {
-	fn    testFunc
-	label string
+	fn       testFunc
+	label    string
+	strategy strategy
 }
 
 // Holds all tests in the exact order we want to execute and display.
 var testSuite = []testCase{
-	{fn: test_TCP_TLS12_Default, label: "Default - TCP - TLS 1.2"},
-	{fn: test_TCP_TLS13_Default, label: "Default - TCP - TLS 1.3"},
-	{fn: test_TCP_TLS13_UTLS_ChromeAuto_Default, label: "Default - TCP - TLS 1.3 - uTLS ChromeAuto"},
-	{fn: test_QUIC_TLS13_UQUIC_Chrome_115_Default, label: "Default - QUIC - TLS 1.3 - uQUIC Chrome"},
-	{fn: test_TCP_TLS13_UTLS_ChromeAuto_bepass_fragment, label: "Bepass Fragment - TCP - TLS 1.3 - uTLS ChromeAuto"},
-	{fn: test_TCP_TLS_warp_plus_custom, label: "WarpPlus Custom - TCP - TLS 1.2"},
+	{fn: test_TCP_TLS12_Default, label: "Default - TCP - TLS 1.2", strategy: strategy{Transport: "tcp"}},
+	{fn: test_TCP_TLS12_renegotiation, label: "Renegotiation - TCP - TLS 1.2"}, // renegotiation isn't a dial strategy
+	{fn: test_TCP_TLS13_Default, label: "Default - TCP - TLS 1.3", strategy: strategy{Transport: "tcp"}},
+	{fn: test_TCP_TLS13_UTLS_ChromeAuto_Default, label: "Default - TCP - TLS 1.3 - uTLS ChromeAuto", strategy: strategy{Transport: "tcp", Fingerprint: "chrome"}},
+	{fn: test_TCP_TLS13_UTLS_ChromeAuto_sni_last, label: "SNI Last - TCP - TLS 1.3 - uTLS ChromeAuto", strategy: strategy{Transport: "tcp", Fingerprint: "chrome"}},
+	{fn: test_TCP_TLS13_UTLS_ChromeAuto_no_compat, label: "No Compat Mode - TCP - TLS 1.3 - uTLS ChromeAuto"}, // compatibility mode can't be turned off in clients
+	{fn: test_TCP_TLS13_UTLS_ChromeAuto_esni, label: "ESNI - TCP - TLS 1.3 - uTLS ChromeAuto"},                // clients can't be configured with a fake ESNI
+	{fn: test_TCP_TLS13_UTLS_ChromeAuto_cert_compression, label: "Cert Compression - TCP - TLS 1.3 - uTLS ChromeAuto", strategy: strategy{Transport: "tcp", Fingerprint: "chrome"}},
+	{fn: test_TCP_TLS13_UTLS_ChromeAuto_no_cert_compression, label: "No Cert Compression - TCP - TLS 1.3 - uTLS ChromeAuto"}, // the chrome fingerprint always offers it
+	{fn: test_TCP_TLS13_UTLS_ChromeAuto_alps_old, label: "ALPS Old Codepoint - TCP - TLS 1.3 - uTLS ChromeAuto"},             // the chrome fingerprint sends the new codepoint
+	{fn: test_TCP_TLS13_UTLS_ChromeAuto_no_alps, label: "No ALPS - TCP - TLS 1.3 - uTLS ChromeAuto"},
+	{fn: test_TCP_TLS13_UTLS_ChromeAuto_record_version_ssl3, label: "Record Version SSL 3.0 - TCP - TLS 1.3 - uTLS ChromeAuto"}, // record versions can't be emitted
+	{fn: test_TCP_TLS13_UTLS_ChromeAuto_record_version_tls13, label: "Record Version TLS 1.3 - TCP - TLS 1.3 - uTLS ChromeAuto"},
+	{fn: test_TCP_TLS13_UTLS_ChromeAuto_maxseg, label: "Tiny MSS - TCP - TLS 1.3 - uTLS ChromeAuto", strategy: strategy{Transport: "tcp", Fingerprint: "chrome", MaxSeg: tinyMSS}},
+	{fn: test_QUIC_TLS13_UQUIC_Chrome_115_Default, label: "Default - QUIC - TLS 1.3 - uQUIC Chrome", strategy: strategy{Transport: "quic", Fingerprint: "chrome"}},
+	{fn: test_QUIC_version_negotiation, label: "Version Negotiation - QUIC"}, // only probes, there's no connection to emit
+	{fn: test_QUIC_TLS13_UQUIC_Chrome_115_padded, label: "Padded Initial - QUIC - TLS 1.3 - uQUIC Chrome", strategy: strategy{Transport: "quic", Fingerprint: "chrome"}},
+	{fn: test_QUIC_TLS13_UQUIC_Chrome_115_padded_chaff, label: "Padded Initial + Chaff - QUIC - TLS 1.3 - uQUIC Chrome", strategy: strategy{Transport: "quic", Fingerprint: "chrome"}},
+	{fn: test_QUIC_TLS13_UQUIC_Chrome_115_split, label: "Split Initial - QUIC - TLS 1.3 - uQUIC Chrome", strategy: strategy{Transport: "quic", Fingerprint: "chrome"}},
+	{fn: test_QUIC_TLS13_UQUIC_Chrome_115_split_coalesced, label: "Coalesced Split Initial - QUIC - TLS 1.3 - uQUIC Chrome", strategy: strategy{Transport: "quic", Fingerprint: "chrome"}},
+	{fn: test_TCP_TLS13_UTLS_ChromeAuto_bepass_fragment, label: "Bepass Fragment - TCP - TLS 1.3 - uTLS ChromeAuto", strategy: strategy{Transport: "tcp", Fingerprint: "chrome", Fragment: &bepassFragment}},
+	{fn: test_TCP_TLS13_UTLS_ChromeAuto_bepass_disorder, label: "Bepass Disorder - TCP - TLS 1.3 - uTLS ChromeAuto", strategy: strategy{Transport: "tcp", Fingerprint: "chrome", Fragment: &bepassDisorder}},
+	{fn: test_TCP_TLS13_UTLS_ChromeAuto_mptcp, label: "MPTCP - TCP - TLS 1.3 - uTLS ChromeAuto", strategy: strategy{Transport: "tcp", Fingerprint: "chrome", MPTCP: true}},
+	{fn: test_TCP_TLS13_UTLS_ChromeAuto_mptcp_bepass_fragment, label: "MPTCP Bepass Fragment - TCP - TLS 1.3 - uTLS ChromeAuto", strategy: strategy{Transport: "tcp", Fingerprint: "chrome", Fragment: &bepassFragment, MPTCP: true}},
+	{fn: test_TCP_TLS_warp_plus_custom, label: "WarpPlus Custom - TCP - TLS 1.2", strategy: strategy{Transport: "tcp"}},
+	{fn: test_TCP_TLS_warp_plus_record_split, label: "WarpPlus Record Split - TCP - TLS 1.2"}, // record splitting can't be emitted
+	{fn: test_TCP_TLS13_UTLS_ChromeAuto_decoy_hello, label: "Decoy Hello - TCP - TLS 1.3 - uTLS ChromeAuto", strategy: strategy{Transport: "tcp", Fingerprint: "chrome", Fake: decoySNI}},
+	{fn: test_TCP_TLS13_UTLS_ChromeAuto_decoy_bad_version, label: "Decoy Bad Version - TCP - TLS 1.3 - uTLS ChromeAuto", strategy: strategy{Transport: "tcp", Fingerprint: "chrome", Fake: decoySNI}},
+	{fn: test_TCP_TLS13_UTLS_ChromeAuto_fake_ttl, label: "Fake TTL - TCP - TLS 1.3 - uTLS ChromeAuto", strategy: strategy{Transport: "tcp", Fingerprint: "chrome", Fake: decoySNI, FakeTTL: fakeTTL}},
+	{fn: test_TCP_TLS13_UTLS_ChromeAuto_fake_badsum, label: "Fake Bad Checksum - TCP - TLS 1.3 - uTLS ChromeAuto", strategy: strategy{Transport: "tcp", Fingerprint: "chrome", Fake: decoySNI, FakeBadChecksum: true}},
 }
 
-func runTests(ctx context.Context, l *slog.Logger, to TestOptions) error {
+// buildSuite returns the tests to run for the given options, which is the
+// static testSuite plus any tests built from user input, narrowed down to
+// to.Tests if set.
+func buildSuite(to TestOptions) []testCase {
+	suite := slices.Clone(testSuite)
+	if to.Recipe != nil {
+		suite = append(suite, testCase{
+			fn:       test_TCP_TLS13_UTLS_ChromeAuto_recipe(to.Recipe),
+			label:    fmt.Sprintf("Recipe %q - TCP - TLS 1.3 - uTLS ChromeAuto", to.Recipe),
+			strategy: strategy{Transport: "tcp", Fingerprint: "chrome"},
+		})
+	}
+	if len(to.SNISplitAt) > 0 {
+		fs := bepassFragment
+		fs.SNISplitAt = to.SNISplitAt
+		suite = append(suite, testCase{
+			fn:       test_TCP_TLS13_UTLS_ChromeAuto_bepass(fs),
+			label:    fmt.Sprintf("Bepass SNI Split at %v - TCP - TLS 1.3 - uTLS ChromeAuto", to.SNISplitAt),
+			strategy: strategy{Transport: "tcp", Fingerprint: "chrome", Fragment: &fs},
+		})
+	}
+	for _, size := range to.PadSizes {
+		suite = append(suite, testCase{
+			fn:       test_TCP_TLS13_UTLS_Chrome106_padded(size),
+			label:    fmt.Sprintf("Padded %dB - TCP - TLS 1.3 - uTLS Chrome 106", size),
+			strategy: strategy{Transport: "tcp", Fingerprint: "chrome", PadSize: size},
+		})
+	}
+	// Record splitting can't be emitted, so these tests have no strategy.
+	for _, size := range to.RecordSizes {
+		suite = append(suite, testCase{
+			fn:    test_TCP_TLS13_UTLS_ChromeAuto_record_size(size),
+			label: recordSizeLabel(size),
+		})
+	}
+	for _, size := range to.QUICSizes {
+		suite = append(suite, testCase{
+			fn:       test_QUIC_TLS13_UQUIC_Chrome_115_pad(size, 0),
+			label:    quicSizeLabel(size),
+			strategy: strategy{Transport: "quic", Fingerprint: "chrome"},
+		})
+	}
+	// A throwaway ECH config can't be emitted.
+	for _, outer := range to.ECHOuterSNIs {
+		suite = append(suite, testCase{
+			fn:    test_TCP_TLS13_UTLS_ChromeAuto_ech_outer(outer),
+			label: fmt.Sprintf("ECH Outer SNI %s - TCP - TLS 1.3 - uTLS ChromeAuto", outer),
+		})
+	}
+	// Holding a connection can't be emitted.
+	for _, period := range to.KeepAliveSweep {
+		suite = append(suite, testCase{
+			fn:    test_TCP_TLS13_UTLS_ChromeAuto_keepalive(period, to.KeepAliveHold),
+			label: fmt.Sprintf("Keepalive %v - TCP - TLS 1.3 - uTLS ChromeAuto", period),
+		})
+	}
+	if cs := to.Custom; cs != nil {
+		suite = append(suite, testCase{
+			fn:       test_custom(*cs),
+			label:    "Custom - " + cs.String(),
+			strategy: cs.strategy(),
+		})
+	}
+	if to.Full {
+		for _, cs := range fullMatrix() {
+			suite = append(suite, testCase{
+				fn:       test_custom(cs),
+				label:    fullLabel(cs),
+				strategy: cs.strategy(),
+			})
+		}
+	}
+	if ws := to.WarpPlus; ws != nil {
+		tc := testCase{
+			fn:    test_TCP_TLS_warp_plus(*ws),
+			label: fmt.Sprintf("WarpPlus Tuned %s - TCP - TLS 1.2", ws),
+		}
+		if ws.RecordSize == 0 {
+			tc.strategy = strategy{Transport: "tcp"}
+		}
+		suite = append(suite, tc)
+	}
+	if to.ClientHello != nil {
+		// A captured ClientHello can't be reproduced by a client config, so
+		// these tests leave the strategy's transport empty for emitConfig to
+		// skip them.
+		suite = append(suite,
+			testCase{
+				fn:    test_TCP_TLS_UTLS_captured(to.ClientHello),
+				label: "Captured Fingerprint - TCP - uTLS",
+			},
+			testCase{
+				fn:    test_TCP_TLS_replay(to.ClientHello, nil),
+				label: "Replay - TCP - Captured ClientHello",
+			},
+			testCase{
+				fn: test_TCP_TLS_replay(to.ClientHello, func() (tlsfrag.Fragmenter, error) {
+					return bepassFragment.fragmenter(), nil
+				}),
+				label: "Replay Bepass Fragment - TCP - Captured ClientHello",
+			},
+		)
+		if to.Recipe != nil {
+			suite = append(suite, testCase{
+				fn:    test_TCP_TLS_replay(to.ClientHello, to.Recipe.Fragmenter),
+				label: fmt.Sprintf("Replay Recipe %q - TCP - Captured ClientHello", to.Recipe),
+			})
+		}
+	}
+	// Reshaping packets can't be emitted either.
+	if to.NFQueue != 0 {
+		suite = append(suite,
+			testCase{
+				fn: test_TCP_TLS13_UTLS_ChromeAuto_nfqueue(to.NFQueue, func() (tlsfrag.Fragmenter, error) {
+					return bepassFragment.fragmenter(), nil
+				}),
+				label: "NFQUEUE Bepass Fragment - TCP - TLS 1.3 - uTLS ChromeAuto",
+			},
+			testCase{
+				fn: test_TCP_TLS13_UTLS_ChromeAuto_nfqueue(to.NFQueue, func() (tlsfrag.Fragmenter, error) {
+					return bepassDisorder.fragmenter(), nil
+				}),
+				label: "NFQUEUE Bepass Disorder - TCP - TLS 1.3 - uTLS ChromeAuto",
+			},
+		)
+		if to.Recipe != nil {
+			suite = append(suite, testCase{
+				fn:    test_TCP_TLS13_UTLS_ChromeAuto_nfqueue(to.NFQueue, to.Recipe.Fragmenter),
+				label: fmt.Sprintf("NFQUEUE Recipe %q - TCP - TLS 1.3 - uTLS ChromeAuto", to.Recipe),
+			})
+		}
+	}
+	if len(to.Tests) > 0 {
+		suite = slices.DeleteFunc(suite, func(tc testCase) bool {
+			return !slices.Contains(to.Tests, testID(tc.label))
+		})
+	}
+	return suite
+}
+
+func runTests(ctx context.Context, l *slog.Logger, to TestOptions) (err error) {
+	ctx, span := tracer.Start(ctx, "run", trace.WithAttributes(attribute.String("heybabe.sni", to.SNI)))
+	defer func() { endSpan(span, err) }()
+
+	switch {
+	case to.Cooldown > 0:
+		return runCooldown(ctx, l, to)
+	case to.BisectSNI:
+		return runBisect(ctx, l, to)
+	}
+
+	run := newRunInfo(to.Labels)
+	var network *networkInfo
+	if to.NetworkInfo {
+		ni, err := discoverNetwork(withSocketSettings(ctx, to.socketSettings()), l)
+		if err != nil {
+			l.Warn("failed to discover the network", "error", err)
+		} else {
+			l.Info("discovered network", "public_ip", ni.PublicIP, "asn", ni.ASN, "as_name", ni.ASName, "country", ni.Country)
+			network = &ni
+		}
+	}
+
+	// The control host is measured first, so that it's done before any
+	// blocking the tests might trigger.
+	var control *controlResult
+	if to.ControlHost != "" {
+		cr := runControl(ctx, l, to)
+		if !cr.ok() {
+			l.Warn("control host failed, there is a local connectivity problem", "control_host", cr.host, "error", cr.err)
+		}
+		control = &cr
+	}
+
+	if to.Stream {
+		s, err := newStreamer(l, to, network, run)
+		if err != nil {
+			return fmt.Errorf("failed to open output: %w", err)
+		}
+		defer s.close()
+		if network != nil && s.table != nil {
+			fmt.Printf("\nNetwork: %s\n", network)
+		}
+		if control != nil {
+			s.writeControl(*control)
+		}
+		to.OnTestDone = s.testDone
+	}
+
+	var (
+		results    = make(map[string][]TestResult)
+		labelOrder []string
+		suite      []testCase
+	)
+	// Bridges and servers can be tested on their own, without an SNI.
+	if to.SNI != "" || len(to.Targets) > 0 {
+		results, labelOrder, suite, err = runSuite(ctx, l, to)
+	}
+	if len(to.Obfs4Bridges) > 0 && err == nil {
+		results[obfs4Label], err = runObfs4(ctx, l, to)
+		labelOrder = append(labelOrder, obfs4Label)
+	}
+	if len(to.RealityServers) > 0 && err == nil {
+		results[realityLabel], err = runReality(ctx, l, to)
+		labelOrder = append(labelOrder, realityLabel)
+	}
+	if err != nil {
+		if results == nil {
+			return err
+		}
+		// Long runs are often stopped on purpose, so show what completed.
+		l.Warn("interrupted, showing the results of the tests completed so far", "error", err)
+	}
+
+	run.End = time.Now()
+	if to.Output != "" && !to.Stream {
+		l.Debug("writing attempts", "format", to.Output, "file", to.OutputFile)
+		outResults, outOrder := results, labelOrder
+		if control != nil {
+			outResults, outOrder = withControl(*control, results, labelOrder)
+		}
+		if err := writeOutputTo(to.OutputFile, to.Output, outResults, outOrder, network, run); err != nil {
+			return fmt.Errorf("failed to write output: %w", err)
+		}
+	}
+
+	var trends map[historyKey]string
+	if to.History != "" {
+		h, err := loadHistory(to.History)
+		if err != nil {
+			l.Warn("failed to read history, not showing trends", "file", to.History, "error", err)
+		}
+		records := historyRecords(results, labelOrder, time.Now())
+		if h != nil {
+			trends = h.trends(records)
+		}
+		if err := appendHistory(to.History, records); err != nil {
+			l.Warn("failed to append to history", "file", to.History, "error", err)
+		}
+	}
+
+	// A partial run, or one from an unknown network, would only mislead
+	// the collector.
+	switch {
+	case to.Submit == "" || len(labelOrder) == 0:
+	case ctx.Err() != nil || err != nil:
+		l.Warn("not submitting the results of an interrupted run", "collector", to.Submit)
+	case network == nil || network.ASN == 0:
+		l.Warn("not submitting the results, the network's ASN is unknown", "collector", to.Submit)
+	default:
+		l.Debug("submitting results", "collector", to.Submit)
+		s := newSubmission(run, network, to.SubmitIP, results, labelOrder)
+		if err := submit(withSocketSettings(ctx, to.socketSettings()), to.Submit, s); err != nil {
+			l.Warn("failed to submit results", "collector", to.Submit, "error", err)
+		} else {
+			l.Info("submitted results", "collector", to.Submit, "run_id", run.ID)
+		}
+	}
+
+	if to.PrintBest {
+		l.Debug("printing best test")
+		return printBest(os.Stdout, results, suite)
+	}
+
+	// Without a file, the attempts are written to stdout in place of the
+	// tables, for other programs to consume.
+	if to.Output == "" || to.OutputFile != "" {
+		l.Debug("all tests completed, generating results table")
+		if !to.Stream {
+			if network != nil {
+				fmt.Printf("\nNetwork: %s\n", network)
+			}
+			printTable(results, labelOrder, trends)
+		}
+		printTargetSummary(results, labelOrder)
+		printMatrix(results, labelOrder)
+		if to.Full {
+			printFullMatrix(results)
+		}
+		if to.Categories != nil {
+			printSnapshot(results, labelOrder, to.Categories)
+		}
+		printStackSummary(results, labelOrder)
+		printCertErrors(results, labelOrder)
+		printRevocation(results, labelOrder)
+		printCertCompression(results, labelOrder)
+		printNegotiated(results, labelOrder)
+		printFailureControls(results, labelOrder)
+		printRetries(results, labelOrder)
+		printRecordSweep(results, to.RecordSizes)
+		printQUICSizeSweep(results, to.QUICSizes)
+		if control != nil {
+			printControl(*control)
+		}
+		if to.Explain {
+			printExplanation(results, labelOrder)
+		}
+		if to.Quick {
+			printVerdict(results, labelOrder, control)
+		}
+	}
+
+	if to.EmitConfig != "" {
+		l.Debug("emitting config snippet", "format", to.EmitConfig)
+		if err := emitConfig(os.Stdout, to.EmitConfig, to.SNI, results, suite); err != nil {
+			return fmt.Errorf("failed to emit config: %w", err)
+		}
+	}
+	l.Debug("test suite execution completed")
+
+	return nil
+}
+
+// runSuite runs the tests for to against every target, and returns their
+// results by label, the labels in the order they ran, and the suite. The
+// results are partial if it was interrupted, see runCases.
+func runSuite(ctx context.Context, l *slog.Logger, to TestOptions) (map[string][]TestResult, []string, []testCase, error) {
+	if len(to.Targets) > 0 {
+		return runBatch(ctx, l, to)
+	}
+	suite := buildSuite(to)
+	results, labelOrder, err := runCases(ctx, l, to, suite)
+	return results, labelOrder, suite, err
+}
+
+// runCases runs the given tests against every target for to, and returns
+// their results by label and the labels in the order they ran. When ctx is
+// done midway, the tests that didn't complete are marked as skipped and
+// returned along with ctx's error.
+func runCases(ctx context.Context, l *slog.Logger, to TestOptions, suite []testCase) (map[string][]TestResult, []string, error) {
 	l = l.With("sni", to.SNI, "port", to.Port)
-	
-	l.Debug("starting test suite execution", 
+
+	l.Debug("starting test suite execution",
 		"resolve_ipv4", to.ResolveIPv4,
 		"resolve_ipv6", to.ResolveIPv6,
-		"manual_ip", to.ManualIP,
+		"manual_ips", to.ManualIPs,
 		"repeat_count", to.Repeat)
 
 	testAddrPorts := []netip.AddrPort{}
-	if to.ManualIP == netip.IPv4Unspecified() {
+	var dnsDuration time.Duration
+	if len(to.ManualIPs) == 0 {
 		l.Debug("manual IP not specified, attempting DNS resolution")
 
 		// Resolve DNS
-		var err error
-		v4, v6, err := resolve(ctx, to.SNI, to.ResolveIPv4, to.ResolveIPv6)
+		var (
+			v4, v6 netip.Addr
+			err    error
+		)
+		dnsCtx, dnsSpan := tracer.Start(ctx, "dns", trace.WithAttributes(attribute.String("heybabe.sni", to.SNI)))
+		t0 := time.Now()
+		for retry := uint(0); ; retry++ {
+			v4, v6, err = resolve(dnsCtx, to.resolveHost(), to.ResolveIPv4, to.ResolveIPv6)
+			if err == nil || !transient(err) || retry == to.Retries {
+				break
+			}
+			l.Debug("DNS resolution failed, retrying", "retry", retry+1, "error", err)
+			if err = sleep(ctx, retryBackoff(retry)); err != nil {
+				break
+			}
+		}
+		endSpan(dnsSpan, err)
 		if err != nil {
-			l.Error("DNS resolution failed", "error", err)
-			return fmt.Errorf("failed to resolve SNI: %w", err)
+			l.Error("DNS resolution failed", "host", to.resolveHost(), "error", err)
+			return nil, nil, fmt.Errorf("failed to resolve %s: %w", to.resolveHost(), err)
 		}
+		dnsDuration = time.Since(t0)
 
-		l.Debug("DNS resolution completed", "ipv4", v4, "ipv6", v6)
+		l.Debug("DNS resolution completed", "ipv4", v4, "ipv6", v6, "duration", dnsDuration)
 
 		if to.ResolveIPv4 && v4 != netip.IPv4Unspecified() {
 			testAddrPorts = append(testAddrPorts, netip.AddrPortFrom(v4, to.Port))
@@ -87,121 +889,288 @@ func runTests(ctx context.Context, l *slog.Logger, to TestOptions) error {
 			l.Debug("added IPv6 address to test targets", "ipv6", v6)
 		}
 	} else {
-		l.Debug("manual IP specified, proceeding with the provided IP", "manual_ip", to.ManualIP)
-		testAddrPorts = append(testAddrPorts, netip.AddrPortFrom(to.ManualIP, to.Port))
+		l.Debug("manual IPs specified, proceeding with the provided IPs", "manual_ips", to.ManualIPs)
+		for _, addr := range to.ManualIPs {
+			testAddrPorts = append(testAddrPorts, netip.AddrPortFrom(addr, to.Port))
+		}
+	}
+
+	if to.Shuffle {
+		// Tests can leave behind blocking that affects the next ones on the
+		// same IP, so a fixed order would favour the first tests.
+		suite = slices.Clone(suite)
+		rand.Shuffle(len(suite), func(i, j int) { suite[i], suite[j] = suite[j], suite[i] })
+		rand.Shuffle(len(testAddrPorts), func(i, j int) { testAddrPorts[i], testAddrPorts[j] = testAddrPorts[j], testAddrPorts[i] })
+		l.Debug("shuffled tests and targets")
 	}
 
 	l.Debug("test targets determined", "target_count", len(testAddrPorts), "targets", testAddrPorts)
 
+	ctx = withSocketSettings(ctx, to.socketSettings())
+	ctx = withTLSSettings(ctx, to.tlsSettings())
+
 	results := make(map[string][]TestResult)
-	labelOrder := make([]string, 0, len(testSuite))
+	labelOrder := make([]string, 0, len(suite))
+
+	l.Debug("starting test execution", "test_count", len(suite))
+	for i, tc := range suite {
+		l.Debug("executing test", "test_index", i+1, "test_name", tc.label, "test_count", len(suite))
 
-	l.Debug("starting test execution", "test_count", len(testSuite))
-	for i, tc := range testSuite {
-		l.Debug("executing test", "test_index", i+1, "test_name", tc.label, "test_count", len(testSuite))
-		
 		test := tc.fn
 		resultsPerTest := make([]TestResult, len(testAddrPorts))
 		for x, addrPort := range testAddrPorts {
 			l.Debug("testing target", "target_index", x+1, "target", addrPort.String())
-			
+
+			if to.WarmUp {
+				if err := warmUp(ctx, l, to, test, addrPort); err != nil {
+					return skipRemaining(results, labelOrder, suite[i:], testAddrPorts, to, err)
+				}
+			}
+
 			tr := TestResult{AddrPort: addrPort, SNI: to.SNI, Attempts: make([]TestAttemptResult, to.Repeat)}
 			for j := uint(0); j < to.Repeat; j++ {
 				l.Debug("executing test attempt", "attempt", j+1, "total_attempts", to.Repeat)
-				
-				// Create a context with 10-second timeout for each individual test
-				testCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
-				tr.Attempts[j] = test(testCtx, l, addrPort, to.SNI)
-				cancel() // Always cancel to release resources
-				
-				if tr.Attempts[j].err != nil {
-					l.Debug("test attempt failed", "attempt", j+1, "error", tr.Attempts[j].err)
+
+				for retry := uint(0); ; retry++ {
+					if err := to.Pacer.wait(ctx); err != nil {
+						return skipRemaining(results, labelOrder, suite[i:], testAddrPorts, to, err)
+					}
+					// Bound each individual test, see attemptTimeout
+					testCtx, cancel := context.WithTimeout(ctx, to.attemptTimeout())
+					testCtx, span := tracer.Start(testCtx, tc.label, trace.WithAttributes(
+						attribute.String("heybabe.sni", to.SNI),
+						attribute.String("heybabe.addr_port", addrPort.String()),
+						attribute.Int("heybabe.attempt", int(j+1)),
+					))
+					target, dns := addrPort, dnsDuration
+					var resolveErr error
+					if to.ResolveEveryAttempt && len(to.ManualIPs) == 0 {
+						target, dns, resolveErr = resolveAttempt(testCtx, to.resolveHost(), addrPort)
+						l.Debug("resolved SNI for the attempt", "target", target, "duration", dns, "error", resolveErr)
+					}
+					clock, watcher, hello, rec := &setupClock{}, &sockopt.TCPInfoWatcher{}, &helloClock{}, &wireRecorder{}
+					start := time.Now()
+					if resolveErr != nil {
+						tr.Attempts[j] = TestAttemptResult{Err: newTestError(resolveErr)}
+					} else {
+						attemptCtx := context.WithValue(testCtx, setupClockKey{}, clock)
+						attemptCtx = context.WithValue(attemptCtx, tcpInfoKey{}, watcher)
+						attemptCtx = context.WithValue(attemptCtx, helloClockKey{}, hello)
+						attemptCtx = context.WithValue(attemptCtx, wireKey{}, rec)
+						tr.Attempts[j] = test(attemptCtx, l, target, to.SNI)
+					}
+					if info, ok := watcher.Release(); ok {
+						tr.Attempts[j].addTCPInfo(info)
+						l.Debug("read TCP_INFO", "rtt", info.RTT, "retransmits", info.Retransmits, "closed", info.Closed)
+					}
+					tr.Attempts[j].addTimeToRST(hello)
+					tr.Attempts[j].Wire = rec.wire()
+					tr.Attempts[j].Start = start
+					tr.Attempts[j].DNSDuration = dns
+					tr.Attempts[j].SetupDuration = clock.since(start)
+					if target != addrPort {
+						tr.Attempts[j].AddrPort = target
+					}
+					tr.Attempts[j].Retries = int(retry)
+					traceAttemptPhases(testCtx, start, tr.Attempts[j])
+					span.SetAttributes(attemptAttributes(tr.Attempts[j])...)
+					if tr.Attempts[j].Err != nil {
+						endSpan(span, tr.Attempts[j].Err)
+					} else {
+						span.End()
+					}
+					cancel() // Always cancel to release resources
+
+					if tr.Attempts[j].Err == nil || !tr.Attempts[j].Err.Transient() || retry == to.Retries || ctx.Err() != nil {
+						break
+					}
+					l.Debug("test attempt failed transiently, retrying", "attempt", j+1, "retry", retry+1, "error", tr.Attempts[j].Err)
+					if err := sleep(ctx, retryBackoff(retry)); err != nil {
+						return skipRemaining(results, labelOrder, suite[i:], testAddrPorts, to, err)
+					}
+				}
+				if err := ctx.Err(); err != nil {
+					l.Debug("interrupted, skipping the remaining tests", "attempt", j+1)
+					return skipRemaining(results, labelOrder, suite[i:], testAddrPorts, to, err)
+				}
+
+				var skipErr *skipError
+				if tr.Attempts[j].Err != nil && errors.As(tr.Attempts[j].Err, &skipErr) {
+					l.Debug("test skipped, not repeating", "reason", skipErr.reason)
+					for k := j + 1; k < to.Repeat; k++ {
+						tr.Attempts[k] = tr.Attempts[j]
+					}
+					break
+				}
+
+				if tr.Attempts[j].Err != nil {
+					l.Debug("test attempt failed", "attempt", j+1, "error", tr.Attempts[j].Err)
+					if to.FailureControls {
+						target := addrPort
+						if tr.Attempts[j].AddrPort.IsValid() {
+							target = tr.Attempts[j].AddrPort
+						}
+						tr.Attempts[j].FailureControl = runFailureControl(ctx, l, to, test, target)
+					}
 				} else {
-					l.Debug("test attempt succeeded", "attempt", j+1, 
+					l.Debug("test attempt succeeded", "attempt", j+1,
 						"transport_duration", tr.Attempts[j].TransportEstablishDuration,
 						"tls_duration", tr.Attempts[j].TLSHandshakeDuration)
 				}
-				
+
 				if j < to.Repeat-1 {
 					l.Debug("waiting between attempts", "wait_duration", "2s")
-					time.Sleep(2 * time.Second)
+					if err := sleep(ctx, 2*time.Second); err != nil {
+						return skipRemaining(results, labelOrder, suite[i:], testAddrPorts, to, err)
+					}
 				}
 			}
 			resultsPerTest[x] = tr
 		}
 		results[tc.label] = resultsPerTest
 		labelOrder = append(labelOrder, tc.label)
-		
-		if i < len(testSuite)-1 {
-			l.Debug("waiting between test types", "wait_duration", "2s")
-			// 2-second delay between different test types
-			time.Sleep(2 * time.Second)
+		if to.OnTestDone != nil {
+			to.OnTestDone(tc.label, resultsPerTest)
+		}
+
+		if i < len(suite)-1 {
+			l.Debug("waiting between test types", "wait_duration", to.testGap())
+			if err := sleep(ctx, to.testGap()); err != nil {
+				return skipRemaining(results, labelOrder, suite[i+1:], testAddrPorts, to, err)
+			}
 		}
 	}
 
-	l.Debug("all tests completed, generating results table")
-	printTable(results, labelOrder)
-	l.Debug("test suite execution completed")
+	return results, labelOrder, nil
+}
 
-	return nil
+// warmUp runs an attempt of test against addrPort whose result is thrown
+// away, so the counted attempts find the route, ARP and other caches warm,
+// then waits as between attempts. It returns ctx's error if interrupted.
+func warmUp(ctx context.Context, l *slog.Logger, to TestOptions, test testFunc, addrPort netip.AddrPort) error {
+	if err := to.Pacer.wait(ctx); err != nil {
+		return err
+	}
+	testCtx, cancel := context.WithTimeout(ctx, to.attemptTimeout())
+	res := test(testCtx, l, addrPort, to.SNI)
+	cancel()
+	l.Debug("warm-up attempt done", "target", addrPort.String(), "error", res.Err)
+	return sleep(ctx, 2*time.Second)
+}
+
+// skipRemaining adds the rest of the tests to results as skipped after an
+// interrupt, and returns them with err.
+func skipRemaining(results map[string][]TestResult, order []string, rest []testCase, targets []netip.AddrPort, to TestOptions, err error) (map[string][]TestResult, []string, error) {
+	skipped := newTestError(&skipError{reason: "interrupted", err: err})
+	for _, tc := range rest {
+		resultsPerTest := make([]TestResult, len(targets))
+		for x, addrPort := range targets {
+			tr := TestResult{AddrPort: addrPort, SNI: to.SNI, Attempts: make([]TestAttemptResult, to.Repeat)}
+			for j := range tr.Attempts {
+				tr.Attempts[j].Err = skipped
+			}
+			resultsPerTest[x] = tr
+		}
+		results[tc.label] = resultsPerTest
+		order = append(order, tc.label)
+	}
+	return results, order, err
+}
+
+// sleep waits for d, or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
-func printTable(results map[string][]TestResult, order []string) {
+// retryBackoff returns how long to wait before the given retry, doubling
+// from a second each time.
+func retryBackoff(retry uint) time.Duration {
+	return time.Second << min(retry, 5)
+}
+
+// status returns the handshake status shown for tr, and how many attempts
+// succeeded.
+func (tr TestResult) status() (string, int) {
+	var (
+		successCount int
+		skipErr      *skipError
+	)
+	for _, attempt := range tr.Attempts {
+		if attempt.Err == nil {
+			successCount++
+		} else {
+			errors.As(attempt.Err, &skipErr)
+		}
+	}
+
+	totalAttempts := len(tr.Attempts)
+	switch {
+	case skipErr != nil && successCount == 0:
+		return fmt.Sprintf("Skipped (%s)", skipErr.reason), successCount
+	case successCount == 0:
+		return fmt.Sprintf("Failed  (%d/%d)", successCount, totalAttempts), successCount
+	case successCount == totalAttempts:
+		return fmt.Sprintf("Success (%d/%d)", successCount, totalAttempts), successCount
+	default:
+		return fmt.Sprintf("Partial (%d/%d)", successCount, totalAttempts), successCount
+	}
+}
+
+// printTable prints a row per test and target, with the sparklines of
+// trends next to the status, if any.
+func printTable(results map[string][]TestResult, order []string, trends map[historyKey]string) {
 	headerFmt := color.New(color.FgHiMagenta, color.Bold, color.Underline).SprintfFunc()
 	columnFmt := color.New(color.FgHiCyan, color.Bold).SprintfFunc()
 
-	tbl := table.New("Test Method", "SNI", "IP:Port", "Handshake Status", "Transport Time", "TLS Handshake Time")
-	tbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt)
-
+	// Only tests probing the server have a TTFB, so its column is left
+	// out when none did, as is the time to RST when nothing was reset.
+	var probed, reset bool
 	for _, testName := range order {
-		testResults := results[testName]
-		for _, testResult := range testResults {
-			var (
-				successCount   int
-				totalTransport time.Duration
-				totalTLS       time.Duration
-			)
-
+		for _, testResult := range results[testName] {
 			for _, attempt := range testResult.Attempts {
-				if attempt.err == nil {
-					successCount++
-					totalTransport += attempt.TransportEstablishDuration
-					totalTLS += attempt.TLSHandshakeDuration
-				}
-			}
-
-			totalAttempts := len(testResult.Attempts)
-			var status string
-			switch {
-			case successCount == 0:
-				status = fmt.Sprintf("Failed  (%d/%d)", successCount, totalAttempts)
-			case successCount == totalAttempts:
-				status = fmt.Sprintf("Success (%d/%d)", successCount, totalAttempts)
-			default:
-				status = fmt.Sprintf("Partial (%d/%d)", successCount, totalAttempts)
+				probed = probed || attempt.TTFBDuration > 0
+				reset = reset || attempt.TimeToRST > 0
 			}
+		}
+	}
 
-			var avgTransport, avgTLS time.Duration
-			if successCount > 0 {
-				avgTransport = totalTransport / time.Duration(successCount)
-				avgTLS = totalTLS / time.Duration(successCount)
-			}
+	columns := []any{"Test Method", "SNI", "IP:Port", "Handshake Status", "DNS Time", "Setup Time", "Transport Time", "TLS Handshake Time"}
+	if trends != nil {
+		columns = slices.Insert(columns, 4, any("Trend"))
+	}
+	if probed {
+		columns = append(columns, "TTFB")
+	}
+	if reset {
+		columns = append(columns, "Time to RST")
+	}
+	tbl := table.New(columns...)
+	tbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt)
 
-			formatDur := func(d time.Duration) string {
-				if d == 0 {
-					return "0 ms"
+	for _, testName := range order {
+		for _, testResult := range results[testName] {
+			row, ttfb := tableRow(testName, testResult)
+			if trends != nil {
+				trend, ok := trends[historyKey{testName, testResult.SNI}]
+				if !ok {
+					trend = "-"
 				}
-				return fmt.Sprintf("%.1f ms", float64(d)/float64(time.Millisecond))
+				row = slices.Insert(row, 4, any(trend))
 			}
-
-			tbl.AddRow(
-				testName,
-				testResult.SNI,
-				testResult.AddrPort,
-				status,
-				formatDur(avgTransport),
-				formatDur(avgTLS),
-			)
+			if probed {
+				row = append(row, ttfb)
+			}
+			if reset {
+				row = append(row, rstCell(testResult))
+			}
+			tbl.AddRow(row...)
 		}
 	}
 
@@ -210,6 +1179,87 @@ func printTable(results map[string][]TestResult, order []string) {
 	fmt.Println("")
 }
 
+// tableRow returns the row of the results table for a test against one
+// target, with average timings of the successful attempts, and its TTFB
+// cell.
+func tableRow(testName string, testResult TestResult) ([]any, string) {
+	var (
+		totalTransport time.Duration
+		totalTLS       time.Duration
+		totalTTFB      time.Duration
+	)
+
+	for _, attempt := range testResult.Attempts {
+		if attempt.Err == nil {
+			totalTransport += attempt.TransportEstablishDuration
+			totalTLS += attempt.TLSHandshakeDuration
+			totalTTFB += attempt.TTFBDuration
+		}
+	}
+
+	status, successCount := testResult.status()
+
+	var avgTransport, avgTLS, avgTTFB time.Duration
+	if successCount > 0 {
+		avgTransport = totalTransport / time.Duration(successCount)
+		avgTLS = totalTLS / time.Duration(successCount)
+		avgTTFB = totalTTFB / time.Duration(successCount)
+	}
+
+	// DNS is resolved before the attempts, whether they succeed or not,
+	// once for all of them unless resolved for every attempt. Sockets are
+	// set up whether they succeed or not too.
+	var dns, setup time.Duration
+	if len(testResult.Attempts) > 0 {
+		for _, attempt := range testResult.Attempts {
+			dns += attempt.DNSDuration
+			setup += attempt.SetupDuration
+		}
+		dns /= time.Duration(len(testResult.Attempts))
+		setup /= time.Duration(len(testResult.Attempts))
+	}
+
+	formatDur := func(d time.Duration) string {
+		if d == 0 {
+			return "0 ms"
+		}
+		return fmt.Sprintf("%.1f ms", float64(d)/float64(time.Millisecond))
+	}
+
+	row := []any{
+		testName,
+		testResult.SNI,
+		testResult.AddrPort,
+		status,
+		formatDur(dns),
+		formatDur(setup),
+		formatDur(avgTransport),
+		formatDur(avgTLS),
+	}
+	return row, formatDur(avgTTFB)
+}
+
+// resolveAttempt resolves sni again for an attempt against target, and
+// returns the address of target's family with target's port, and how long
+// resolving took.
+func resolveAttempt(ctx context.Context, sni string, target netip.AddrPort) (netip.AddrPort, time.Duration, error) {
+	t0 := time.Now()
+	v4, v6, err := resolve(ctx, sni, target.Addr().Is4(), target.Addr().Is6())
+	d := time.Since(t0)
+	if err != nil {
+		return target, d, err
+	}
+
+	addr, family := v4, "IPv4"
+	if target.Addr().Is6() {
+		addr, family = v6, "IPv6"
+	}
+	if addr.IsUnspecified() {
+		return target, d, &net.DNSError{Err: "no " + family + " address", Name: sni, IsNotFound: true}
+	}
+	return netip.AddrPortFrom(addr, target.Port()), d, nil
+}
+
 func resolve(ctx context.Context, hostname string, getv4, getv6 bool) (v4, v6 netip.Addr, err error) {
 	v4, v6 = netip.IPv4Unspecified(), netip.IPv6Unspecified()
 
@@ -255,3 +1305,428 @@ func GetFunctionName(temp interface{}) string {
 	strs := strings.Split((runtime.FuncForPC(reflect.ValueOf(temp).Pointer()).Name()), ".")
 	return strs[len(strs)-1]
 }
+
+// printTargetSummary scores each target tested, when there are several: how
+// many of the tests worked against it, their mean latency (transport and TLS
+// handshake) and what that makes of it. The best targets come first.
+func printTargetSummary(results map[string][]TestResult, order []string) {
+	scores := targetScores(results, order)
+	if len(scores) < 2 {
+		return
+	}
+
+	slices.SortStableFunc(scores, func(a, b *targetScore) int {
+		if a.passed != b.passed {
+			return b.passed - a.passed
+		}
+		return int(a.latency - b.latency)
+	})
+
+	headerFmt := color.New(color.FgHiMagenta, color.Bold, color.Underline).SprintfFunc()
+	columnFmt := color.New(color.FgHiCyan, color.Bold).SprintfFunc()
+
+	tbl := table.New("Target", "SNI", "Tests Passed", "Mean Latency", "Classification")
+	tbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt)
+	for _, s := range scores {
+		latency := "-"
+		if s.successes > 0 {
+			latency = fmt.Sprintf("%.1f ms", float64(s.latency)/float64(time.Millisecond))
+		}
+		tbl.AddRow(s.addrPort, s.sni, fmt.Sprintf("%d/%d", s.passed, s.total), latency, s.class())
+	}
+
+	tbl.Print()
+	fmt.Println("")
+}
+
+// targetScore is how a target fared over the tests run against it.
+type targetScore struct {
+	sni            string
+	addrPort       netip.AddrPort
+	passed, total  int
+	latency        time.Duration // mean of the successful attempts
+	successes      int
+	transportFails int // tests that never got a transport connection
+}
+
+// targetScores scores each target tested, in the order they were first
+// tested.
+func targetScores(results map[string][]TestResult, order []string) []*targetScore {
+	var scores []*targetScore
+	for _, testName := range order {
+		for _, tr := range results[testName] {
+			i := slices.IndexFunc(scores, func(s *targetScore) bool { return s.sni == tr.SNI && s.addrPort == tr.AddrPort })
+			if i < 0 {
+				scores = append(scores, &targetScore{sni: tr.SNI, addrPort: tr.AddrPort})
+				i = len(scores) - 1
+			}
+			s := scores[i]
+
+			var skipped, transported bool
+			for _, attempt := range tr.Attempts {
+				transported = transported || attempt.TransportEstablishDuration > 0
+				if attempt.Err == nil {
+					s.latency += attempt.TransportEstablishDuration + attempt.TLSHandshakeDuration
+					s.successes++
+					continue
+				}
+				var skipErr *skipError
+				skipped = skipped || errors.As(attempt.Err, &skipErr)
+			}
+			if _, success := tr.status(); success > 0 {
+				s.passed++
+			} else if skipped {
+				continue
+			} else if !transported {
+				s.transportFails++
+			}
+			s.total++
+		}
+	}
+
+	for _, s := range scores {
+		if s.successes > 0 {
+			s.latency /= time.Duration(s.successes)
+		}
+	}
+	return scores
+}
+
+// class classifies the target by how many of its tests passed.
+func (s targetScore) class() string {
+	switch {
+	case s.total == 0:
+		return "not tested"
+	case s.passed == s.total:
+		return "open"
+	case s.passed > 0:
+		return "filtered, some tests work"
+	case s.transportFails == s.total:
+		return "unreachable"
+	default:
+		return "blocked"
+	}
+}
+
+// printStackSummary compares the IPv4 and IPv6 results of each test, when
+// one address of each was tested, since IPv6 paths often don't go through
+// the DPI.
+func printStackSummary(results map[string][]TestResult, order []string) {
+	headerFmt := color.New(color.FgHiMagenta, color.Bold, color.Underline).SprintfFunc()
+	columnFmt := color.New(color.FgHiCyan, color.Bold).SprintfFunc()
+
+	tbl := table.New("Test Method", "IPv4", "IPv6")
+	tbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt)
+
+	var (
+		tested     []string
+		v4Ok, v6Ok []string
+	)
+	for _, testName := range order {
+		var v4, v6 *TestResult
+		var n4, n6 int
+		for i, tr := range results[testName] {
+			if tr.AddrPort.Addr().Is4() {
+				v4, n4 = &results[testName][i], n4+1
+			} else {
+				v6, n6 = &results[testName][i], n6+1
+			}
+		}
+		if n4 != 1 || n6 != 1 {
+			continue
+		}
+
+		v4Status, v4Success := v4.status()
+		v6Status, v6Success := v6.status()
+		tbl.AddRow(testName, v4Status, v6Status)
+
+		tested = append(tested, testName)
+		if v4Success > 0 {
+			v4Ok = append(v4Ok, testName)
+		}
+		if v6Success > 0 {
+			v6Ok = append(v6Ok, testName)
+		}
+	}
+	if len(tested) == 0 {
+		return
+	}
+
+	verdict := func(family string, ok []string) string {
+		switch len(ok) {
+		case len(tested):
+			return family + " unblocked for all strategies"
+		case 0:
+			return family + " blocked for all strategies"
+		default:
+			return fmt.Sprintf("%s only works with: %s", family, strings.Join(ok, ", "))
+		}
+	}
+
+	tbl.Print()
+	fmt.Println("")
+	fmt.Printf("%s\n%s\n\n", verdict("IPv4", v4Ok), verdict("IPv6", v6Ok))
+}
+
+// printRevocation lists the OCSP staples and live revocation statuses, one
+// row per test and target that asked for them.
+func printRevocation(results map[string][]TestResult, order []string) {
+	headerFmt := color.New(color.FgHiMagenta, color.Bold, color.Underline).SprintfFunc()
+	columnFmt := color.New(color.FgHiCyan, color.Bold).SprintfFunc()
+
+	tbl := table.New("Test Method", "IP:Port", "OCSP Staple", "Revocation")
+	tbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt)
+
+	var found bool
+	for _, testName := range order {
+		for _, tr := range results[testName] {
+			for _, attempt := range tr.Attempts {
+				if attempt.OCSPStaple != "" {
+					tbl.AddRow(testName, tr.AddrPort, attempt.OCSPStaple, attempt.Revocation)
+					found = true
+					break
+				}
+			}
+		}
+	}
+	if !found {
+		return
+	}
+
+	tbl.Print()
+	fmt.Println("")
+}
+
+// printCertCompression lists the certificate compression the servers used,
+// one row per test and target that offered it.
+func printCertCompression(results map[string][]TestResult, order []string) {
+	headerFmt := color.New(color.FgHiMagenta, color.Bold, color.Underline).SprintfFunc()
+	columnFmt := color.New(color.FgHiCyan, color.Bold).SprintfFunc()
+
+	tbl := table.New("Test Method", "IP:Port", "Cert Compression")
+	tbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt)
+
+	var found bool
+	for _, testName := range order {
+		for _, tr := range results[testName] {
+			for _, attempt := range tr.Attempts {
+				if attempt.CertCompression != "" {
+					tbl.AddRow(testName, tr.AddrPort, attempt.CertCompression)
+					found = true
+					break
+				}
+			}
+		}
+	}
+	if !found {
+		return
+	}
+
+	tbl.Print()
+	fmt.Println("")
+}
+
+// printNegotiated lists the TLS parameters the servers picked, one row per
+// test and target with a successful attempt.
+func printNegotiated(results map[string][]TestResult, order []string) {
+	headerFmt := color.New(color.FgHiMagenta, color.Bold, color.Underline).SprintfFunc()
+	columnFmt := color.New(color.FgHiCyan, color.Bold).SprintfFunc()
+
+	tbl := table.New("Test Method", "IP:Port", "TLS Version", "Cipher Suite", "ALPN", "Group")
+	tbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt)
+
+	var found bool
+	for _, testName := range order {
+		for _, tr := range results[testName] {
+			for _, attempt := range tr.Attempts {
+				if n := attempt.Negotiated; n != nil && attempt.Err == nil {
+					alpn, group := n.ALPN, n.Group
+					if alpn == "" {
+						alpn = "-"
+					}
+					if group == "" {
+						group = "-"
+					}
+					tbl.AddRow(testName, tr.AddrPort, n.Version, n.CipherSuite, alpn, group)
+					found = true
+					break
+				}
+			}
+		}
+	}
+	if !found {
+		return
+	}
+
+	tbl.Print()
+	fmt.Println("")
+}
+
+// printRetries lists the QUIC tests and targets where the server sent a
+// Retry, with the average time the attempts waited for it.
+func printRetries(results map[string][]TestResult, order []string) {
+	headerFmt := color.New(color.FgHiMagenta, color.Bold, color.Underline).SprintfFunc()
+	columnFmt := color.New(color.FgHiCyan, color.Bold).SprintfFunc()
+
+	tbl := table.New("Test Method", "IP:Port", "With Retry", "Retry Wait")
+	tbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt)
+
+	var found bool
+	for _, testName := range order {
+		for _, tr := range results[testName] {
+			var n int
+			var total time.Duration
+			for _, attempt := range tr.Attempts {
+				if attempt.RetryDuration > 0 {
+					n++
+					total += attempt.RetryDuration
+				}
+			}
+			if n == 0 {
+				continue
+			}
+			tbl.AddRow(testName, tr.AddrPort, fmt.Sprintf("%d/%d", n, len(tr.Attempts)), fmt.Sprintf("%.1f ms", float64(total)/float64(n)/float64(time.Millisecond)))
+			found = true
+		}
+	}
+	if !found {
+		return
+	}
+
+	tbl.Print()
+	fmt.Println("")
+}
+
+// printRecordSweep shows the smallest and largest record sizes that
+// worked against each target, which bound the DPI's reassembly window.
+// The sizes are in ascending order.
+func printRecordSweep(results map[string][]TestResult, sizes []int) {
+	if len(sizes) == 0 {
+		return
+	}
+
+	headerFmt := color.New(color.FgHiMagenta, color.Bold, color.Underline).SprintfFunc()
+	columnFmt := color.New(color.FgHiCyan, color.Bold).SprintfFunc()
+
+	tbl := table.New("Record Size Sweep", "Smallest Working", "Largest Working", "Failed Sizes")
+	tbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt)
+
+	var targets []netip.AddrPort
+	for _, tr := range results[recordSizeLabel(sizes[0])] {
+		targets = append(targets, tr.AddrPort)
+	}
+	for _, target := range targets {
+		var ok, failed []string
+		for _, size := range sizes {
+			for _, tr := range results[recordSizeLabel(size)] {
+				if tr.AddrPort != target {
+					continue
+				}
+				if _, success := tr.status(); success > 0 {
+					ok = append(ok, fmt.Sprintf("%dB", size))
+				} else {
+					failed = append(failed, fmt.Sprintf("%dB", size))
+				}
+			}
+		}
+		smallest, largest := "none", "none"
+		if len(ok) > 0 {
+			smallest, largest = ok[0], ok[len(ok)-1]
+		}
+		tbl.AddRow(target, smallest, largest, strings.Join(failed, ", "))
+	}
+	if len(targets) == 0 {
+		return
+	}
+
+	tbl.Print()
+	fmt.Println("")
+}
+
+// printQUICSizeSweep shows which Initial datagram sizes got a handshake
+// through against each target. When only the smaller ones do, the large
+// datagrams are lost on the path, which looks like QUIC blocking but is an
+// MTU problem. The sizes are in ascending order.
+func printQUICSizeSweep(results map[string][]TestResult, sizes []int) {
+	if len(sizes) == 0 {
+		return
+	}
+
+	headerFmt := color.New(color.FgHiMagenta, color.Bold, color.Underline).SprintfFunc()
+	columnFmt := color.New(color.FgHiCyan, color.Bold).SprintfFunc()
+
+	tbl := table.New("QUIC Size Sweep", "Working Sizes", "Failed Sizes", "Diagnosis")
+	tbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt)
+
+	var targets []netip.AddrPort
+	for _, tr := range results[quicSizeLabel(sizes[0])] {
+		targets = append(targets, tr.AddrPort)
+	}
+	for _, target := range targets {
+		var ok, failed []string
+		largest, smallestFailed := 0, 0
+		for _, size := range sizes {
+			for _, tr := range results[quicSizeLabel(size)] {
+				if tr.AddrPort != target {
+					continue
+				}
+				if _, success := tr.status(); success > 0 {
+					ok = append(ok, fmt.Sprintf("%dB", size))
+					largest = size
+				} else {
+					failed = append(failed, fmt.Sprintf("%dB", size))
+					if smallestFailed == 0 {
+						smallestFailed = size
+					}
+				}
+			}
+		}
+		var diagnosis string
+		switch {
+		case len(ok) == 0:
+			diagnosis = "no size works, QUIC blocked or unreachable"
+		case len(failed) == 0:
+			diagnosis = "all sizes work"
+		case smallestFailed > largest:
+			diagnosis = fmt.Sprintf("datagrams over %dB lost, path MTU", largest)
+		default:
+			diagnosis = "inconsistent, possibly loss"
+		}
+		tbl.AddRow(target, strings.Join(ok, ", "), strings.Join(failed, ", "), diagnosis)
+	}
+	if len(targets) == 0 {
+		return
+	}
+
+	tbl.Print()
+	fmt.Println("")
+}
+
+// printCertErrors lists the certificate problems found after insecure
+// handshakes, one row per test and target with any.
+func printCertErrors(results map[string][]TestResult, order []string) {
+	headerFmt := color.New(color.FgHiMagenta, color.Bold, color.Underline).SprintfFunc()
+	columnFmt := color.New(color.FgHiCyan, color.Bold).SprintfFunc()
+
+	tbl := table.New("Test Method", "IP:Port", "Certificate Error")
+	tbl.WithHeaderFormatter(headerFmt).WithFirstColumnFormatter(columnFmt)
+
+	var found bool
+	for _, testName := range order {
+		for _, tr := range results[testName] {
+			for _, attempt := range tr.Attempts {
+				if attempt.CertError != nil {
+					tbl.AddRow(testName, tr.AddrPort, attempt.CertError)
+					found = true
+					break
+				}
+			}
+		}
+	}
+	if !found {
+		return
+	}
+
+	tbl.Print()
+	fmt.Println("")
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/carlmjohnson/versioninfo"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer traces runs for --otlp-endpoint. Until setupTracing is called it
+// is a no-op.
+var tracer = otel.Tracer("github.com/markpash/heybabe")
+
+// setupTracing exports spans over OTLP/HTTP to endpoint, e.g.
+// "http://localhost:4318". The returned function flushes the spans left.
+func setupTracing(ctx context.Context, endpoint string) (func(context.Context) error, error) {
+	exp, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, err
+	}
+	ver := version
+	if ver == "" {
+		ver = versioninfo.Short()
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(resource.NewSchemaless(
+			semconv.ServiceName(appName),
+			semconv.ServiceVersion(ver),
+		)),
+	)
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// flushTracing exports the spans left with shutdown, as returned by
+// setupTracing, giving up after a few seconds if the collector is gone.
+func flushTracing(l *slog.Logger, shutdown func(context.Context) error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdown(ctx); err != nil {
+		l.Warn("failed to export traces", "error", err)
+	}
+}
+
+// endSpan ends span, marking it failed if err isn't nil.
+func endSpan(span trace.Span, err error, opts ...trace.SpanEndOption) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End(opts...)
+}
+
+// traceAttemptPhases adds dial, handshake and probe spans to the context's
+// span for an attempt that started at start. The tests only measure how
+// long each phase took, so the spans are laid back to back from start.
+func traceAttemptPhases(ctx context.Context, start time.Time, res TestAttemptResult) {
+	phases := []struct {
+		name string
+		d    time.Duration
+	}{
+		{"setup", res.SetupDuration},
+		{"dial", res.TransportEstablishDuration},
+		{"handshake", res.TLSHandshakeDuration},
+		{"probe", res.TTFBDuration},
+	}
+	t := start
+	for _, p := range phases {
+		if p.d == 0 {
+			continue
+		}
+		_, span := tracer.Start(ctx, p.name, trace.WithTimestamp(t))
+		t = t.Add(p.d)
+		span.End(trace.WithTimestamp(t))
+	}
+}
+
+// attemptAttributes describes an attempt's outcome on its span.
+func attemptAttributes(res TestAttemptResult) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{
+		attribute.Bool("heybabe.success", res.Err == nil),
+		attribute.Int("heybabe.retries", res.Retries),
+	}
+	if res.Err != nil {
+		attrs = append(attrs, attribute.String("heybabe.error_class", string(res.Err.Class)))
+	}
+	return attrs
+}
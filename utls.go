@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// uClient is tls.UClient with the TLS settings from ctx applied to the
+// fingerprint id. Without settings the fingerprint is used as is.
+func uClient(ctx context.Context, conn net.Conn, config *tls.Config, id tls.ClientHelloID) (*tls.UConn, error) {
+	s := tlsSettingsFrom(ctx)
+	if s.grease == greaseDefault && s.cipherSuites == nil && s.curves == nil && s.alpn == nil {
+		return tls.UClient(conn, config, id), nil
+	}
+
+	spec, err := tls.UTLSIdToSpec(id)
+	if err != nil {
+		return nil, err
+	}
+	uconn := tls.UClient(conn, config, tls.HelloCustom)
+	if err := uconn.ApplyPreset(applyTLSSettings(ctx, &spec)); err != nil {
+		uconn.Close()
+		return nil, err
+	}
+	return uconn, nil
+}
+
+// applyTLSSettings applies the TLS settings from ctx to spec, for tests
+// building their own ClientHelloSpec, and returns it.
+func applyTLSSettings(ctx context.Context, spec *tls.ClientHelloSpec) *tls.ClientHelloSpec {
+	s := tlsSettingsFrom(ctx)
+	if s.cipherSuites != nil {
+		spec.CipherSuites = s.cipherSuites
+	}
+	if s.curves != nil {
+		setCurves(spec, s.curves)
+	}
+	if s.alpn != nil {
+		setALPN(spec, s.alpn)
+	}
+	switch s.grease {
+	case greaseOff:
+		removeGREASE(spec)
+	case greaseOn:
+		addGREASE(spec)
+	}
+	return spec
+}
+
+// appendExtension adds e to the end of exts, but before padding and
+// pre_shared_key, which must stay at the end.
+func appendExtension(exts []tls.TLSExtension, e tls.TLSExtension) []tls.TLSExtension {
+	end := len(exts)
+	for end > 0 {
+		switch exts[end-1].(type) {
+		case *tls.UtlsPaddingExtension, *tls.UtlsPreSharedKeyExtension, *tls.FakePreSharedKeyExtension:
+			end--
+			continue
+		}
+		break
+	}
+	return slices.Insert(exts, end, e)
+}
+
+// setALPN replaces the ALPN protocols of spec with protos, adding the
+// extension if the fingerprint has none.
+func setALPN(spec *tls.ClientHelloSpec, protos []string) {
+	for _, e := range spec.Extensions {
+		if e, ok := e.(*tls.ALPNExtension); ok {
+			e.AlpnProtocols = protos
+			return
+		}
+	}
+	spec.Extensions = appendExtension(slices.Clone(spec.Extensions), &tls.ALPNExtension{AlpnProtocols: protos})
+}
+
+// parseALPN parses a comma separated list of ALPN protocols, and splits it
+// into the ones for the TCP tests and the ones for the QUIC tests, which
+// are h3 and its drafts.
+func parseALPN(s string) (tcp, quic []string, err error) {
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		switch {
+		case f == "" || len(f) > 255:
+			return nil, nil, fmt.Errorf("invalid ALPN protocol %q", f)
+		case f == "h3" || strings.HasPrefix(f, "h3-"):
+			quic = append(quic, f)
+		default:
+			tcp = append(tcp, f)
+		}
+	}
+	return tcp, quic, nil
+}
+
+// parseCipherSuites parses a comma separated list of cipher suites, given
+// by their IANA names (e.g. TLS_AES_128_GCM_SHA256), hex IDs (e.g. 0x0039),
+// or GREASE for a GREASE value.
+func parseCipherSuites(s string) ([]uint16, error) {
+	names := make(map[string]uint16)
+	for _, cs := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		names[cs.Name] = cs.ID
+	}
+
+	var suites []uint16
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if id, ok := names[f]; ok {
+			suites = append(suites, id)
+			continue
+		}
+		if strings.EqualFold(f, "GREASE") {
+			suites = append(suites, tls.GREASE_PLACEHOLDER)
+			continue
+		}
+		id, err := strconv.ParseUint(f, 0, 16)
+		if err != nil || !strings.HasPrefix(f, "0x") {
+			return nil, fmt.Errorf("unknown cipher suite %q", f)
+		}
+		suites = append(suites, uint16(id))
+	}
+	return suites, nil
+}
+
+// curveNames are the names of the groups accepted by parseCurves, as
+// crypto/tls prints them.
+var curveNames = map[string]uint16{
+	"X25519":         uint16(tls.X25519),
+	"P-256":          uint16(tls.CurveP256),
+	"P-384":          uint16(tls.CurveP384),
+	"P-521":          uint16(tls.CurveP521),
+	"X25519MLKEM768": uint16(tls.X25519MLKEM768),
+}
+
+// parseCurves parses a comma separated list of groups, given by name (e.g.
+// X25519 or P-256) or hex ID (e.g. 0x001d).
+func parseCurves(s string) ([]uint16, error) {
+	var curves []uint16
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if id, ok := curveNames[strings.ToUpper(f)]; ok {
+			curves = append(curves, id)
+			continue
+		}
+		id, err := strconv.ParseUint(f, 0, 16)
+		if err != nil || !strings.HasPrefix(f, "0x") {
+			return nil, fmt.Errorf("unknown curve %q", f)
+		}
+		curves = append(curves, uint16(id))
+	}
+	return curves, nil
+}
+
+// setCurves replaces the supported groups of spec with curves, keeping
+// any GREASE value first. Key shares are kept for the groups still offered,
+// in the same order, and one is added for the first group if none are left.
+func setCurves(spec *tls.ClientHelloSpec, curves []uint16) {
+	for _, e := range spec.Extensions {
+		switch e := e.(type) {
+		case *tls.SupportedCurvesExtension:
+			var groups []tls.CurveID
+			for _, c := range e.Curves {
+				if isGREASE(uint16(c)) {
+					groups = append(groups, c)
+				}
+			}
+			for _, c := range curves {
+				groups = append(groups, tls.CurveID(c))
+			}
+			e.Curves = groups
+		case *tls.KeyShareExtension:
+			var shares []tls.KeyShare
+			for _, ks := range e.KeyShares {
+				if isGREASE(uint16(ks.Group)) {
+					shares = append(shares, ks)
+				}
+			}
+			greased := len(shares)
+			for _, c := range curves {
+				for _, ks := range e.KeyShares {
+					if uint16(ks.Group) == c {
+						shares = append(shares, ks)
+					}
+				}
+			}
+			if len(shares) == greased {
+				shares = append(shares, tls.KeyShare{Group: tls.CurveID(curves[0])})
+			}
+			e.KeyShares = shares
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"net"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/markpash/heybabe/sockopt"
+	quic "github.com/refraction-networking/uquic"
+	"github.com/refraction-networking/uquic/logging"
+)
+
+// wireMaxWrites bounds the writes kept of an attempt, for tests that keep
+// their connection going.
+const wireMaxWrites = 64
+
+// Wire is what an attempt's test wrote to and read from its connection, as
+// handed to and from the kernel, so it shows what got out and back before a
+// failure. For QUIC tests, the writes and reads are packets.
+type Wire struct {
+	BytesSent     int
+	BytesReceived int
+	Reads         int
+	// Writes are the first wireMaxWrites writes, in order.
+	Writes []WireWrite
+}
+
+// WireWrite is one write of an attempt.
+type WireWrite struct {
+	// At is how long after the first write it was made.
+	At   time.Duration
+	Size int
+}
+
+// wireKey is the context key of the wireRecorder of an attempt.
+type wireKey struct{}
+
+// wireRecorder collects the Wire of an attempt, from the connections its
+// test wraps with wire and its QUIC tracer.
+type wireRecorder struct {
+	mu    sync.Mutex
+	first time.Time
+	w     Wire
+}
+
+func (r *wireRecorder) wrote(n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	if r.first.IsZero() {
+		r.first = now
+	}
+	r.w.BytesSent += n
+	if len(r.w.Writes) < wireMaxWrites {
+		r.w.Writes = append(r.w.Writes, WireWrite{At: now.Sub(r.first), Size: n})
+	}
+}
+
+func (r *wireRecorder) read(n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.w.BytesReceived += n
+	r.w.Reads++
+}
+
+// wire returns what was recorded, or nil if the test never wrote.
+func (r *wireRecorder) wire() *Wire {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.first.IsZero() {
+		return nil
+	}
+	w := r.w
+	w.Writes = slices.Clone(w.Writes)
+	return &w
+}
+
+// wire wraps the connection of a test to record what goes through it on
+// the wireRecorder from ctx, if any. The socket stays reachable for the
+// socket options of the strategies wrapping it further.
+func wire(ctx context.Context, c net.Conn) net.Conn {
+	r, _ := ctx.Value(wireKey{}).(*wireRecorder)
+	if r == nil {
+		return c
+	}
+	return &wireConn{Conn: c, r: r}
+}
+
+type wireConn struct {
+	net.Conn
+	r *wireRecorder
+}
+
+func (c *wireConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.r.wrote(n)
+	}
+	return n, err
+}
+
+func (c *wireConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.r.read(n)
+	}
+	return n, err
+}
+
+func (c *wireConn) SyscallConn() (syscall.RawConn, error) {
+	sc, ok := c.Conn.(syscall.Conn)
+	if !ok {
+		return nil, sockopt.ErrUnsupported
+	}
+	return sc.SyscallConn()
+}
+
+// wireTracer returns conf also tracing the packets of the QUIC connection
+// into the wireRecorder from ctx, if any. The socket isn't wrapped, so
+// QUIC keeps its ECN marks and segmentation offload.
+func wireTracer(ctx context.Context, conf *quic.Config) *quic.Config {
+	r, _ := ctx.Value(wireKey{}).(*wireRecorder)
+	if r == nil {
+		return conf
+	}
+	next := conf.Tracer
+	conf.Tracer = func(ctx context.Context, p logging.Perspective, id quic.ConnectionID) *logging.ConnectionTracer {
+		t := &logging.ConnectionTracer{
+			SentLongHeaderPacket: func(_ *logging.ExtendedHeader, size logging.ByteCount, _ logging.ECN, _ *logging.AckFrame, _ []logging.Frame) {
+				r.wrote(int(size))
+			},
+			SentShortHeaderPacket: func(_ *logging.ShortHeader, size logging.ByteCount, _ logging.ECN, _ *logging.AckFrame, _ []logging.Frame) {
+				r.wrote(int(size))
+			},
+			ReceivedLongHeaderPacket: func(_ *logging.ExtendedHeader, size logging.ByteCount, _ logging.ECN, _ []logging.Frame) {
+				r.read(int(size))
+			},
+			ReceivedShortHeaderPacket: func(_ *logging.ShortHeader, size logging.ByteCount, _ logging.ECN, _ []logging.Frame) {
+				r.read(int(size))
+			},
+		}
+		if next == nil {
+			return t
+		}
+		return logging.NewMultiplexedConnectionTracer(t, next(ctx, p, id))
+	}
+	return conf
+}
+
+// wireDatagram records a datagram a QUIC test sent or received outside of
+// its QUIC connection on the wireRecorder from ctx, if any.
+func wireDatagram(ctx context.Context, n int, sent bool) {
+	r, _ := ctx.Value(wireKey{}).(*wireRecorder)
+	switch {
+	case r == nil:
+	case sent:
+		r.wrote(n)
+	default:
+		r.read(n)
+	}
+}